@@ -10,6 +10,10 @@ type ModifiedAccessConditions struct {
 	IfUnmodifiedSince time.Time
 	IfMatch           ETag
 	IfNoneMatch       ETag
+
+	// IfTags is a condition on the blob's index tags (x-ms-if-tags), such as one returned by TagFilter.IfTags.
+	// Containers don't support it.
+	IfTags string
 }
 
 // pointers is for internal infrastructure. It returns the fields as pointers.
@@ -29,6 +33,14 @@ func (ac ModifiedAccessConditions) pointers() (ims *time.Time, ius *time.Time, i
 	return
 }
 
+// tagsPointer is for internal infrastructure. It returns IfTags as a pointer.
+func (ac ModifiedAccessConditions) tagsPointer() (ifTags *string) {
+	if ac.IfTags != "" {
+		ifTags = &ac.IfTags
+	}
+	return
+}
+
 // ContainerAccessConditions identifies container-specific access conditions which you optionally set.
 type ContainerAccessConditions struct {
 	ModifiedAccessConditions
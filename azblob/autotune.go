@@ -0,0 +1,170 @@
+package azblob
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// autoTuneMinBlockSize is the smallest block size picked by auto-tuned transfers.
+	autoTuneMinBlockSize = 8 * 1024 * 1024 // 8MiB
+
+	// autoTuneMaxParallelism is the default upper bound on parallel operations for auto-tuned transfers.
+	autoTuneMaxParallelism = 32
+
+	// autoTuneInitialParallelism is the number of parallel operations an auto-tuned transfer starts with.
+	autoTuneInitialParallelism = 4
+
+	// autoTuneGrowthThreshold is how much a window's throughput must improve over the previous
+	// window for an auto-tuned transfer to keep adding parallel operations.
+	autoTuneGrowthThreshold = 1.1
+
+	// autoTuneBackoffCooldown prevents a burst of ServerBusy responses from backing off more than once.
+	autoTuneBackoffCooldown = time.Second
+)
+
+// autoTuneBlockSize picks the block size for an auto-tuned transfer of size bytes: the smallest power-of-two
+// multiple of autoTuneMinBlockSize that splits the transfer into at most BlockBlobMaxBlocks blocks.
+func autoTuneBlockSize(size int64) int64 {
+	blockSize := int64(autoTuneMinBlockSize)
+	for blockSize < BlockBlobMaxStageBlockBytes && (size-1)/blockSize+1 > BlockBlobMaxBlocks {
+		blockSize *= 2
+	}
+	if blockSize > BlockBlobMaxStageBlockBytes {
+		blockSize = BlockBlobMaxStageBlockBytes
+	}
+	return blockSize
+}
+
+// concurrencyTuner limits how many operations of a transfer run in parallel and adjusts that limit from the
+// observed throughput and latency of completed operations (additive increase) and from ServerBusy responses
+// (multiplicative decrease).
+type concurrencyTuner struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	max     int
+	limit   int
+	running int
+	now     func() time.Time // the clock the windows are measured with
+
+	// The current measurement window.
+	windowStart   time.Time
+	windowBytes   int64
+	windowOps     int
+	windowLatency time.Duration
+
+	// The previous measurement window.
+	lastThroughput float64 // bytes per second
+	lastLatency    time.Duration
+	lastBackoff    time.Time
+}
+
+func newConcurrencyTuner(max int) *concurrencyTuner {
+	t := &concurrencyTuner{max: max, limit: autoTuneInitialParallelism, now: time.Now}
+	if t.limit > max {
+		t.limit = max
+	}
+	t.cond = sync.NewCond(&t.lock)
+	return t
+}
+
+// acquire blocks until the operation may run within the current limit.
+func (t *concurrencyTuner) acquire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for t.running >= t.limit {
+		t.cond.Wait()
+	}
+	t.running++
+	if t.windowStart.IsZero() {
+		t.windowStart = t.now()
+	}
+}
+
+// release records the outcome of an operation started with acquire.
+func (t *concurrencyTuner) release(bytes int64, latency time.Duration, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.running--
+	if err == nil {
+		t.windowBytes += bytes
+		t.windowOps++
+		t.windowLatency += latency
+		if t.windowOps >= t.limit {
+			t.adjust()
+		}
+	}
+	t.cond.Broadcast()
+}
+
+// serverBusy halves the limit when the service reports that it is throttling the transfer.
+func (t *concurrencyTuner) serverBusy() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.now().Sub(t.lastBackoff) < autoTuneBackoffCooldown {
+		return // Other operations that were in flight hit the same throttling; back off once
+	}
+	t.lastBackoff = t.now()
+	t.setLimit(t.limit / 2)
+	t.lastThroughput, t.lastLatency = 0, 0 // Probe upwards again from the reduced limit
+	t.resetWindow()
+}
+
+// currentLimit returns the current number of operations allowed to run in parallel.
+func (t *concurrencyTuner) currentLimit() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.limit
+}
+
+// adjust compares the window that just completed with the previous one. The caller must hold the lock.
+func (t *concurrencyTuner) adjust() {
+	elapsed := t.now().Sub(t.windowStart)
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	throughput := float64(t.windowBytes) / elapsed.Seconds()
+	latency := t.windowLatency / time.Duration(t.windowOps)
+
+	switch {
+	case t.lastThroughput == 0 || throughput > t.lastThroughput*autoTuneGrowthThreshold:
+		t.setLimit(t.limit + 1) // More parallelism still pays off
+	case t.lastLatency > 0 && latency > 2*t.lastLatency:
+		t.setLimit(t.limit - 1) // Latency grew without a throughput gain; the link or service is saturated
+	}
+	t.lastThroughput, t.lastLatency = throughput, latency
+	t.resetWindow()
+}
+
+// setLimit clamps and sets the limit. The caller must hold the lock.
+func (t *concurrencyTuner) setLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > t.max {
+		limit = t.max
+	}
+	t.limit = limit
+}
+
+// resetWindow starts a new measurement window. The caller must hold the lock.
+func (t *concurrencyTuner) resetWindow() {
+	t.windowStart = t.now()
+	t.windowBytes, t.windowOps, t.windowLatency = 0, 0, 0
+}
+
+type serverBusyNotifierKey struct{}
+
+// withServerBusyNotifier returns a context that makes the retry policy call notify every time
+// a request made with the context gets a ServerBusy (503) response.
+func withServerBusyNotifier(ctx context.Context, notify func()) context.Context {
+	return context.WithValue(ctx, serverBusyNotifierKey{}, notify)
+}
+
+// notifyServerBusy calls the notifier attached to ctx, if any.
+func notifyServerBusy(ctx context.Context) {
+	if notify, ok := ctx.Value(serverBusyNotifierKey{}).(func()); ok {
+		notify()
+	}
+}
@@ -0,0 +1,112 @@
+package azblob
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// BlobHistoryItem is the current version, a previous version or a snapshot of a blob, as listed by
+// BlobURL.ListHistory.
+type BlobHistoryItem struct {
+	// VersionID is the ID of the version, or "" for a snapshot or a blob in an account without versioning.
+	VersionID string
+
+	// Snapshot is the snapshot's timestamp, or "" if the item isn't a snapshot.
+	Snapshot string
+
+	// IsCurrentVersion is true for the blob's current state, the base blob.
+	IsCurrentVersion bool
+
+	Properties BlobPropertiesInternal
+	Metadata   Metadata
+	BlobTags   *BlobTags
+
+	url BlobURL
+}
+
+// Time returns when the item was made: the snapshot's timestamp, the version's ID or, for a blob without versioning,
+// when it was last modified.
+func (i BlobHistoryItem) Time() time.Time {
+	for _, s := range []string{i.Snapshot, i.VersionID} {
+		if s == "" {
+			continue
+		}
+		if t, err := time.Parse(SnapshotTimeFormat, s); err == nil {
+			return t
+		}
+	}
+	return i.Properties.LastModified
+}
+
+// URL returns the BlobURL of the item: the base blob's URL for the current version, otherwise the URL with the
+// item's version ID or snapshot set.
+func (i BlobHistoryItem) URL() BlobURL {
+	switch {
+	case i.IsCurrentVersion:
+		return i.url
+	case i.Snapshot != "":
+		return i.url.WithSnapshot(i.Snapshot)
+	default:
+		return i.url.WithVersionID(i.VersionID)
+	}
+}
+
+// baseBlobURL returns the URL of the base blob, without a snapshot or version ID, and its container's URL.
+func (b BlobURL) baseBlobURL() (BlobURL, ContainerURL, string) {
+	p := NewBlobURLParts(b.URL())
+	p.Snapshot, p.VersionID = "", ""
+	base := NewBlobURL(p.URL(), b.blobClient.Pipeline())
+	name := p.BlobName
+	p.BlobName = ""
+	return base, NewContainerURL(p.URL(), b.blobClient.Pipeline()), name
+}
+
+// ListHistory returns the versions and snapshots of the blob, oldest first, by listing the blobs whose names start
+// with the blob's name and keeping the ones that have its name. Versions and snapshots are always listed; details
+// can add metadata, tags and soft-deleted items. The current version, if the blob exists, is marked as such.
+// For more information, see https://docs.microsoft.com/rest/api/storageservices/list-blobs.
+func (b BlobURL) ListHistory(ctx context.Context, details BlobListingDetails) ([]BlobHistoryItem, error) {
+	base, containerURL, name := b.baseBlobURL()
+	details.Versions, details.Snapshots = true, true
+	pager := containerURL.NewBlobPager(ListBlobsSegmentOptions{Prefix: name, Details: details})
+	history := []BlobHistoryItem{}
+	// Blobs are listed in name order, so the blob's items come before the other blobs that start with its name.
+	for pager.Next(ctx) {
+		item := pager.Item()
+		if item.Name != name {
+			break
+		}
+		history = append(history, newBlobHistoryItem(item, base))
+	}
+	if err := pager.Err(); err != nil {
+		return nil, err
+	}
+	sortBlobHistory(history)
+	return history, nil
+}
+
+// newBlobHistoryItem returns the history item of a blob listed with its versions and snapshots.
+func newBlobHistoryItem(item *BlobItemInternal, base BlobURL) BlobHistoryItem {
+	h := BlobHistoryItem{Snapshot: item.Snapshot, Properties: item.Properties, Metadata: item.Metadata, BlobTags: item.BlobTags, url: base}
+	if item.VersionID != nil {
+		h.VersionID = *item.VersionID
+	}
+	if item.IsCurrentVersion != nil {
+		h.IsCurrentVersion = *item.IsCurrentVersion
+	} else {
+		h.IsCurrentVersion = h.Snapshot == "" && h.VersionID == "" && !item.Deleted
+	}
+	return h
+}
+
+// sortBlobHistory sorts a blob's history items oldest first. The current version is the blob's latest state even
+// when its time is only its last modified time, which only has a resolution of seconds.
+func sortBlobHistory(history []BlobHistoryItem) {
+	sort.SliceStable(history, func(i, j int) bool {
+		if history[i].IsCurrentVersion != history[j].IsCurrentVersion {
+			return history[j].IsCurrentVersion
+		}
+		return history[i].Time().Before(history[j].Time())
+	})
+}
@@ -0,0 +1,317 @@
+package azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RestoreOptions identifies options used by BlobURL.RestoreFrom.
+type RestoreOptions struct {
+	// AccessConditions are the conditions on the base blob that the restore overwrites.
+	AccessConditions BlobAccessConditions
+
+	// KeepCurrentMetadata keeps the base blob's metadata rather than restoring the metadata of the version or snapshot.
+	KeepCurrentMetadata bool
+
+	// KeepCurrentTags keeps the base blob's index tags rather than restoring the tags of the version or snapshot.
+	KeepCurrentTags bool
+
+	// SourceAuthorization, if set, authorizes reading the version or snapshot for a synchronous copy, as a SAS in the
+	// blob's URL does.
+	SourceAuthorization TokenCredential
+
+	// PollInterval is how often the status of an asynchronous copy is checked (0=default of 1 second).
+	PollInterval time.Duration
+}
+
+// RestoreFrom copies a previous version or snapshot of the blob over the base blob, with its metadata and index tags;
+// pass either the version's ID or the snapshot's timestamp and leave the other "". The version or snapshot's URL is
+// made from the blob's, so a SAS in it authorizes the copy's source too.
+//
+// Block blobs of up to BlockBlobMaxUploadBlobBytes are copied synchronously, with Copy Blob From URL, if the source is
+// authorized by a SAS or SourceAuthorization. Other blobs are copied with Copy Blob, whose status is polled until the
+// copy completes; if ctx is done first, the copy goes on and RestoreFrom returns ctx's error.
+//
+// RestoreFrom returns the restored blob's ETag.
+func (b BlobURL) RestoreFrom(ctx context.Context, versionID string, snapshot string, o RestoreOptions) (ETag, error) {
+	if (versionID == "") == (snapshot == "") {
+		return ETagNone, errors.New("either the version ID or the snapshot must be set")
+	}
+	base, _, _ := b.baseBlobURL()
+	source := base.WithVersionID(versionID)
+	if snapshot != "" {
+		source = base.WithSnapshot(snapshot)
+	}
+	props, err := source.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	if err != nil {
+		return ETagNone, err
+	}
+
+	// Copying a blob copies its metadata, but not its index tags.
+	metadata, tagsSource, tagCount := props.NewMetadata(), source, props.TagCount()
+	if o.KeepCurrentMetadata || o.KeepCurrentTags {
+		current, err := base.GetProperties(ctx, BlobAccessConditions{LeaseAccessConditions: o.AccessConditions.LeaseAccessConditions}, ClientProvidedKeyOptions{})
+		if err != nil && !isNotFound(err) {
+			return ETagNone, err
+		}
+		if err == nil && o.KeepCurrentMetadata {
+			metadata = current.NewMetadata()
+		}
+		if err == nil && o.KeepCurrentTags {
+			tagsSource, tagCount = base, current.TagCount()
+		}
+	}
+	var tags BlobTagsMap
+	if tagCount > 0 {
+		if tags, err = tagsSource.getTagsMap(ctx); err != nil {
+			return ETagNone, err
+		}
+	}
+
+	var etag ETag
+	p := NewBlobURLParts(base.URL())
+	if props.BlobType() == BlobBlockBlob && props.ContentLength() <= BlockBlobMaxUploadBlobBytes && (p.SAS.Signature() != "" || o.SourceAuthorization != nil) {
+		resp, err := base.ToBlockBlobURL().CopyFromURL(ctx, source.URL(), metadata, ModifiedAccessConditions{}, o.AccessConditions,
+			nil, DefaultAccessTier, tags, ImmutabilityPolicyOptions{}, o.SourceAuthorization)
+		if err != nil {
+			return ETagNone, err
+		}
+		etag = resp.ETag()
+	} else {
+		resp, err := base.StartCopyFromURL(ctx, source.URL(), metadata, ModifiedAccessConditions{}, o.AccessConditions, DefaultAccessTier, tags)
+		if err != nil {
+			return ETagNone, err
+		}
+		etag = resp.ETag()
+		if resp.CopyStatus() != CopyStatusSuccess {
+			if etag, err = base.waitForCopy(ctx, resp.CopyID(), o.AccessConditions.LeaseAccessConditions, o.PollInterval); err != nil {
+				return ETagNone, err
+			}
+		}
+	}
+
+	// A copy without metadata copies the source's, so metadata is only cleared after the copy.
+	if len(metadata) == 0 && len(props.NewMetadata()) > 0 {
+		resp, err := base.SetMetadata(ctx, Metadata{}, BlobAccessConditions{ModifiedAccessConditions: ModifiedAccessConditions{IfMatch: etag},
+			LeaseAccessConditions: o.AccessConditions.LeaseAccessConditions}, ClientProvidedKeyOptions{})
+		if err != nil {
+			return ETagNone, err
+		}
+		etag = resp.ETag()
+	}
+	return etag, nil
+}
+
+// getTagsMap returns the blob's index tags.
+func (b BlobURL) getTagsMap(ctx context.Context) (BlobTagsMap, error) {
+	blobTags, err := b.GetTags(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	tags := BlobTagsMap{}
+	for _, t := range blobTags.BlobTagSet {
+		tags[t.Key] = t.Value
+	}
+	return tags, nil
+}
+
+// waitForCopy polls the status of the copy to the blob until it completes, and returns the blob's ETag.
+func (b BlobURL) waitForCopy(ctx context.Context, copyID string, lac LeaseAccessConditions, interval time.Duration) (ETag, error) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for {
+		props, err := b.GetProperties(ctx, BlobAccessConditions{LeaseAccessConditions: lac}, ClientProvidedKeyOptions{})
+		if err != nil {
+			return ETagNone, err
+		}
+		if props.CopyID() != copyID {
+			return ETagNone, fmt.Errorf("the blob was overwritten during the copy %q", copyID)
+		}
+		switch props.CopyStatus() {
+		case CopyStatusSuccess:
+			return props.ETag(), nil
+		case CopyStatusPending:
+		default:
+			return ETagNone, fmt.Errorf("the copy %q is %s: %s", copyID, props.CopyStatus(), props.CopyStatusDescription())
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ETagNone, ctx.Err()
+		}
+	}
+}
+
+// BlobRestoreAction is what ContainerURL.RestoreToTime did with a blob.
+type BlobRestoreAction string
+
+const (
+	// BlobRestoreUnchanged means the blob was already in its state at the time.
+	BlobRestoreUnchanged BlobRestoreAction = "unchanged"
+
+	// BlobRestoreRestored means the blob was restored from a previous version or snapshot.
+	BlobRestoreRestored BlobRestoreAction = "restored"
+
+	// BlobRestoreDeleted means the blob was created after the time and was deleted.
+	BlobRestoreDeleted BlobRestoreAction = "deleted"
+
+	// BlobRestoreSkipped means the blob was left as it is because its state at the time isn't known for sure: it
+	// changed after the time and has no version or snapshot from before the time to restore it from, and either
+	// RestoreToTimeOptions.DeleteCreatedAfter isn't set or the blob wasn't created after the time; or it was deleted
+	// without changing after the time, so it may have been deleted before the time, and
+	// RestoreToTimeOptions.RestoreDeletedUnchanged isn't set.
+	BlobRestoreSkipped BlobRestoreAction = "skipped"
+)
+
+// BlobRestoreResult is the result of restoring a blob with ContainerURL.RestoreToTime.
+type BlobRestoreResult struct {
+	Name   string
+	Action BlobRestoreAction
+
+	// From is the version or snapshot the blob was restored from, if it was restored.
+	From *BlobHistoryItem
+
+	// Err is the error that made restoring the blob fail, if any. Action is then what was attempted.
+	Err error
+}
+
+// RestoreToTimeOptions identifies options used by ContainerURL.RestoreToTime.
+type RestoreToTimeOptions struct {
+	// Restore are the options used to restore each blob. The ModifiedAccessConditions of its AccessConditions are
+	// replaced with a condition on the blob being as it was listed, so that a blob that changes during the restore is
+	// left alone; its restore fails with a condition error.
+	Restore RestoreOptions
+
+	// DeleteCreatedAfter deletes the blobs that were created after the time, which are otherwise skipped. A blob's
+	// creation time is reported to the second, so a blob created in the same second as the time is skipped.
+	DeleteCreatedAfter bool
+
+	// RestoreDeletedUnchanged restores the deleted blobs whose last version or snapshot was made at or before the
+	// time, which are otherwise skipped. Listing a blob's versions doesn't tell when it was deleted, so such a blob
+	// may have been deleted before the time, and then restoring it brings back a blob that didn't exist at the time.
+	RestoreDeletedUnchanged bool
+
+	// Parallelism indicates the maximum number of blobs to restore in parallel (0=default)
+	Parallelism uint16
+}
+
+// RestoreToTime restores each blob whose name starts with the prefix to its state at the time, using its previous
+// versions and snapshots: a blob is restored from the last version or snapshot made at or before the time, unless
+// it hasn't changed since. A deleted blob is restored too if it changed after the time, so that it was deleted after
+// the time; see RestoreToTimeOptions.RestoreDeletedUnchanged for the others.
+//
+// RestoreToTime returns a result for each blob, in name order. Failing to restore a blob doesn't stop the others;
+// its result has the error. The returned error is only for failing to list the blobs, or ctx being done, which stops
+// restoring the blobs not started yet.
+func (c ContainerURL) RestoreToTime(ctx context.Context, prefix string, t time.Time, o RestoreToTimeOptions) ([]BlobRestoreResult, error) {
+	if o.Parallelism == 0 {
+		o.Parallelism = 5 // default Parallelism
+	}
+	results := []BlobRestoreResult{}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, o.Parallelism)
+	// restore starts restoring the blob once fewer than Parallelism blobs are being restored. It returns false if
+	// ctx is done first.
+	restore := func(name string, history []BlobHistoryItem) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r := c.restoreBlobToTime(ctx, name, history, t, o)
+			lock.Lock()
+			results = append(results, r)
+			lock.Unlock()
+		}()
+		return true
+	}
+
+	// A blob's versions and snapshots are listed together, before the next blob.
+	pager := c.NewBlobPager(ListBlobsSegmentOptions{Prefix: prefix, Details: BlobListingDetails{Versions: true, Snapshots: true}})
+	var name string
+	var history []BlobHistoryItem
+	stopped := false
+	for pager.Next(ctx) {
+		item := pager.Item()
+		if item.Name != name && len(history) > 0 {
+			if stopped = !restore(name, history); stopped {
+				break
+			}
+			history = nil
+		}
+		name = item.Name
+		history = append(history, newBlobHistoryItem(item, c.NewBlobURL(item.Name)))
+	}
+	if !stopped && len(history) > 0 && pager.Err() == nil {
+		stopped = !restore(name, history)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	if stopped {
+		return results, ctx.Err()
+	}
+	return results, pager.Err()
+}
+
+// restoreBlobToTime restores a blob to its state at the time, given its history.
+func (c ContainerURL) restoreBlobToTime(ctx context.Context, name string, history []BlobHistoryItem, t time.Time, o RestoreToTimeOptions) BlobRestoreResult {
+	sortBlobHistory(history)
+	var current, from, last *BlobHistoryItem
+	for i := range history {
+		h := &history[i]
+		switch {
+		case h.IsCurrentVersion:
+			current = h
+		case h.VersionID != "" || h.Snapshot != "":
+			last = h
+			if !h.Time().After(t) {
+				from = h
+			}
+		}
+	}
+
+	r := BlobRestoreResult{Name: name, Action: BlobRestoreUnchanged}
+	ro := o.Restore
+	ro.AccessConditions.ModifiedAccessConditions = ModifiedAccessConditions{IfNoneMatch: ETagAny}
+	if current != nil {
+		ro.AccessConditions.ModifiedAccessConditions = ModifiedAccessConditions{IfMatch: current.Properties.Etag}
+	}
+	switch {
+	case current != nil && !current.Time().After(t):
+	case current == nil && from != nil && from == last && !o.RestoreDeletedUnchanged:
+		// The blob was deleted without changing after the time, possibly before the time.
+		r.Action = BlobRestoreSkipped
+	case from != nil:
+		r.Action, r.From = BlobRestoreRestored, from
+		if from.Snapshot != "" {
+			_, r.Err = c.NewBlobURL(name).RestoreFrom(ctx, "", from.Snapshot, ro)
+		} else {
+			_, r.Err = c.NewBlobURL(name).RestoreFrom(ctx, from.VersionID, "", ro)
+		}
+	case current != nil && o.DeleteCreatedAfter && current.Properties.CreationTime != nil && current.Properties.CreationTime.After(t):
+		// The creation time, unlike Time, isn't changed by overwriting the blob. A blob that existed at the time but
+		// has no version or snapshot to restore it from is skipped, as is one whose creation time is unknown.
+		r.Action = BlobRestoreDeleted
+		_, r.Err = c.NewBlobURL(name).Delete(ctx, DeleteSnapshotsOptionInclude, ro.AccessConditions)
+	case current != nil:
+		r.Action = BlobRestoreSkipped
+	}
+	return r
+}
@@ -0,0 +1,203 @@
+package blobsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	chk "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { chk.TestingT(t) }
+
+type blobsyncSuite struct{}
+
+var _ = chk.Suite(&blobsyncSuite{})
+
+var ctx = context.Background()
+
+// testOptions returns options for a holder that renews its lease and polls often.
+func testOptions(identity string) Options {
+	return Options{Identity: identity, LeaseDuration: 15 * time.Second, RenewInterval: 20 * time.Millisecond, PollInterval: 10 * time.Millisecond}
+}
+
+// waitDone waits for the context to be cancelled.
+func waitDone(c *chk.C, ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		c.Fatal("the context wasn't cancelled")
+	}
+}
+
+func (s *blobsyncSuite) TestMutexExcludesOtherHolders(c *chk.C) {
+	fake := newFakeService()
+	defer fake.close()
+	blobA, _ := fake.blobURL("job")
+	blobB, _ := fake.blobURL("job")
+	a, b := NewMutex(blobA, testOptions("a")), NewMutex(blobB, testOptions("b"))
+
+	// The lock blob is created on demand.
+	c.Assert(a.TryLock(ctx), chk.IsNil)
+	c.Assert(a.Context().Err(), chk.IsNil)
+	c.Assert(a.TryLock(ctx), chk.NotNil)
+	c.Assert(b.TryLock(ctx), chk.Equals, ErrLocked)
+	holder, err := b.Holder(ctx)
+	c.Assert(err, chk.IsNil)
+	c.Assert(holder.Identity, chk.Equals, "a")
+	c.Assert(time.Since(holder.Since) < time.Minute, chk.Equals, true)
+
+	locked := make(chan error)
+	go func() {
+		locked <- b.Lock(ctx)
+	}()
+	select {
+	case <-locked:
+		c.Fatal("the lock was acquired while it was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Assert(a.Unlock(ctx), chk.IsNil)
+	c.Assert(a.Context().Err(), chk.Equals, context.Canceled)
+	c.Assert(<-locked, chk.IsNil)
+	holder, err = a.Holder(ctx)
+	c.Assert(err, chk.IsNil)
+	c.Assert(holder.Identity, chk.Equals, "b")
+	c.Assert(b.Unlock(ctx), chk.IsNil)
+
+	holder, err = a.Holder(ctx)
+	c.Assert(err, chk.IsNil)
+	c.Assert(holder, chk.Equals, Holder{})
+	c.Assert(a.Unlock(ctx), chk.NotNil)
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	c.Assert(a.TryLock(ctx), chk.IsNil)
+	c.Assert(b.Lock(timeout), chk.Equals, context.DeadlineExceeded)
+}
+
+func (s *blobsyncSuite) TestMutexStealsAndBreaks(c *chk.C) {
+	fake := newFakeService()
+	defer fake.close()
+	blobURL, _ := fake.blobURL("job")
+	crashed := NewMutex(blobURL, testOptions("job-1"))
+	c.Assert(crashed.TryLock(ctx), chk.IsNil)
+
+	// A restarted process steals the lock it held before.
+	o := testOptions("job-1")
+	o.StealOwn = true
+	restarted := NewMutex(blobURL, o)
+	c.Assert(restarted.TryLock(ctx), chk.IsNil)
+	waitDone(c, crashed.Context())
+	c.Assert(errors.Is(crashed.Err(), azblob.ErrLeaseLost), chk.Equals, true)
+	c.Assert(errors.Is(crashed.Unlock(ctx), azblob.ErrLeaseLost), chk.Equals, true)
+
+	// Another process doesn't steal it, but breaks it after waiting.
+	other := NewMutex(blobURL, Options{Identity: "job-2", StealOwn: true, PollInterval: 10 * time.Millisecond})
+	c.Assert(other.TryLock(ctx), chk.Equals, ErrLocked)
+	o = testOptions("job-2")
+	o.BreakAfter = 50 * time.Millisecond
+	breaker := NewMutex(blobURL, o)
+	start := time.Now()
+	c.Assert(breaker.Lock(ctx), chk.IsNil)
+	c.Assert(time.Since(start) >= o.BreakAfter, chk.Equals, true)
+	waitDone(c, restarted.Context())
+	holder, err := breaker.Holder(ctx)
+	c.Assert(err, chk.IsNil)
+	c.Assert(holder.Identity, chk.Equals, "job-2")
+}
+
+func (s *blobsyncSuite) TestPartitionedHolderStopsBeforeOthersAcquire(c *chk.C) {
+	if testing.Short() {
+		c.Skip("waits for a lease to expire")
+	}
+	fake := newFakeService()
+	defer fake.close()
+	blobA, clientA := fake.blobURL("job")
+	blobB, _ := fake.blobURL("job")
+	a, b := NewMutex(blobA, testOptions("a")), NewMutex(blobB, testOptions("b"))
+	c.Assert(a.TryLock(ctx), chk.IsNil)
+
+	clientA.partition(true)
+	stopped := make(chan time.Time, 1)
+	go func() {
+		<-a.Context().Done()
+		stopped <- time.Now()
+	}()
+	c.Assert(b.Lock(ctx), chk.IsNil)
+	acquired := time.Now()
+	select {
+	case t := <-stopped:
+		c.Assert(t.Before(acquired), chk.Equals, true)
+	default:
+		c.Fatal("the partitioned holder still had the lock when another acquired it")
+	}
+	c.Assert(errors.Is(a.Err(), azblob.ErrLeaseLost), chk.Equals, true)
+
+	// The partitioned holder can't get the lock back once the partition heals.
+	clientA.partition(false)
+	c.Assert(errors.Is(a.Unlock(ctx), azblob.ErrLeaseLost), chk.Equals, true)
+	c.Assert(a.TryLock(ctx), chk.Equals, ErrLocked)
+}
+
+func (s *blobsyncSuite) TestHolderKeepsLockThroughServerErrors(c *chk.C) {
+	fake := newFakeService()
+	defer fake.close()
+	blobA, _ := fake.blobURL("job")
+	blobB, _ := fake.blobURL("leader")
+	a, b := NewMutex(blobA, testOptions("a")), NewElection(blobB, testOptions("b"))
+	c.Assert(a.TryLock(ctx), chk.IsNil)
+	c.Assert(b.Campaign(ctx, "10.0.0.2:80"), chk.IsNil)
+
+	// Renewals that fail with a server error are tried again before the leases expire.
+	fake.failRenewals(4)
+	time.Sleep(300 * time.Millisecond)
+	fake.lock.Lock()
+	c.Assert(fake.renewFailures, chk.Equals, 0)
+	fake.lock.Unlock()
+	c.Assert(a.Context().Err(), chk.IsNil)
+	c.Assert(a.Err(), chk.IsNil)
+	c.Assert(b.Context().Err(), chk.IsNil)
+	c.Assert(a.Unlock(ctx), chk.IsNil)
+	c.Assert(b.Resign(ctx), chk.IsNil)
+}
+
+func (s *blobsyncSuite) TestElectionFailsOverWhenServiceClockJumps(c *chk.C) {
+	fake := newFakeService()
+	defer fake.close()
+	blobA, _ := fake.blobURL("leader")
+	blobB, _ := fake.blobURL("leader")
+	blobObserver, _ := fake.blobURL("leader")
+	// a renews its lease less often than b tries to acquire it.
+	o := testOptions("a")
+	o.RenewInterval = time.Second
+	a, b := NewElection(blobA, o), NewElection(blobB, testOptions("b"))
+	observeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaders := NewElection(blobObserver, testOptions("observer")).Observe(observeCtx)
+	c.Assert((<-leaders).Identity, chk.Equals, "")
+
+	c.Assert(a.Campaign(ctx, "10.0.0.1:80"), chk.IsNil)
+	leader := <-leaders
+	c.Assert(leader.Identity, chk.Equals, "a")
+	c.Assert(leader.Value, chk.Equals, "10.0.0.1:80")
+	campaigned := make(chan error)
+	go func() {
+		campaigned <- b.Campaign(ctx, "10.0.0.2:80")
+	}()
+
+	// The service's clock jumps past the lease's expiry between renewals, so b is elected while a still leads. a
+	// finds out when it next renews the lease.
+	fake.skewClock(20 * time.Second)
+	c.Assert(<-campaigned, chk.IsNil)
+	waitDone(c, a.Context())
+	c.Assert(errors.Is(a.Resign(ctx), azblob.ErrLeaseLost), chk.Equals, true)
+	leader = <-leaders
+	c.Assert(leader.Identity, chk.Equals, "b")
+	c.Assert(leader.Value, chk.Equals, "10.0.0.2:80")
+
+	c.Assert(b.Resign(ctx), chk.IsNil)
+	c.Assert((<-leaders).Identity, chk.Equals, "")
+	c.Assert(b.Context().Err(), chk.NotNil)
+}
@@ -0,0 +1,68 @@
+package blobsync
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Election elects one leader at a time among the processes campaigning on the same blob. The leader is the holder of
+// a Mutex on the blob, and its value is written into the blob's metadata.
+type Election struct {
+	m *Mutex
+}
+
+// NewElection returns an Election held on the blob.
+func NewElection(blob azblob.BlobURL, o Options) *Election {
+	return &Election{m: NewMutex(blob, o)}
+}
+
+// Campaign waits until this process is elected leader with the value, such as the address it serves on, or ctx is
+// done. The leadership lasts until Resign or until the Context is cancelled.
+func (e *Election) Campaign(ctx context.Context, value string) error {
+	return e.m.lockWithValue(ctx, value)
+}
+
+// Resign gives up the leadership, so that another process can be elected.
+func (e *Election) Resign(ctx context.Context) error {
+	return e.m.Unlock(ctx)
+}
+
+// Context returns a context that is cancelled when the leadership is lost or resigned. It is cancelled already if this
+// process isn't the leader.
+func (e *Election) Context() context.Context {
+	return e.m.Context()
+}
+
+// Leader returns the current leader. Its Identity is "" if there's none.
+func (e *Election) Leader(ctx context.Context) (Holder, error) {
+	return e.m.Holder(ctx)
+}
+
+// Observe returns a channel that receives the leader when the election starts being observed and each time it
+// changes, until ctx is done. The leader is checked every PollInterval; errors checking it are ignored, so the leader
+// is reported once it can be checked again.
+func (e *Election) Observe(ctx context.Context) <-chan Holder {
+	leaders := make(chan Holder)
+	go func() {
+		defer close(leaders)
+		var last *Holder
+		for {
+			if leader, err := e.Leader(ctx); err == nil && (last == nil || leader != *last) {
+				select {
+				case leaders <- leader:
+					last = &leader
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-time.After(e.m.o.PollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return leaders
+}
@@ -0,0 +1,277 @@
+package blobsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// fakeService is an in-memory Blob service that only supports what locks use: creating blobs, their properties and
+// metadata, and leases. Its clock can be skewed, and the connections of its clients can be cut.
+type fakeService struct {
+	lock   sync.Mutex
+	server *httptest.Server
+	blobs  map[string]*fakeBlob
+	etag   int
+
+	// skew is added to the fake's clock, which leases expire by.
+	skew time.Duration
+
+	// renewFailures is how many of the next lease renewals fail with ServerBusy.
+	renewFailures int
+}
+
+type fakeBlob struct {
+	metadata map[string]string
+	etag     string
+	leaseID  string
+	duration time.Duration // 0 for an infinite lease
+	expiry   time.Time     // when a fixed lease expires or a broken lease finishes breaking
+	broken   bool
+}
+
+func newFakeService() *fakeService {
+	f := &fakeService{blobs: map[string]*fakeBlob{}}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeService) close() {
+	f.server.Close()
+}
+
+// skewClock moves the fake's clock by d.
+func (f *fakeService) skewClock(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.skew += d
+}
+
+// failRenewals makes the next n lease renewals fail with ServerBusy, as a busy service does.
+func (f *fakeService) failRenewals(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.renewFailures = n
+}
+
+// client is a process's connection to the fake service, which partition cuts.
+type client struct {
+	partitioned int32
+}
+
+// partition cuts the client's connection to the service, or restores it.
+func (cl *client) partition(cut bool) {
+	v := int32(0)
+	if cut {
+		v = 1
+	}
+	atomic.StoreInt32(&cl.partitioned, v)
+}
+
+// New creates the policy that sends requests, unless the client is partitioned.
+func (cl *client) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		if atomic.LoadInt32(&cl.partitioned) != 0 {
+			return nil, errors.New("the network is unreachable")
+		}
+		resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+		return pipeline.NewHTTPResponse(resp), err
+	})
+}
+
+// blobURL returns the URL of the blob for a new client, which doesn't retry failed requests.
+func (f *fakeService) blobURL(name string) (azblob.BlobURL, *client) {
+	cl := &client{}
+	u, _ := url.Parse(f.server.URL + "/devstoreaccount1/locks/" + name)
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1},
+		RequestLog: azblob.RequestLogOptions{SyslogDisabled: true}, HTTPSender: cl})
+	return azblob.NewBlobURL(*u, p), cl
+}
+
+func (f *fakeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if code, status := f.serve(w, r); code != "" {
+		w.Header().Set("x-ms-error-code", string(code))
+		w.WriteHeader(status)
+	}
+}
+
+func (f *fakeService) serve(w http.ResponseWriter, r *http.Request) (azblob.ServiceCodeType, int) {
+	now := time.Now().Add(f.skew)
+	if r.Header.Get("x-ms-lease-action") == "renew" && f.renewFailures > 0 {
+		f.renewFailures--
+		return azblob.ServiceCodeServerBusy, http.StatusServiceUnavailable
+	}
+	b := f.blobs[r.URL.Path]
+	comp := r.URL.Query().Get("comp")
+	if r.Method == http.MethodPut && comp == "" {
+		if b != nil && r.Header.Get("If-None-Match") == "*" {
+			return azblob.ServiceCodeBlobAlreadyExists, http.StatusConflict
+		}
+		if b == nil {
+			b = &fakeBlob{}
+			f.blobs[r.URL.Path] = b
+		} else if code := b.checkLease(r, now); code != "" {
+			return code, http.StatusPreconditionFailed
+		}
+		b.metadata = fakeMetadata(r)
+		f.touch(w, b)
+		w.WriteHeader(http.StatusCreated)
+		return "", 0
+	}
+	if b == nil {
+		return azblob.ServiceCodeBlobNotFound, http.StatusNotFound
+	}
+	switch {
+	case r.Method == http.MethodHead && comp == "":
+		for k, v := range b.metadata {
+			w.Header().Set("x-ms-meta-"+k, v)
+		}
+		state := b.leaseState(now)
+		status := "unlocked"
+		if state == "leased" || state == "breaking" {
+			status = "locked"
+		}
+		w.Header().Set("x-ms-lease-state", state)
+		w.Header().Set("x-ms-lease-status", status)
+		w.Header().Set("ETag", b.etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && comp == "metadata":
+		if code := b.checkLease(r, now); code != "" {
+			return code, http.StatusPreconditionFailed
+		}
+		b.metadata = fakeMetadata(r)
+		f.touch(w, b)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && comp == "lease":
+		return b.serveLease(w, r, now)
+	default:
+		return azblob.ServiceCodeUnsupportedQueryParameter, http.StatusBadRequest
+	}
+	return "", 0
+}
+
+func (f *fakeService) touch(w http.ResponseWriter, b *fakeBlob) {
+	f.etag++
+	b.etag = fmt.Sprintf("\"0x%X\"", f.etag)
+	w.Header().Set("ETag", b.etag)
+}
+
+func fakeMetadata(r *http.Request) map[string]string {
+	md := map[string]string{}
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			md[strings.ToLower(k[len("x-ms-meta-"):])] = r.Header.Get(k)
+		}
+	}
+	return md
+}
+
+// leaseState returns the blob's lease state at the time.
+func (b *fakeBlob) leaseState(now time.Time) string {
+	switch {
+	case b.leaseID == "":
+		return "available"
+	case b.broken && now.Before(b.expiry):
+		return "breaking"
+	case b.broken:
+		return "broken"
+	case b.duration != 0 && !now.Before(b.expiry):
+		return "expired"
+	}
+	return "leased"
+}
+
+// checkLease checks the lease ID of a write to the blob.
+func (b *fakeBlob) checkLease(r *http.Request, now time.Time) azblob.ServiceCodeType {
+	id := r.Header.Get("x-ms-lease-id")
+	state := b.leaseState(now)
+	held := state == "leased" || state == "breaking"
+	switch {
+	case id == "" && held:
+		return azblob.ServiceCodeLeaseIDMissing
+	case id == "":
+		return ""
+	case !held && b.leaseID == id:
+		return azblob.ServiceCodeLeaseLost
+	case !held:
+		return azblob.ServiceCodeLeaseNotPresentWithBlobOperation
+	case b.leaseID != id:
+		return azblob.ServiceCodeLeaseIDMismatchWithBlobOperation
+	}
+	return ""
+}
+
+func (b *fakeBlob) serveLease(w http.ResponseWriter, r *http.Request, now time.Time) (azblob.ServiceCodeType, int) {
+	state := b.leaseState(now)
+	id := r.Header.Get("x-ms-lease-id")
+	switch r.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		seconds, err := strconv.Atoi(r.Header.Get("x-ms-lease-duration"))
+		if err != nil || (seconds != -1 && (seconds < 15 || seconds > 60)) {
+			return azblob.ServiceCodeInvalidHeaderValue, http.StatusBadRequest
+		}
+		proposed := r.Header.Get("x-ms-proposed-lease-id")
+		switch {
+		case state == "breaking":
+			return azblob.ServiceCodeLeaseIsBreakingAndCannotBeAcquired, http.StatusConflict
+		case state == "leased" && b.leaseID != proposed:
+			return azblob.ServiceCodeLeaseAlreadyPresent, http.StatusConflict
+		}
+		b.leaseID, b.broken, b.duration = proposed, false, 0
+		if seconds != -1 {
+			b.duration = time.Duration(seconds) * time.Second
+			b.expiry = now.Add(b.duration)
+		}
+		w.Header().Set("x-ms-lease-id", b.leaseID)
+		w.WriteHeader(http.StatusCreated)
+		return "", 0
+	case "renew":
+		switch {
+		case b.leaseID != id:
+			return azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation, http.StatusConflict
+		case b.broken:
+			return azblob.ServiceCodeLeaseIsBrokenAndCannotBeRenewed, http.StatusConflict
+		}
+		b.expiry = now.Add(b.duration)
+	case "release":
+		if b.leaseID != id {
+			return azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation, http.StatusConflict
+		}
+		b.leaseID = ""
+	case "break":
+		if state != "leased" && state != "breaking" {
+			return azblob.ServiceCodeLeaseNotPresentWithLeaseOperation, http.StatusConflict
+		}
+		if state == "leased" {
+			period := time.Duration(0)
+			if b.duration != 0 {
+				period = b.expiry.Sub(now)
+			}
+			if seconds, err := strconv.Atoi(r.Header.Get("x-ms-lease-break-period")); err == nil && (b.duration == 0 || time.Duration(seconds)*time.Second < period) {
+				period = time.Duration(seconds) * time.Second
+			}
+			b.broken, b.expiry = true, now.Add(period)
+		}
+		w.Header().Set("x-ms-lease-time", strconv.Itoa(int(b.expiry.Sub(now)/time.Second)))
+		w.WriteHeader(http.StatusAccepted)
+		return "", 0
+	default:
+		return azblob.ServiceCodeInvalidHeaderValue, http.StatusBadRequest
+	}
+	w.Header().Set("x-ms-lease-id", b.leaseID)
+	w.WriteHeader(http.StatusOK)
+	return "", 0
+}
@@ -0,0 +1,254 @@
+// Package blobsync coordinates processes with leases on blobs: a Mutex held by one process at a time, and an
+// Election of a leader among processes.
+//
+// A lock is a lease on a lock blob, which is created on demand and renewed by an azblob.LeaseKeeper while the lock is
+// held. The holder's identity is written into the blob's metadata, so that Holder and the portal show who holds it.
+//
+// Work done under a lock should stop when the lock's Context is cancelled: the lease can be lost, for example when
+// the holder can't reach the service to renew it, and another process can then acquire the lock. A holder that can't
+// renew its lease cancels the Context when the lease may have expired, which is before the service lets another
+// process acquire it, as long as the clocks of the holder and the service run at the same rate. Renewals that fail
+// with a server error or timeout are tried again until then; only the service saying the lease is gone loses the
+// lock sooner.
+package blobsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// ErrLocked is returned by TryLock when another holder has the lock.
+var ErrLocked = errors.New("the lock is held by another holder")
+
+// The metadata of the lock blob that describes its holder.
+const (
+	metadataHolder   = "holder"
+	metadataValue    = "value"
+	metadataAcquired = "acquired"
+)
+
+// Options identifies options used by NewMutex and NewElection.
+type Options struct {
+	// Identity identifies the holder in the lock blob's metadata (""=the host name and process ID). Every holder must
+	// have a different identity.
+	Identity string
+
+	// LeaseDuration is the duration of the lease, between 15 and 60 seconds (0=60 seconds). A lock whose holder stops
+	// without unlocking it can be acquired after it.
+	LeaseDuration time.Duration
+
+	// RenewInterval is how often the lease is renewed (0=a third of LeaseDuration).
+	RenewInterval time.Duration
+
+	// PollInterval is how often Lock and Campaign try to acquire the lock, and Observe checks the leader (0=1 second).
+	PollInterval time.Duration
+
+	// BreakAfter, if set, makes Lock and Campaign break the lease of a holder they have waited for this long, for
+	// example one that acquired it with an infinite lease. The holder finds out when it next renews the lease.
+	BreakAfter time.Duration
+
+	// BreakPeriod is how long a lease broken by BreakAfter lasts before it can be acquired, up to 60 seconds. 0 breaks
+	// it at once, stealing the lock from its holder.
+	BreakPeriod time.Duration
+
+	// StealOwn makes acquiring the lock break, at once, a lease held with the same Identity: a previous run of the
+	// process that didn't unlock it.
+	StealOwn bool
+}
+
+// Holder is the holder of a lock, as written in the lock blob's metadata.
+type Holder struct {
+	// Identity is the holder's identity, or "" if the lock isn't held.
+	Identity string
+
+	// Value is the value a leader was elected with by Election.Campaign.
+	Value string
+
+	// Since is when the holder acquired the lock, by its clock.
+	Since time.Time
+}
+
+// Mutex is a lock held by one process at a time, as a lease on a blob. A Mutex is safe for concurrent use, but is held
+// by the process rather than a goroutine.
+type Mutex struct {
+	blob azblob.BlockBlobURL
+	o    Options
+
+	lock   sync.Mutex
+	keeper *azblob.LeaseKeeper
+}
+
+// NewMutex returns a Mutex that is held as a lease on the blob.
+func NewMutex(blob azblob.BlobURL, o Options) *Mutex {
+	if o.Identity == "" {
+		host, _ := os.Hostname()
+		o.Identity = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	return &Mutex{blob: blob.ToBlockBlobURL(), o: o}
+}
+
+// Lock waits until it acquires the lock, or ctx is done.
+func (m *Mutex) Lock(ctx context.Context) error {
+	return m.lockWithValue(ctx, "")
+}
+
+// TryLock acquires the lock, or returns ErrLocked if another holder has it.
+func (m *Mutex) TryLock(ctx context.Context) error {
+	return m.tryLock(ctx, "")
+}
+
+func (m *Mutex) lockWithValue(ctx context.Context, value string) error {
+	waitingSince := time.Now()
+	for {
+		err := m.tryLock(ctx, value)
+		if err != ErrLocked && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != ErrLocked {
+			return err
+		}
+		if m.o.BreakAfter > 0 && time.Since(waitingSince) >= m.o.BreakAfter {
+			if _, err := m.blob.BreakLease(ctx, int32(m.o.BreakPeriod/time.Second), azblob.ModifiedAccessConditions{}); err != nil && !hasServiceCode(err, azblob.ServiceCodeLeaseNotPresentWithLeaseOperation) {
+				return err
+			}
+			waitingSince = time.Now()
+		}
+		wait := time.Duration(float32(m.o.PollInterval) * (rand.Float32()/2 + 0.75)) // NOTE: We want math/rand; not crypto/rand
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *Mutex) tryLock(ctx context.Context, value string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.keeper != nil && m.keeper.Err() == nil {
+		return errors.New("the lock is already held")
+	}
+	keeper, err := m.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	md := azblob.Metadata{metadataHolder: m.o.Identity, metadataAcquired: time.Now().UTC().Format(time.RFC3339Nano)}
+	if value != "" {
+		md[metadataValue] = value
+	}
+	_, err = m.blob.SetMetadata(ctx, md, azblob.BlobAccessConditions{LeaseAccessConditions: keeper.AccessConditions()}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		keeper.Close(ctx)
+		return err
+	}
+	m.keeper = keeper
+	return nil
+}
+
+// acquire acquires the lease on the lock blob, creating the blob if it doesn't exist.
+func (m *Mutex) acquire(ctx context.Context) (*azblob.LeaseKeeper, error) {
+	created, stolen := false, false
+	for {
+		keeper, err := m.blob.KeepLease(ctx, azblob.LeaseKeeperOptions{Duration: m.o.LeaseDuration, RenewInterval: m.o.RenewInterval})
+		switch {
+		case err == nil:
+			return keeper, nil
+		case errors.Is(err, azblob.ErrLeaseAlreadyPresent) && m.o.StealOwn && !stolen:
+			stolen = true
+			if holder, err := m.Holder(ctx); err != nil || holder.Identity != m.o.Identity {
+				return nil, ErrLocked
+			}
+			if _, err := m.blob.BreakLease(ctx, 0, azblob.ModifiedAccessConditions{}); err != nil && !hasServiceCode(err, azblob.ServiceCodeLeaseNotPresentWithLeaseOperation) {
+				return nil, err
+			}
+		case errors.Is(err, azblob.ErrLeaseAlreadyPresent) || hasServiceCode(err, azblob.ServiceCodeLeaseIsBreakingAndCannotBeAcquired):
+			return nil, ErrLocked
+		case hasServiceCode(err, azblob.ServiceCodeBlobNotFound) && !created:
+			created = true
+			_, err := m.blob.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+				azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}},
+				azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
+			if err != nil && !hasServiceCode(err, azblob.ServiceCodeBlobAlreadyExists) {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Unlock clears the holder from the lock blob's metadata and releases the lock. If the lock was lost, it returns the
+// azblob.LeaseError of azblob.ErrLeaseLost.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	m.lock.Lock()
+	keeper := m.keeper
+	m.keeper = nil
+	m.lock.Unlock()
+	if keeper == nil {
+		return errors.New("the lock isn't held")
+	}
+	if keeper.Err() == nil {
+		// The holder is only cleared for visibility; it's the lease that holds the lock.
+		m.blob.SetMetadata(ctx, azblob.Metadata{}, azblob.BlobAccessConditions{LeaseAccessConditions: keeper.AccessConditions()}, azblob.ClientProvidedKeyOptions{})
+	}
+	return keeper.Close(ctx)
+}
+
+// Context returns a context that is cancelled when the lock is lost or unlocked. It is cancelled already if the lock
+// isn't held.
+func (m *Mutex) Context() context.Context {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.keeper == nil {
+		return cancelledContext
+	}
+	return m.keeper.Context()
+}
+
+// Err returns the azblob.LeaseError of azblob.ErrLeaseLost if the lock was lost, or nil.
+func (m *Mutex) Err() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.keeper == nil {
+		return nil
+	}
+	return m.keeper.Err()
+}
+
+// Holder returns the holder of the lock, from the lock blob's metadata. Its Identity is "" if the lock isn't held.
+func (m *Mutex) Holder(ctx context.Context) (Holder, error) {
+	props, err := m.blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if hasServiceCode(err, azblob.ServiceCodeBlobNotFound) {
+		return Holder{}, nil
+	} else if err != nil {
+		return Holder{}, err
+	}
+	if state := props.LeaseState(); state != azblob.LeaseStateLeased && state != azblob.LeaseStateBreaking {
+		return Holder{}, nil
+	}
+	md := props.NewMetadata()
+	since, _ := time.Parse(time.RFC3339Nano, md[metadataAcquired])
+	return Holder{Identity: md[metadataHolder], Value: md[metadataValue], Since: since}, nil
+}
+
+var cancelledContext = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// hasServiceCode reports whether the error is caused by a StorageError with the code.
+func hasServiceCode(err error, code azblob.ServiceCodeType) bool {
+	var stgErr azblob.StorageError
+	return errors.As(err, &stgErr) && stgErr.ServiceCode() == code
+}
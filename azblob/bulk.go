@@ -0,0 +1,378 @@
+package azblob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// BlobBatchMaxOperations is the maximum number of operations in a Blob Batch request.
+const BlobBatchMaxOperations = 256
+
+// BulkOperation is an operation that ContainerURL.Bulk applies to blobs. Make one with BulkDelete, BulkSetTier,
+// BulkSetTags or BulkSetMetadata.
+type BulkOperation struct {
+	kind              bulkOperationKind
+	deleteSnapshots   DeleteSnapshotsOptionType
+	tier              AccessTierType
+	rehydratePriority RehydratePriorityType
+	tags              BlobTagsMap
+	metadata          Metadata
+}
+
+type bulkOperationKind int
+
+const (
+	bulkDelete bulkOperationKind = iota + 1
+	bulkSetTier
+	bulkSetTags
+	bulkSetMetadata
+)
+
+// BulkDelete returns an operation that deletes blobs, and their snapshots as deleteSnapshots says.
+func BulkDelete(deleteSnapshots DeleteSnapshotsOptionType) BulkOperation {
+	return BulkOperation{kind: bulkDelete, deleteSnapshots: deleteSnapshots}
+}
+
+// BulkSetTier returns an operation that sets the tier of blobs.
+func BulkSetTier(tier AccessTierType, rehydratePriority RehydratePriorityType) BulkOperation {
+	return BulkOperation{kind: bulkSetTier, tier: tier, rehydratePriority: rehydratePriority}
+}
+
+// BulkSetTags returns an operation that replaces the index tags of blobs.
+func BulkSetTags(tags BlobTagsMap) BulkOperation {
+	return BulkOperation{kind: bulkSetTags, tags: tags}
+}
+
+// BulkSetMetadata returns an operation that replaces the metadata of blobs.
+func BulkSetMetadata(metadata Metadata) BulkOperation {
+	return BulkOperation{kind: bulkSetMetadata, metadata: metadata}
+}
+
+// String describes the operation.
+func (op BulkOperation) String() string {
+	switch op.kind {
+	case bulkDelete:
+		return "delete"
+	case bulkSetTier:
+		return "set tier to " + string(op.tier)
+	case bulkSetTags:
+		return "set tags"
+	case bulkSetMetadata:
+		return "set metadata"
+	}
+	return "none"
+}
+
+// BulkOptions identifies options used by ContainerURL.Bulk.
+type BulkOptions struct {
+	// Prefix limits the operation to the blobs whose names start with it.
+	Prefix string
+
+	// Where, if set, selects the blobs by their index tags, as for ServiceURL.FindBlobsByTags but without ContainerIs,
+	// instead of listing the container. See TagFilter.Where.
+	Where string
+
+	// Match, if set, selects the blobs it returns true for. The items are the ones listed with Details or, if Where
+	// is set, only have their Name and BlobTags.
+	Match func(item *BlobItemInternal) bool
+
+	// Details indicates what additional information the service should return with each blob, for Match. Versions
+	// and snapshots are never listed.
+	Details BlobListingDetails
+
+	// Parallelism indicates the maximum number of requests to make in parallel (0=default)
+	Parallelism uint16
+
+	// UseBatch sends deletes and tier changes in Blob Batch requests of up to BlobBatchMaxOperations blobs. If a Blob
+	// Batch request fails, for example because the service doesn't support it, its blobs and the remaining ones are
+	// acted on with a request each.
+	UseBatch bool
+
+	// DryRun only returns the plan: the selected blobs, with the BulkPlanned status.
+	DryRun bool
+}
+
+// BulkStatus is the outcome of applying an operation to a blob with ContainerURL.Bulk.
+type BulkStatus string
+
+const (
+	// BulkPlanned means the blob was selected but a dry run didn't act on it.
+	BulkPlanned BulkStatus = "planned"
+
+	// BulkDone means the operation was applied to the blob.
+	BulkDone BulkStatus = "done"
+
+	// BulkSkipped means the blob was changed or deleted since it was selected, so the operation wasn't applied.
+	BulkSkipped BulkStatus = "skipped"
+
+	// BulkFailed means applying the operation failed.
+	BulkFailed BulkStatus = "failed"
+)
+
+// BulkResult is the result of applying an operation to a blob with ContainerURL.Bulk.
+type BulkResult struct {
+	Name string
+
+	// ETag is the blob's ETag when it was listed, or ETagNone if it was selected with Where.
+	ETag ETag
+
+	Status BulkStatus
+
+	// Err is the error the service returned for a skipped or failed blob.
+	Err error
+}
+
+// Bulk applies the operation to each of the container's blobs selected by the options: the blobs listed under the
+// Prefix, or found by Where, for which Match returns true.
+//
+// Deleting and setting metadata are conditional on the blob's ETag as listed, so blobs that have changed since are
+// skipped; the service doesn't support ETag conditions on setting tiers or tags. Blobs selected by Where are only
+// acted on if they still match it.
+//
+// Bulk returns a result for each selected blob, in name order. Failing to act on a blob doesn't stop the others; its
+// result has the error. The returned error is only for failing to select the blobs, or ctx being done.
+func (c ContainerURL) Bulk(ctx context.Context, op BulkOperation, o BulkOptions) ([]BulkResult, error) {
+	if op.kind == 0 {
+		return nil, errors.New("the operation must be made with BulkDelete, BulkSetTier, BulkSetTags or BulkSetMetadata")
+	}
+	results, err := c.bulkSelect(ctx, o)
+	if err != nil || o.DryRun {
+		return results, err
+	}
+
+	chunkSize := int64(1)
+	useBatch := o.UseBatch && (op.kind == bulkDelete || op.kind == bulkSetTier)
+	if useBatch {
+		chunkSize = BlobBatchMaxOperations
+	}
+	batchFailed := int32(0)
+	err = DoBatchTransfer(ctx, BatchTransferOptions{
+		OperationName: "Bulk",
+		TransferSize:  int64(len(results)),
+		ChunkSize:     chunkSize,
+		Parallelism:   o.Parallelism,
+		Operation: func(offset int64, count int64, ctx context.Context) error {
+			chunk := results[offset : offset+count]
+			if useBatch && atomic.LoadInt32(&batchFailed) == 0 {
+				if err := c.submitBulkBatch(ctx, op, o, chunk); err == nil || ctx.Err() != nil {
+					return ctx.Err()
+				}
+				atomic.StoreInt32(&batchFailed, 1)
+			}
+			for i := range chunk {
+				chunk[i].setOutcome(c.applyBulkOperation(ctx, op, o, chunk[i]))
+			}
+			return ctx.Err()
+		},
+	})
+	return results, err
+}
+
+// bulkSelect returns the blobs selected by the options, in name order, with the BulkPlanned status.
+func (c ContainerURL) bulkSelect(ctx context.Context, o BulkOptions) ([]BulkResult, error) {
+	results := []BulkResult{}
+	if o.Where != "" {
+		p := NewBlobURLParts(c.URL())
+		where := o.Where + " AND " + ContainerIs(p.ContainerName).expr
+		p.ContainerName = ""
+		pager := NewServiceURL(p.URL(), c.client.Pipeline()).NewBlobsByTagsPager(where, 0)
+		for pager.Next(ctx) {
+			item := pager.Item()
+			if len(item.Name) < len(o.Prefix) || item.Name[:len(o.Prefix)] != o.Prefix {
+				continue
+			}
+			if o.Match == nil || o.Match(&BlobItemInternal{Name: item.Name, BlobTags: item.Tags}) {
+				results = append(results, BulkResult{Name: item.Name, Status: BulkPlanned})
+			}
+		}
+		if err := pager.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		o.Details.Versions, o.Details.Snapshots = false, false
+		pager := c.NewBlobPager(ListBlobsSegmentOptions{Prefix: o.Prefix, Details: o.Details})
+		for pager.Next(ctx) {
+			item := pager.Item()
+			if o.Match == nil || o.Match(item) {
+				results = append(results, BulkResult{Name: item.Name, ETag: item.Properties.Etag, Status: BulkPlanned})
+			}
+		}
+		if err := pager.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// conditions returns the conditions on the blob still being as it was selected.
+func (r BulkResult) conditions(o BulkOptions) ModifiedAccessConditions {
+	return ModifiedAccessConditions{IfMatch: r.ETag, IfTags: o.Where}
+}
+
+// setOutcome sets the status of the result from the error of applying the operation.
+func (r *BulkResult) setOutcome(err error) {
+	r.Err = err
+	var stgErr StorageError
+	switch {
+	case err == nil:
+		r.Status = BulkDone
+	case errors.As(err, &stgErr) && (stgErr.ServiceCode() == ServiceCodeConditionNotMet || stgErr.ServiceCode() == ServiceCodeBlobNotFound):
+		r.Status = BulkSkipped
+	default:
+		r.Status = BulkFailed
+	}
+}
+
+// applyBulkOperation applies the operation to a blob with a request of its own.
+func (c ContainerURL) applyBulkOperation(ctx context.Context, op BulkOperation, o BulkOptions, r BulkResult) error {
+	b := c.NewBlobURL(r.Name)
+	ac := r.conditions(o)
+	var err error
+	switch op.kind {
+	case bulkDelete:
+		_, err = b.Delete(ctx, op.deleteSnapshots, BlobAccessConditions{ModifiedAccessConditions: ac})
+	case bulkSetTier:
+		_, err = b.blobClient.SetTier(ctx, op.tier, nil, nil, nil, op.rehydratePriority, nil, nil, ac.tagsPointer())
+	case bulkSetTags:
+		_, err = b.SetTags(ctx, nil, nil, ac.tagsPointer(), op.tags)
+	case bulkSetMetadata:
+		_, err = b.SetMetadata(ctx, op.metadata, BlobAccessConditions{ModifiedAccessConditions: ac}, ClientProvidedKeyOptions{})
+	}
+	return err
+}
+
+// submitBulkBatch applies a delete or tier change to the blobs with a Blob Batch request. The error is for the
+// request as a whole; the results of the blobs are set from their responses.
+func (c ContainerURL) submitBulkBatch(ctx context.Context, op BulkOperation, o BulkOptions, results []BulkResult) error {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	if err := w.SetBoundary("batch_" + newUUID().String()); err != nil {
+		return err
+	}
+	for i, r := range results {
+		req, err := c.bulkBatchRequest(ctx, op, o, r)
+		if err != nil {
+			return err
+		}
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+			"Content-ID":                {strconv.Itoa(i)},
+		})
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Length", "0")
+		fmt.Fprintf(part, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+		if err := req.Header.Write(part); err != nil {
+			return err
+		}
+		fmt.Fprint(part, "\r\n")
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	resp, err := c.client.SubmitBatch(ctx, bytes.NewReader(body.Bytes()), int64(body.Len()), "multipart/mixed; boundary="+w.Boundary(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Response().Body.Close()
+	_, params, err := mime.ParseMediaType(resp.ContentType())
+	if err != nil {
+		return err
+	}
+	answered := make([]bool, len(results))
+	parts := multipart.NewReader(resp.Response().Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			break
+		}
+		i, err := strconv.Atoi(part.Header.Get("Content-ID"))
+		if err != nil || i < 0 || i >= len(results) {
+			continue
+		}
+		subResp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			results[i].Status, results[i].Err = BulkFailed, err
+			answered[i] = true
+			continue
+		}
+		b, err := ioutil.ReadAll(subResp.Body)
+		subResp.Body.Close()
+		if err == nil {
+			subResp.Body = ioutil.NopCloser(bytes.NewReader(b))
+			err = validateResponse(pipeline.NewHTTPResponse(subResp), http.StatusOK, http.StatusAccepted)
+		}
+		results[i].setOutcome(err)
+		answered[i] = true
+	}
+	for i := range results {
+		if !answered[i] {
+			results[i].Status, results[i].Err = BulkFailed, errors.New("the Blob Batch response has no response for the blob")
+		}
+	}
+	return nil
+}
+
+// bulkBatchRequest returns the request that applies the operation to a blob, authorized by the pipeline's credential,
+// to send in a Blob Batch request.
+func (c ContainerURL) bulkBatchRequest(ctx context.Context, op BulkOperation, o BulkOptions, r BulkResult) (*http.Request, error) {
+	b := c.NewBlobURL(r.Name)
+	ac := r.conditions(o)
+	var req pipeline.Request
+	var err error
+	if op.kind == bulkDelete {
+		ifMatch := ac.IfMatch
+		var ifMatchPointer *ETag
+		if ifMatch != ETagNone {
+			ifMatchPointer = &ifMatch
+		}
+		req, err = b.blobClient.deletePreparer(nil, nil, nil, nil, op.deleteSnapshots, nil, nil, ifMatchPointer, nil, ac.tagsPointer(), nil, BlobDeleteNone)
+	} else {
+		req, err = b.blobClient.setTierPreparer(op.tier, nil, nil, nil, op.rehydratePriority, nil, nil, ac.tagsPointer())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The service version is set by the Blob Batch request alone.
+	req.Header.Del("x-ms-version")
+	captured := &http.Request{}
+	if _, err := b.blobClient.Pipeline().Do(ctx, batchRequestCapturer{captured}, req); err != nil {
+		return nil, err
+	}
+	return captured, nil
+}
+
+// batchRequestCapturer is the method factory of a pipeline that prepares a Blob Batch subrequest: it keeps the
+// request, once the pipeline's policies have authorized it, instead of sending it.
+type batchRequestCapturer struct {
+	request *http.Request
+}
+
+// New creates the policy that keeps the request.
+func (f batchRequestCapturer) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		*f.request = *request.Request
+		f.request.Header = request.Header.Clone()
+		return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusAccepted, Header: http.Header{}, Body: http.NoBody,
+			Request: request.Request}), nil
+	})
+}
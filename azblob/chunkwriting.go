@@ -3,6 +3,7 @@ package azblob
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	guuid "github.com/google/uuid"
 )
@@ -19,6 +21,7 @@ import (
 type blockWriter interface {
 	StageBlock(context.Context, string, io.ReadSeeker, LeaseAccessConditions, []byte, ClientProvidedKeyOptions) (*BlockBlobStageBlockResponse, error)
 	CommitBlockList(context.Context, []string, BlobHTTPHeaders, Metadata, BlobAccessConditions, AccessTierType, BlobTagsMap, ClientProvidedKeyOptions, ImmutabilityPolicyOptions) (*BlockBlobCommitBlockListResponse, error)
+	GetBlockList(context.Context, BlockListType, LeaseAccessConditions) (*BlockList, error)
 }
 
 // copyFromReader copies a source io.Reader to blob storage using concurrent uploads.
@@ -46,6 +49,21 @@ func copyFromReader(ctx context.Context, from io.Reader, to blockWriter, o Uploa
 		o:      o,
 		errCh:  make(chan error, 1),
 	}
+	if o.AutoTune {
+		max := autoTuneMaxParallelism // A TransferManager's buffers bound the parallel uploads anyway
+		if o.transferMangerNotSet {
+			max = o.MaxBuffers
+		}
+		cp.tuner = newConcurrencyTuner(max)
+		cp.ctx = withServerBusyNotifier(ctx, cp.tuner.serverBusy)
+	}
+	if o.ContentAddressedBlockIDs {
+		existing, err := existingBlocks(ctx, to, o.AccessConditions.LeaseAccessConditions)
+		if err != nil {
+			return nil, err
+		}
+		cp.existing = existing
+	}
 
 	// Send all our chunks until we get an error.
 	var err error
@@ -87,6 +105,14 @@ type copier struct {
 	// to is the location we are writing our chunks to.
 	to blockWriter
 
+	// existing holds the sizes of the blocks the blob already has, by ID, when uploading with content-addressed
+	// block IDs. staged records the blocks staged by this upload, so a repeated block is only sent once.
+	existing map[string]int64
+	staged   sync.Map
+
+	// tuner, if set, limits and adjusts how many blocks are staged in parallel.
+	tuner *concurrencyTuner
+
 	// errCh is used to hold the first error from our concurrent writers.
 	errCh chan error
 	// wg provides a count of how many writers we are waiting to finish.
@@ -128,7 +154,12 @@ func (c *copier) sendChunk() error {
 	n, err := io.ReadFull(c.reader, buffer)
 	if n > 0 {
 		// Some data was read, schedule the write.
-		id := c.id.next()
+		var id string
+		if c.o.ContentAddressedBlockIDs {
+			id = c.id.nextFor(buffer[:n])
+		} else {
+			id = c.id.next()
+		}
 		c.wg.Add(1)
 		c.o.TransferManager.Run(
 			func() {
@@ -162,7 +193,23 @@ func (c *copier) write(chunk copierChunk) {
 		return
 	}
 
+	if c.o.ContentAddressedBlockIDs {
+		if size, ok := c.existing[chunk.id]; ok && size == int64(chunk.length) {
+			return // The service already has this block
+		}
+		if _, staged := c.staged.LoadOrStore(chunk.id, true); staged {
+			return // The same content appeared earlier in the stream
+		}
+	}
+
+	if c.tuner != nil {
+		c.tuner.acquire()
+	}
+	start := time.Now()
 	_, err := c.to.StageBlock(c.ctx, chunk.id, bytes.NewReader(chunk.buffer[:chunk.length]), c.o.AccessConditions.LeaseAccessConditions, nil, c.o.ClientProvidedKeyOptions)
+	if c.tuner != nil {
+		c.tuner.release(int64(chunk.length), time.Since(start), err)
+	}
 	if err != nil {
 		c.errCh <- fmt.Errorf("write error: %w", err)
 		return
@@ -208,6 +255,40 @@ func (id *id) next() string {
 	return str
 }
 
+// nextFor returns the content-addressed ID of a block: the SHA-256 hash of its content, padded to the length of
+// the IDs returned by next so that a blob's block IDs have the same length whichever way they were issued.
+func (id *id) nextFor(block []byte) string {
+	str := contentBlockID(sha256.Sum256(block))
+	id.all = append(id.all, str)
+	return str
+}
+
+// contentBlockID returns the content-addressed block ID of a block from the SHA-256 hash of its content.
+func contentBlockID(sum [sha256.Size]byte) string {
+	u := [64]byte{}
+	copy(u[:], sum[:])
+	return base64.StdEncoding.EncodeToString(u[:])
+}
+
+// existingBlocks returns the sizes of the committed and uncommitted blocks of a blob by ID. A blob that doesn't exist
+// has no blocks.
+func existingBlocks(ctx context.Context, to blockWriter, ac LeaseAccessConditions) (map[string]int64, error) {
+	existing := map[string]int64{}
+	blockList, err := to.GetBlockList(ctx, BlockListAll, ac)
+	if err != nil {
+		if stgErr, ok := err.(StorageError); ok && stgErr.ServiceCode() == ServiceCodeBlobNotFound {
+			return existing, nil
+		}
+		return nil, err
+	}
+	for _, blocks := range [][]Block{blockList.CommittedBlocks, blockList.UncommittedBlocks} {
+		for _, b := range blocks {
+			existing[b.Name] = b.Size
+		}
+	}
+	return existing, nil
+}
+
 // issued returns all ids that have been issued. This returned value shares the internal slice so it is not safe to modify the return.
 // The value is only valid until the next time next() is called.
 func (id *id) issued() []string {
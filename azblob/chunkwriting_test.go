@@ -82,6 +82,10 @@ func (f *fakeBlockWriter) CommitBlockList(ctx context.Context, blockIDs []string
 	return &BlockBlobCommitBlockListResponse{}, nil
 }
 
+func (f *fakeBlockWriter) GetBlockList(ctx context.Context, listType BlockListType, ac LeaseAccessConditions) (*BlockList, error) {
+	return &BlockList{}, nil // Every upload is to a new blob
+}
+
 func (f *fakeBlockWriter) cleanup() {
 	os.RemoveAll(f.path)
 }
@@ -0,0 +1,416 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The client-side encryption format is version 2.0 of the format used by the other Azure Storage SDKs: the content is
+// split into regions of 4MiB that are each encrypted with AES-256-GCM under a random per-blob content key, and stored
+// as nonce || ciphertext || tag. The content key, wrapped by a KeyWrapper, is stored in the blob's metadata as JSON.
+const (
+	// clientSideEncryptionMetadataKey is the metadata key that holds the encryption data of an encrypted blob.
+	clientSideEncryptionMetadataKey = "encryptiondata"
+
+	clientSideEncryptionProtocol  = "2.0"
+	clientSideEncryptionAlgorithm = "AES_GCM_256"
+
+	clientSideEncryptionRegionDataLength = 4 * 1024 * 1024
+	clientSideEncryptionNonceLength      = 12
+	clientSideEncryptionTagLength        = 16
+
+	// clientSideEncryptionRegionLength is the size of an encrypted region, including its nonce and tag.
+	clientSideEncryptionRegionLength = clientSideEncryptionRegionDataLength + clientSideEncryptionNonceLength + clientSideEncryptionTagLength
+)
+
+// KeyWrapper wraps and unwraps the per-blob content keys of client-side encrypted blobs with a key encryption key.
+// Implementations backed by a key management service, such as Azure Key Vault, can be plugged in; NewRSAKeyWrapper
+// and NewAESKeyWrapper wrap content keys with local keys.
+type KeyWrapper interface {
+	// KeyID returns the ID of the key encryption key. It is stored with the wrapped content key so that the key
+	// encryption key can be found when the blob is downloaded.
+	KeyID() string
+
+	// WrapKey wraps a content key. It returns the wrapped key and the name of the key wrap algorithm used
+	// (for example "RSA-OAEP" or "A256KW").
+	WrapKey(ctx context.Context, key []byte) (wrappedKey []byte, algorithm string, err error)
+
+	// UnwrapKey unwraps a content key that was wrapped with the algorithm.
+	UnwrapKey(ctx context.Context, wrappedKey []byte, algorithm string) ([]byte, error)
+}
+
+// ClientSideEncryptionOptions configures the client-side encryption of uploaded blobs and the decryption of
+// downloaded blobs. Unlike ClientProvidedKeyOptions, which only chooses the key the service encrypts with, the data
+// is encrypted before it leaves the process.
+type ClientSideEncryptionOptions struct {
+	// KeyWrapper wraps the content key of uploaded blobs. It also unwraps the content key of downloaded blobs
+	// if KeyResolver is nil.
+	KeyWrapper KeyWrapper
+
+	// KeyResolver, if set, returns the KeyWrapper that unwraps the content key of a downloaded blob from the ID of
+	// the key encryption key the content key was wrapped with.
+	KeyResolver func(ctx context.Context, keyID string) (KeyWrapper, error)
+}
+
+func (o ClientSideEncryptionOptions) enabled() bool {
+	return o.KeyWrapper != nil || o.KeyResolver != nil
+}
+
+// clientSideEncryptionData is the JSON stored in the metadata of an encrypted blob.
+type clientSideEncryptionData struct {
+	WrappedContentKey struct {
+		KeyID        string `json:"KeyId"`
+		EncryptedKey []byte `json:"EncryptedKey"`
+		Algorithm    string `json:"Algorithm"`
+	} `json:"WrappedContentKey"`
+	EncryptionAgent struct {
+		Protocol            string `json:"Protocol"`
+		EncryptionAlgorithm string `json:"EncryptionAlgorithm"`
+	} `json:"EncryptionAgent"`
+	EncryptedRegionInfo *struct {
+		DataLength  int64 `json:"DataLength"`
+		NonceLength int   `json:"NonceLength"`
+	} `json:"EncryptedRegionInfo,omitempty"`
+	KeyWrappingMetadata map[string]string `json:"KeyWrappingMetadata,omitempty"`
+}
+
+// wrappedKeyPrefix returns the protocol version padded to 8 bytes, which version 2.0 of the format prepends to the
+// content key before it is wrapped.
+func wrappedKeyPrefix() []byte {
+	prefix := make([]byte, 8)
+	copy(prefix, clientSideEncryptionProtocol)
+	return prefix
+}
+
+// newContentKey generates a content key and returns it with the metadata that must be stored with the blob.
+func (o ClientSideEncryptionOptions) newContentKey(ctx context.Context, metadata Metadata) ([]byte, Metadata, error) {
+	if o.KeyWrapper == nil {
+		return nil, nil, errors.New("a KeyWrapper is required to upload a client-side encrypted blob")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	wrappedKey, algorithm, err := o.KeyWrapper.WrapKey(ctx, append(wrappedKeyPrefix(), key...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data clientSideEncryptionData
+	data.WrappedContentKey.KeyID = o.KeyWrapper.KeyID()
+	data.WrappedContentKey.EncryptedKey = wrappedKey
+	data.WrappedContentKey.Algorithm = algorithm
+	data.EncryptionAgent.Protocol = clientSideEncryptionProtocol
+	data.EncryptionAgent.EncryptionAlgorithm = clientSideEncryptionAlgorithm
+	data.EncryptedRegionInfo = &struct {
+		DataLength  int64 `json:"DataLength"`
+		NonceLength int   `json:"NonceLength"`
+	}{DataLength: clientSideEncryptionRegionDataLength, NonceLength: clientSideEncryptionNonceLength}
+	data.KeyWrappingMetadata = map[string]string{"EncryptionLibrary": "Go " + serviceLibVersion}
+	j, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md := Metadata{}
+	for k, v := range metadata {
+		md[k] = v
+	}
+	md[clientSideEncryptionMetadataKey] = string(j)
+	return key, md, nil
+}
+
+// contentKey unwraps the content key of a blob from its metadata.
+func (o ClientSideEncryptionOptions) contentKey(ctx context.Context, metadata Metadata) ([]byte, error) {
+	j, ok := metadata[clientSideEncryptionMetadataKey]
+	if !ok {
+		return nil, errors.New("the blob is not client-side encrypted")
+	}
+	var data clientSideEncryptionData
+	if err := json.Unmarshal([]byte(j), &data); err != nil {
+		return nil, fmt.Errorf("invalid client-side encryption metadata: %w", err)
+	}
+	if data.EncryptionAgent.Protocol != clientSideEncryptionProtocol || data.EncryptionAgent.EncryptionAlgorithm != clientSideEncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported client-side encryption protocol %s with %s", data.EncryptionAgent.Protocol, data.EncryptionAgent.EncryptionAlgorithm)
+	}
+	if data.EncryptedRegionInfo == nil || data.EncryptedRegionInfo.DataLength != clientSideEncryptionRegionDataLength ||
+		data.EncryptedRegionInfo.NonceLength != clientSideEncryptionNonceLength {
+		return nil, errors.New("unsupported client-side encryption region size")
+	}
+
+	kw := o.KeyWrapper
+	if o.KeyResolver != nil {
+		var err error
+		if kw, err = o.KeyResolver(ctx, data.WrappedContentKey.KeyID); err != nil {
+			return nil, err
+		}
+	}
+	if kw == nil || kw.KeyID() != data.WrappedContentKey.KeyID {
+		return nil, fmt.Errorf("no KeyWrapper for the key %q the blob's content key is wrapped with", data.WrappedContentKey.KeyID)
+	}
+	key, err := kw.UnwrapKey(ctx, data.WrappedContentKey.EncryptedKey, data.WrappedContentKey.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	prefix := wrappedKeyPrefix()
+	if len(key) != len(prefix)+32 || !bytes.Equal(key[:len(prefix)], prefix) {
+		return nil, errors.New("the unwrapped content key is not a version 2.0 content key")
+	}
+	return key[len(prefix):], nil
+}
+
+// clientSideEncryptedSize returns the size of the encrypted content of size bytes.
+func clientSideEncryptedSize(size int64) int64 {
+	regions := (size + clientSideEncryptionRegionDataLength - 1) / clientSideEncryptionRegionDataLength
+	return size + regions*(clientSideEncryptionNonceLength+clientSideEncryptionTagLength)
+}
+
+// clientSideDecryptedSize returns the size of the content that was encrypted to size bytes.
+func clientSideDecryptedSize(size int64) int64 {
+	regions := (size + clientSideEncryptionRegionLength - 1) / clientSideEncryptionRegionLength
+	return size - regions*(clientSideEncryptionNonceLength+clientSideEncryptionTagLength)
+}
+
+func newContentCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, clientSideEncryptionNonceLength)
+}
+
+// encryptingReader reads the encrypted content of a reader region by region. The nonce of each region is its
+// index: the content key is only used for one blob, so this keeps nonces unique while making the encrypted content
+// the same every time it is produced.
+type encryptingReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	region  uint64
+	plain   []byte
+	pending []byte
+	err     error
+}
+
+func newEncryptingReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{src: src, aead: aead, plain: make([]byte, clientSideEncryptionRegionDataLength)}, nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.err = io.EOF
+		} else if err != nil {
+			r.err = err
+		}
+		if n > 0 {
+			nonce := make([]byte, clientSideEncryptionNonceLength)
+			binary.BigEndian.PutUint64(nonce[clientSideEncryptionNonceLength-8:], r.region)
+			r.region++
+			r.pending = r.aead.Seal(nonce, nonce, r.plain[:n], nil)
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// decryptRegions decrypts consecutive encrypted regions.
+func decryptRegions(aead cipher.AEAD, encrypted []byte) ([]byte, error) {
+	plain := make([]byte, 0, len(encrypted))
+	for len(encrypted) > 0 {
+		region := encrypted
+		if len(region) > clientSideEncryptionRegionLength {
+			region = region[:clientSideEncryptionRegionLength]
+		}
+		if len(region) < clientSideEncryptionNonceLength+clientSideEncryptionTagLength {
+			return nil, errors.New("truncated client-side encrypted region")
+		}
+		var err error
+		plain, err = aead.Open(plain, region[:clientSideEncryptionNonceLength], region[clientSideEncryptionNonceLength:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt client-side encrypted region: %w", err)
+		}
+		encrypted = encrypted[len(region):]
+	}
+	return plain, nil
+}
+
+// decryptingReader reads the decrypted content of a body of whole encrypted regions. The content key is unwrapped
+// on the first read.
+type decryptingReader struct {
+	ctx      context.Context
+	body     io.ReadCloser
+	metadata Metadata
+	o        ClientSideEncryptionOptions
+	aead     cipher.AEAD
+	region   []byte
+	pending  []byte
+	err      error
+}
+
+// newDecryptingReader returns a reader of the decrypted content of body, the encrypted content of a blob with the
+// metadata starting at offset.
+func newDecryptingReader(ctx context.Context, body io.ReadCloser, metadata Metadata, offset int64, o ClientSideEncryptionOptions) io.ReadCloser {
+	r := &decryptingReader{ctx: ctx, body: body, metadata: metadata, o: o}
+	if offset%clientSideEncryptionRegionLength != 0 {
+		r.err = errors.New("a client-side encrypted download must start at an encrypted region to be decrypted")
+	}
+	return r
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.aead == nil {
+			key, err := r.o.contentKey(r.ctx, r.metadata)
+			if err == nil {
+				r.aead, err = newContentCipher(key)
+			}
+			if err != nil {
+				r.err = err
+				return 0, err
+			}
+			r.region = make([]byte, clientSideEncryptionRegionLength)
+		}
+		n, err := io.ReadFull(r.body, r.region)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.err = io.EOF
+		} else if err != nil {
+			r.err = err
+			continue
+		}
+		if n > 0 {
+			if r.pending, err = decryptRegions(r.aead, r.region[:n]); err != nil {
+				r.err = err
+			}
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.body.Close()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type rsaKeyWrapper struct {
+	keyID string
+	key   *rsa.PrivateKey
+}
+
+// NewRSAKeyWrapper returns a KeyWrapper that wraps content keys with a local RSA key using RSA-OAEP.
+func NewRSAKeyWrapper(keyID string, key *rsa.PrivateKey) KeyWrapper {
+	return rsaKeyWrapper{keyID: keyID, key: key}
+}
+
+func (w rsaKeyWrapper) KeyID() string {
+	return w.keyID
+}
+
+func (w rsaKeyWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, string, error) {
+	wrapped, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &w.key.PublicKey, key, nil)
+	return wrapped, "RSA-OAEP", err
+}
+
+func (w rsaKeyWrapper) UnwrapKey(ctx context.Context, wrappedKey []byte, algorithm string) ([]byte, error) {
+	if algorithm != "RSA-OAEP" {
+		return nil, fmt.Errorf("unsupported key wrap algorithm %q for an RSA key", algorithm)
+	}
+	return rsa.DecryptOAEP(sha1.New(), rand.Reader, w.key, wrappedKey, nil)
+}
+
+type aesKeyWrapper struct {
+	keyID     string
+	block     cipher.Block
+	algorithm string
+}
+
+// NewAESKeyWrapper returns a KeyWrapper that wraps content keys with a local 128, 192 or 256-bit AES key using the
+// AES key wrap algorithm (RFC 3394).
+func NewAESKeyWrapper(keyID string, key []byte) (KeyWrapper, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aesKeyWrapper{keyID: keyID, block: block, algorithm: fmt.Sprintf("A%dKW", len(key)*8)}, nil
+}
+
+func (w aesKeyWrapper) KeyID() string {
+	return w.keyID
+}
+
+// aesKeyWrapIV is the default initial value of RFC 3394.
+var aesKeyWrapIV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+func (w aesKeyWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, string, error) {
+	if len(key)%8 != 0 || len(key) < 16 {
+		return nil, "", errors.New("the key to wrap must be a multiple of 8 bytes and at least 16 bytes long")
+	}
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, aesKeyWrapIV)
+	copy(out[8:], key)
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[i*8:i*8+8])
+			w.block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[i*8:], b[8:])
+		}
+	}
+	return out, w.algorithm, nil
+}
+
+func (w aesKeyWrapper) UnwrapKey(ctx context.Context, wrappedKey []byte, algorithm string) ([]byte, error) {
+	if algorithm != w.algorithm {
+		return nil, fmt.Errorf("unsupported key wrap algorithm %q for a %s key", algorithm, w.algorithm)
+	}
+	if len(wrappedKey)%8 != 0 || len(wrappedKey) < 24 {
+		return nil, errors.New("invalid wrapped key length")
+	}
+	n := len(wrappedKey)/8 - 1
+	out := make([]byte, len(wrappedKey))
+	copy(out, wrappedKey)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^t)
+			copy(b[8:], out[i*8:i*8+8])
+			w.block.Decrypt(b, b)
+			copy(out[:8], b[:8])
+			copy(out[i*8:], b[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(out[:8], aesKeyWrapIV) != 1 {
+		return nil, errors.New("the wrapped key failed the AES key wrap integrity check")
+	}
+	return out[8:], nil
+}
@@ -0,0 +1,227 @@
+package azblob
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression compresses blob content on upload and decompresses it on download. The blob's Content-Encoding
+// identifies the Compression used to upload it.
+//
+// This package only provides gzip (CompressionGzip and NewGzipCompression). The standard library has no zstd, and the
+// zstd packages need a newer Go than this module supports, so zstd is left to a Compression that wraps the zstd
+// package of your choice: pass it to uploads, and register it with RegisterCompression for downloads.
+type Compression interface {
+	// ContentEncoding returns the name stored in the Content-Encoding of blobs compressed with this Compression.
+	ContentEncoding() string
+
+	// NewWriter returns a writer that compresses the data written to it into w. Close flushes the compressed data.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader that decompresses the data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// CompressionProgressReceiver is a function that is invoked periodically as data is compressed or decompressed,
+// with the number of uncompressed (raw) and compressed bytes processed so far.
+type CompressionProgressReceiver func(rawBytes int64, compressedBytes int64)
+
+// CompressionGzip compresses blob content with gzip at the default compression level. Its Content-Encoding is "gzip".
+var CompressionGzip Compression = gzipCompression{level: gzip.DefaultCompression}
+
+type gzipCompression struct {
+	level int
+}
+
+// NewGzipCompression returns a Compression that compresses with gzip at the level, one of the levels defined by the
+// compress/gzip package.
+func NewGzipCompression(level int) (Compression, error) {
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	return gzipCompression{level: level}, nil
+}
+
+func (c gzipCompression) ContentEncoding() string {
+	return "gzip"
+}
+
+func (c gzipCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (c gzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	compressionsLock sync.RWMutex
+	compressions     = map[string]Compression{"gzip": CompressionGzip}
+)
+
+// RegisterCompression makes downloads that decompress blobs use c for blobs whose Content-Encoding is
+// c.ContentEncoding(). gzip is registered by default. To download blobs uploaded with zstd, register a Compression
+// with the Content-Encoding "zstd", as described by Compression.
+func RegisterCompression(c Compression) {
+	compressionsLock.Lock()
+	defer compressionsLock.Unlock()
+	compressions[strings.ToLower(c.ContentEncoding())] = c
+}
+
+// compressionFor returns the registered Compression for the Content-Encoding; nil if the content isn't encoded.
+func compressionFor(contentEncoding string) (Compression, error) {
+	contentEncoding = strings.ToLower(strings.TrimSpace(contentEncoding))
+	if contentEncoding == "" || contentEncoding == "identity" {
+		return nil, nil
+	}
+	compressionsLock.RLock()
+	defer compressionsLock.RUnlock()
+	if c, ok := compressions[contentEncoding]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("no Compression is registered for the Content-Encoding %q; see RegisterCompression", contentEncoding)
+}
+
+// setContentEncoding sets the Content-Encoding of content compressed with c.
+func setContentEncoding(h *BlobHTTPHeaders, c Compression) error {
+	if h.ContentEncoding != "" && !strings.EqualFold(h.ContentEncoding, c.ContentEncoding()) {
+		return fmt.Errorf("cannot compress content with the Content-Encoding %q as %q", h.ContentEncoding, c.ContentEncoding())
+	}
+	h.ContentEncoding = c.ContentEncoding()
+	return nil
+}
+
+// compressionCounter counts the raw and compressed bytes of a compression or decompression and reports them.
+type compressionCounter struct {
+	raw        int64
+	compressed int64
+	progress   CompressionProgressReceiver
+}
+
+func (c *compressionCounter) report() {
+	if c.progress != nil {
+		c.progress(atomic.LoadInt64(&c.raw), atomic.LoadInt64(&c.compressed))
+	}
+}
+
+// countingReader adds the number of bytes read to a counter.
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// countingWriter adds the number of bytes written to a counter.
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
+
+// compressReader returns a reader of the content of r compressed with c. The content is compressed by a goroutine
+// as it is read; closing the returned reader stops it.
+func compressReader(r io.Reader, c Compression, progress CompressionProgressReceiver) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	counter := &compressionCounter{progress: progress}
+	cw, err := c.NewWriter(countingWriter{w: pw, count: &counter.compressed})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buffer)
+			if n > 0 {
+				atomic.AddInt64(&counter.raw, int64(n))
+				if _, werr := cw.Write(buffer[:n]); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+				counter.report()
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		err := cw.Close()
+		counter.report()
+		pw.CloseWithError(err) // A nil error makes the reader return io.EOF
+	}()
+	return pr, nil
+}
+
+// decompressingReader decodes a blob's content according to its Content-Encoding. The decoder is created on the
+// first Read so that Body can report an unknown Content-Encoding as a read error.
+type decompressingReader struct {
+	body            io.ReadCloser
+	contentEncoding string
+	counter         compressionCounter
+	decoder         io.Reader
+	closer          io.Closer
+	err             error
+}
+
+// newDecompressingReader returns a reader of the decoded content of body. If decoded is true, the HTTP client
+// already decoded the response, so the compressed bytes are not known and are reported as -1.
+func newDecompressingReader(body io.ReadCloser, contentEncoding string, decoded bool, progress CompressionProgressReceiver) io.ReadCloser {
+	r := &decompressingReader{body: body, contentEncoding: contentEncoding, counter: compressionCounter{progress: progress}}
+	if decoded {
+		r.decoder, r.counter.compressed = body, -1
+	}
+	return r
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.decoder == nil {
+		c, err := compressionFor(r.contentEncoding)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		var compressed io.Reader = countingReader{r: r.body, count: &r.counter.compressed}
+		if c == nil {
+			r.decoder = compressed
+		} else {
+			decoder, err := c.NewReader(compressed)
+			if err != nil {
+				r.err = err
+				return 0, err
+			}
+			r.decoder, r.closer = decoder, decoder
+		}
+	}
+	n, err := r.decoder.Read(p)
+	if n > 0 {
+		r.counter.raw += int64(n)
+		r.counter.report()
+	}
+	return n, err
+}
+
+func (r *decompressingReader) Close() error {
+	if r.closer != nil {
+		r.closer.Close()
+	}
+	return r.body.Close()
+}
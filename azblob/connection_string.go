@@ -0,0 +1,201 @@
+package azblob
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DevelopmentStorageAccountName is the name of the well-known account of the storage emulators, Azurite and the
+	// Azure Storage Emulator.
+	DevelopmentStorageAccountName = "devstoreaccount1"
+
+	// DevelopmentStorageAccountKey is the key of the well-known account of the storage emulators. It isn't a secret.
+	DevelopmentStorageAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+	// developmentStorageBlobPort is the port the storage emulators serve the Blob service on.
+	developmentStorageBlobPort = "10000"
+)
+
+// ConnectionString is what an Azure Storage connection string says about the Blob service.
+type ConnectionString struct {
+	// BlobEndpoint is the URL of the Blob service, with the connection string's SharedAccessSignature, if any, as its
+	// query. For the storage emulators, the account name is the first segment of the path (IP endpoint style).
+	BlobEndpoint url.URL
+
+	// AccountName is the name of the account, or "" if the connection string doesn't name it.
+	AccountName string
+
+	// Credential is a *SharedKeyCredential if the connection string has an AccountKey, and the anonymous credential
+	// otherwise.
+	Credential Credential
+}
+
+// The settings of connection strings, by lowercase name.
+var connectionStringSettings = map[string]string{
+	"defaultendpointsprotocol":   "DefaultEndpointsProtocol",
+	"accountname":                "AccountName",
+	"accountkey":                 "AccountKey",
+	"sharedaccesssignature":      "SharedAccessSignature",
+	"endpointsuffix":             "EndpointSuffix",
+	"blobendpoint":               "BlobEndpoint",
+	"usedevelopmentstorage":      "UseDevelopmentStorage",
+	"developmentstorageproxyuri": "DevelopmentStorageProxyUri",
+
+	// The endpoints of the other services are valid, but not used.
+	"blobsecondaryendpoint":  "BlobSecondaryEndpoint",
+	"queueendpoint":          "QueueEndpoint",
+	"queuesecondaryendpoint": "QueueSecondaryEndpoint",
+	"tableendpoint":          "TableEndpoint",
+	"tablesecondaryendpoint": "TableSecondaryEndpoint",
+	"fileendpoint":           "FileEndpoint",
+	"filesecondaryendpoint":  "FileSecondaryEndpoint",
+}
+
+// ParseConnectionString parses an Azure Storage connection string, such as
+// "DefaultEndpointsProtocol=https;AccountName=myaccount;AccountKey=...;EndpointSuffix=core.windows.net" or
+// "UseDevelopmentStorage=true". Setting names are case-insensitive; unknown or repeated settings, and settings that
+// conflict, are errors. The errors never include the AccountKey or SharedAccessSignature.
+func ParseConnectionString(connectionString string) (ConnectionString, error) {
+	settings := map[string]string{}
+	for _, setting := range strings.Split(connectionString, ";") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		i := strings.Index(setting, "=")
+		if i <= 0 {
+			// The setting isn't quoted, as it could be a key
+			return ConnectionString{}, errors.New("connection string has a setting that isn't of the form name=value")
+		}
+		key, value := strings.TrimSpace(setting[:i]), strings.TrimSpace(setting[i+1:])
+		name, ok := connectionStringSettings[strings.ToLower(key)]
+		switch {
+		case !ok && !isSettingName(key):
+			return ConnectionString{}, errors.New("connection string has a setting that isn't of the form name=value")
+		case !ok:
+			return ConnectionString{}, fmt.Errorf("connection string has the unknown setting %q", key)
+		case settings[name] != "":
+			return ConnectionString{}, fmt.Errorf("connection string has the setting %s more than once", name)
+		case value == "":
+			return ConnectionString{}, fmt.Errorf("connection string setting %s is empty", name)
+		}
+		settings[name] = value
+	}
+	if len(settings) == 0 {
+		return ConnectionString{}, errors.New("connection string is empty")
+	}
+	if v, ok := settings["UseDevelopmentStorage"]; ok {
+		return parseDevelopmentStorage(v, settings)
+	}
+	if _, ok := settings["DevelopmentStorageProxyUri"]; ok {
+		return ConnectionString{}, errors.New("connection string setting DevelopmentStorageProxyUri requires UseDevelopmentStorage=true")
+	}
+
+	cs := ConnectionString{AccountName: settings["AccountName"], Credential: NewAnonymousCredential()}
+	key, sas := settings["AccountKey"], settings["SharedAccessSignature"]
+	switch {
+	case key != "" && sas != "":
+		return ConnectionString{}, errors.New("connection string can't have both AccountKey and SharedAccessSignature")
+	case key != "" && cs.AccountName == "":
+		return ConnectionString{}, errors.New("connection string setting AccountKey requires AccountName")
+	case key != "":
+		credential, err := NewSharedKeyCredential(cs.AccountName, key)
+		if err != nil {
+			return ConnectionString{}, errors.New("connection string setting AccountKey isn't valid base64")
+		}
+		cs.Credential = credential
+	}
+
+	if endpoint, ok := settings["BlobEndpoint"]; ok {
+		if _, ok := settings["EndpointSuffix"]; ok {
+			return ConnectionString{}, errors.New("connection string can't have both BlobEndpoint and EndpointSuffix")
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return ConnectionString{}, fmt.Errorf("connection string setting BlobEndpoint %q isn't an http or https URL without a query", endpoint)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = ""
+		cs.BlobEndpoint = *u
+	} else {
+		if cs.AccountName == "" {
+			return ConnectionString{}, errors.New("connection string requires BlobEndpoint or AccountName")
+		}
+		protocol, suffix := "https", "core.windows.net"
+		if p, ok := settings["DefaultEndpointsProtocol"]; ok {
+			protocol = strings.ToLower(p)
+			if protocol != "http" && protocol != "https" {
+				return ConnectionString{}, fmt.Errorf("connection string setting DefaultEndpointsProtocol %q isn't http or https", p)
+			}
+		}
+		if s, ok := settings["EndpointSuffix"]; ok {
+			suffix = strings.Trim(s, ".")
+			if strings.ContainsAny(suffix, "/:?#@ ") {
+				return ConnectionString{}, fmt.Errorf("connection string setting EndpointSuffix %q isn't a domain name", s)
+			}
+		}
+		cs.BlobEndpoint = url.URL{Scheme: protocol, Host: cs.AccountName + ".blob." + suffix}
+	}
+
+	if sas != "" {
+		sas = strings.TrimPrefix(sas, "?")
+		if query, err := url.ParseQuery(sas); err != nil || query.Get("sig") == "" {
+			return ConnectionString{}, errors.New("connection string setting SharedAccessSignature isn't a signed SAS query")
+		}
+		cs.BlobEndpoint.RawQuery = sas
+	}
+	return cs, nil
+}
+
+// isSettingName reports whether s looks like the name of a setting rather than, for example, a key that was pasted
+// without one, so that it can be quoted in errors.
+func isSettingName(s string) bool {
+	if len(s) > 32 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDevelopmentStorage returns the ConnectionString of the storage emulators, at DevelopmentStorageProxyUri if set
+// or else on this machine.
+func parseDevelopmentStorage(use string, settings map[string]string) (ConnectionString, error) {
+	if !strings.EqualFold(use, "true") {
+		return ConnectionString{}, fmt.Errorf("connection string setting UseDevelopmentStorage %q isn't true", use)
+	}
+	for name := range settings {
+		if name != "UseDevelopmentStorage" && name != "DevelopmentStorageProxyUri" {
+			return ConnectionString{}, fmt.Errorf("connection string can't have both UseDevelopmentStorage and %s", name)
+		}
+	}
+	endpoint := url.URL{Scheme: "http", Host: "127.0.0.1:" + developmentStorageBlobPort, Path: "/" + DevelopmentStorageAccountName}
+	if proxy, ok := settings["DevelopmentStorageProxyUri"]; ok {
+		u, err := url.Parse(proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return ConnectionString{}, fmt.Errorf("connection string setting DevelopmentStorageProxyUri %q isn't an http or https URL", proxy)
+		}
+		endpoint.Scheme = u.Scheme
+		endpoint.Host = u.Hostname() + ":" + developmentStorageBlobPort
+		if strings.Contains(u.Hostname(), ":") {
+			endpoint.Host = "[" + u.Hostname() + "]:" + developmentStorageBlobPort
+		}
+	}
+	credential, _ := NewSharedKeyCredential(DevelopmentStorageAccountName, DevelopmentStorageAccountKey)
+	return ConnectionString{BlobEndpoint: endpoint, AccountName: DevelopmentStorageAccountName, Credential: credential}, nil
+}
+
+// NewServiceURLFromConnectionString creates a ServiceURL object from an Azure Storage connection string (see
+// ParseConnectionString). Its pipeline is created with the connection string's credential and the options.
+func NewServiceURLFromConnectionString(connectionString string, o PipelineOptions) (ServiceURL, error) {
+	cs, err := ParseConnectionString(connectionString)
+	if err != nil {
+		return ServiceURL{}, err
+	}
+	return NewServiceURL(cs.BlobEndpoint, NewPipeline(cs.Credential, o)), nil
+}
@@ -0,0 +1,354 @@
+//go:build go1.16
+// +build go1.16
+
+package azblob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ContainerFS is a read-only fs.FS of the blobs of a container under a prefix, for use with packages like
+// html/template, net/http and io/fs itself. Directories are the virtual directories that "/" delimiters in blob
+// names make. A name that is both a blob and a virtual directory is a file.
+type ContainerFS struct {
+	ctx    context.Context
+	c      ContainerURL
+	prefix string
+}
+
+// ContainerFS implements these interfaces
+var (
+	_ fs.FS         = (*ContainerFS)(nil)
+	_ fs.ReadDirFS  = (*ContainerFS)(nil)
+	_ fs.StatFS     = (*ContainerFS)(nil)
+	_ fs.ReadFileFS = (*ContainerFS)(nil)
+)
+
+// NewContainerFS returns an fs.FS of the blobs of the container whose names start with the prefix, which is the
+// root directory of the FS. A prefix that doesn't end with "/" is treated as if it did. The requests made by the
+// FS's methods are made with ctx.
+func NewContainerFS(ctx context.Context, c ContainerURL, prefix string) *ContainerFS {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &ContainerFS{ctx: ctx, c: c, prefix: prefix}
+}
+
+// blobName returns the name of the blob (or virtual directory, without its trailing "/") of a valid FS path.
+func (f *ContainerFS) blobName(name string) string {
+	if name == "." {
+		return strings.TrimSuffix(f.prefix, "/")
+	}
+	return f.prefix + name
+}
+
+// dirPrefix returns the prefix of the blobs in the directory with the valid FS path.
+func (f *ContainerFS) dirPrefix(name string) string {
+	if name == "." {
+		return f.prefix
+	}
+	return f.prefix + name + "/"
+}
+
+// Open opens the named file or directory.
+func (f *ContainerFS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &containerFSDir{fs: f, name: name, info: info}, nil
+	}
+	return &containerFSFile{fs: f, name: name, info: info, blobURL: f.c.NewBlobURL(f.blobName(name))}, nil
+}
+
+// Stat returns a FileInfo describing the named file or directory.
+func (f *ContainerFS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f *ContainerFS) stat(op string, name string) (*containerFSFileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &containerFSFileInfo{name: ".", dir: true}, nil
+	}
+	props, err := f.c.NewBlobURL(f.blobName(name)).GetProperties(f.ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	if err == nil {
+		return &containerFSFileInfo{name: path.Base(name), size: props.ContentLength(), modTime: props.LastModified(), etag: props.ETag()}, nil
+	} else if !isNotFound(err) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// A virtual directory exists if any blob's name starts with it
+	page, err := f.c.ListBlobsHierarchySegment(f.ctx, Marker{}, "/", ListBlobsSegmentOptions{Prefix: f.dirPrefix(name), MaxResults: 1})
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if len(page.Segment.BlobItems) == 0 && len(page.Segment.BlobPrefixes) == 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &containerFSFileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by filename.
+func (f *ContainerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := f.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 && name != "." {
+		// An empty listing usually means the directory doesn't exist or the name is a file
+		info, err := f.stat("readdir", name)
+		if err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+	}
+	return entries, nil
+}
+
+func (f *ContainerFS) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := f.dirPrefix(name)
+	files := map[string]bool{}
+	var dirs []string
+	entries := []fs.DirEntry{}
+	pager := f.c.NewBlobHierarchyPager("/", ListBlobsSegmentOptions{Prefix: prefix})
+	for pager.Next(f.ctx) {
+		item := pager.Item()
+		entryName := strings.TrimSuffix(strings.TrimPrefix(item.Name(), prefix), "/")
+		if entryName == "" || !fs.ValidPath(entryName) {
+			continue // Names like "a//b" can't be FS paths
+		}
+		if item.Prefix != nil {
+			dirs = append(dirs, entryName)
+			continue
+		}
+		files[entryName] = true
+		props := item.Blob.Properties
+		info := &containerFSFileInfo{name: entryName, size: *props.ContentLength, modTime: props.LastModified, etag: props.Etag}
+		entries = append(entries, info)
+	}
+	if err := pager.Err(); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	for _, dir := range dirs {
+		if !files[dir] {
+			entries = append(entries, &containerFSFileInfo{name: dir, dir: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ReadFile reads the named file and returns its contents.
+func (f *ContainerFS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info, _ := file.Stat(); info.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	data := make([]byte, file.(*containerFSFile).info.size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// containerFSFileInfo describes a blob or virtual directory. It is both its fs.FileInfo and its fs.DirEntry.
+type containerFSFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	etag    ETag
+	dir     bool
+}
+
+func (i *containerFSFileInfo) Name() string       { return i.name }
+func (i *containerFSFileInfo) Size() int64        { return i.size }
+func (i *containerFSFileInfo) ModTime() time.Time { return i.modTime }
+func (i *containerFSFileInfo) IsDir() bool        { return i.dir }
+func (i *containerFSFileInfo) Sys() interface{}   { return nil }
+
+func (i *containerFSFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i *containerFSFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *containerFSFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// containerFSFile is an open blob. Its content is read from the version of the blob that was opened.
+type containerFSFile struct {
+	fs      *ContainerFS
+	name    string
+	info    *containerFSFileInfo
+	blobURL BlobURL
+	offset  int64
+	body    io.ReadCloser
+	closed  bool
+}
+
+func (f *containerFSFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.info, nil
+}
+
+func (f *containerFSFile) accessConditions() BlobAccessConditions {
+	return BlobAccessConditions{ModifiedAccessConditions: ModifiedAccessConditions{IfMatch: f.info.etag}}
+}
+
+func (f *containerFSFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		dr, err := f.blobURL.Download(f.fs.ctx, f.offset, CountToEnd, f.accessConditions(), false, ClientProvidedKeyOptions{})
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.body = dr.Body(RetryReaderOptions{MaxRetryRequests: 3})
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *containerFSFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	count := int64(len(p))
+	if off+count > f.info.size {
+		count = f.info.size - off
+	}
+	dr, err := f.blobURL.Download(f.fs.ctx, off, count, f.accessConditions(), false, ClientProvidedKeyOptions{})
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	body := dr.Body(RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:count])
+	if err == nil && count < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *containerFSFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *containerFSFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// containerFSDir is an open virtual directory. Its entries are listed by the first call to ReadDir.
+type containerFSDir struct {
+	fs      *ContainerFS
+	name    string
+	info    *containerFSFileInfo
+	entries []fs.DirEntry
+	listed  bool
+	closed  bool
+}
+
+func (d *containerFSDir) Stat() (fs.FileInfo, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "stat", Path: d.name, Err: fs.ErrClosed}
+	}
+	return d.info, nil
+}
+
+func (d *containerFSDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *containerFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+	if !d.listed {
+		entries, err := d.fs.readDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *containerFSDir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
@@ -3,12 +3,16 @@ package azblob
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -69,18 +73,48 @@ type UploadToBlockBlobOptions struct {
 
 	// Parallelism indicates the maximum number of blocks to upload in parallel (0=default)
 	Parallelism uint16
+
+	// AutoTune, if true, picks BlockSize (when it is 0) from the size of the data and the BlockBlobMaxBlocks limit,
+	// and adjusts the number of blocks uploaded in parallel at runtime from the observed throughput, latency
+	// and ServerBusy (503) responses. Parallelism is then the upper bound on parallel uploads (0=32).
+	AutoTune bool
+
+	// ContentAddressedBlockIDs, if true, derives each block's ID from a SHA-256 hash of its content and doesn't stage
+	// the blocks the blob already has, committed or uncommitted, so re-uploading mostly unchanged data only sends
+	// the changed blocks. The data is always staged in blocks (by default of at least BlobDefaultDownloadBlockSize),
+	// and unchanged data is only recognized in blocks at the same BlockSize boundaries as the previous upload.
+	ContentAddressedBlockIDs bool
+
+	// Compression, if set, compresses the data as it is uploaded and sets BlobHTTPHeaders.ContentEncoding to the
+	// Compression's Content-Encoding. Since the compressed size isn't known up front, the compressed data is
+	// uploaded like UploadStreamToBlockBlob does, in blocks of BlockSize (default BlobDefaultDownloadBlockSize)
+	// with up to Parallelism blocks in flight; Progress then reports the uncompressed bytes read.
+	Compression Compression
+
+	// CompressionProgress, if set, is invoked periodically with the uncompressed and compressed bytes of a
+	// compressed upload.
+	CompressionProgress CompressionProgressReceiver
+
+	// ClientSideEncryption, if its KeyWrapper is set, encrypts the data before it is uploaded. Like compressed
+	// data, encrypted data is uploaded like UploadStreamToBlockBlob does. Encrypted data can't also be compressed.
+	ClientSideEncryption ClientSideEncryptionOptions
 }
 
 // uploadReaderAtToBlockBlob uploads a buffer in blocks to a block blob.
 func uploadReaderAtToBlockBlob(ctx context.Context, reader io.ReaderAt, readerSize int64,
 	blockBlobURL BlockBlobURL, o UploadToBlockBlobOptions) (CommonResponse, error) {
+	if o.Compression != nil || o.ClientSideEncryption.enabled() {
+		return uploadReaderAtAsStream(ctx, reader, readerSize, blockBlobURL, o)
+	}
 	if o.BlockSize == 0 {
 		// If bufferSize > (BlockBlobMaxStageBlockBytes * BlockBlobMaxBlocks), then error
 		if readerSize > BlockBlobMaxStageBlockBytes*BlockBlobMaxBlocks {
 			return nil, errors.New("buffer is too large to upload to a block blob")
 		}
-		// If bufferSize <= BlockBlobMaxUploadBlobBytes, then Upload should be used with just 1 I/O request
-		if readerSize <= BlockBlobMaxUploadBlobBytes {
+		if o.AutoTune {
+			o.BlockSize = autoTuneBlockSize(readerSize)
+		} else if readerSize <= BlockBlobMaxUploadBlobBytes && !o.ContentAddressedBlockIDs {
+			// If bufferSize <= BlockBlobMaxUploadBlobBytes, then Upload should be used with just 1 I/O request
 			o.BlockSize = BlockBlobMaxUploadBlobBytes // Default if unspecified
 		} else {
 			o.BlockSize = readerSize / BlockBlobMaxBlocks   // buffer / max blocks = block size to use all 50,000 blocks
@@ -91,7 +125,14 @@ func uploadReaderAtToBlockBlob(ctx context.Context, reader io.ReaderAt, readerSi
 		}
 	}
 
-	if readerSize <= BlockBlobMaxUploadBlobBytes {
+	singleUpload := readerSize <= BlockBlobMaxUploadBlobBytes
+	if o.AutoTune {
+		singleUpload = singleUpload && readerSize <= o.BlockSize // Stage blocks in parallel unless the data fits in a single block
+	}
+	if o.ContentAddressedBlockIDs {
+		singleUpload = singleUpload && readerSize == 0 // Blocks the blob already has are only skipped when staging blocks
+	}
+	if singleUpload {
 		// If the size can fit in 1 Upload call, do it this way
 		var body io.ReadSeeker = io.NewSectionReader(reader, 0, readerSize)
 		if o.Progress != nil {
@@ -100,17 +141,36 @@ func uploadReaderAtToBlockBlob(ctx context.Context, reader io.ReaderAt, readerSi
 		return blockBlobURL.Upload(ctx, body, o.BlobHTTPHeaders, o.Metadata, o.AccessConditions, o.BlobAccessTier, o.BlobTagsMap, o.ClientProvidedKeyOptions, o.ImmutabilityPolicyOptions)
 	}
 
-	var numBlocks = uint16(((readerSize - 1) / o.BlockSize) + 1)
+	var numBlocks = ((readerSize - 1) / o.BlockSize) + 1
+	if numBlocks > BlockBlobMaxBlocks {
+		return nil, fmt.Errorf("block size %d is too small to upload %d bytes in at most %d blocks", o.BlockSize, readerSize, BlockBlobMaxBlocks)
+	}
+
+	var existing map[string]int64
+	if o.ContentAddressedBlockIDs {
+		var err error
+		if existing, err = existingBlocks(ctx, blockBlobURL, o.AccessConditions.LeaseAccessConditions); err != nil {
+			return nil, err
+		}
+	}
 
 	blockIDList := make([]string, numBlocks) // Base-64 encoded block IDs
 	progress := int64(0)
 	progressLock := &sync.Mutex{}
+	addProgress := func(bytesTransferred int64) {
+		progressLock.Lock() // 1 goroutine at a time gets a progress report
+		progress += bytesTransferred
+		o.Progress(progress)
+		progressLock.Unlock()
+	}
+	var staged sync.Map // The content-addressed blocks staged by this upload, so a repeated block is only sent once
 
 	err := DoBatchTransfer(ctx, BatchTransferOptions{
-		OperationName: "uploadReaderAtToBlockBlob",
-		TransferSize:  readerSize,
-		ChunkSize:     o.BlockSize,
-		Parallelism:   o.Parallelism,
+		OperationName:       "uploadReaderAtToBlockBlob",
+		TransferSize:        readerSize,
+		ChunkSize:           o.BlockSize,
+		Parallelism:         o.Parallelism,
+		AutoTuneParallelism: o.AutoTune,
 		Operation: func(offset int64, count int64, ctx context.Context) error {
 			// This function is called once per block.
 			// It is passed this block's offset within the buffer and its count of bytes
@@ -123,13 +183,33 @@ func uploadReaderAtToBlockBlob(ctx context.Context, reader io.ReaderAt, readerSi
 					func(bytesTransferred int64) {
 						diff := bytesTransferred - blockProgress
 						blockProgress = bytesTransferred
-						progressLock.Lock() // 1 goroutine at a time gets a progress report
-						progress += diff
-						o.Progress(progress)
-						progressLock.Unlock()
+						addProgress(diff)
 					})
 			}
 
+			if o.ContentAddressedBlockIDs {
+				var sum [sha256.Size]byte
+				h := sha256.New()
+				if _, err := io.Copy(h, io.NewSectionReader(reader, offset, count)); err != nil {
+					return err
+				}
+				copy(sum[:], h.Sum(nil))
+				blockIDList[blockNum] = contentBlockID(sum)
+				_, alreadyStaged := staged.LoadOrStore(blockIDList[blockNum], true)
+				if size, ok := existing[blockIDList[blockNum]]; alreadyStaged || (ok && size == count) {
+					// The service already has this block, or the same content appeared earlier in the data
+					if o.Progress != nil {
+						addProgress(count)
+					}
+					return nil
+				}
+				_, err := blockBlobURL.StageBlock(ctx, blockIDList[blockNum], body, o.AccessConditions.LeaseAccessConditions, nil, o.ClientProvidedKeyOptions)
+				if err != nil {
+					staged.Delete(blockIDList[blockNum]) // So that the block is staged if the chunk is tried again
+				}
+				return err
+			}
+
 			// Block IDs are unique values to avoid issue if 2+ clients are uploading blocks
 			// at the same time causing PutBlockList to get a mix of blocks from all the clients.
 			blockIDList[blockNum] = base64.StdEncoding.EncodeToString(newUUID().bytes())
@@ -144,6 +224,47 @@ func uploadReaderAtToBlockBlob(ctx context.Context, reader io.ReaderAt, readerSi
 	return blockBlobURL.CommitBlockList(ctx, blockIDList, o.BlobHTTPHeaders, o.Metadata, o.AccessConditions, o.BlobAccessTier, o.BlobTagsMap, o.ClientProvidedKeyOptions, o.ImmutabilityPolicyOptions)
 }
 
+// uploadReaderAtAsStream uploads the data of a reader as a stream, for uploads that transform the data so that its
+// size isn't known up front.
+func uploadReaderAtAsStream(ctx context.Context, reader io.ReaderAt, readerSize int64,
+	blockBlobURL BlockBlobURL, o UploadToBlockBlobOptions) (CommonResponse, error) {
+	bufferSize := o.BlockSize
+	if bufferSize == 0 {
+		bufferSize = BlobDefaultDownloadBlockSize
+	}
+	maxBuffers := int(o.Parallelism)
+	if maxBuffers == 0 {
+		maxBuffers = 5 // default Parallelism
+	}
+	var body io.Reader = io.NewSectionReader(reader, 0, readerSize)
+	progress := o.CompressionProgress
+	if o.Progress != nil && o.Compression != nil {
+		progress = func(rawBytes int64, compressedBytes int64) {
+			if o.CompressionProgress != nil {
+				o.CompressionProgress(rawBytes, compressedBytes)
+			}
+			o.Progress(rawBytes)
+		}
+	} else if o.Progress != nil {
+		body = pipeline.NewRequestBodyProgress(io.NewSectionReader(reader, 0, readerSize), o.Progress)
+	}
+	return UploadStreamToBlockBlob(ctx, body, blockBlobURL, UploadStreamToBlockBlobOptions{
+		BufferSize:                int(bufferSize),
+		MaxBuffers:                maxBuffers,
+		BlobHTTPHeaders:           o.BlobHTTPHeaders,
+		Metadata:                  o.Metadata,
+		AccessConditions:          o.AccessConditions,
+		BlobAccessTier:            o.BlobAccessTier,
+		BlobTagsMap:               o.BlobTagsMap,
+		ClientProvidedKeyOptions:  o.ClientProvidedKeyOptions,
+		ImmutabilityPolicyOptions: o.ImmutabilityPolicyOptions,
+		ContentAddressedBlockIDs:  o.ContentAddressedBlockIDs,
+		Compression:               o.Compression,
+		CompressionProgress:       progress,
+		ClientSideEncryption:      o.ClientSideEncryption,
+	})
+}
+
 // UploadBufferToBlockBlob uploads a buffer in blocks to a block blob.
 func UploadBufferToBlockBlob(ctx context.Context, b []byte,
 	blockBlobURL BlockBlobURL, o UploadToBlockBlobOptions) (CommonResponse, error) {
@@ -184,12 +305,42 @@ type DownloadFromBlobOptions struct {
 
 	// RetryReaderOptionsPerBlock is used when downloading each block.
 	RetryReaderOptionsPerBlock RetryReaderOptions
+
+	// AutoTune, if true, picks BlockSize (when it is 0) from the size of the download, and adjusts the number of
+	// blocks downloaded in parallel at runtime from the observed throughput, latency and ServerBusy (503) responses.
+	// Parallelism is then the upper bound on parallel downloads (0=32).
+	AutoTune bool
+
+	// Decompress, if true, decodes the blob's content with the Compression registered for its Content-Encoding
+	// (see RegisterCompression); offset and count then refer to the decoded content. Compressed content can only be
+	// decoded in order, so the blob is downloaded with a single request, retried as RetryReaderOptionsPerBlock
+	// specifies, rather than in parallel blocks. Progress then reports the decoded bytes, and DownloadBlobToFile
+	// truncates the file to the size of the decoded content.
+	Decompress bool
+
+	// CompressionProgress, if set, is invoked periodically with the decoded and compressed bytes of a download
+	// with Decompress.
+	CompressionProgress CompressionProgressReceiver
+
+	// ClientSideEncryption, if its KeyWrapper or KeyResolver is set, decrypts a client-side encrypted blob; offset
+	// and count then refer to the decrypted content, and only the encrypted regions that hold it are downloaded.
+	// BlockSize is rounded up to a whole number of encrypted regions.
+	ClientSideEncryption ClientSideEncryptionOptions
 }
 
 // downloadBlobToWriterAt downloads an Azure blob to a buffer with parallel.
 func downloadBlobToWriterAt(ctx context.Context, blobURL BlobURL, offset int64, count int64,
 	writer io.WriterAt, o DownloadFromBlobOptions, initialDownloadResponse *DownloadResponse) error {
-	if o.BlockSize == 0 {
+	// Blocks aren't whole encrypted regions; the regions are decrypted with o.ClientSideEncryption
+	o.RetryReaderOptionsPerBlock.ClientSideEncryption = ClientSideEncryptionOptions{}
+	if o.ClientSideEncryption.enabled() {
+		return downloadDecryptedToWriterAt(ctx, blobURL, offset, count, writer, o)
+	}
+	if o.Decompress {
+		_, err := downloadDecompressedToWriterAt(ctx, blobURL, offset, count, writer, o)
+		return err
+	}
+	if o.BlockSize == 0 && !o.AutoTune {
 		o.BlockSize = BlobDefaultDownloadBlockSize
 	}
 
@@ -211,15 +362,20 @@ func downloadBlobToWriterAt(ctx context.Context, blobURL BlobURL, offset int64,
 		return nil
 	}
 
+	if o.BlockSize == 0 { // Auto-tuned downloads pick the block size from the size of the download
+		o.BlockSize = autoTuneBlockSize(count)
+	}
+
 	// Prepare and do parallel download.
 	progress := int64(0)
 	progressLock := &sync.Mutex{}
 
 	err := DoBatchTransfer(ctx, BatchTransferOptions{
-		OperationName: "downloadBlobToWriterAt",
-		TransferSize:  count,
-		ChunkSize:     o.BlockSize,
-		Parallelism:   o.Parallelism,
+		OperationName:       "downloadBlobToWriterAt",
+		TransferSize:        count,
+		ChunkSize:           o.BlockSize,
+		Parallelism:         o.Parallelism,
+		AutoTuneParallelism: o.AutoTune,
 		Operation: func(chunkStart int64, count int64, ctx context.Context) error {
 			dr, err := blobURL.Download(ctx, chunkStart+offset, count, o.AccessConditions, false, o.ClientProvidedKeyOptions)
 			if err != nil {
@@ -250,6 +406,137 @@ func downloadBlobToWriterAt(ctx context.Context, blobURL BlobURL, offset int64,
 	return nil
 }
 
+// downloadDecryptedToWriterAt downloads the encrypted regions of a client-side encrypted blob that hold count bytes
+// of its content starting at offset, and writes the decrypted bytes to the start of the writer.
+func downloadDecryptedToWriterAt(ctx context.Context, blobURL BlobURL, offset int64, count int64,
+	writer io.WriterAt, o DownloadFromBlobOptions) error {
+	if o.Decompress {
+		return errors.New("client-side encrypted blobs can't be decompressed")
+	}
+	props, err := blobURL.GetProperties(ctx, o.AccessConditions, o.ClientProvidedKeyOptions)
+	if err != nil {
+		return err
+	}
+	key, err := o.ClientSideEncryption.contentKey(ctx, props.NewMetadata())
+	if err != nil {
+		return err
+	}
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return err
+	}
+
+	encryptedSize := props.ContentLength()
+	size := clientSideDecryptedSize(encryptedSize)
+	if count == CountToEnd || offset+count > size {
+		count = size - offset
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	// Every range is read from the version of the blob the content key was read from
+	ac := o.AccessConditions
+	ac.ModifiedAccessConditions = ModifiedAccessConditions{IfMatch: props.ETag()}
+
+	regionsPerBlock := (o.BlockSize + clientSideEncryptionRegionDataLength - 1) / clientSideEncryptionRegionDataLength
+	if regionsPerBlock == 0 {
+		regionsPerBlock = 1
+	}
+	firstRegion := offset / clientSideEncryptionRegionDataLength
+	lastRegion := (offset + count - 1) / clientSideEncryptionRegionDataLength
+	progress := int64(0)
+	progressLock := &sync.Mutex{}
+
+	return DoBatchTransfer(ctx, BatchTransferOptions{
+		OperationName:       "downloadDecryptedToWriterAt",
+		TransferSize:        lastRegion - firstRegion + 1,
+		ChunkSize:           regionsPerBlock,
+		Parallelism:         o.Parallelism,
+		AutoTuneParallelism: o.AutoTune,
+		Operation: func(chunkStart int64, regions int64, ctx context.Context) error {
+			region := firstRegion + chunkStart
+			encryptedOffset := region * clientSideEncryptionRegionLength
+			encryptedCount := regions * clientSideEncryptionRegionLength
+			if encryptedOffset+encryptedCount > encryptedSize {
+				encryptedCount = encryptedSize - encryptedOffset
+			}
+			dr, err := blobURL.Download(ctx, encryptedOffset, encryptedCount, ac, false, o.ClientProvidedKeyOptions)
+			if err != nil {
+				return err
+			}
+			body := dr.Body(o.RetryReaderOptionsPerBlock)
+			encrypted := make([]byte, encryptedCount)
+			_, err = io.ReadFull(body, encrypted)
+			body.Close()
+			if err != nil {
+				return err
+			}
+			plain, err := decryptRegions(aead, encrypted)
+			if err != nil {
+				return err
+			}
+
+			// Write the part of the decrypted regions that was asked for
+			plainOffset := region * clientSideEncryptionRegionDataLength
+			start, end := offset, offset+count
+			if plainOffset > start {
+				start = plainOffset
+			}
+			if plainOffset+int64(len(plain)) < end {
+				end = plainOffset + int64(len(plain))
+			}
+			if _, err = writer.WriteAt(plain[start-plainOffset:end-plainOffset], start-offset); err != nil {
+				return err
+			}
+			if o.Progress != nil {
+				progressLock.Lock()
+				progress += end - start
+				o.Progress(progress)
+				progressLock.Unlock()
+			}
+			return nil
+		},
+	})
+}
+
+// downloadDecompressedToWriterAt downloads and decodes an Azure blob, writing count bytes of the decoded content
+// starting at offset to the start of the writer. It returns the number of bytes written.
+func downloadDecompressedToWriterAt(ctx context.Context, blobURL BlobURL, offset int64, count int64,
+	writer io.WriterAt, o DownloadFromBlobOptions) (int64, error) {
+	dr, err := blobURL.Download(ctx, 0, CountToEnd, o.AccessConditions, false, o.ClientProvidedKeyOptions)
+	if err != nil {
+		return 0, err
+	}
+	progress := o.CompressionProgress
+	if o.Progress != nil {
+		progress = func(rawBytes int64, compressedBytes int64) {
+			if o.CompressionProgress != nil {
+				o.CompressionProgress(rawBytes, compressedBytes)
+			}
+			if rawBytes > offset {
+				o.Progress(rawBytes - offset)
+			}
+		}
+	}
+	ro := o.RetryReaderOptionsPerBlock
+	ro.Decompress = true
+	body := dr.body(ro, progress)
+	defer body.Close()
+
+	if _, err := io.CopyN(ioutil.Discard, body, offset); err == io.EOF {
+		return 0, nil // The offset is beyond the end of the content
+	} else if err != nil {
+		return 0, err
+	}
+	var src io.Reader = body
+	limit := int64(math.MaxInt64)
+	if count != CountToEnd {
+		src, limit = io.LimitReader(body, count), count
+	}
+	return io.Copy(newSectionWriter(writer, 0, limit), src)
+}
+
 // DownloadBlobToBuffer downloads an Azure blob to a buffer with parallel.
 // Offset and count are optional, pass 0 for both to download the entire blob.
 func DownloadBlobToBuffer(ctx context.Context, blobURL BlobURL, offset int64, count int64,
@@ -262,6 +549,15 @@ func DownloadBlobToBuffer(ctx context.Context, blobURL BlobURL, offset int64, co
 // Offset and count are optional, pass 0 for both to download the entire blob.
 func DownloadBlobToFile(ctx context.Context, blobURL BlobURL, offset int64, count int64,
 	file *os.File, o DownloadFromBlobOptions) error {
+	if o.Decompress {
+		// The decoded size isn't known up front
+		n, err := downloadDecompressedToWriterAt(ctx, blobURL, offset, count, file, o)
+		if err != nil {
+			return err
+		}
+		return file.Truncate(n)
+	}
+
 	// 1. Calculate the size of the destination file
 	var size int64
 
@@ -272,6 +568,9 @@ func DownloadBlobToFile(ctx context.Context, blobURL BlobURL, offset int64, coun
 			return err
 		}
 		size = props.ContentLength() - offset
+		if o.ClientSideEncryption.enabled() {
+			size = clientSideDecryptedSize(props.ContentLength()) - offset
+		}
 	} else {
 		size = count
 	}
@@ -303,63 +602,207 @@ type BatchTransferOptions struct {
 	Parallelism   uint16
 	Operation     func(offset int64, chunkSize int64, ctx context.Context) error
 	OperationName string
+
+	// MaxChunkTries specifies the maximum number of times Operation is invoked for a single chunk before the
+	// chunk is considered failed. These tries are in addition to any retries done by the pipeline's retry policy.
+	// A value of 0 or 1 means that a chunk is never retried.
+	MaxChunkTries int32
+
+	// ChunkRetryDelay specifies the base delay used for the exponential back-off between tries of a chunk (0=default of 1s).
+	ChunkRetryDelay time.Duration
+
+	// MaxChunkRetryDelay specifies the maximum delay between tries of a chunk (0=default of 30s).
+	MaxChunkRetryDelay time.Duration
+
+	// ContinueOnError, if true, keeps transferring the remaining chunks after a chunk fails instead of
+	// cancelling the whole transfer. The failed chunks are reported by DoBatchTransferWithResult.
+	ContinueOnError bool
+
+	// Chunks, if non-nil, restricts the transfer to the chunks with these indexes. This is typically set from
+	// BatchTransferResult.FailedChunkIndexes to retry only the chunks that failed in a previous transfer.
+	Chunks []int64
+
+	// AutoTuneParallelism, if true, adjusts the number of chunks transferred in parallel at runtime from the
+	// observed throughput, latency and ServerBusy (503) responses. Parallelism is then the upper bound (0=32).
+	AutoTuneParallelism bool
+}
+
+// numChunks returns the number of chunks the transfer is split into.
+func (o BatchTransferOptions) numChunks() int64 {
+	return ((o.TransferSize - 1) / o.ChunkSize) + 1
+}
+
+// chunkRange returns the offset and size of the chunk with the specified index.
+func (o BatchTransferOptions) chunkRange(chunkNum int64) (offset int64, count int64) {
+	offset = chunkNum * o.ChunkSize
+	count = o.ChunkSize
+	if chunkNum == o.numChunks()-1 { // Last chunk
+		count = o.TransferSize - offset // Remove size of all transferred chunks from total
+	}
+	return offset, count
+}
+
+// doChunk invokes Operation for a single chunk, retrying it with exponential back-off if MaxChunkTries allows it.
+func (o BatchTransferOptions) doChunk(ctx context.Context, offset int64, count int64) error {
+	ro := RetryOptions{Policy: RetryPolicyExponential, RetryDelay: o.ChunkRetryDelay, MaxRetryDelay: o.MaxChunkRetryDelay}
+	if ro.RetryDelay == 0 {
+		ro.RetryDelay = time.Second
+	}
+	if ro.MaxRetryDelay == 0 {
+		ro.MaxRetryDelay = 30 * time.Second
+	}
+
+	for try := int32(1); ; try++ {
+		err := o.Operation(offset, count, ctx)
+		if err == nil || try >= o.MaxChunkTries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(ro.calcDelay(try + 1)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// BatchTransferChunk describes a chunk that failed during DoBatchTransferWithResult.
+type BatchTransferChunk struct {
+	// Index is the chunk's index within the transfer; pass it back through BatchTransferOptions.Chunks to retry the chunk.
+	Index int64
+
+	// Offset and Count identify the range of the transfer covered by the chunk.
+	Offset int64
+	Count  int64
+
+	// Err is the error returned by the chunk's last try, or the context's error if the chunk never ran.
+	Err error
+}
+
+// BatchTransferResult describes the outcome of DoBatchTransferWithResult.
+type BatchTransferResult struct {
+	// FailedChunks lists, in ascending index order, every chunk that did not complete successfully.
+	FailedChunks []BatchTransferChunk
+}
+
+// FailedChunkIndexes returns the indexes of the failed chunks; it is suitable for BatchTransferOptions.Chunks.
+func (r BatchTransferResult) FailedChunkIndexes() []int64 {
+	indexes := make([]int64, len(r.FailedChunks))
+	for i, chunk := range r.FailedChunks {
+		indexes[i] = chunk.Index
+	}
+	return indexes
 }
 
 // DoBatchTransfer helps to execute operations in a batch manner.
 // Can be used by users to customize batch works (for other scenarios that the SDK does not provide)
 func DoBatchTransfer(ctx context.Context, o BatchTransferOptions) error {
+	_, err := DoBatchTransferWithResult(ctx, o)
+	return err
+}
+
+// DoBatchTransferWithResult is like DoBatchTransfer but also reports which chunks failed so that the
+// caller can retry just those chunks by passing BatchTransferResult.FailedChunkIndexes as BatchTransferOptions.Chunks.
+// The returned error is the first error returned by any chunk.
+func DoBatchTransferWithResult(ctx context.Context, o BatchTransferOptions) (BatchTransferResult, error) {
 	if o.ChunkSize == 0 {
-		return errors.New("ChunkSize cannot be 0")
+		return BatchTransferResult{}, errors.New("ChunkSize cannot be 0")
 	}
 
 	if o.Parallelism == 0 {
 		o.Parallelism = 5 // default Parallelism
+		if o.AutoTuneParallelism {
+			o.Parallelism = autoTuneMaxParallelism
+		}
+	}
+
+	numChunks := o.numChunks()
+	chunks := o.Chunks
+	if chunks == nil {
+		chunks = make([]int64, numChunks)
+		for chunkNum := range chunks {
+			chunks[chunkNum] = int64(chunkNum)
+		}
+	}
+	for _, chunkNum := range chunks {
+		if chunkNum < 0 || chunkNum >= numChunks {
+			return BatchTransferResult{}, fmt.Errorf("chunk index %d is out of range; the transfer has %d chunks", chunkNum, numChunks)
+		}
 	}
 
 	// Prepare and do parallel operations.
-	numChunks := uint16(((o.TransferSize - 1) / o.ChunkSize) + 1)
-	operationChannel := make(chan func() error, o.Parallelism) // Create the channel that release 'Parallelism' goroutines concurrently
-	operationResponseChannel := make(chan error, numChunks)    // Holds each response
+	chunkErrors := make([]error, len(chunks))         // Holds each chunk's error, indexed like chunks
+	operationChannel := make(chan int, o.Parallelism) // Create the channel that release 'Parallelism' goroutines concurrently
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var tuner *concurrencyTuner
+	if o.AutoTuneParallelism {
+		tuner = newConcurrencyTuner(int(o.Parallelism))
+		ctx = withServerBusyNotifier(ctx, tuner.serverBusy)
+	}
+
+	var firstErr error
+	firstErrLock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+
 	// Create the goroutines that process each operation (in parallel).
 	for g := uint16(0); g < o.Parallelism; g++ {
-		//grIndex := g
+		wg.Add(1)
 		go func() {
-			for f := range operationChannel {
-				err := f()
-				operationResponseChannel <- err
+			defer wg.Done()
+			for i := range operationChannel {
+				offset, count := o.chunkRange(chunks[i])
+				if tuner != nil {
+					tuner.acquire()
+				}
+				start := time.Now()
+				err := o.doChunk(ctx, offset, count)
+				if tuner != nil {
+					tuner.release(count, time.Since(start), err)
+				}
+				if err == nil {
+					continue
+				}
+				chunkErrors[i] = err
+				firstErrLock.Lock()
+				// record the first error (the original error which should cause the other chunks to fail with canceled context)
+				if firstErr == nil {
+					firstErr = err
+					if !o.ContinueOnError {
+						cancel() // As soon as any operation fails, cancel all remaining operation calls
+					}
+				}
+				firstErrLock.Unlock()
 			}
 		}()
 	}
 
-	// Add each chunk's operation to the channel.
-	for chunkNum := uint16(0); chunkNum < numChunks; chunkNum++ {
-		curChunkSize := o.ChunkSize
-
-		if chunkNum == numChunks-1 { // Last chunk
-			curChunkSize = o.TransferSize - (int64(chunkNum) * o.ChunkSize) // Remove size of all transferred chunks from total
-		}
-		offset := int64(chunkNum) * o.ChunkSize
-
-		operationChannel <- func() error {
-			return o.Operation(offset, curChunkSize, ctx)
+	// Add each chunk's operation to the channel; chunks that are never started are failed with the context's error.
+	for i := range chunks {
+		if err := ctx.Err(); err != nil {
+			chunkErrors[i] = err
+			continue
 		}
+		operationChannel <- i
 	}
 	close(operationChannel)
 
 	// Wait for the operations to complete.
-	var firstErr error = nil
-	for chunkNum := uint16(0); chunkNum < numChunks; chunkNum++ {
-		responseError := <-operationResponseChannel
-		// record the first error (the original error which should cause the other chunks to fail with canceled context)
-		if responseError != nil && firstErr == nil {
-			cancel() // As soon as any operation fails, cancel all remaining operation calls
-			firstErr = responseError
+	wg.Wait()
+
+	result := BatchTransferResult{}
+	for i, err := range chunkErrors {
+		if err != nil {
+			offset, count := o.chunkRange(chunks[i])
+			result.FailedChunks = append(result.FailedChunks, BatchTransferChunk{Index: chunks[i], Offset: offset, Count: count, Err: err})
 		}
 	}
-	return firstErr
+	sort.Slice(result.FailedChunks, func(i, j int) bool { return result.FailedChunks[i].Index < result.FailedChunks[j].Index })
+
+	if firstErr == nil && len(result.FailedChunks) > 0 {
+		firstErr = result.FailedChunks[0].Err // The caller's context was cancelled before every chunk could run
+	}
+	return result, firstErr
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////
@@ -498,12 +941,168 @@ func (s *syncPool) Close() {
 	close(s.threadpool)
 }
 
+// TransferBudget caps the memory used for buffers by every TransferManager created from it. A single
+// TransferBudget is meant to be shared by all of a process's concurrent stream uploads: each upload
+// gets its own TransferManager from NewTransferManager and the budget's buffers are split fairly between
+// the uploads that are currently using buffers. When the budget is exhausted, uploads wait for a buffer
+// instead of allocating a new one, which lowers their parallelism.
+type TransferBudget struct {
+	bufferSize int
+	maxBuffers int
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	free    [][]byte // buffers that were returned and can be reused
+	inUse   int
+	active  int // number of transfer managers holding or waiting for a buffer
+	created int
+
+	waits    int64
+	waitTime time.Duration
+}
+
+// TransferBudgetStats is a snapshot of a TransferBudget's metrics.
+type TransferBudgetStats struct {
+	// MaxBuffers is the number of buffers that fit in the budget.
+	MaxBuffers int
+
+	// BuffersInUse is the number of buffers currently held by uploads.
+	BuffersInUse int
+
+	// BuffersAllocated is the number of buffers allocated so far; it never exceeds MaxBuffers.
+	BuffersAllocated int
+
+	// ActiveTransfers is the number of transfer managers currently holding or waiting for buffers.
+	ActiveTransfers int
+
+	// Waits is the number of times a buffer was not immediately available.
+	Waits int64
+
+	// WaitTime is the cumulative time spent waiting for buffers.
+	WaitTime time.Duration
+}
+
+// NewTransferBudget creates a TransferBudget that hands out buffers of bufferSize bytes while never
+// holding more than maxMemory bytes of buffers.
+func NewTransferBudget(bufferSize int, maxMemory int64) (*TransferBudget, error) {
+	if bufferSize < _1MiB {
+		return nil, fmt.Errorf("cannot have size < 1MiB")
+	}
+	if maxMemory < int64(bufferSize) {
+		return nil, fmt.Errorf("maxMemory must be able to hold at least one buffer of %d bytes", bufferSize)
+	}
+
+	b := &TransferBudget{bufferSize: bufferSize, maxBuffers: int(maxMemory / int64(bufferSize))}
+	b.cond = sync.NewCond(&b.lock)
+	return b, nil
+}
+
+// NewTransferManager creates a TransferManager for a single upload that draws its buffers from the budget.
+// Close must be called on the returned TransferManager once the upload is done.
+func (b *TransferBudget) NewTransferManager() TransferManager {
+	return &budgetedTransferManager{budget: b}
+}
+
+// Stats returns a snapshot of the budget's metrics.
+func (b *TransferBudget) Stats() TransferBudgetStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return TransferBudgetStats{
+		MaxBuffers:       b.maxBuffers,
+		BuffersInUse:     b.inUse,
+		BuffersAllocated: b.created,
+		ActiveTransfers:  b.active,
+		Waits:            b.waits,
+		WaitTime:         b.waitTime,
+	}
+}
+
+// fairShare returns the number of buffers each active transfer manager may hold. The caller must hold the lock.
+func (b *TransferBudget) fairShare() int {
+	if b.active == 0 {
+		return b.maxBuffers
+	}
+	if share := b.maxBuffers / b.active; share > 0 {
+		return share
+	}
+	return 1
+}
+
+type budgetedTransferManager struct {
+	budget  *TransferBudget
+	inUse   int
+	waiting int
+}
+
+// isActive reports whether the transfer manager counts towards the budget's fair share. The caller must hold the lock.
+func (m *budgetedTransferManager) isActive() bool {
+	return m.inUse > 0 || m.waiting > 0
+}
+
+// Get implements TransferManager.Get().
+func (m *budgetedTransferManager) Get() []byte {
+	b := m.budget
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !m.isActive() {
+		b.active++
+	}
+	if m.inUse >= b.fairShare() || b.inUse >= b.maxBuffers {
+		m.waiting++
+		start := time.Now()
+		for m.inUse >= b.fairShare() || b.inUse >= b.maxBuffers {
+			b.cond.Wait()
+		}
+		m.waiting--
+		b.waits++
+		b.waitTime += time.Since(start)
+	}
+
+	m.inUse++
+	b.inUse++
+	if n := len(b.free); n > 0 {
+		buffer := b.free[n-1]
+		b.free = b.free[:n-1]
+		return buffer
+	}
+	b.created++
+	return make([]byte, b.bufferSize)
+}
+
+// Put implements TransferManager.Put().
+func (m *budgetedTransferManager) Put(buffer []byte) {
+	b := m.budget
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if m.inUse == 0 || len(buffer) != b.bufferSize {
+		return // This shouldn't happen, but just in case they call Put() with their own buffer.
+	}
+	m.inUse--
+	b.inUse--
+	b.free = append(b.free, buffer)
+	if !m.isActive() {
+		b.active--
+	}
+	b.cond.Broadcast() // The buffer may be claimed by any waiter and the fair share may have grown
+}
+
+// Run implements TransferManager.Run(). Concurrency is bounded by the buffers held, so f runs on its own goroutine.
+func (m *budgetedTransferManager) Run(f func()) {
+	go f()
+}
+
+// Close implements TransferManager.Close(). The budget itself stays usable by other transfer managers.
+func (m *budgetedTransferManager) Close() {}
+
 const _1MiB = 1024 * 1024
 
 // UploadStreamToBlockBlobOptions is options for UploadStreamToBlockBlob.
 type UploadStreamToBlockBlobOptions struct {
 	// TransferManager provides a TransferManager that controls buffer allocation/reuse and
-	// concurrency. This overrides BufferSize and MaxBuffers if set.
+	// concurrency. This overrides BufferSize and MaxBuffers if set. Use TransferBudget.NewTransferManager
+	// to cap the memory used by all of the process's concurrent uploads.
 	TransferManager      TransferManager
 	transferMangerNotSet bool
 	// BufferSize sizes the buffer used to read data from source. If < 1 MiB, defaults to 1 MiB.
@@ -517,6 +1116,25 @@ type UploadStreamToBlockBlobOptions struct {
 	BlobTagsMap               BlobTagsMap
 	ClientProvidedKeyOptions  ClientProvidedKeyOptions
 	ImmutabilityPolicyOptions ImmutabilityPolicyOptions
+	// ContentAddressedBlockIDs, if true, derives each block's ID from a SHA-256 hash of its content and doesn't stage
+	// the blocks the blob already has, committed or uncommitted, so re-uploading mostly unchanged data only sends
+	// the changed blocks. Unchanged data is only recognized in blocks at the same BufferSize boundaries as the
+	// previous upload.
+	ContentAddressedBlockIDs bool
+	// Compression, if set, compresses the data as it is uploaded and sets BlobHTTPHeaders.ContentEncoding to the
+	// Compression's Content-Encoding.
+	Compression Compression
+	// CompressionProgress, if set, is invoked periodically with the uncompressed bytes read from the reader and
+	// the compressed bytes produced from them.
+	CompressionProgress CompressionProgressReceiver
+	// ClientSideEncryption, if its KeyWrapper is set, encrypts the data before it is uploaded. Encrypted data can't
+	// also be compressed.
+	ClientSideEncryption ClientSideEncryptionOptions
+	// AutoTune, if true, adjusts the number of blocks staged in parallel at runtime from the observed throughput,
+	// latency and ServerBusy (503) responses, like UploadToBlockBlobOptions.AutoTune. MaxBuffers is then the upper
+	// bound on parallel uploads (0=32), or the TransferManager's buffers if it is set. BufferSize isn't tuned: the
+	// stream's size isn't known up front, and the buffers are allocated before the first block is read.
+	AutoTune bool
 }
 
 func (u *UploadStreamToBlockBlobOptions) defaults() error {
@@ -526,6 +1144,9 @@ func (u *UploadStreamToBlockBlobOptions) defaults() error {
 
 	if u.MaxBuffers == 0 {
 		u.MaxBuffers = 1
+		if u.AutoTune {
+			u.MaxBuffers = autoTuneMaxParallelism
+		}
 	}
 
 	if u.BufferSize < _1MiB {
@@ -553,6 +1174,32 @@ func UploadStreamToBlockBlob(ctx context.Context, reader io.Reader, blockBlobURL
 		defer o.TransferManager.Close()
 	}
 
+	if o.Compression != nil && o.ClientSideEncryption.enabled() {
+		return nil, errors.New("client-side encrypted data can't also be compressed")
+	}
+	if o.Compression != nil {
+		if err := setContentEncoding(&o.BlobHTTPHeaders, o.Compression); err != nil {
+			return nil, err
+		}
+		compressed, err := compressReader(reader, o.Compression, o.CompressionProgress)
+		if err != nil {
+			return nil, err
+		}
+		defer compressed.Close()
+		reader = compressed
+	}
+
+	if o.ClientSideEncryption.enabled() {
+		key, metadata, err := o.ClientSideEncryption.newContentKey(ctx, o.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		o.Metadata = metadata
+		if reader, err = newEncryptingReader(reader, key); err != nil {
+			return nil, err
+		}
+	}
+
 	result, err := copyFromReader(ctx, reader, blockBlobURL, o)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,241 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BlockBlobPatch is a range of bytes that PatchBlockBlob writes over an existing block blob's content.
+type BlockBlobPatch struct {
+	// Offset is where in the blob Data is written. It can't be beyond the end of the blob; data written
+	// past the end of the blob extends it.
+	Offset int64
+	Data   []byte
+}
+
+// PatchBlockBlobOptions identifies options used by PatchBlockBlob.
+type PatchBlockBlobOptions struct {
+	// BlockSize specifies the size of the blocks staged for data the blob has no committed blocks for: data written
+	// past the end of the blob, or all of a blob that was created by a single Put Blob. The default size is
+	// BlobDefaultDownloadBlockSize.
+	BlockSize int64
+
+	// Parallelism indicates the maximum number of blocks to stage in parallel (0=default)
+	Parallelism uint16
+
+	// AccessConditions indicates the access conditions for reading the blob. Once the blob is read, every request
+	// is made with If-Match set to the blob's ETag.
+	AccessConditions BlobAccessConditions
+
+	// ClientProvidedKeyOptions indicates the client provided key by name and/or by value to encrypt/decrypt data.
+	ClientProvidedKeyOptions ClientProvidedKeyOptions
+}
+
+// patchBlock is a block of the patched blob. A block with an empty newID is committed unchanged.
+type patchBlock struct {
+	offset int64
+	count  int64
+	id     string
+	newID  string
+}
+
+// PatchBlockBlob writes patches over the content of an existing block blob, staging replacement blocks only for the
+// committed blocks the patches overlap and committing them together with the IDs of the unchanged blocks. Every
+// request is conditional on the ETag of the blob read at the start, so either all the patches are applied to that
+// version of the blob or the commit fails with ServiceCodeConditionNotMet and the blob is left as it was.
+// The blob keeps its HTTP headers except Content-MD5 (which no longer matches its content), metadata, tags and tier.
+func PatchBlockBlob(ctx context.Context, blockBlobURL BlockBlobURL, patches []BlockBlobPatch, o PatchBlockBlobOptions) (*BlockBlobCommitBlockListResponse, error) {
+	if o.BlockSize == 0 {
+		o.BlockSize = BlobDefaultDownloadBlockSize
+	}
+	if o.BlockSize < 0 || o.BlockSize > BlockBlobMaxStageBlockBytes {
+		return nil, fmt.Errorf("BlockSize option must be > 0 and <= %d", BlockBlobMaxStageBlockBytes)
+	}
+
+	props, err := blockBlobURL.GetProperties(ctx, o.AccessConditions, o.ClientProvidedKeyOptions)
+	if err != nil {
+		return nil, err
+	}
+	if props.BlobType() != BlobBlockBlob {
+		return nil, fmt.Errorf("cannot patch a blob of type %s", props.BlobType())
+	}
+	size := props.ContentLength()
+	end := size
+	for _, p := range patches {
+		if p.Offset < 0 || p.Offset > size {
+			return nil, fmt.Errorf("patch offset %d is outside the blob's %d bytes", p.Offset, size)
+		}
+		if pEnd := p.Offset + int64(len(p.Data)); pEnd > end {
+			end = pEnd
+		}
+	}
+
+	ac := o.AccessConditions
+	ac.ModifiedAccessConditions = ModifiedAccessConditions{IfMatch: props.ETag()}
+
+	blockList, err := blockBlobURL.GetBlockList(ctx, BlockListCommitted, ac.LeaseAccessConditions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map the blob's offsets to its committed blocks. A blob created by a single Put Blob has no committed blocks,
+	// so all of it is staged as new blocks.
+	var blocks []patchBlock
+	blocksEnd := int64(0)
+	for _, b := range blockList.CommittedBlocks {
+		blocks = append(blocks, patchBlock{offset: blocksEnd, count: b.Size, id: b.Name})
+		blocksEnd += b.Size
+	}
+	if blocksEnd != size {
+		blocks, blocksEnd = nil, 0
+	}
+	for ; blocksEnd < end; blocksEnd += o.BlockSize {
+		count := o.BlockSize
+		if blocksEnd+count > end {
+			count = end - blocksEnd
+		}
+		blocks = append(blocks, patchBlock{offset: blocksEnd, count: count})
+	}
+	if len(blocks) > BlockBlobMaxBlocks {
+		return nil, fmt.Errorf("the patched blob would have more than %d blocks", BlockBlobMaxBlocks)
+	}
+
+	// New block IDs must have the same length as the blob's existing ones, and not collide with them.
+	idLength := base64.StdEncoding.EncodedLen(len(newUUID().bytes()))
+	usedIDs := map[string]bool{}
+	for _, b := range blocks {
+		if b.id != "" {
+			idLength = len(b.id)
+			usedIDs[b.id] = true
+		}
+	}
+	var staged []int
+	for i := range blocks {
+		b := &blocks[i]
+		if b.id == "" || overlapsPatch(b.offset, b.count, patches) {
+			if b.newID, err = newBlockIDOfLength(idLength, usedIDs); err != nil {
+				return nil, err
+			}
+			staged = append(staged, i)
+		}
+	}
+
+	if len(staged) > 0 {
+		// DoBatchTransfer is given one 1-byte chunk per block to stage since the blocks aren't all the same size.
+		err = DoBatchTransfer(ctx, BatchTransferOptions{
+			OperationName: "PatchBlockBlob",
+			TransferSize:  int64(len(staged)),
+			ChunkSize:     1,
+			Parallelism:   o.Parallelism,
+			Operation: func(index int64, _ int64, ctx context.Context) error {
+				b := blocks[staged[index]]
+				data := make([]byte, b.count)
+				if b.offset < size && !coveredByPatch(b.offset, b.count, patches) {
+					count := b.count
+					if b.offset+count > size {
+						count = size - b.offset
+					}
+					dr, err := blockBlobURL.Download(ctx, b.offset, count, ac, false, o.ClientProvidedKeyOptions)
+					if err != nil {
+						return err
+					}
+					body := dr.Body(RetryReaderOptions{})
+					_, err = io.ReadFull(body, data[:count])
+					body.Close()
+					if err != nil {
+						return err
+					}
+				}
+				for _, p := range patches {
+					applyPatch(data, b.offset, p)
+				}
+				_, err := blockBlobURL.StageBlock(ctx, b.newID, bytes.NewReader(data), ac.LeaseAccessConditions, nil, o.ClientProvidedKeyOptions)
+				return err
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make([]string, len(blocks))
+	for i, b := range blocks {
+		if b.newID != "" {
+			ids[i] = b.newID
+		} else {
+			ids[i] = b.id
+		}
+	}
+
+	// Committing a block list replaces the blob's properties, so pass along the current ones.
+	headers := props.NewHTTPHeaders()
+	headers.ContentMD5 = nil
+	var tags BlobTagsMap
+	if props.TagCount() > 0 {
+		if tags, err = blockBlobURL.getTagsMap(ctx); err != nil {
+			return nil, err
+		}
+	}
+	tier := AccessTierNone
+	if props.AccessTierInferred() != "true" {
+		tier = AccessTierType(props.AccessTier())
+	}
+	return blockBlobURL.CommitBlockList(ctx, ids, headers, props.NewMetadata(), ac, tier, tags, o.ClientProvidedKeyOptions, ImmutabilityPolicyOptions{})
+}
+
+// overlapsPatch returns true if any of the patches writes to the count bytes starting at offset.
+func overlapsPatch(offset int64, count int64, patches []BlockBlobPatch) bool {
+	for _, p := range patches {
+		if len(p.Data) > 0 && p.Offset < offset+count && offset < p.Offset+int64(len(p.Data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredByPatch returns true if a single patch writes all of the count bytes starting at offset.
+func coveredByPatch(offset int64, count int64, patches []BlockBlobPatch) bool {
+	for _, p := range patches {
+		if p.Offset <= offset && offset+count <= p.Offset+int64(len(p.Data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPatch copies the part of the patch that overlaps data, which holds the blob's bytes starting at offset.
+func applyPatch(data []byte, offset int64, p BlockBlobPatch) {
+	start := p.Offset - offset
+	if start >= int64(len(data)) || start+int64(len(p.Data)) <= 0 {
+		return
+	}
+	if start < 0 {
+		copy(data, p.Data[-start:])
+	} else {
+		copy(data[start:], p.Data)
+	}
+}
+
+// newBlockIDOfLength returns a random base64 block ID of the length that isn't in used, and adds it to used.
+func newBlockIDOfLength(length int, used map[string]bool) (string, error) {
+	encoding, n := base64.StdEncoding, length/4*3
+	if length%4 != 0 { // The blob's block IDs are unpadded
+		encoding, n = base64.RawStdEncoding, length*3/4
+	}
+	b := make([]byte, n)
+	for try := 0; try < 100; try++ {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		if id := encoding.EncodeToString(b); len(id) == length && !used[id] {
+			used[id] = true
+			return id, nil
+		}
+	}
+	return "", errors.New("cannot generate a new block ID with the same length as the blob's block IDs")
+}
@@ -0,0 +1,244 @@
+package azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLeaseAlreadyPresent is the error of a LeaseKeeper that couldn't acquire its lease because the blob or
+	// container already has another lease. Test for it with errors.Is.
+	ErrLeaseAlreadyPresent = errors.New("the blob or container already has a lease")
+
+	// ErrLeaseLost is the error of a LeaseKeeper that failed to renew its lease before it expired, or whose lease was
+	// broken, released or changed by another client. Test for it with errors.Is.
+	ErrLeaseLost = errors.New("the lease was lost")
+)
+
+// LeaseError is the error of a LeaseKeeper that failed to acquire or keep its lease. errors.Is reports whether it is
+// ErrLeaseAlreadyPresent or ErrLeaseLost, and errors.As finds the StorageError that caused it, if any.
+type LeaseError struct {
+	// Kind is ErrLeaseAlreadyPresent, ErrLeaseLost, or nil for other failures to acquire a lease.
+	Kind error
+
+	LeaseID string
+
+	// Err is the error of the request that failed.
+	Err error
+}
+
+// Error returns the error's description.
+func (e *LeaseError) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("acquiring the lease %s failed: %v", e.LeaseID, e.Err)
+	}
+	return fmt.Sprintf("%v (lease %s): %v", e.Kind, e.LeaseID, e.Err)
+}
+
+// Is reports whether the error is of the kind of the target.
+func (e *LeaseError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// Unwrap returns the error of the request that failed.
+func (e *LeaseError) Unwrap() error {
+	return e.Err
+}
+
+// LeaseKeeperOptions identifies options used by BlobURL.KeepLease and ContainerURL.KeepLease.
+type LeaseKeeperOptions struct {
+	// ProposedID is the lease ID to acquire the lease with (""=a new UUID).
+	ProposedID string
+
+	// Duration is the lease's duration, between 15 and 60 seconds (0=60 seconds). The lease is renewed ahead of it.
+	Duration time.Duration
+
+	// RenewInterval is how often the lease is renewed (0=a third of Duration). Each renewal comes up to a fifth of
+	// the interval earlier, at random, so that keepers started together don't renew together.
+	RenewInterval time.Duration
+
+	// AccessConditions are the conditions on acquiring the lease. Containers only support the modified time conditions.
+	AccessConditions ModifiedAccessConditions
+}
+
+// LeaseKeeper holds a lease on a blob or container, renewing it in the background until it is closed. Its Context is
+// cancelled the moment the lease is lost, so work that needs the lease can stop.
+type LeaseKeeper struct {
+	leaseID string
+	renew   func(ctx context.Context, leaseID string) error
+	release func(ctx context.Context, leaseID string) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+
+	lock   sync.Mutex
+	err    error
+	closed bool
+}
+
+// KeepLease acquires a lease on the blob and returns a LeaseKeeper that renews it until it is closed. ctx only
+// applies to acquiring the lease. If the blob already has a lease, the error is a LeaseError of ErrLeaseAlreadyPresent.
+// For more information, see https://docs.microsoft.com/rest/api/storageservices/lease-blob.
+func (b BlobURL) KeepLease(ctx context.Context, o LeaseKeeperOptions) (*LeaseKeeper, error) {
+	return keepLease(ctx, o,
+		func(ctx context.Context, proposedID string, duration int32) error {
+			_, err := b.AcquireLease(ctx, proposedID, duration, o.AccessConditions)
+			return err
+		},
+		func(ctx context.Context, leaseID string) error {
+			_, err := b.RenewLease(ctx, leaseID, ModifiedAccessConditions{})
+			return err
+		},
+		func(ctx context.Context, leaseID string) error {
+			_, err := b.ReleaseLease(ctx, leaseID, ModifiedAccessConditions{})
+			return err
+		})
+}
+
+// KeepLease acquires a lease on the container and returns a LeaseKeeper that renews it until it is closed. ctx only
+// applies to acquiring the lease. If the container already has a lease, the error is a LeaseError of
+// ErrLeaseAlreadyPresent.
+// For more information, see https://docs.microsoft.com/rest/api/storageservices/lease-container.
+func (c ContainerURL) KeepLease(ctx context.Context, o LeaseKeeperOptions) (*LeaseKeeper, error) {
+	return keepLease(ctx, o,
+		func(ctx context.Context, proposedID string, duration int32) error {
+			_, err := c.AcquireLease(ctx, proposedID, duration, o.AccessConditions)
+			return err
+		},
+		func(ctx context.Context, leaseID string) error {
+			_, err := c.RenewLease(ctx, leaseID, ModifiedAccessConditions{})
+			return err
+		},
+		func(ctx context.Context, leaseID string) error {
+			_, err := c.ReleaseLease(ctx, leaseID, ModifiedAccessConditions{})
+			return err
+		})
+}
+
+func keepLease(ctx context.Context, o LeaseKeeperOptions, acquire func(ctx context.Context, proposedID string, duration int32) error,
+	renew, release func(ctx context.Context, leaseID string) error) (*LeaseKeeper, error) {
+	if o.Duration == 0 {
+		o.Duration = 60 * time.Second
+	}
+	if o.Duration < 15*time.Second || o.Duration > 60*time.Second {
+		return nil, errors.New("the lease duration must be between 15 and 60 seconds")
+	}
+	if o.RenewInterval <= 0 {
+		o.RenewInterval = o.Duration / 3
+	}
+	if o.ProposedID == "" {
+		o.ProposedID = newUUID().String()
+	}
+
+	start := time.Now()
+	if err := acquire(ctx, o.ProposedID, int32(o.Duration/time.Second)); err != nil {
+		var stgErr StorageError
+		if errors.As(err, &stgErr) && stgErr.ServiceCode() == ServiceCodeLeaseAlreadyPresent {
+			return nil, &LeaseError{Kind: ErrLeaseAlreadyPresent, LeaseID: o.ProposedID, Err: err}
+		}
+		return nil, &LeaseError{LeaseID: o.ProposedID, Err: err}
+	}
+	k := &LeaseKeeper{leaseID: o.ProposedID, renew: renew, release: release, stop: make(chan struct{}), done: make(chan struct{})}
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	go k.keep(start.Add(o.Duration), o.Duration, o.RenewInterval)
+	return k, nil
+}
+
+// keep renews the lease until the keeper is closed or the lease is lost. The lease expires at expiry unless it's
+// renewed; a renewal that fails with a transient error is retried until then.
+func (k *LeaseKeeper) keep(expiry time.Time, duration time.Duration, interval time.Duration) {
+	defer close(k.done)
+	wait := interval
+	for {
+		wait = time.Duration(float32(wait) * (1 - rand.Float32()/5)) // NOTE: We want math/rand; not crypto/rand
+		if remaining := time.Until(expiry); wait > remaining {
+			wait = remaining
+		}
+		select {
+		case <-k.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		start := time.Now()
+		ctx, cancel := context.WithDeadline(k.ctx, expiry)
+		err := k.renew(ctx, k.leaseID)
+		cancel()
+		if err == nil {
+			expiry, wait = start.Add(duration), interval
+			continue
+		}
+		if isTransientLeaseError(err) && time.Now().Before(expiry) {
+			// The lease may still be renewed before it expires.
+			wait = interval / 5
+			continue
+		}
+		k.lock.Lock()
+		k.err = &LeaseError{Kind: ErrLeaseLost, LeaseID: k.leaseID, Err: err}
+		k.lock.Unlock()
+		k.cancel()
+		return
+	}
+}
+
+// isTransientLeaseError reports whether a renewal failed without the service saying the lease is lost: a transport
+// error, a timeout (408) or a server error (5xx) that outlasted the pipeline's retries. Other responses, such as
+// LeaseIdMismatchWithLeaseOperation, LeaseNotPresentWithLeaseOperation, LeaseIsBrokenAndCannotBeRenewed and
+// LeaseLost, mean the lease is gone.
+func isTransientLeaseError(err error) bool {
+	var stgErr StorageError
+	if !errors.As(err, &stgErr) || stgErr.Response() == nil {
+		return true
+	}
+	status := stgErr.Response().StatusCode
+	return status == http.StatusRequestTimeout || status >= http.StatusInternalServerError
+}
+
+// LeaseID returns the ID of the lease.
+func (k *LeaseKeeper) LeaseID() string {
+	return k.leaseID
+}
+
+// AccessConditions returns the lease access conditions that operations on the leased blob or container need.
+func (k *LeaseKeeper) AccessConditions() LeaseAccessConditions {
+	return LeaseAccessConditions{LeaseID: k.leaseID}
+}
+
+// Context returns a context that is cancelled when the lease is lost or the keeper is closed.
+func (k *LeaseKeeper) Context() context.Context {
+	return k.ctx
+}
+
+// Err returns a LeaseError of ErrLeaseLost if the lease was lost, or nil.
+func (k *LeaseKeeper) Err() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.err
+}
+
+// Close stops renewing the lease and releases it, unless it was lost; it returns Err if so. Closing a closed keeper
+// does nothing.
+func (k *LeaseKeeper) Close(ctx context.Context) error {
+	k.lock.Lock()
+	if k.closed {
+		k.lock.Unlock()
+		return nil
+	}
+	k.closed = true
+	k.lock.Unlock()
+
+	close(k.stop)
+	<-k.done
+	defer k.cancel()
+	if err := k.Err(); err != nil {
+		return err
+	}
+	return k.release(ctx, k.leaseID)
+}
@@ -0,0 +1,304 @@
+package lifecycle
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Action is an action of a lifecycle rule.
+type Action string
+
+const (
+	ActionTierToCool    Action = "tierToCool"
+	ActionTierToCold    Action = "tierToCold"
+	ActionTierToArchive Action = "tierToArchive"
+	ActionDelete        Action = "delete"
+)
+
+// accessTierCold is the cold tier, which the service version of azblob doesn't define.
+const accessTierCold azblob.AccessTierType = "Cold"
+
+// Tier returns the tier that the action moves a blob to, or azblob.AccessTierNone for ActionDelete.
+func (a Action) Tier() azblob.AccessTierType {
+	switch a {
+	case ActionTierToCool:
+		return azblob.AccessTierCool
+	case ActionTierToCold:
+		return accessTierCold
+	case ActionTierToArchive:
+		return azblob.AccessTierArchive
+	}
+	return azblob.AccessTierNone
+}
+
+// tierRanks orders the tiers from the hottest. Actions only move blobs to colder tiers.
+var tierRanks = map[azblob.AccessTierType]int{
+	azblob.AccessTierHot:     0,
+	azblob.AccessTierCool:    1,
+	accessTierCold:           2,
+	azblob.AccessTierArchive: 3,
+}
+
+// itemKind is what a listed blob is: a base blob, a snapshot or a previous version.
+type itemKind string
+
+const (
+	baseBlobs itemKind = "baseBlob"
+	snapshots itemKind = "snapshot"
+	versions  itemKind = "version"
+)
+
+// ruleAction is an action of a rule on a kind of item, and its condition.
+type ruleAction struct {
+	kind      itemKind
+	action    Action
+	condition *Condition
+}
+
+// ruleActions returns the actions of a rule, cheapest first: when several actions apply to a blob, the service takes
+// the cheapest one.
+func ruleActions(a Actions) []ruleAction {
+	actions := []ruleAction{}
+	if b := a.BaseBlob; b != nil {
+		actions = append(actions, ruleAction{baseBlobs, ActionDelete, b.Delete}, ruleAction{baseBlobs, ActionTierToArchive, b.TierToArchive},
+			ruleAction{baseBlobs, ActionTierToCold, b.TierToCold}, ruleAction{baseBlobs, ActionTierToCool, b.TierToCool})
+	}
+	for _, h := range []struct {
+		kind    itemKind
+		actions *HistoryActions
+	}{{snapshots, a.Snapshot}, {versions, a.Version}} {
+		if h.actions != nil {
+			actions = append(actions, ruleAction{h.kind, ActionDelete, h.actions.Delete}, ruleAction{h.kind, ActionTierToArchive, h.actions.TierToArchive},
+				ruleAction{h.kind, ActionTierToCold, h.actions.TierToCold}, ruleAction{h.kind, ActionTierToCool, h.actions.TierToCool})
+		}
+	}
+	return actions
+}
+
+// Decision is an action that a policy takes on a blob, snapshot or version.
+type Decision struct {
+	Name string
+
+	// VersionID is the ID of the previous version the action is on, if any.
+	VersionID string
+
+	// Snapshot is the timestamp of the snapshot the action is on, if any.
+	Snapshot string
+
+	// Rule is the name of the rule whose action it is.
+	Rule   string
+	Action Action
+
+	// ETag is the blob's ETag when it was listed. Apply only deletes a base blob if it hasn't changed since.
+	ETag azblob.ETag
+
+	// Err is the error applying the action, if Apply failed to.
+	Err error
+}
+
+// Evaluate returns the action the policy takes on a blob of the container, as listed with its versions, snapshots
+// and tags, at the time now. It returns false if the policy takes no action on it.
+//
+// Ages are measured from the blob's last modified, creation, last access and tier change times, and from a
+// snapshot's or version's timestamp. A blob without a last access time, because access time tracking is off, is
+// taken as last accessed when it was created. When several actions apply, the cheapest is taken, as the service
+// does: deleting, then moving to the archive, cold and cool tiers; moving a blob to its tier or a warmer one is never
+// taken.
+func (p *Policy) Evaluate(container string, item *azblob.BlobItemInternal, now time.Time) (Decision, bool) {
+	if item.Deleted {
+		return Decision{}, false
+	}
+	kind, created := baseBlobs, item.Properties.CreationTime
+	if item.Snapshot != "" {
+		kind, created = snapshots, parseTimestamp(item.Snapshot)
+	} else if item.VersionID != nil && (item.IsCurrentVersion == nil || !*item.IsCurrentVersion) {
+		kind, created = versions, parseTimestamp(*item.VersionID)
+	}
+	tier := item.Properties.AccessTier
+	if tier == azblob.AccessTierNone {
+		tier = azblob.AccessTierHot
+	}
+
+	var d Decision
+	found := false
+	for _, r := range p.Rules {
+		if !r.IsEnabled() || !r.Definition.Filters.match(container, item) {
+			continue
+		}
+		for _, a := range ruleActions(r.Definition.Actions) {
+			if a.kind != kind || a.condition == nil || (found && actionCost(a.action) >= actionCost(d.Action)) {
+				continue
+			}
+			if a.action != ActionDelete && tierRanks[a.action.Tier()] <= tierRanks[tier] {
+				continue
+			}
+			if a.condition.met(item, created, now) {
+				d, found = Decision{Name: item.Name, Rule: r.Name, Action: a.action}, true
+				break
+			}
+		}
+	}
+	if !found {
+		return Decision{}, false
+	}
+	switch kind {
+	case snapshots:
+		d.Snapshot = item.Snapshot
+	case versions:
+		d.VersionID = *item.VersionID
+	default:
+		d.ETag = item.Properties.Etag
+	}
+	return d, true
+}
+
+// actionCost orders the actions from the cheapest.
+func actionCost(a Action) int {
+	if a == ActionDelete {
+		return 0
+	}
+	return len(tierRanks) - tierRanks[a.Tier()]
+}
+
+// parseTimestamp parses a snapshot's timestamp or a version's ID.
+func parseTimestamp(s string) *time.Time {
+	t, err := time.Parse(azblob.SnapshotTimeFormat, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// match reports whether the filters select the blob.
+func (f Filters) match(container string, item *azblob.BlobItemInternal) bool {
+	blobType := ""
+	switch item.Properties.BlobType {
+	case azblob.BlobBlockBlob:
+		blobType = "blockBlob"
+	case azblob.BlobAppendBlob:
+		blobType = "appendBlob"
+	}
+	if !contains(f.BlobTypes, blobType) {
+		return false
+	}
+	if len(f.PrefixMatch) > 0 {
+		matched := false
+		for _, prefix := range f.PrefixMatch {
+			matched = matched || strings.HasPrefix(container+"/"+item.Name, prefix)
+		}
+		if !matched {
+			return false
+		}
+	}
+	tags := map[string]string{}
+	if item.BlobTags != nil {
+		for _, t := range item.BlobTags.BlobTagSet {
+			tags[t.Key] = t.Value
+		}
+	}
+	for _, m := range f.BlobIndexMatch {
+		if value, ok := tags[m.Name]; !ok || value != m.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// met reports whether the item is old enough for the condition. created is when the item was created, if known.
+func (c Condition) met(item *azblob.BlobItemInternal, created *time.Time, now time.Time) bool {
+	olderThan := func(t *time.Time, days *int) bool {
+		return t != nil && now.Sub(*t) > time.Duration(*days)*24*time.Hour
+	}
+	p := item.Properties
+	switch {
+	case c.DaysAfterModificationGreaterThan != nil && !olderThan(&p.LastModified, c.DaysAfterModificationGreaterThan):
+		return false
+	case c.DaysAfterCreationGreaterThan != nil && !olderThan(created, c.DaysAfterCreationGreaterThan):
+		return false
+	case c.DaysAfterLastTierChangeGreaterThan != nil && p.AccessTierChangeTime != nil && !olderThan(p.AccessTierChangeTime, c.DaysAfterLastTierChangeGreaterThan):
+		return false
+	case c.DaysAfterLastAccessTimeGreaterThan != nil:
+		accessed := p.LastAccessedOn
+		if accessed == nil {
+			accessed = p.CreationTime
+		}
+		return olderThan(accessed, c.DaysAfterLastAccessTimeGreaterThan)
+	}
+	return true
+}
+
+// Options identifies options used by Run.
+type Options struct {
+	// Now is the time the policy is evaluated at (zero=the current time).
+	Now time.Time
+
+	// Apply applies the actions; otherwise Run only returns them.
+	Apply bool
+
+	// Parallelism indicates the maximum number of actions to apply in parallel (0=default)
+	Parallelism uint16
+}
+
+// Run lists the container's blobs, with their versions, snapshots and index tags, and returns the actions that the
+// policy takes on them, in listing order. If o.Apply is set, it applies them too; see Apply.
+func Run(ctx context.Context, c azblob.ContainerURL, p *Policy, o Options) ([]Decision, error) {
+	if o.Now.IsZero() {
+		o.Now = time.Now()
+	}
+	container := azblob.NewBlobURLParts(c.URL()).ContainerName
+	decisions := []Decision{}
+	pager := c.NewBlobPager(azblob.ListBlobsSegmentOptions{Details: azblob.BlobListingDetails{Versions: true, Snapshots: true, Tags: true}})
+	for pager.Next(ctx) {
+		if d, ok := p.Evaluate(container, pager.Item(), o.Now); ok {
+			decisions = append(decisions, d)
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return nil, err
+	}
+	if o.Apply {
+		return decisions, Apply(ctx, c, decisions, o.Parallelism)
+	}
+	return decisions, nil
+}
+
+// Apply applies the actions to the container's blobs with Set Blob Tier and Delete Blob, and sets the Err of the
+// decisions whose action failed. Base blobs are only deleted if their ETag is still the listed one; a blob that has
+// snapshots isn't deleted. The returned error is only for ctx being done.
+func Apply(ctx context.Context, c azblob.ContainerURL, decisions []Decision, parallelism uint16) error {
+	return azblob.DoBatchTransfer(ctx, azblob.BatchTransferOptions{
+		OperationName: "lifecycle",
+		TransferSize:  int64(len(decisions)),
+		ChunkSize:     1,
+		Parallelism:   parallelism,
+		Operation: func(offset int64, count int64, ctx context.Context) error {
+			d := &decisions[offset]
+			b := c.NewBlobURL(d.Name)
+			switch {
+			case d.Snapshot != "":
+				b = b.WithSnapshot(d.Snapshot)
+			case d.VersionID != "":
+				b = b.WithVersionID(d.VersionID)
+			}
+			if d.Action == ActionDelete {
+				_, d.Err = b.Delete(ctx, azblob.DeleteSnapshotsOptionNone,
+					azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: d.ETag}})
+			} else {
+				_, d.Err = b.SetTier(ctx, d.Action.Tier(), azblob.LeaseAccessConditions{}, azblob.RehydratePriorityNone)
+			}
+			return ctx.Err()
+		},
+	})
+}
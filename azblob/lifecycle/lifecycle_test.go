@@ -0,0 +1,236 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	chk "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { chk.TestingT(t) }
+
+type lifecycleSuite struct{}
+
+var _ = chk.Suite(&lifecycleSuite{})
+
+var now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+const testPolicy = `{
+  "properties": {
+    "policy": {
+      "rules": [
+        {
+          "name": "logs",
+          "type": "Lifecycle",
+          "definition": {
+            "filters": {"blobTypes": ["blockBlob"], "prefixMatch": ["logs/app/"]},
+            "actions": {
+              "baseBlob": {
+                "tierToCool": {"daysAfterModificationGreaterThan": 30},
+                "tierToArchive": {"daysAfterModificationGreaterThan": 90, "daysAfterLastTierChangeGreaterThan": 7},
+                "delete": {"daysAfterModificationGreaterThan": 365}
+              },
+              "snapshot": {"delete": {"daysAfterCreationGreaterThan": 10}},
+              "version": {"tierToCool": {"daysAfterCreationGreaterThan": 5}}
+            }
+          }
+        },
+        {
+          "name": "temp",
+          "type": "Lifecycle",
+          "definition": {
+            "filters": {"blobTypes": ["blockBlob", "appendBlob"], "blobIndexMatch": [{"name": "retain", "op": "==", "value": "no"}]},
+            "actions": {"baseBlob": {"delete": {"daysAfterCreationGreaterThan": 1}}}
+          }
+        },
+        {
+          "enabled": false,
+          "name": "disabled",
+          "type": "Lifecycle",
+          "definition": {
+            "filters": {"blobTypes": ["blockBlob"]},
+            "actions": {"baseBlob": {"delete": {"daysAfterModificationGreaterThan": 0}}}
+          }
+        }
+      ]
+    }
+  }
+}`
+
+func daysAgo(days int) *time.Time {
+	t := now.Add(-time.Duration(days) * 24 * time.Hour)
+	return &t
+}
+
+func baseBlob(name string, modifiedDaysAgo int, tier azblob.AccessTierType, tags azblob.BlobTagsMap) *azblob.BlobItemInternal {
+	item := &azblob.BlobItemInternal{Name: name, Properties: azblob.BlobPropertiesInternal{
+		BlobType:     azblob.BlobBlockBlob,
+		CreationTime: daysAgo(modifiedDaysAgo),
+		LastModified: *daysAgo(modifiedDaysAgo),
+		Etag:         azblob.ETag(`"` + name + `"`),
+		AccessTier:   tier,
+	}}
+	if len(tags) > 0 {
+		blobTags := azblob.SerializeBlobTags(tags)
+		item.BlobTags = &blobTags
+	}
+	return item
+}
+
+func (s *lifecycleSuite) TestParseValidatesPolicies(c *chk.C) {
+	p, err := Parse([]byte(testPolicy))
+	c.Assert(err, chk.IsNil)
+	c.Assert(p.Rules, chk.HasLen, 3)
+	c.Assert(*p.Rules[0].Definition.Actions.BaseBlob.TierToArchive.DaysAfterLastTierChangeGreaterThan, chk.Equals, 7)
+	c.Assert(p.Rules[1].IsEnabled(), chk.Equals, true)
+	c.Assert(p.Rules[2].IsEnabled(), chk.Equals, false)
+
+	rule := func(filters, actions string) string {
+		return `{"rules": [{"name": "r", "type": "Lifecycle", "definition": {"filters": ` + filters + `, "actions": ` + actions + `}}]}`
+	}
+	for _, invalid := range []string{
+		`{"rules": []}`,
+		rule(`{}`, `{"baseBlob": {"delete": {"daysAfterModificationGreaterThan": 1}}}`),
+		rule(`{"blobTypes": ["pageBlob"]}`, `{"baseBlob": {"delete": {"daysAfterModificationGreaterThan": 1}}}`),
+		rule(`{"blobTypes": ["appendBlob"]}`, `{"baseBlob": {"tierToCool": {"daysAfterModificationGreaterThan": 1}}}`),
+		rule(`{"blobTypes": ["blockBlob"], "blobIndexMatch": [{"name": "a", "op": ">", "value": "1"}]}`, `{"baseBlob": {"delete": {"daysAfterModificationGreaterThan": 1}}}`),
+		rule(`{"blobTypes": ["blockBlob"]}`, `{}`),
+		rule(`{"blobTypes": ["blockBlob"]}`, `{"baseBlob": {"delete": {}}}`),
+		rule(`{"blobTypes": ["blockBlob"]}`, `{"baseBlob": {"delete": {"daysAfterModificationGreaterThan": 1, "daysAfterCreationGreaterThan": 1}}}`),
+		rule(`{"blobTypes": ["blockBlob"]}`, `{"snapshot": {"delete": {"daysAfterModificationGreaterThan": 1}}}`),
+		rule(`{"blobTypes": ["blockBlob"]}`, `{"baseBlob": {"tierToCool": {"daysAfterModificationGreaterThan": 1, "daysAfterLastTierChangeGreaterThan": 1}}}`),
+	} {
+		_, err := Parse([]byte(invalid))
+		c.Assert(err, chk.NotNil, chk.Commentf("%s", invalid))
+	}
+}
+
+func (s *lifecycleSuite) TestEvaluateTakesCheapestAction(c *chk.C) {
+	p, err := Parse([]byte(testPolicy))
+	c.Assert(err, chk.IsNil)
+	versionID := daysAgo(6).Format(azblob.SnapshotTimeFormat)
+	version := baseBlob("app/1", 100, azblob.AccessTierHot, nil)
+	version.VersionID = &versionID
+	snapshot := baseBlob("app/1", 100, azblob.AccessTierHot, nil)
+	snapshot.Snapshot = daysAgo(11).Format(azblob.SnapshotTimeFormat)
+	recentlyTiered := baseBlob("app/tiered", 100, azblob.AccessTierCool, nil)
+	recentlyTiered.Properties.AccessTierChangeTime = daysAgo(3)
+	appendBlob := baseBlob("other/append", 2, azblob.AccessTierNone, azblob.BlobTagsMap{"retain": "no"})
+	appendBlob.Properties.BlobType = azblob.BlobAppendBlob
+	deleted := baseBlob("app/deleted", 1000, azblob.AccessTierHot, nil)
+	deleted.Deleted = true
+
+	for _, test := range []struct {
+		item     *azblob.BlobItemInternal
+		decision *Decision
+	}{
+		{baseBlob("app/new", 10, azblob.AccessTierHot, nil), nil},
+		{baseBlob("app/old", 31, azblob.AccessTierHot, nil), &Decision{Name: "app/old", Rule: "logs", Action: ActionTierToCool, ETag: `"app/old"`}},
+		{baseBlob("app/older", 91, azblob.AccessTierHot, nil), &Decision{Name: "app/older", Rule: "logs", Action: ActionTierToArchive, ETag: `"app/older"`}},
+		{baseBlob("app/oldest", 400, azblob.AccessTierArchive, nil), &Decision{Name: "app/oldest", Rule: "logs", Action: ActionDelete, ETag: `"app/oldest"`}},
+		// Blobs aren't moved to their tier or a warmer one.
+		{baseBlob("app/cool", 31, azblob.AccessTierCool, nil), nil},
+		{recentlyTiered, nil},
+		{baseBlob("web/old", 400, azblob.AccessTierHot, nil), nil},
+		// Deleting is cheaper than tiering, whichever rule it's from.
+		{baseBlob("app/temp", 31, azblob.AccessTierHot, azblob.BlobTagsMap{"retain": "no"}), &Decision{Name: "app/temp", Rule: "temp", Action: ActionDelete, ETag: `"app/temp"`}},
+		{appendBlob, &Decision{Name: "other/append", Rule: "temp", Action: ActionDelete, ETag: `"other/append"`}},
+		{snapshot, &Decision{Name: "app/1", Snapshot: snapshot.Snapshot, Rule: "logs", Action: ActionDelete}},
+		{version, &Decision{Name: "app/1", VersionID: versionID, Rule: "logs", Action: ActionTierToCool}},
+		{deleted, nil},
+	} {
+		d, ok := p.Evaluate("logs", test.item, now)
+		if test.decision == nil {
+			c.Assert(ok, chk.Equals, false, chk.Commentf("%s: %+v", test.item.Name, d))
+			continue
+		}
+		c.Assert(ok, chk.Equals, true, chk.Commentf("%s", test.item.Name))
+		c.Assert(d, chk.DeepEquals, *test.decision)
+	}
+}
+
+// blobServer serves listings of the blobs and records the other requests.
+type blobServer struct {
+	lock     sync.Mutex
+	blobs    []string
+	requests []string
+}
+
+func (s *blobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := r.URL.Query()
+	if r.Method == http.MethodGet && q.Get("comp") == "list" {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`+strings.Join(s.blobs, "")+`</Blobs><NextMarker/></EnumerationResults>`)
+		return
+	}
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	s.requests = append(s.requests, fmt.Sprintf("%s %s comp=%s snapshot=%s if-match=%s tier=%s", r.Method, name, q.Get("comp"),
+		q.Get("snapshot"), r.Header.Get("If-Match"), r.Header.Get("x-ms-access-tier")))
+	if name == "fails" {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeConditionNotMet))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *lifecycleSuite) TestRunAppliesActions(c *chk.C) {
+	listed := func(name, snapshot string, modified time.Time) string {
+		return fmt.Sprintf(`<Blob><Name>%s</Name><Snapshot>%s</Snapshot><Properties><Last-Modified>%s</Last-Modified><Etag>"%s"</Etag>`+
+			`<BlobType>BlockBlob</BlobType><AccessTier>Hot</AccessTier></Properties></Blob>`, name, snapshot, modified.Format(http.TimeFormat), name)
+	}
+	snapshot := daysAgo(11).Format(azblob.SnapshotTimeFormat)
+	server := &blobServer{blobs: []string{
+		listed("cool", "", *daysAgo(31)),
+		listed("delete", "", *daysAgo(400)),
+		listed("delete", snapshot, *daysAgo(400)),
+		listed("fails", "", *daysAgo(400)),
+		listed("new", "", *daysAgo(1)),
+	}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL + "/account/logs")
+	containerURL := azblob.NewContainerURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	p, err := Parse([]byte(`{"rules": [{"name": "app", "type": "Lifecycle", "definition": {"filters": {"blobTypes": ["blockBlob"]}, "actions": {` +
+		`"baseBlob": {"tierToCool": {"daysAfterModificationGreaterThan": 30}, "delete": {"daysAfterModificationGreaterThan": 365}},` +
+		`"snapshot": {"delete": {"daysAfterCreationGreaterThan": 10}}}}}]}`))
+	c.Assert(err, chk.IsNil)
+
+	decisions, err := Run(context.Background(), containerURL, p, Options{Now: now})
+	c.Assert(err, chk.IsNil)
+	c.Assert(decisions, chk.HasLen, 4)
+	c.Assert(server.requests, chk.HasLen, 0)
+
+	decisions, err = Run(context.Background(), containerURL, p, Options{Now: now, Apply: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(decisions, chk.HasLen, 4)
+	for _, d := range decisions {
+		if d.Name == "fails" {
+			c.Assert(d.Err, chk.NotNil)
+		} else {
+			c.Assert(d.Err, chk.IsNil)
+		}
+	}
+	sort.Strings(server.requests)
+	c.Assert(server.requests, chk.DeepEquals, []string{
+		`DELETE delete comp= snapshot= if-match="delete" tier=`,
+		`DELETE delete comp= snapshot=` + snapshot + ` if-match= tier=`,
+		`DELETE fails comp= snapshot= if-match="fails" tier=`,
+		`PUT cool comp=tier snapshot= if-match= tier=Cool`,
+	})
+}
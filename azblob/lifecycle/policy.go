@@ -0,0 +1,210 @@
+// Package lifecycle evaluates Azure Storage lifecycle management policies on the client, to see what a policy would
+// do to a container's blobs before deploying it, or to apply it where the service doesn't, such as on the storage
+// emulator.
+//
+// For more information, see https://docs.microsoft.com/azure/storage/blobs/lifecycle-management-overview.
+package lifecycle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Policy is a lifecycle management policy, as the JSON of its rules.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule is a rule of a lifecycle management policy.
+type Rule struct {
+	// Enabled disables the rule if it's false. A rule without it is enabled.
+	Enabled *bool  `json:"enabled,omitempty"`
+	Name    string `json:"name"`
+
+	// Type is always "Lifecycle".
+	Type       string     `json:"type"`
+	Definition Definition `json:"definition"`
+}
+
+// IsEnabled reports whether the rule is enabled.
+func (r Rule) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// Definition is what a rule applies to and what it does.
+type Definition struct {
+	Actions Actions `json:"actions"`
+	Filters Filters `json:"filters"`
+}
+
+// Filters select the blobs a rule applies to.
+type Filters struct {
+	// BlobTypes are the types of blobs the rule applies to: "blockBlob" or "appendBlob".
+	BlobTypes []string `json:"blobTypes"`
+
+	// PrefixMatch, if set, limits the rule to the blobs whose container name, a slash and blob name start with one of
+	// the prefixes.
+	PrefixMatch []string `json:"prefixMatch,omitempty"`
+
+	// BlobIndexMatch, if set, limits the rule to the blobs with all of the index tags.
+	BlobIndexMatch []TagMatch `json:"blobIndexMatch,omitempty"`
+}
+
+// TagMatch is a condition on a blob's index tag.
+type TagMatch struct {
+	Name string `json:"name"`
+
+	// Op is always "==".
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// Actions are the actions of a rule on base blobs, snapshots and previous versions.
+type Actions struct {
+	BaseBlob *BaseBlobActions `json:"baseBlob,omitempty"`
+	Snapshot *HistoryActions  `json:"snapshot,omitempty"`
+	Version  *HistoryActions  `json:"version,omitempty"`
+}
+
+// BaseBlobActions are the actions of a rule on base blobs.
+type BaseBlobActions struct {
+	TierToCool    *Condition `json:"tierToCool,omitempty"`
+	TierToCold    *Condition `json:"tierToCold,omitempty"`
+	TierToArchive *Condition `json:"tierToArchive,omitempty"`
+	Delete        *Condition `json:"delete,omitempty"`
+
+	// EnableAutoTierToHotFromCool moves a blob back to the hot tier when it's accessed. It's kept when a policy is
+	// parsed but not evaluated, since it happens on access.
+	EnableAutoTierToHotFromCool bool `json:"enableAutoTierToHotFromCool,omitempty"`
+}
+
+// HistoryActions are the actions of a rule on snapshots or previous versions.
+type HistoryActions struct {
+	TierToCool    *Condition `json:"tierToCool,omitempty"`
+	TierToCold    *Condition `json:"tierToCold,omitempty"`
+	TierToArchive *Condition `json:"tierToArchive,omitempty"`
+	Delete        *Condition `json:"delete,omitempty"`
+}
+
+// Condition is the age at which a rule's action applies. A condition has one of DaysAfterModificationGreaterThan,
+// DaysAfterCreationGreaterThan and DaysAfterLastAccessTimeGreaterThan; snapshots and versions only have
+// DaysAfterCreationGreaterThan. DaysAfterLastTierChangeGreaterThan can be added to a TierToArchive condition.
+type Condition struct {
+	DaysAfterModificationGreaterThan   *int `json:"daysAfterModificationGreaterThan,omitempty"`
+	DaysAfterCreationGreaterThan       *int `json:"daysAfterCreationGreaterThan,omitempty"`
+	DaysAfterLastAccessTimeGreaterThan *int `json:"daysAfterLastAccessTimeGreaterThan,omitempty"`
+	DaysAfterLastTierChangeGreaterThan *int `json:"daysAfterLastTierChangeGreaterThan,omitempty"`
+}
+
+// Parse parses and validates the JSON of a lifecycle management policy: either the policy itself or a management
+// policy resource, whose "properties" or top level has the policy in "policy".
+func Parse(data []byte) (*Policy, error) {
+	var wrapper struct {
+		Policy     *Policy `json:"policy"`
+		Properties *struct {
+			Policy *Policy `json:"policy"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return nil, err
+	}
+	p := wrapper.Policy
+	if p == nil && wrapper.Properties != nil {
+		p = wrapper.Properties.Policy
+	}
+	if p == nil {
+		p = &Policy{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks the policy against the rules the service enforces when a policy is set.
+func (p *Policy) Validate() error {
+	if len(p.Rules) == 0 {
+		return errors.New("a lifecycle policy must have at least one rule")
+	}
+	names := map[string]bool{}
+	for _, r := range p.Rules {
+		if r.Name == "" {
+			return errors.New("a lifecycle rule must have a name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("there's more than one lifecycle rule named %q", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("lifecycle rule %q: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r Rule) validate() error {
+	if r.Type != "Lifecycle" {
+		return fmt.Errorf("the type %q isn't Lifecycle", r.Type)
+	}
+	f, a := r.Definition.Filters, r.Definition.Actions
+	if len(f.BlobTypes) == 0 {
+		return errors.New("the filters must have blobTypes")
+	}
+	onlyDelete := false
+	for _, t := range f.BlobTypes {
+		switch t {
+		case "blockBlob":
+		case "appendBlob":
+			onlyDelete = true
+		default:
+			return fmt.Errorf("the blob type %q isn't blockBlob or appendBlob", t)
+		}
+	}
+	for _, m := range f.BlobIndexMatch {
+		if m.Op != "==" {
+			return fmt.Errorf("the blob index match on %q has the operator %q rather than ==", m.Name, m.Op)
+		}
+	}
+	if a.BaseBlob == nil && a.Snapshot == nil && a.Version == nil {
+		return errors.New("the rule has no actions")
+	}
+	for _, s := range ruleActions(a) {
+		if s.condition == nil {
+			continue
+		}
+		if onlyDelete && s.action != ActionDelete {
+			return fmt.Errorf("the %s action of %s isn't supported for append blobs", s.action, s.kind)
+		}
+		if err := s.condition.validate(s.kind, s.action); err != nil {
+			return fmt.Errorf("the %s action of %s: %w", s.action, s.kind, err)
+		}
+	}
+	return nil
+}
+
+func (c Condition) validate(kind itemKind, action Action) error {
+	ages := 0
+	for _, days := range []*int{c.DaysAfterModificationGreaterThan, c.DaysAfterCreationGreaterThan, c.DaysAfterLastAccessTimeGreaterThan} {
+		if days != nil {
+			if *days < 0 {
+				return errors.New("the number of days is negative")
+			}
+			ages++
+		}
+	}
+	switch {
+	case ages != 1:
+		return errors.New("the condition must have exactly one of daysAfterModificationGreaterThan, daysAfterCreationGreaterThan and daysAfterLastAccessTimeGreaterThan")
+	case kind != baseBlobs && c.DaysAfterCreationGreaterThan == nil:
+		return errors.New("the condition must be daysAfterCreationGreaterThan")
+	case c.DaysAfterLastTierChangeGreaterThan != nil && action != ActionTierToArchive:
+		return errors.New("daysAfterLastTierChangeGreaterThan is only supported for tierToArchive")
+	case c.DaysAfterLastTierChangeGreaterThan != nil && *c.DaysAfterLastTierChangeGreaterThan < 0:
+		return errors.New("the number of days is negative")
+	}
+	return nil
+}
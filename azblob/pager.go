@@ -0,0 +1,384 @@
+package azblob
+
+import (
+	"context"
+	"sort"
+)
+
+// The pagers in this file iterate over listings so that callers don't have to loop over the Marker of each segment.
+// A segment pager returns a listing a segment at a time; its Marker can be persisted and passed to the pager's
+// constructor later to resume the listing where it left off. An item pager returns a listing an item at a time:
+//
+//	pager := containerURL.NewBlobPager(ListBlobsSegmentOptions{Prefix: "logs/"})
+//	for pager.Next(ctx) {
+//		blob := pager.Item()
+//		...
+//	}
+//	if err := pager.Err(); err != nil {
+//		...
+//	}
+
+// segmentPager holds the state shared by the pagers: the marker of the next segment and the error that stopped the
+// listing.
+type segmentPager struct {
+	marker Marker
+	err    error
+}
+
+// Marker returns the marker of the next segment to list. Passing it to a pager's constructor resumes the listing
+// with that segment. Once the listing is done, the marker's NotDone returns false.
+func (p *segmentPager) Marker() Marker {
+	return p.marker
+}
+
+// Err returns the error that stopped the listing, or nil if the listing is done or hasn't failed.
+func (p *segmentPager) Err() error {
+	return p.err
+}
+
+// next lists the segment at the pager's marker with fetch, which returns the marker of the segment after it.
+// It returns false once the listing is done, the context is canceled or listing fails.
+func (p *segmentPager) next(ctx context.Context, fetch func(ctx context.Context, marker Marker) (Marker, error)) bool {
+	if p.err != nil || !p.marker.NotDone() {
+		return false
+	}
+	if p.err = ctx.Err(); p.err != nil {
+		return false
+	}
+	next, err := fetch(ctx, p.marker)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	if next.Val == nil { // A segment without a NextMarker is the last one
+		done := ""
+		next.Val = &done
+	}
+	p.marker = next
+	return true
+}
+
+// nextItem moves index to the next of the count items of the current segment, listing segments with nextPage until
+// one that has items is found. It returns false once the listing is done, the context is canceled or listing fails.
+func (p *segmentPager) nextItem(ctx context.Context, index *int, count func() int, nextPage func(ctx context.Context) bool) bool {
+	if p.err != nil {
+		return false
+	}
+	if p.err = ctx.Err(); p.err != nil {
+		return false
+	}
+	*index++
+	for *index >= count() {
+		if !nextPage(ctx) {
+			return false
+		}
+		*index = 0
+	}
+	return true
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// BlobFlatSegmentPager lists the blobs of a container a segment at a time.
+type BlobFlatSegmentPager struct {
+	segmentPager
+	c    ContainerURL
+	o    ListBlobsSegmentOptions
+	page *ListBlobsFlatSegmentResponse
+}
+
+// NewBlobFlatSegmentPager returns a pager that lists the blobs of the container a segment at a time, starting with
+// the segment at the marker. Use an empty Marker to start from the beginning.
+func (c ContainerURL) NewBlobFlatSegmentPager(marker Marker, o ListBlobsSegmentOptions) *BlobFlatSegmentPager {
+	return &BlobFlatSegmentPager{segmentPager: segmentPager{marker: marker}, c: c, o: o}
+}
+
+// NextPage lists the next segment. It returns false once the listing is done or has failed; Err then returns the
+// error, if any.
+func (p *BlobFlatSegmentPager) NextPage(ctx context.Context) bool {
+	return p.next(ctx, func(ctx context.Context, marker Marker) (Marker, error) {
+		page, err := p.c.ListBlobsFlatSegment(ctx, marker, p.o)
+		if err != nil {
+			return Marker{}, err
+		}
+		p.page = page
+		return page.NextMarker, nil
+	})
+}
+
+// Page returns the segment listed by the last call to NextPage.
+func (p *BlobFlatSegmentPager) Page() *ListBlobsFlatSegmentResponse {
+	return p.page
+}
+
+// BlobPager lists the blobs of a container one at a time.
+type BlobPager struct {
+	pages *BlobFlatSegmentPager
+	index int
+}
+
+// NewBlobPager returns a pager that lists the blobs of the container one at a time. MaxResults sets the number of
+// blobs listed by each request.
+func (c ContainerURL) NewBlobPager(o ListBlobsSegmentOptions) *BlobPager {
+	return &BlobPager{pages: c.NewBlobFlatSegmentPager(Marker{}, o), index: -1}
+}
+
+// Next moves to the next blob, listing the next segment if needed. It returns false once there are no more blobs or
+// listing has failed; Err then returns the error, if any.
+func (p *BlobPager) Next(ctx context.Context) bool {
+	return p.pages.nextItem(ctx, &p.index, func() int {
+		if p.pages.page == nil {
+			return 0
+		}
+		return len(p.pages.page.Segment.BlobItems)
+	}, p.pages.NextPage)
+}
+
+// Item returns the current blob.
+func (p *BlobPager) Item() *BlobItemInternal {
+	return &p.pages.page.Segment.BlobItems[p.index]
+}
+
+// Err returns the error that stopped the listing, or nil.
+func (p *BlobPager) Err() error {
+	return p.pages.Err()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// BlobHierarchySegmentPager lists the blobs and virtual directories of a container a segment at a time.
+type BlobHierarchySegmentPager struct {
+	segmentPager
+	c         ContainerURL
+	delimiter string
+	o         ListBlobsSegmentOptions
+	page      *ListBlobsHierarchySegmentResponse
+}
+
+// NewBlobHierarchySegmentPager returns a pager that lists the blobs and virtual directories of the container a
+// segment at a time, starting with the segment at the marker. Use an empty Marker to start from the beginning.
+func (c ContainerURL) NewBlobHierarchySegmentPager(marker Marker, delimiter string, o ListBlobsSegmentOptions) *BlobHierarchySegmentPager {
+	return &BlobHierarchySegmentPager{segmentPager: segmentPager{marker: marker}, c: c, delimiter: delimiter, o: o}
+}
+
+// NextPage lists the next segment. It returns false once the listing is done or has failed; Err then returns the
+// error, if any.
+func (p *BlobHierarchySegmentPager) NextPage(ctx context.Context) bool {
+	return p.next(ctx, func(ctx context.Context, marker Marker) (Marker, error) {
+		page, err := p.c.ListBlobsHierarchySegment(ctx, marker, p.delimiter, p.o)
+		if err != nil {
+			return Marker{}, err
+		}
+		p.page = page
+		return page.NextMarker, nil
+	})
+}
+
+// Page returns the segment listed by the last call to NextPage.
+func (p *BlobHierarchySegmentPager) Page() *ListBlobsHierarchySegmentResponse {
+	return p.page
+}
+
+// BlobHierarchyItem is a virtual directory or a blob of a hierarchy listing; exactly one of Prefix and Blob is set.
+type BlobHierarchyItem struct {
+	Prefix *BlobPrefix
+	Blob   *BlobItemInternal
+}
+
+// Name returns the name of the virtual directory or blob.
+func (i BlobHierarchyItem) Name() string {
+	if i.Prefix != nil {
+		return i.Prefix.Name
+	}
+	return i.Blob.Name
+}
+
+// BlobHierarchyPager lists the blobs and virtual directories of a container one at a time, in name order.
+type BlobHierarchyPager struct {
+	pages *BlobHierarchySegmentPager
+	items []BlobHierarchyItem
+	index int
+}
+
+// NewBlobHierarchyPager returns a pager that lists the blobs and virtual directories of the container one at a time.
+// MaxResults sets the number of items listed by each request.
+func (c ContainerURL) NewBlobHierarchyPager(delimiter string, o ListBlobsSegmentOptions) *BlobHierarchyPager {
+	return &BlobHierarchyPager{pages: c.NewBlobHierarchySegmentPager(Marker{}, delimiter, o), index: -1}
+}
+
+// Next moves to the next blob or virtual directory, listing the next segment if needed. It returns false once there
+// are no more items or listing has failed; Err then returns the error, if any.
+func (p *BlobHierarchyPager) Next(ctx context.Context) bool {
+	return p.pages.nextItem(ctx, &p.index, func() int { return len(p.items) }, func(ctx context.Context) bool {
+		if !p.pages.NextPage(ctx) {
+			return false
+		}
+		p.items = hierarchyItems(p.pages.page.Segment)
+		return true
+	})
+}
+
+// Item returns the current blob or virtual directory.
+func (p *BlobHierarchyPager) Item() BlobHierarchyItem {
+	return p.items[p.index]
+}
+
+// Err returns the error that stopped the listing, or nil.
+func (p *BlobHierarchyPager) Err() error {
+	return p.pages.Err()
+}
+
+// hierarchyItems returns the virtual directories and blobs of a segment in name order, the order the service lists
+// them in.
+func hierarchyItems(segment BlobHierarchyListSegment) []BlobHierarchyItem {
+	items := make([]BlobHierarchyItem, 0, len(segment.BlobPrefixes)+len(segment.BlobItems))
+	for i := range segment.BlobPrefixes {
+		items = append(items, BlobHierarchyItem{Prefix: &segment.BlobPrefixes[i]})
+	}
+	for i := range segment.BlobItems {
+		items = append(items, BlobHierarchyItem{Blob: &segment.BlobItems[i]})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Name() < items[j].Name() })
+	return items
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// ContainerSegmentPager lists the containers of an account a segment at a time.
+type ContainerSegmentPager struct {
+	segmentPager
+	s    ServiceURL
+	o    ListContainersSegmentOptions
+	page *ListContainersSegmentResponse
+}
+
+// NewContainerSegmentPager returns a pager that lists the containers of the account a segment at a time, starting
+// with the segment at the marker. Use an empty Marker to start from the beginning.
+func (s ServiceURL) NewContainerSegmentPager(marker Marker, o ListContainersSegmentOptions) *ContainerSegmentPager {
+	return &ContainerSegmentPager{segmentPager: segmentPager{marker: marker}, s: s, o: o}
+}
+
+// NextPage lists the next segment. It returns false once the listing is done or has failed; Err then returns the
+// error, if any.
+func (p *ContainerSegmentPager) NextPage(ctx context.Context) bool {
+	return p.next(ctx, func(ctx context.Context, marker Marker) (Marker, error) {
+		page, err := p.s.ListContainersSegment(ctx, marker, p.o)
+		if err != nil {
+			return Marker{}, err
+		}
+		p.page = page
+		return page.NextMarker, nil
+	})
+}
+
+// Page returns the segment listed by the last call to NextPage.
+func (p *ContainerSegmentPager) Page() *ListContainersSegmentResponse {
+	return p.page
+}
+
+// ContainerPager lists the containers of an account one at a time.
+type ContainerPager struct {
+	pages *ContainerSegmentPager
+	index int
+}
+
+// NewContainerPager returns a pager that lists the containers of the account one at a time. MaxResults sets the
+// number of containers listed by each request.
+func (s ServiceURL) NewContainerPager(o ListContainersSegmentOptions) *ContainerPager {
+	return &ContainerPager{pages: s.NewContainerSegmentPager(Marker{}, o), index: -1}
+}
+
+// Next moves to the next container, listing the next segment if needed. It returns false once there are no more
+// containers or listing has failed; Err then returns the error, if any.
+func (p *ContainerPager) Next(ctx context.Context) bool {
+	return p.pages.nextItem(ctx, &p.index, func() int {
+		if p.pages.page == nil {
+			return 0
+		}
+		return len(p.pages.page.ContainerItems)
+	}, p.pages.NextPage)
+}
+
+// Item returns the current container.
+func (p *ContainerPager) Item() *ContainerItem {
+	return &p.pages.page.ContainerItems[p.index]
+}
+
+// Err returns the error that stopped the listing, or nil.
+func (p *ContainerPager) Err() error {
+	return p.pages.Err()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// BlobsByTagsSegmentPager lists the blobs of an account whose tags match an expression a segment at a time.
+type BlobsByTagsSegmentPager struct {
+	segmentPager
+	s          ServiceURL
+	where      string
+	maxResults int32
+	page       *FilterBlobSegment
+}
+
+// NewBlobsByTagsSegmentPager returns a pager that lists the blobs of the account whose tags match the where
+// expression (see FindBlobsByTags) a segment of at most maxResults blobs at a time (0 for the service's default),
+// starting with the segment at the marker. Use an empty Marker to start from the beginning.
+func (s ServiceURL) NewBlobsByTagsSegmentPager(marker Marker, where string, maxResults int32) *BlobsByTagsSegmentPager {
+	return &BlobsByTagsSegmentPager{segmentPager: segmentPager{marker: marker}, s: s, where: where, maxResults: maxResults}
+}
+
+// NextPage lists the next segment. It returns false once the listing is done or has failed; Err then returns the
+// error, if any.
+func (p *BlobsByTagsSegmentPager) NextPage(ctx context.Context) bool {
+	return p.next(ctx, func(ctx context.Context, marker Marker) (Marker, error) {
+		var maxResults *int32
+		if p.maxResults != 0 {
+			maxResults = &p.maxResults
+		}
+		page, err := p.s.FindBlobsByTags(ctx, nil, nil, &p.where, marker, maxResults)
+		if err != nil {
+			return Marker{}, err
+		}
+		p.page = page
+		return Marker{Val: page.NextMarker}, nil
+	})
+}
+
+// Page returns the segment listed by the last call to NextPage.
+func (p *BlobsByTagsSegmentPager) Page() *FilterBlobSegment {
+	return p.page
+}
+
+// BlobsByTagsPager lists the blobs of an account whose tags match an expression one at a time.
+type BlobsByTagsPager struct {
+	pages *BlobsByTagsSegmentPager
+	index int
+}
+
+// NewBlobsByTagsPager returns a pager that lists the blobs of the account whose tags match the where expression
+// (see FindBlobsByTags) one at a time. maxResults sets the number of blobs listed by each request (0 for the
+// service's default).
+func (s ServiceURL) NewBlobsByTagsPager(where string, maxResults int32) *BlobsByTagsPager {
+	return &BlobsByTagsPager{pages: s.NewBlobsByTagsSegmentPager(Marker{}, where, maxResults), index: -1}
+}
+
+// Next moves to the next blob, listing the next segment if needed. It returns false once there are no more blobs or
+// listing has failed; Err then returns the error, if any.
+func (p *BlobsByTagsPager) Next(ctx context.Context) bool {
+	return p.pages.nextItem(ctx, &p.index, func() int {
+		if p.pages.page == nil {
+			return 0
+		}
+		return len(p.pages.page.Blobs)
+	}, p.pages.NextPage)
+}
+
+// Item returns the current blob.
+func (p *BlobsByTagsPager) Item() *FilterBlobItem {
+	return &p.pages.page.Blobs[p.index]
+}
+
+// Err returns the error that stopped the listing, or nil.
+func (p *BlobsByTagsPager) Err() error {
+	return p.pages.Err()
+}
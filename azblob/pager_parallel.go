@@ -0,0 +1,297 @@
+package azblob
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ParallelListBlobsOptions identifies options used by ContainerURL.NewParallelBlobPager.
+type ParallelListBlobsOptions struct {
+	// Prefix limits the listing to the blobs whose names start with it.
+	Prefix string
+
+	// Details indicates what additional information the service should return with each blob. Snapshots can only be
+	// listed with caller-supplied Partitions, since splitting the keyspace lists the hierarchy.
+	Details BlobListingDetails
+
+	// MaxResults sets the number of blobs listed by each request (0 for the service's default).
+	MaxResults int32
+
+	// Delimiter splits the keyspace into the virtual directories under Prefix, which are listed concurrently.
+	// The default is "/".
+	Delimiter string
+
+	// SplitDepth is the number of levels of virtual directories under Prefix the keyspace is split into (0=1).
+	// Splitting deeper makes more, smaller partitions, at the cost of listing the levels above them first.
+	SplitDepth int
+
+	// Partitions, if set, are the name prefixes under Prefix listed instead of splitting the keyspace; only the
+	// blobs that start with Prefix followed by one of them are listed. No partition may start with another.
+	Partitions []string
+
+	// Parallelism indicates the maximum number of partitions to list in parallel (0=default)
+	Parallelism uint16
+
+	// Ordered returns the blobs in name order, like a single listing does. Otherwise blobs are returned as soon as
+	// their partition lists them.
+	Ordered bool
+}
+
+// blobPartition is a part of the keyspace: either the blobs that start with a prefix, or blobs that were listed
+// while splitting the keyspace.
+type blobPartition struct {
+	prefix string
+	blobs  []BlobItemInternal
+}
+
+// ParallelBlobPager lists the blobs of a container one at a time, listing partitions of the container's keyspace
+// concurrently.
+type ParallelBlobPager struct {
+	cancel context.CancelFunc
+	pages  chan []BlobItemInternal
+	page   []BlobItemInternal
+	index  int
+	err    error
+
+	failLock sync.Mutex
+	failure  error
+}
+
+// NewParallelBlobPager returns a pager that lists the blobs of the container by splitting its keyspace into
+// partitions, with ListBlobsHierarchySegment and the Delimiter or as given by Partitions, and listing the partitions
+// concurrently. Since the set of names that start with a prefix is a contiguous range of the keyspace, the
+// partitions' listings can be merged in name order. Listing starts right away and stops when ctx is done, the
+// listing fails or Close is called.
+func (c ContainerURL) NewParallelBlobPager(ctx context.Context, o ParallelListBlobsOptions) *ParallelBlobPager {
+	if o.Delimiter == "" {
+		o.Delimiter = "/"
+	}
+	if o.SplitDepth <= 0 {
+		o.SplitDepth = 1
+	}
+	if o.Parallelism == 0 {
+		o.Parallelism = 5 // default Parallelism
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &ParallelBlobPager{cancel: cancel, pages: make(chan []BlobItemInternal, o.Parallelism), index: -1}
+	go p.run(ctx, c, o)
+	return p
+}
+
+// Next moves to the next blob. It returns false once there are no more blobs, ctx is done or listing has failed;
+// Err then returns the error, if any.
+func (p *ParallelBlobPager) Next(ctx context.Context) bool {
+	if p.err != nil {
+		return false
+	}
+	p.index++
+	for p.index >= len(p.page) {
+		select {
+		case page, ok := <-p.pages:
+			if !ok {
+				p.err = p.fail(nil)
+				return false
+			}
+			p.page, p.index = page, 0
+		case <-ctx.Done():
+			p.err = ctx.Err()
+			p.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// Item returns the current blob.
+func (p *ParallelBlobPager) Item() *BlobItemInternal {
+	return &p.page[p.index]
+}
+
+// Err returns the error that stopped the listing, or nil.
+func (p *ParallelBlobPager) Err() error {
+	return p.err
+}
+
+// Close stops the listing. Call it if the listing is abandoned before Next returns false.
+func (p *ParallelBlobPager) Close() {
+	p.cancel()
+}
+
+// fail records the first error that stops the listing and stops it; fail(nil) returns the recorded error.
+func (p *ParallelBlobPager) fail(err error) error {
+	p.failLock.Lock()
+	defer p.failLock.Unlock()
+	if err != nil && p.failure == nil {
+		p.failure = err
+		p.cancel()
+	}
+	return p.failure
+}
+
+// send sends a page of blobs to ch unless the listing stops first.
+func (p *ParallelBlobPager) send(ctx context.Context, ch chan<- []BlobItemInternal, page []BlobItemInternal) bool {
+	select {
+	case ch <- page:
+		return true
+	case <-ctx.Done():
+		p.fail(ctx.Err())
+		return false
+	}
+}
+
+func (p *ParallelBlobPager) run(ctx context.Context, c ContainerURL, o ParallelListBlobsOptions) {
+	defer p.cancel()
+	defer close(p.pages)
+	partitions, err := c.blobPartitions(ctx, o)
+	if err != nil {
+		p.fail(err)
+		return
+	}
+
+	// Each partition is listed into its own channel when the blobs are ordered, so that the merge can drain the
+	// partitions in name order. Partitions are started in that order too, so the partition being drained is always
+	// one that is running.
+	channels := make([]chan []BlobItemInternal, len(partitions))
+	for i := range channels {
+		if o.Ordered {
+			channels[i] = make(chan []BlobItemInternal, 2)
+		} else {
+			channels[i] = p.pages
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	started := make(chan struct{}) // closed once every partition is started
+	go func() {
+		defer close(started)
+		sem := make(chan struct{}, o.Parallelism)
+		for i, part := range partitions {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				p.fail(ctx.Err())
+				return
+			}
+			wg.Add(1)
+			go func(part blobPartition, ch chan []BlobItemInternal) {
+				defer func() {
+					if o.Ordered {
+						close(ch)
+					}
+					<-sem
+					wg.Done()
+				}()
+				p.listPartition(ctx, c, o, part, ch)
+			}(part, channels[i])
+		}
+	}()
+
+	if o.Ordered {
+		for _, ch := range channels {
+			for {
+				var page []BlobItemInternal
+				ok := false
+				select {
+				case page, ok = <-ch:
+				case <-ctx.Done():
+					p.fail(ctx.Err())
+				}
+				if !ok {
+					break
+				}
+				if !p.send(ctx, p.pages, page) {
+					break
+				}
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	<-started
+	wg.Wait()
+}
+
+// listPartition lists the blobs of a partition into ch.
+func (p *ParallelBlobPager) listPartition(ctx context.Context, c ContainerURL, o ParallelListBlobsOptions, part blobPartition, ch chan<- []BlobItemInternal) {
+	if part.blobs != nil {
+		p.send(ctx, ch, part.blobs)
+		return
+	}
+	pager := c.NewBlobFlatSegmentPager(Marker{}, ListBlobsSegmentOptions{Prefix: part.prefix, Details: o.Details, MaxResults: o.MaxResults})
+	for pager.NextPage(ctx) {
+		if blobs := pager.Page().Segment.BlobItems; len(blobs) > 0 && !p.send(ctx, ch, blobs) {
+			return
+		}
+	}
+	if err := pager.Err(); err != nil {
+		p.fail(err)
+	}
+}
+
+// blobPartitions returns the partitions of the keyspace in name order.
+func (c ContainerURL) blobPartitions(ctx context.Context, o ParallelListBlobsOptions) ([]blobPartition, error) {
+	if len(o.Partitions) > 0 {
+		prefixes := make([]string, len(o.Partitions))
+		for i, partition := range o.Partitions {
+			prefixes[i] = o.Prefix + partition
+		}
+		sort.Strings(prefixes)
+		partitions := make([]blobPartition, len(prefixes))
+		for i, prefix := range prefixes {
+			// Sorted, a prefix that starts with another comes right after it (or after one that starts with it too)
+			if i > 0 && strings.HasPrefix(prefix, prefixes[i-1]) {
+				return nil, fmt.Errorf("the partition %q overlaps the partition %q", prefix, prefixes[i-1])
+			}
+			partitions[i] = blobPartition{prefix: prefix}
+		}
+		return partitions, nil
+	}
+
+	// Split each level's virtual directories into the ones under them, which keeps the partitions in name order.
+	// The blobs directly under a level are listed while splitting it, so splitting only helps when most names
+	// contain the Delimiter; containers of flat names should be listed with Partitions.
+	partitions := []blobPartition{{prefix: o.Prefix}}
+	for depth := 0; depth < o.SplitDepth; depth++ {
+		split := make([][]blobPartition, len(partitions))
+		err := DoBatchTransfer(ctx, BatchTransferOptions{
+			OperationName: "blobPartitions",
+			TransferSize:  int64(len(partitions)),
+			ChunkSize:     1,
+			Parallelism:   o.Parallelism,
+			Operation: func(i int64, _ int64, ctx context.Context) error {
+				part := partitions[i]
+				if part.blobs != nil {
+					split[i] = []blobPartition{part}
+					return nil
+				}
+				// Consecutive blobs are kept together as one partition
+				pager := c.NewBlobHierarchyPager(o.Delimiter, ListBlobsSegmentOptions{Prefix: part.prefix, Details: o.Details, MaxResults: o.MaxResults})
+				for pager.Next(ctx) {
+					item := pager.Item()
+					last := len(split[i]) - 1
+					switch {
+					case item.Prefix != nil:
+						split[i] = append(split[i], blobPartition{prefix: item.Prefix.Name})
+					case last >= 0 && split[i][last].blobs != nil:
+						split[i][last].blobs = append(split[i][last].blobs, *item.Blob)
+					default:
+						split[i] = append(split[i], blobPartition{blobs: []BlobItemInternal{*item.Blob}})
+					}
+				}
+				return pager.Err()
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		partitions = nil
+		for _, parts := range split {
+			partitions = append(partitions, parts...)
+		}
+	}
+	return partitions, nil
+}
@@ -0,0 +1,323 @@
+//go:build go1.18
+// +build go1.18
+
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Codec encodes the documents of a Store into blobs and decodes them.
+type Codec interface {
+	// ContentType returns the Content-Type of the blobs.
+	ContentType() string
+
+	// Marshal encodes v, a pointer to a document.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into v, a pointer to a zero document.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes documents with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes documents with encoding/gob.
+	GobCodec Codec = gobCodec{}
+
+	// MarshalerCodec encodes documents with their own Marshal() ([]byte, error) and Unmarshal([]byte) error methods,
+	// such as those of generated protocol buffer messages. The methods can be those of the document type or of a
+	// pointer to it; if the document type is a pointer, a nil document is allocated to be decoded into.
+	MarshalerCodec Codec = marshalerCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                        { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	err := gob.NewEncoder(b).Encode(v)
+	return b.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type marshalerCodec struct{}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type unmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+func (marshalerCodec) ContentType() string { return "application/octet-stream" }
+
+func (marshalerCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(marshaler); ok {
+		return m.Marshal()
+	}
+	if e := reflect.ValueOf(v).Elem(); e.Kind() == reflect.Ptr && !e.IsNil() {
+		if m, ok := e.Interface().(marshaler); ok {
+			return m.Marshal()
+		}
+	}
+	return nil, fmt.Errorf("%T has no Marshal() ([]byte, error) method", v)
+}
+
+func (marshalerCodec) Unmarshal(data []byte, v interface{}) error {
+	if u, ok := v.(unmarshaler); ok {
+		return u.Unmarshal(data)
+	}
+	if e := reflect.ValueOf(v).Elem(); e.Kind() == reflect.Ptr {
+		p := reflect.New(e.Type().Elem())
+		if u, ok := p.Interface().(unmarshaler); ok {
+			if err := u.Unmarshal(data); err != nil {
+				return err
+			}
+			e.Set(p)
+			return nil
+		}
+	}
+	return fmt.Errorf("%T has no Unmarshal([]byte) error method", v)
+}
+
+// StoreOptions identifies options used by NewStore.
+type StoreOptions[T any] struct {
+	// Codec encodes the documents (nil=JSONCodec).
+	Codec Codec
+
+	// Index, if set, returns the blob index tags of a document, such as some of its fields, so that the store can be
+	// queried by them with Find.
+	Index func(doc *T) BlobTagsMap
+
+	// MaxUpdateTries is the maximum number of tries of Update (0=the default of UpdateBlob).
+	MaxUpdateTries int
+}
+
+// Store is a store of documents of type T, each kept in a block blob of a container under a prefix. Documents are
+// identified by a key, the name of their blob without the prefix.
+//
+// Writes can be conditional on the document's ETag, which Update uses to change documents with optimistic
+// concurrency: a document changed by another writer meanwhile is read again and the change is tried again.
+type Store[T any] struct {
+	c      ContainerURL
+	prefix string
+	o      StoreOptions[T]
+}
+
+// Document is a document of a Store, with the properties of its blob.
+type Document[T any] struct {
+	Key   string
+	Value T
+
+	// ETag identifies the version of the document that Value is, for writes that are conditional on it.
+	ETag ETag
+
+	// VersionID is the ID of the blob's version, if the account has blob versioning enabled. Store.GetVersion reads
+	// the document as it was in that version.
+	VersionID string
+
+	LastModified time.Time
+}
+
+// NewStore returns a Store of the documents kept in blobs of the container whose names start with the prefix.
+func NewStore[T any](c ContainerURL, prefix string, o StoreOptions[T]) *Store[T] {
+	if o.Codec == nil {
+		o.Codec = JSONCodec
+	}
+	return &Store[T]{c: c, prefix: prefix, o: o}
+}
+
+// blobURL returns the URL of the blob of the document with the key.
+func (s *Store[T]) blobURL(key string) BlockBlobURL {
+	return s.c.NewBlockBlobURL(s.prefix + key)
+}
+
+// Get reads the document with the key. If it doesn't exist, the error is a StorageError with
+// ServiceCodeBlobNotFound.
+func (s *Store[T]) Get(ctx context.Context, key string) (*Document[T], error) {
+	return s.get(ctx, key, s.blobURL(key).BlobURL)
+}
+
+// GetVersion reads the document with the key as it was in the blob version with the ID.
+func (s *Store[T]) GetVersion(ctx context.Context, key string, versionID string) (*Document[T], error) {
+	return s.get(ctx, key, s.blobURL(key).BlobURL.WithVersionID(versionID))
+}
+
+func (s *Store[T]) get(ctx context.Context, key string, blobURL BlobURL) (*Document[T], error) {
+	dr, err := blobURL.Download(ctx, 0, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	body := dr.Body(RetryReaderOptions{})
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document[T]{Key: key, ETag: dr.ETag(), VersionID: dr.Response().Header.Get("x-ms-version-id"), LastModified: dr.LastModified()}
+	if err := s.o.Codec.Unmarshal(data, &doc.Value); err != nil {
+		return nil, fmt.Errorf("decoding document %q: %w", key, err)
+	}
+	return doc, nil
+}
+
+// Put writes the document with the key, replacing it if it exists. ac makes the write conditional, for example on the
+// document's ETag with IfMatch, or on it not existing with IfNoneMatch ETagAny.
+func (s *Store[T]) Put(ctx context.Context, key string, value T, ac ModifiedAccessConditions) (*Document[T], error) {
+	return s.put(ctx, key, value, ac, DefaultAccessTier)
+}
+
+// put writes the document like Put, to a blob of the tier.
+func (s *Store[T]) put(ctx context.Context, key string, value T, ac ModifiedAccessConditions, tier AccessTierType) (*Document[T], error) {
+	data, err := s.o.Codec.Marshal(&value)
+	if err != nil {
+		return nil, fmt.Errorf("encoding document %q: %w", key, err)
+	}
+	var tags BlobTagsMap
+	if s.o.Index != nil {
+		tags = s.o.Index(&value)
+		for k, v := range tags {
+			if err := validateTag("key", k, 1, TagKeyMaxLength); err != nil {
+				return nil, err
+			}
+			if err := validateTag("value", v, 0, TagValueMaxLength); err != nil {
+				return nil, err
+			}
+		}
+	}
+	resp, err := s.blobURL(key).Upload(ctx, bytes.NewReader(data), BlobHTTPHeaders{ContentType: s.o.Codec.ContentType()}, Metadata{},
+		BlobAccessConditions{ModifiedAccessConditions: ac}, tier, tags, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &Document[T]{Key: key, Value: value, ETag: resp.ETag(), VersionID: resp.VersionID(), LastModified: resp.LastModified()}, nil
+}
+
+// Update reads the document with the key, changes it with update and writes it, conditional on it not having changed
+// meanwhile; if it has, Update tries again as UpdateBlob does. exists is false if the document doesn't exist, and
+// value is then the zero value. The blob of an existing document keeps its access tier. If update fails, Update returns
+// its error; after too many tries, it returns an *UpdateConflictError.
+func (s *Store[T]) Update(ctx context.Context, key string, update func(value *T, exists bool) error) (*Document[T], error) {
+	var doc *Document[T]
+	err := UpdateBlobOptions{MaxTries: s.o.MaxUpdateTries}.retryConflicts(ctx, func() error {
+		var value T
+		ac := ModifiedAccessConditions{IfNoneMatch: ETagAny}
+		old, err := s.Get(ctx, key)
+		if err == nil {
+			value, ac = old.Value, ModifiedAccessConditions{IfMatch: old.ETag}
+		} else if !isNotFound(err) {
+			return err
+		}
+		if err := update(&value, old != nil); err != nil {
+			return err
+		}
+		tier := DefaultAccessTier
+		if old != nil {
+			if tier, err = s.blobURL(key).keptAccessTier(ctx, old.ETag); err != nil {
+				return err
+			}
+		}
+		doc, err = s.put(ctx, key, value, ac, tier)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Delete deletes the document with the key, and the snapshots of its blob. ac makes the deletion conditional, for
+// example on the document's ETag with IfMatch.
+func (s *Store[T]) Delete(ctx context.Context, key string, ac ModifiedAccessConditions) error {
+	_, err := s.blobURL(key).Delete(ctx, DeleteSnapshotsOptionInclude, BlobAccessConditions{ModifiedAccessConditions: ac})
+	return err
+}
+
+// List returns a pager that reads the documents whose keys start with the prefix, in key order.
+func (s *Store[T]) List(prefix string) *StorePager[T] {
+	pager := s.c.NewBlobPager(ListBlobsSegmentOptions{Prefix: s.prefix + prefix})
+	return &StorePager[T]{s: s, names: pager, name: func() string { return pager.Item().Name }}
+}
+
+// Find returns a pager that reads the documents whose index tags match the filter, which must be valid for
+// ServiceURL.FindBlobsByTags. The blob index is updated some time after documents are written, so the documents
+// read can differ from those that match the filter at the time.
+func (s *Store[T]) Find(filter TagFilter) *StorePager[T] {
+	p := NewBlobURLParts(s.c.URL())
+	where, err := filter.And(ContainerIs(p.ContainerName)).Where()
+	if err != nil {
+		return &StorePager[T]{err: err}
+	}
+	p.ContainerName = ""
+	pager := NewServiceURL(p.URL(), s.c.client.Pipeline()).NewBlobsByTagsPager(where, 0)
+	return &StorePager[T]{s: s, names: pager, name: func() string { return pager.Item().Name }}
+}
+
+// StorePager reads documents of a Store one at a time.
+type StorePager[T any] struct {
+	s     *Store[T]
+	names interface {
+		Next(ctx context.Context) bool
+		Err() error
+	}
+	name func() string
+	doc  *Document[T]
+	err  error
+}
+
+// Next moves to the next document, listing and reading it. Documents deleted after being listed are skipped. It
+// returns false once there are no more documents or listing or reading has failed; Err then returns the error, if
+// any.
+func (p *StorePager[T]) Next(ctx context.Context) bool {
+	if p.err != nil {
+		return false
+	}
+	for p.names.Next(ctx) {
+		name := p.name()
+		if !strings.HasPrefix(name, p.s.prefix) {
+			continue
+		}
+		doc, err := p.s.Get(ctx, strings.TrimPrefix(name, p.s.prefix))
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			p.err = err
+			return false
+		}
+		p.doc = doc
+		return true
+	}
+	p.err = p.names.Err()
+	return false
+}
+
+// Item returns the current document.
+func (p *StorePager[T]) Item() *Document[T] {
+	return p.doc
+}
+
+// Err returns the error that stopped the listing, or nil.
+func (p *StorePager[T]) Err() error {
+	return p.err
+}
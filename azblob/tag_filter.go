@@ -0,0 +1,179 @@
+package azblob
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TagFilter is an expression over blob index tags, built with Tag and ContainerIs and combined with And and Or.
+// Where serializes it for ServiceURL.FindBlobsByTags and IfTags for a tag condition (x-ms-if-tags). Keys are
+// double-quoted and values single-quoted; keys and values are checked against the characters and lengths the
+// service allows in tags, so a TagFilter can't be used to inject other expressions.
+//
+//	where, err := Tag("env").Eq("prod").And(Tag("date").Gt("2024")).Where()
+type TagFilter struct {
+	expr string
+	err  error
+
+	// kind is how the expression is joined at its top level, to know when it needs parentheses.
+	kind tagFilterKind
+
+	// Features of the expression that only one kind of expression supports
+	hasOr, hasNotEqual, hasContainer bool
+}
+
+type tagFilterKind int
+
+const (
+	tagFilterComparison tagFilterKind = iota
+	tagFilterAnd
+	tagFilterOr
+)
+
+const (
+	// TagKeyMaxLength is the maximum length of a blob index tag key.
+	TagKeyMaxLength = 128
+
+	// TagValueMaxLength is the maximum length of a blob index tag value.
+	TagValueMaxLength = 256
+)
+
+// TagKey is a blob index tag key that values are compared with to make a TagFilter.
+type TagKey struct {
+	key string
+}
+
+// Tag returns the TagKey of the blob index tag with the key.
+func Tag(key string) TagKey {
+	return TagKey{key: key}
+}
+
+// Eq returns a TagFilter that matches blobs whose tag has the value.
+func (k TagKey) Eq(value string) TagFilter { return k.compare("=", value) }
+
+// Ne returns a TagFilter that matches blobs whose tag doesn't have the value. It can only be used in IfTags.
+func (k TagKey) Ne(value string) TagFilter { return k.compare("<>", value) }
+
+// Gt returns a TagFilter that matches blobs whose tag value sorts after the value.
+func (k TagKey) Gt(value string) TagFilter { return k.compare(">", value) }
+
+// Ge returns a TagFilter that matches blobs whose tag value is the value or sorts after it.
+func (k TagKey) Ge(value string) TagFilter { return k.compare(">=", value) }
+
+// Lt returns a TagFilter that matches blobs whose tag value sorts before the value.
+func (k TagKey) Lt(value string) TagFilter { return k.compare("<", value) }
+
+// Le returns a TagFilter that matches blobs whose tag value is the value or sorts before it.
+func (k TagKey) Le(value string) TagFilter { return k.compare("<=", value) }
+
+func (k TagKey) compare(op string, value string) TagFilter {
+	f := TagFilter{expr: `"` + k.key + `" ` + op + ` '` + value + `'`, hasNotEqual: op == "<>"}
+	if err := validateTag("key", k.key, 1, TagKeyMaxLength); err != nil {
+		f.err = err
+	} else if err := validateTag("value", value, 0, TagValueMaxLength); err != nil {
+		f.err = err
+	}
+	return f
+}
+
+// ContainerIs returns a TagFilter that limits ServiceURL.FindBlobsByTags to the blobs of a container. It can only be
+// used in Where.
+func ContainerIs(containerName string) TagFilter {
+	f := TagFilter{expr: `@container = '` + containerName + `'`, hasContainer: true}
+	if l := len(containerName); l < 3 || l > 63 {
+		f.err = fmt.Errorf("container name %q must be 3 to 63 characters long", containerName)
+	}
+	for _, r := range containerName {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			f.err = fmt.Errorf("container name %q can only contain lowercase letters, digits and hyphens", containerName)
+			break
+		}
+	}
+	return f
+}
+
+// validateTag checks that a tag key or value is as long as the service allows and only has the characters it
+// allows: letters, digits, space and + - . / : = _
+func validateTag(what string, s string, minLength int, maxLength int) error {
+	if len(s) < minLength || len(s) > maxLength {
+		return fmt.Errorf("tag %s %q must be %d to %d characters long", what, s, minLength, maxLength)
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(" +-./:=_", r)) {
+			return fmt.Errorf("tag %s %q has the character %q, which tags can't contain", what, s, r)
+		}
+	}
+	return nil
+}
+
+// And returns a TagFilter that matches blobs that match f and all the others.
+func (f TagFilter) And(others ...TagFilter) TagFilter {
+	return f.join(tagFilterAnd, " AND ", others)
+}
+
+// Or returns a TagFilter that matches blobs that match f or any of the others. It can only be used in IfTags.
+func (f TagFilter) Or(others ...TagFilter) TagFilter {
+	return f.join(tagFilterOr, " OR ", others)
+}
+
+func (f TagFilter) join(kind tagFilterKind, op string, others []TagFilter) TagFilter {
+	if len(others) == 0 {
+		return f
+	}
+	joined := TagFilter{kind: kind, hasOr: kind == tagFilterOr}
+	exprs := make([]string, 0, len(others)+1)
+	for _, o := range append([]TagFilter{f}, others...) {
+		if o.expr == "" && o.err == nil {
+			o.err = errors.New("a TagFilter must be made with Tag or ContainerIs")
+		}
+		if joined.err == nil {
+			joined.err = o.err
+		}
+		joined.hasOr = joined.hasOr || o.hasOr
+		joined.hasNotEqual = joined.hasNotEqual || o.hasNotEqual
+		joined.hasContainer = joined.hasContainer || o.hasContainer
+		if kind == tagFilterAnd && o.kind == tagFilterOr { // AND binds more tightly than OR
+			exprs = append(exprs, "("+o.expr+")")
+		} else {
+			exprs = append(exprs, o.expr)
+		}
+	}
+	joined.expr = strings.Join(exprs, op)
+	return joined
+}
+
+// String returns the expression, without checking it.
+func (f TagFilter) String() string {
+	return f.expr
+}
+
+// Where returns the expression for the where parameter of ServiceURL.FindBlobsByTags, which only supports the
+// =, >, >=, < and <= comparisons joined with AND, and ContainerIs.
+func (f TagFilter) Where() (string, error) {
+	switch {
+	case f.err != nil:
+		return "", f.err
+	case f.expr == "":
+		return "", errors.New("a TagFilter must be made with Tag or ContainerIs")
+	case f.hasOr:
+		return "", errors.New("finding blobs by tags doesn't support OR")
+	case f.hasNotEqual:
+		return "", errors.New("finding blobs by tags doesn't support the <> comparison")
+	}
+	return f.expr, nil
+}
+
+// IfTags returns the expression for a blob's tag condition (x-ms-if-tags), which supports the =, <>, >, >=, < and
+// <= comparisons joined with AND and OR, but not ContainerIs.
+func (f TagFilter) IfTags() (string, error) {
+	switch {
+	case f.err != nil:
+		return "", f.err
+	case f.expr == "":
+		return "", errors.New("a TagFilter must be made with Tag or ContainerIs")
+	case f.hasContainer:
+		return "", errors.New("a tag condition can't use ContainerIs")
+	}
+	return f.expr, nil
+}
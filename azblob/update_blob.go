@@ -0,0 +1,169 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// UpdateBlobOptions identifies options used by UpdateBlobWithOptions.
+type UpdateBlobOptions struct {
+	// MaxTries is the maximum number of times the blob is read, updated and written before giving up because it kept
+	// changing (0=default of 10).
+	MaxTries int
+
+	// RetryDelay is the delay before the second try; it doubles with each try after that (0=default of 50ms).
+	RetryDelay time.Duration
+
+	// MaxRetryDelay is the maximum delay between tries (0=default of 2s).
+	MaxRetryDelay time.Duration
+
+	// HTTPHeaders and Metadata are set on the blob if UpdateBlob creates it. An existing blob keeps its own.
+	HTTPHeaders BlobHTTPHeaders
+	Metadata    Metadata
+}
+
+// UpdateConflictError is returned by UpdateBlob when the blob changed between reading and writing it on every try.
+type UpdateConflictError struct {
+	Tries int
+
+	// Err is the error of the last write, a StorageError with ServiceCodeConditionNotMet or
+	// ServiceCodeBlobAlreadyExists.
+	Err error
+}
+
+// Error returns the error's description.
+func (e *UpdateConflictError) Error() string {
+	return fmt.Sprintf("the blob changed while it was being updated, %d times: %v", e.Tries, e.Err)
+}
+
+// Unwrap returns the error of the last write.
+func (e *UpdateConflictError) Unwrap() error {
+	return e.Err
+}
+
+// UpdateBlob reads the blob, passes its content to update and writes what update returns, conditional on the blob not
+// having changed since it was read. If it has, UpdateBlob tries again, after a delay, with the new content. old is nil
+// if the blob doesn't exist, and UpdateBlob then creates it, conditional on it still not existing.
+//
+// An existing blob keeps its HTTP headers, metadata, index tags and access tier. If update returns the content unchanged, nothing
+// is written. If update fails, UpdateBlob returns its error; after too many tries, it returns an
+// *UpdateConflictError. Otherwise, it returns the blob's ETag.
+//
+// update is called again on each try, so it shouldn't have other effects. UpdateBlob reads the whole blob into memory,
+// so it's meant for small documents such as configuration or state.
+func UpdateBlob(ctx context.Context, blobURL BlockBlobURL, update func(old []byte) ([]byte, error)) (ETag, error) {
+	return UpdateBlobWithOptions(ctx, blobURL, update, UpdateBlobOptions{})
+}
+
+// UpdateBlobWithOptions is UpdateBlob with options.
+func UpdateBlobWithOptions(ctx context.Context, blobURL BlockBlobURL, update func(old []byte) ([]byte, error), o UpdateBlobOptions) (ETag, error) {
+	etag := ETagNone
+	err := o.retryConflicts(ctx, func() (err error) {
+		etag, err = updateBlobOnce(ctx, blobURL, update, o)
+		return err
+	})
+	return etag, err
+}
+
+// retryConflicts calls attempt until it succeeds, fails other than because the blob changed, or has been called
+// MaxTries times, waiting between calls.
+func (o UpdateBlobOptions) retryConflicts(ctx context.Context, attempt func() error) error {
+	if o.MaxTries <= 0 {
+		o.MaxTries = 10 // default MaxTries
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = 50 * time.Millisecond
+	}
+	if o.MaxRetryDelay <= 0 {
+		o.MaxRetryDelay = 2 * time.Second
+	}
+	delay := o.RetryDelay
+	for try := 1; ; try++ {
+		err := attempt()
+		var stgErr StorageError
+		if err == nil || !errors.As(err, &stgErr) ||
+			(stgErr.ServiceCode() != ServiceCodeConditionNotMet && stgErr.ServiceCode() != ServiceCodeBlobAlreadyExists) {
+			return err
+		}
+		if try == o.MaxTries {
+			return &UpdateConflictError{Tries: try, Err: err}
+		}
+		wait := time.Duration(float32(delay) * (rand.Float32()/2 + 0.8)) // NOTE: We want math/rand; not crypto/rand
+		if delay *= 2; delay > o.MaxRetryDelay {
+			delay = o.MaxRetryDelay
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// updateBlobOnce reads, updates and writes the blob once.
+func updateBlobOnce(ctx context.Context, blobURL BlockBlobURL, update func(old []byte) ([]byte, error), o UpdateBlobOptions) (ETag, error) {
+	var old []byte
+	h, metadata, tags := o.HTTPHeaders, o.Metadata, BlobTagsMap(nil)
+	ac := BlobAccessConditions{ModifiedAccessConditions: ModifiedAccessConditions{IfNoneMatch: ETagAny}}
+	dr, err := blobURL.Download(ctx, 0, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+	if err == nil {
+		body := dr.Body(RetryReaderOptions{})
+		old, err = ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return ETagNone, err
+		}
+		if old == nil {
+			old = []byte{}
+		}
+		h, metadata = dr.NewHTTPHeaders(), dr.NewMetadata()
+		h.ContentMD5 = nil // The MD5 is the old content's
+		ac.ModifiedAccessConditions = ModifiedAccessConditions{IfMatch: dr.ETag()}
+		if n, _ := strconv.Atoi(dr.Response().Header.Get("x-ms-tag-count")); n > 0 {
+			// Writing the blob replaces its tags, so they're written again.
+			if tags, err = blobURL.getTagsMap(ctx); err != nil {
+				return ETagNone, err
+			}
+		}
+	} else if !isNotFound(err) {
+		return ETagNone, err
+	}
+
+	data, err := update(old)
+	if err != nil {
+		return ETagNone, err
+	}
+	if old != nil && bytes.Equal(data, old) {
+		return dr.ETag(), nil
+	}
+	tier := DefaultAccessTier
+	if old != nil {
+		if tier, err = blobURL.keptAccessTier(ctx, dr.ETag()); err != nil {
+			return ETagNone, err
+		}
+	}
+	resp, err := blobURL.Upload(ctx, bytes.NewReader(data), h, metadata, ac, tier, tags, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	if err != nil {
+		return ETagNone, err
+	}
+	return resp.ETag(), nil
+}
+
+// keptAccessTier returns the tier to rewrite the blob with, as it is in the version with the ETag, so that rewriting it
+// keeps its tier: Put Blob otherwise sets the account's default tier. It is AccessTierNone if the tier is inferred.
+func (b BlobURL) keptAccessTier(ctx context.Context, etag ETag) (AccessTierType, error) {
+	props, err := b.GetProperties(ctx, BlobAccessConditions{ModifiedAccessConditions: ModifiedAccessConditions{IfMatch: etag}}, ClientProvidedKeyOptions{})
+	if err != nil {
+		return AccessTierNone, err
+	}
+	if props.AccessTierInferred() == "true" {
+		return AccessTierNone, nil
+	}
+	return AccessTierType(props.AccessTier()), nil
+}
@@ -117,7 +117,7 @@ func (b BlobURL) Download(ctx context.Context, offset int64, count int64, ac Blo
 		ac.LeaseAccessConditions.pointers(), xRangeGetContentMD5, nil,
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 	if err != nil {
 		return nil, err
@@ -140,7 +140,7 @@ func (b BlobURL) Delete(ctx context.Context, deleteOptions DeleteSnapshotsOption
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.ModifiedAccessConditions.pointers()
 	return b.blobClient.Delete(ctx, nil, nil, nil, ac.LeaseAccessConditions.pointers(), deleteOptions,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil, BlobDeleteNone)
 }
 
@@ -151,7 +151,7 @@ func (b BlobURL) PermanentDelete(ctx context.Context, deleteOptions DeleteSnapsh
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.ModifiedAccessConditions.pointers()
 	return b.blobClient.Delete(ctx, nil, nil, nil, ac.LeaseAccessConditions.pointers(), deleteOptions,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil, BlobDeletePermanent)
 }
 
@@ -202,7 +202,7 @@ func (b BlobURL) GetProperties(ctx context.Context, ac BlobAccessConditions, cpk
 		nil, ac.LeaseAccessConditions.pointers(),
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -213,7 +213,7 @@ func (b BlobURL) SetHTTPHeaders(ctx context.Context, h BlobHTTPHeaders, ac BlobA
 	return b.blobClient.SetHTTPHeaders(ctx, nil,
 		&h.CacheControl, &h.ContentType, h.ContentMD5, &h.ContentEncoding, &h.ContentLanguage,
 		ac.LeaseAccessConditions.pointers(), ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		&h.ContentDisposition, nil)
 }
 
@@ -225,7 +225,7 @@ func (b BlobURL) SetMetadata(ctx context.Context, metadata Metadata, ac BlobAcce
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK-V
 		cpk.EncryptionScope, // CPK-N
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -240,7 +240,7 @@ func (b BlobURL) CreateSnapshot(ctx context.Context, metadata Metadata, ac BlobA
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK-V
 		cpk.EncryptionScope, // CPK-N
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		ac.LeaseAccessConditions.pointers(), nil)
 }
 
@@ -251,7 +251,7 @@ func (b BlobURL) AcquireLease(ctx context.Context, proposedID string, duration i
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.pointers()
 	return b.blobClient.AcquireLease(ctx, nil, &duration, &proposedID,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -261,7 +261,7 @@ func (b BlobURL) RenewLease(ctx context.Context, leaseID string, ac ModifiedAcce
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.pointers()
 	return b.blobClient.RenewLease(ctx, leaseID, nil,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -271,7 +271,7 @@ func (b BlobURL) ReleaseLease(ctx context.Context, leaseID string, ac ModifiedAc
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.pointers()
 	return b.blobClient.ReleaseLease(ctx, leaseID, nil,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -282,7 +282,7 @@ func (b BlobURL) BreakLease(ctx context.Context, breakPeriodInSeconds int32, ac
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.pointers()
 	return b.blobClient.BreakLease(ctx, nil, leasePeriodPointer(breakPeriodInSeconds),
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -292,7 +292,7 @@ func (b BlobURL) ChangeLease(ctx context.Context, leaseID string, proposedID str
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := ac.pointers()
 	return b.blobClient.ChangeLease(ctx, leaseID, proposedID,
 		nil, ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -303,7 +303,7 @@ func leasePeriodPointer(period int32) (p *int32) {
 	if period != LeaseBreakNaturally {
 		p = &period
 	}
-	return nil
+	return p
 }
 
 // StartCopyFromURL copies the data at the source URL to a blob.
@@ -316,10 +316,10 @@ func (b BlobURL) StartCopyFromURL(ctx context.Context, source url.URL, metadata
 	return b.blobClient.StartCopyFromURL(ctx, source.String(), nil, metadata,
 		tier, RehydratePriorityNone, srcIfModifiedSince, srcIfUnmodifiedSince,
 		srcIfMatchETag, srcIfNoneMatchETag,
-		nil, // source ifTags
+		srcac.tagsPointer(), // source ifTags
 		dstIfModifiedSince, dstIfUnmodifiedSince,
 		dstIfMatchETag, dstIfNoneMatchETag,
-		nil, // Blob ifTags
+		dstac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		dstLeaseID,
 		nil,
 		blobTagsString, // Blob tags
@@ -2,6 +2,7 @@ package azblob
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -68,7 +69,7 @@ func (pb PageBlobURL) Create(ctx context.Context, size int64, sequenceNumber int
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK-V
 		cpk.EncryptionScope, // CPK-N
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob tags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		&sequenceNumber, nil,
 		blobTagsString, // Blob tags
 		// immutability policy
@@ -94,7 +95,7 @@ func (pb PageBlobURL) UploadPages(ctx context.Context, offset int64, body io.Rea
 		cpk.EncryptionScope, // CPK-N
 		ifSequenceNumberLessThanOrEqual, ifSequenceNumberLessThan, ifSequenceNumberEqual,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -105,6 +106,9 @@ func (pb PageBlobURL) UploadPages(ctx context.Context, offset int64, body io.Rea
 // For more information, see https://docs.microsoft.com/rest/api/storageservices/put-page-from-url.
 func (pb PageBlobURL) UploadPagesFromURL(ctx context.Context, sourceURL url.URL, sourceOffset int64, destOffset int64, count int64, transactionalMD5 []byte, destinationAccessConditions PageBlobAccessConditions, sourceAccessConditions ModifiedAccessConditions, cpk ClientProvidedKeyOptions, sourceAuthorization TokenCredential) (*PageBlobUploadPagesFromURLResponse, error) {
 	ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag := destinationAccessConditions.ModifiedAccessConditions.pointers()
+	if sourceAccessConditions.IfTags != "" {
+		return nil, errors.New("the source IfTags access condition must have its default value because it is not supported by the service for this operation")
+	}
 	sourceIfModifiedSince, sourceIfUnmodifiedSince, sourceIfMatchETag, sourceIfNoneMatchETag := sourceAccessConditions.pointers()
 	ifSequenceNumberLessThanOrEqual, ifSequenceNumberLessThan, ifSequenceNumberEqual := destinationAccessConditions.SequenceNumberAccessConditions.pointers()
 	return pb.pbClient.UploadPagesFromURL(ctx, sourceURL.String(), *PageRange{Start: sourceOffset, End: sourceOffset + count - 1}.pointers(), 0,
@@ -114,7 +118,7 @@ func (pb PageBlobURL) UploadPagesFromURL(ctx context.Context, sourceURL url.URL,
 		destinationAccessConditions.LeaseAccessConditions.pointers(),
 		ifSequenceNumberLessThanOrEqual, ifSequenceNumberLessThan, ifSequenceNumberEqual,
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		destinationAccessConditions.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		sourceIfModifiedSince, sourceIfUnmodifiedSince, sourceIfMatchETag, sourceIfNoneMatchETag, nil, tokenCredentialPointers(sourceAuthorization))
 }
 
@@ -129,7 +133,9 @@ func (pb PageBlobURL) ClearPages(ctx context.Context, offset int64, count int64,
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK
 		cpk.EncryptionScope, // CPK-N
 		ifSequenceNumberLessThanOrEqual, ifSequenceNumberLessThan,
-		ifSequenceNumberEqual, ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag, nil, nil)
+		ifSequenceNumberEqual, ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
+		nil)
 }
 
 // GetPageRanges returns the list of valid page ranges for a page blob or snapshot of a page blob.
@@ -140,7 +146,7 @@ func (pb PageBlobURL) GetPageRanges(ctx context.Context, offset int64, count int
 		httpRange{offset: offset, count: count}.pointers(),
 		ac.LeaseAccessConditions.pointers(),
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -154,7 +160,7 @@ func (pb PageBlobURL) GetManagedDiskPageRangesDiff(ctx context.Context, offset i
 		httpRange{offset: offset, count: count}.pointers(),
 		ac.LeaseAccessConditions.pointers(),
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -167,7 +173,7 @@ func (pb PageBlobURL) GetPageRangesDiff(ctx context.Context, offset int64, count
 		httpRange{offset: offset, count: count}.pointers(),
 		ac.LeaseAccessConditions.pointers(),
 		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
-		nil, // Blob ifTags
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
 		nil)
 }
 
@@ -178,7 +184,9 @@ func (pb PageBlobURL) Resize(ctx context.Context, size int64, ac BlobAccessCondi
 	return pb.pbClient.Resize(ctx, size, nil, ac.LeaseAccessConditions.pointers(),
 		cpk.EncryptionKey, cpk.EncryptionKeySha256, cpk.EncryptionAlgorithm, // CPK
 		cpk.EncryptionScope, // CPK-N
-		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag, nil, nil)
+		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
+		nil)
 }
 
 // UpdateSequenceNumber sets the page blob's sequence number.
@@ -191,7 +199,8 @@ func (pb PageBlobURL) UpdateSequenceNumber(ctx context.Context, action SequenceN
 	ifModifiedSince, ifUnmodifiedSince, ifMatch, ifNoneMatch := ac.ModifiedAccessConditions.pointers()
 	return pb.pbClient.UpdateSequenceNumber(ctx, action, nil,
 		ac.LeaseAccessConditions.pointers(), ifModifiedSince, ifUnmodifiedSince, ifMatch, ifNoneMatch,
-		nil, sn, nil)
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
+		sn, nil)
 }
 
 // StartCopyIncremental begins an operation to start an incremental copy from one page blob's snapshot to this page blob.
@@ -205,7 +214,9 @@ func (pb PageBlobURL) StartCopyIncremental(ctx context.Context, source url.URL,
 	qp.Set("snapshot", snapshot)
 	source.RawQuery = qp.Encode()
 	return pb.pbClient.CopyIncremental(ctx, source.String(), nil,
-		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag, nil, nil)
+		ifModifiedSince, ifUnmodifiedSince, ifMatchETag, ifNoneMatchETag,
+		ac.ModifiedAccessConditions.tagsPointer(), // Blob ifTags
+		nil)
 }
 
 func (pr PageRange) pointers() *string {
@@ -0,0 +1,171 @@
+package azblob
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+)
+
+// SkipDir is used as a return value from a WalkFunc to indicate that the virtual directory named in the call is to
+// be skipped. It is the same error as filepath.SkipDir.
+var SkipDir = filepath.SkipDir
+
+// WalkFunc is the type of the function called by ContainerURL.Walk to visit each virtual directory and blob.
+//
+// The item is a virtual directory (its Prefix is set) or a blob (its Blob is set). The first call is for the
+// virtual directory Walk was given, even if it is the empty prefix.
+//
+// If listing a virtual directory fails, the function is called a second time for it with the error. Otherwise err is
+// nil.
+//
+// If the function returns SkipDir for a virtual directory, Walk doesn't walk it. If it returns SkipDir for a blob,
+// Walk skips the rest of the blob's virtual directory. Any other error stops the walk and is returned by Walk.
+type WalkFunc func(item BlobHierarchyItem, err error) error
+
+// WalkOptions identifies options used by ContainerURL.Walk.
+type WalkOptions struct {
+	// Details indicates what additional information the service should return with each blob.
+	Details BlobListingDetails
+
+	// MaxResults sets the number of items listed by each request (0 for the service's default).
+	MaxResults int32
+
+	// MaxDepth, if not 0, is the number of levels of virtual directories to walk. Virtual directories at that depth
+	// are passed to the WalkFunc, but not walked.
+	MaxDepth int
+
+	// Parallelism indicates the maximum number of virtual directories to walk in parallel (0=default). With a
+	// Parallelism of 1, items are visited depth-first in name order, like filepath.WalkDir does; otherwise the
+	// WalkFunc is called concurrently, though the items of each virtual directory are still visited in name order.
+	Parallelism uint16
+}
+
+// Walk walks the tree of virtual directories under the prefix, whose levels are separated by the delimiter,
+// calling fn for each virtual directory and blob in it.
+func (c ContainerURL) Walk(ctx context.Context, prefix string, delimiter string, fn WalkFunc, o WalkOptions) error {
+	if o.Parallelism == 0 {
+		o.Parallelism = 5 // default Parallelism
+	}
+	if err := fn(BlobHierarchyItem{Prefix: &BlobPrefix{Name: prefix}}, nil); err != nil {
+		if err == SkipDir {
+			return nil
+		}
+		return err
+	}
+	w := &walker{c: c, delimiter: delimiter, fn: fn, o: o}
+	if o.Parallelism == 1 {
+		w.descend = w.walkDir
+		return w.walkDir(ctx, prefix, 1)
+	}
+
+	ctx, w.cancel = context.WithCancel(ctx)
+	defer w.cancel()
+	w.descend = w.enqueue
+	w.enqueue(ctx, prefix, 1)
+	w.wg.Wait()
+	return w.err
+}
+
+// walker holds the state of a walk.
+type walker struct {
+	c         ContainerURL
+	delimiter string
+	fn        WalkFunc
+	o         WalkOptions
+
+	// descend walks a virtual directory found in another, either right away or by one of the concurrent workers.
+	descend func(ctx context.Context, dir string, depth int) error
+
+	// Used by concurrent walks
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	queue   []walkerDir // the virtual directories waiting for a worker
+	workers int         // the number of worker goroutines, at most Parallelism
+	err     error
+}
+
+// walkerDir is a virtual directory waiting to be walked by a concurrent walk.
+type walkerDir struct {
+	dir   string
+	depth int
+}
+
+// walkDir visits the items of the virtual directory, which is at the depth.
+func (w *walker) walkDir(ctx context.Context, dir string, depth int) error {
+	pager := w.c.NewBlobHierarchyPager(w.delimiter, ListBlobsSegmentOptions{Prefix: dir, Details: w.o.Details, MaxResults: w.o.MaxResults})
+	for pager.Next(ctx) {
+		item := pager.Item()
+		err := w.fn(item, nil)
+		if err == SkipDir {
+			if item.Blob != nil {
+				return nil
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if item.Prefix != nil && (w.o.MaxDepth == 0 || depth < w.o.MaxDepth) {
+			if err := w.descend(ctx, item.Prefix.Name, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if err := pager.Err(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err = w.fn(BlobHierarchyItem{Prefix: &BlobPrefix{Name: dir}}, err); err != SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue queues the virtual directory to be walked, and starts a worker to walk it if fewer than Parallelism are
+// running; a wide tree thus queues its virtual directories rather than starting a goroutine for each.
+func (w *walker) enqueue(ctx context.Context, dir string, depth int) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.queue = append(w.queue, walkerDir{dir: dir, depth: depth})
+	if w.workers < int(w.o.Parallelism) {
+		w.workers++
+		w.wg.Add(1)
+		go w.work(ctx)
+	}
+	return nil
+}
+
+// work walks queued virtual directories until none are left.
+func (w *walker) work(ctx context.Context) {
+	defer w.wg.Done()
+	for {
+		w.lock.Lock()
+		if len(w.queue) == 0 {
+			w.workers--
+			w.lock.Unlock()
+			return
+		}
+		d := w.queue[0]
+		w.queue = w.queue[1:]
+		w.lock.Unlock()
+
+		if err := ctx.Err(); err != nil {
+			w.fail(err)
+			continue
+		}
+		if err := w.walkDir(ctx, d.dir, d.depth); err != nil {
+			w.fail(err)
+		}
+	}
+}
+
+// fail records the first error that stops a concurrent walk and stops it.
+func (w *walker) fail(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.cancel()
+	}
+}
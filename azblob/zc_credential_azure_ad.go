@@ -0,0 +1,253 @@
+package azblob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTokenResource is the resource that tokens for Azure Storage are for.
+	defaultTokenResource = "https://storage.azure.com/"
+
+	// defaultAuthorityHost is the Azure AD endpoint of the Azure public cloud.
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+
+	// tokenRefreshMargin is how long before a token expires it is refreshed, at most.
+	tokenRefreshMargin = 5 * time.Minute
+
+	// tokenRefreshTimeout is how long refreshing a token can take.
+	tokenRefreshTimeout = 30 * time.Second
+
+	// tokenRetryDelay and tokenMaxRetryDelay bound the delay before refreshing a token again after failing to.
+	tokenRetryDelay    = 5 * time.Second
+	tokenMaxRetryDelay = 5 * time.Minute
+)
+
+// TokenCredentialOptions identifies options used by the constructors of token credentials that get their tokens from
+// Azure AD or a managed identity, such as NewClientSecretCredential and NewManagedIdentityCredential.
+//
+// These credentials get a token when they are created, and refresh it in the background a few minutes before it
+// expires. If refreshing fails, it is tried again with backoff while the current token is used. They also refresh it
+// when the service rejects it, as described by NewChallengeTokenCredential, from the configured authority and tenant
+// rather than the challenge's; a rejection during backoff doesn't refresh it before the scheduled retry.
+type TokenCredentialOptions struct {
+	// Resource is the resource the tokens are for (""=https://storage.azure.com/). Tokens from Azure AD are for its
+	// .default scope.
+	Resource string
+
+	// AuthorityHost is the Azure AD endpoint (""=the AZURE_AUTHORITY_HOST environment variable, or else
+	// https://login.microsoftonline.com/ for the Azure public cloud). It isn't used by managed identities.
+	AuthorityHost string
+
+	// HTTPClient sends the requests for tokens (nil=http.DefaultClient).
+	HTTPClient *http.Client
+
+	// OnRefreshError, if set, is called when refreshing the token fails.
+	OnRefreshError func(err error)
+}
+
+func (o TokenCredentialOptions) withDefaults() TokenCredentialOptions {
+	if o.Resource == "" {
+		o.Resource = defaultTokenResource
+	}
+	if o.AuthorityHost == "" {
+		o.AuthorityHost = os.Getenv("AZURE_AUTHORITY_HOST")
+	}
+	if o.AuthorityHost == "" {
+		o.AuthorityHost = defaultAuthorityHost
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+	return o
+}
+
+// TokenRequestError is returned when a token endpoint refuses to issue a token.
+type TokenRequestError struct {
+	StatusCode int
+
+	// Code and Description are the error and its description from the response, if any, such as "invalid_client".
+	Code        string
+	Description string
+}
+
+// Error returns the error's description.
+func (e *TokenRequestError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("token request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("token request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Description)
+}
+
+// accessToken is a token and when it expires.
+type accessToken struct {
+	token     string
+	expiresOn time.Time
+}
+
+// tokenNumber is a number in a token response, which some endpoints send as a string.
+type tokenNumber string
+
+func (n *tokenNumber) UnmarshalJSON(b []byte) error {
+	*n = tokenNumber(strings.Trim(string(b), `"`))
+	return nil
+}
+
+// requestToken sends the request for a token and parses the response of Azure AD or a managed identity endpoint.
+func (o TokenCredentialOptions) requestToken(ctx context.Context, request *http.Request) (accessToken, error) {
+	sent := time.Now()
+	response, err := o.HTTPClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return accessToken{}, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return accessToken{}, err
+	}
+	if response.StatusCode != http.StatusOK {
+		e := &TokenRequestError{StatusCode: response.StatusCode}
+		var errorResponse struct {
+			Code        string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &errorResponse) == nil {
+			e.Code, e.Description = errorResponse.Code, errorResponse.Description
+		}
+		return accessToken{}, e
+	}
+	var tokenResponse struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   tokenNumber `json:"expires_in"`
+		ExpiresOn   tokenNumber `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return accessToken{}, fmt.Errorf("token response isn't valid: %w", err)
+	}
+	t := accessToken{token: tokenResponse.AccessToken}
+	if seconds, err := strconv.ParseInt(string(tokenResponse.ExpiresOn), 10, 64); err == nil {
+		t.expiresOn = time.Unix(seconds, 0)
+	} else if seconds, err := strconv.ParseInt(string(tokenResponse.ExpiresIn), 10, 64); err == nil {
+		t.expiresOn = sent.Add(time.Duration(seconds) * time.Second)
+	}
+	if t.token == "" || t.expiresOn.IsZero() {
+		return accessToken{}, errors.New("token response has no access_token or expiry")
+	}
+	return t, nil
+}
+
+// requestAzureADToken requests a token for the client of the tenant from Azure AD with the client credentials grant,
+// authenticating the client with the form's credential.
+func (o TokenCredentialOptions) requestAzureADToken(ctx context.Context, tenantID, clientID string, form url.Values) (accessToken, error) {
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("scope", strings.TrimSuffix(o.Resource, "/")+"/.default")
+	request, err := http.NewRequest(http.MethodPost, o.azureADTokenEndpoint(tenantID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	request.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	return o.requestToken(ctx, request)
+}
+
+func (o TokenCredentialOptions) azureADTokenEndpoint(tenantID string) string {
+	return strings.TrimSuffix(o.AuthorityHost, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+}
+
+// newRefreshingTokenCredential returns a TokenCredential with a token from fetch, which it calls again to refresh the
+// token before it expires, or when the service rejects it.
+func newRefreshingTokenCredential(ctx context.Context, o TokenCredentialOptions, fetch func(ctx context.Context) (accessToken, error)) (TokenCredential, error) {
+	t, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := &tokenRefresh{fetch: fetch, onError: o.OnRefreshError, expiresOn: t.expiresOn, fetched: true}
+	return NewChallengeTokenCredential(t.token, r.refresh), nil
+}
+
+// tokenRefresh is the TokenRefresher of the credentials that get tokens from Azure AD or a managed identity.
+type tokenRefresh struct {
+	fetch     func(ctx context.Context) (accessToken, error)
+	onError   func(err error)
+	expiresOn time.Time
+	fetched   bool // whether the token was just fetched, when NewTokenCredential first calls refresh
+	failures  int
+	retryAt   time.Time // when to fetch the token again after fetching it failed
+}
+
+func (r *tokenRefresh) refresh(credential TokenCredential, challenge *TokenChallenge) time.Duration {
+	if r.fetched {
+		r.fetched = false
+		return r.untilRefresh()
+	}
+	if challenge != nil && time.Now().Before(r.retryAt) {
+		// A rejected request doesn't cut the backoff short; the scheduled retry stays as it is.
+		if d := time.Until(r.retryAt); d >= time.Second {
+			return d
+		}
+		return time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	t, err := r.fetch(ctx)
+	if err != nil {
+		if r.onError != nil {
+			r.onError(err)
+		}
+		// Try again with backoff, and before half the current token's remaining lifetime has passed.
+		delay := tokenMaxRetryDelay
+		if r.failures < 10 && tokenRetryDelay<<r.failures < delay {
+			delay = tokenRetryDelay << r.failures
+		}
+		if half := time.Until(r.expiresOn) / 2; half > 0 && half < delay {
+			delay = half
+			if delay < time.Second {
+				delay = time.Second
+			}
+		}
+		r.failures++
+		delay = time.Duration(float32(delay) * (rand.Float32()/2 + 0.75)) // NOTE: We want math/rand; not crypto/rand
+		r.retryAt = time.Now().Add(delay)
+		return delay
+	}
+	r.failures, r.retryAt = 0, time.Time{}
+	r.expiresOn = t.expiresOn
+	credential.SetToken(t.token)
+	return r.untilRefresh()
+}
+
+// untilRefresh returns how long until the token is refreshed: when it has tokenRefreshMargin or half its lifetime
+// left, whichever is shorter. Refreshes are spread a little so that processes started together don't refresh
+// together.
+func (r *tokenRefresh) untilRefresh() time.Duration {
+	left := time.Until(r.expiresOn)
+	margin := tokenRefreshMargin
+	if left/2 < margin {
+		margin = left / 2
+	}
+	d := time.Duration(float32(left-margin) * (rand.Float32()/10 + 0.9)) // NOTE: We want math/rand; not crypto/rand
+	if d < time.Second {
+		d = time.Second // A duration of 0 would stop refreshing
+	}
+	return d
+}
+
+// NewClientSecretCredential creates a TokenCredential for a service principal, the client of an app registration in
+// the tenant, that authenticates to Azure AD with a client secret.
+func NewClientSecretCredential(ctx context.Context, tenantID, clientID, clientSecret string, o TokenCredentialOptions) (TokenCredential, error) {
+	o = o.withDefaults()
+	return newRefreshingTokenCredential(ctx, o, func(ctx context.Context) (accessToken, error) {
+		return o.requestAzureADToken(ctx, tenantID, clientID, url.Values{"client_secret": {clientSecret}})
+	})
+}
@@ -0,0 +1,154 @@
+package azblob
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// clientAssertionType is the type of the client assertions that authenticate a client to Azure AD: a JWT.
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// NewClientCertificateCredential creates a TokenCredential for a service principal, the client of an app registration
+// in the tenant, that authenticates to Azure AD with a certificate registered for the app and its private key. See
+// ParseClientCertificate to load them from PEM.
+func NewClientCertificateCredential(ctx context.Context, tenantID, clientID string, certificate *x509.Certificate, privateKey *rsa.PrivateKey, o TokenCredentialOptions) (TokenCredential, error) {
+	if certificate == nil || privateKey == nil {
+		return nil, errors.New("a certificate and its private key are required")
+	}
+	o = o.withDefaults()
+	return newRefreshingTokenCredential(ctx, o, func(ctx context.Context) (accessToken, error) {
+		assertion, err := signClientAssertion(certificate, privateKey, clientID, o.azureADTokenEndpoint(tenantID))
+		if err != nil {
+			return accessToken{}, err
+		}
+		return o.requestAzureADToken(ctx, tenantID, clientID, url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {assertion}})
+	})
+}
+
+// ParseClientCertificate parses the certificate and its RSA private key from PEM data, such as a file with both.
+// The private key can be in PKCS #1 or unencrypted PKCS #8 form. If there are several certificates, the first one
+// whose public key matches the private key is returned.
+func ParseClientCertificate(pemData []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	var certificates []*x509.Certificate
+	var privateKey *rsa.PrivateKey
+	for block, rest := pem.Decode(pemData); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certificates = append(certificates, certificate)
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			privateKey = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, errors.New("the private key isn't an RSA key")
+			}
+			privateKey = rsaKey
+		}
+	}
+	if privateKey == nil {
+		return nil, nil, errors.New("the PEM data has no private key")
+	}
+	for _, certificate := range certificates {
+		if publicKey, ok := certificate.PublicKey.(*rsa.PublicKey); ok && publicKey.Equal(&privateKey.PublicKey) {
+			return certificate, privateKey, nil
+		}
+	}
+	return nil, nil, errors.New("the PEM data has no certificate for the private key")
+}
+
+// signClientAssertion returns a JWT that authenticates the client to the audience, Azure AD's token endpoint, signed
+// with the certificate's private key.
+func signClientAssertion(certificate *x509.Certificate, privateKey *rsa.PrivateKey, clientID, audience string) (string, error) {
+	thumbprint := sha1.Sum(certificate.Raw)
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:])})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": newUUID().String(),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// WorkloadIdentityCredentialOptions identifies options used by NewWorkloadIdentityCredential.
+type WorkloadIdentityCredentialOptions struct {
+	TokenCredentialOptions
+
+	// TenantID and ClientID identify the app registration or user-assigned managed identity that the workload's
+	// identity is federated with (""=the AZURE_TENANT_ID and AZURE_CLIENT_ID environment variables).
+	TenantID string
+	ClientID string
+
+	// TokenFile is the file of the workload's token from its identity provider, such as a Kubernetes service account
+	// token (""=the AZURE_FEDERATED_TOKEN_FILE environment variable). It is read each time the token is refreshed, as
+	// it is rotated.
+	TokenFile string
+}
+
+// NewWorkloadIdentityCredential creates a TokenCredential for a workload, such as a Kubernetes pod, whose identity is
+// federated with an app registration or managed identity: it authenticates to Azure AD with a token from its own
+// identity provider. By default, it is configured by the environment variables that Azure Workload Identity sets.
+func NewWorkloadIdentityCredential(ctx context.Context, o WorkloadIdentityCredentialOptions) (TokenCredential, error) {
+	settings := []struct {
+		value *string
+		env   string
+	}{{&o.TenantID, "AZURE_TENANT_ID"}, {&o.ClientID, "AZURE_CLIENT_ID"}, {&o.TokenFile, "AZURE_FEDERATED_TOKEN_FILE"}}
+	for _, s := range settings {
+		if *s.value == "" {
+			*s.value = os.Getenv(s.env)
+		}
+		if *s.value == "" {
+			return nil, fmt.Errorf("workload identity requires the %s environment variable or option", s.env)
+		}
+	}
+	t := o.TokenCredentialOptions.withDefaults()
+	return newRefreshingTokenCredential(ctx, t, func(ctx context.Context) (accessToken, error) {
+		assertion, err := ioutil.ReadFile(o.TokenFile)
+		if err != nil {
+			return accessToken{}, err
+		}
+		return t.requestAzureADToken(ctx, o.TenantID, o.ClientID, url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {strings.TrimSpace(string(assertion))}})
+	})
+}
@@ -0,0 +1,124 @@
+package azblob
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// imdsTokenEndpoint is the token endpoint of the Azure Instance Metadata Service (IMDS) of virtual machines.
+const imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// ManagedIdentityCredentialOptions identifies options used by NewManagedIdentityCredential.
+type ManagedIdentityCredentialOptions struct {
+	TokenCredentialOptions
+
+	// ClientID, ObjectID or ResourceID, if one is set, identifies the user-assigned managed identity to use instead of
+	// the system-assigned one.
+	ClientID   string
+	ObjectID   string
+	ResourceID string
+
+	// IMDSEndpoint is the token endpoint of the Instance Metadata Service (""=its well-known address). It isn't used
+	// where the IDENTITY_ENDPOINT and IDENTITY_HEADER environment variables are set, such as on App Service and
+	// Azure Functions, whose managed identity endpoint they are.
+	IMDSEndpoint string
+
+	// MaxTries is the maximum number of times a token request is tried (0=default of 5). Requests are tried again
+	// after connection errors and the statuses the endpoint uses while it's unavailable: 404, 410, 429 and 5xx.
+	MaxTries int
+
+	// RetryDelay is the delay before the second try; it doubles with each try after that (0=default of 1s).
+	RetryDelay time.Duration
+}
+
+// NewManagedIdentityCredential creates a TokenCredential for the managed identity of the Azure resource the process
+// runs on: the endpoint given by the IDENTITY_ENDPOINT and IDENTITY_HEADER environment variables (App Service and
+// Azure Functions) if they're set, or else the Instance Metadata Service of virtual machines.
+func NewManagedIdentityCredential(ctx context.Context, o ManagedIdentityCredentialOptions) (TokenCredential, error) {
+	ids := 0
+	for _, id := range []string{o.ClientID, o.ObjectID, o.ResourceID} {
+		if id != "" {
+			ids++
+		}
+	}
+	if ids > 1 {
+		return nil, errors.New("only one of ClientID, ObjectID and ResourceID can be set")
+	}
+	if o.MaxTries <= 0 {
+		o.MaxTries = 5 // default MaxTries
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = time.Second
+	}
+	if o.IMDSEndpoint == "" {
+		o.IMDSEndpoint = imdsTokenEndpoint
+	}
+	t := o.TokenCredentialOptions.withDefaults()
+	newRequest, err := o.newTokenRequest(t.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return newRefreshingTokenCredential(ctx, t, func(ctx context.Context) (accessToken, error) {
+		return o.requestManagedIdentityToken(ctx, t, newRequest)
+	})
+}
+
+// newTokenRequest returns a function that creates the requests for tokens for the resource.
+func (o ManagedIdentityCredentialOptions) newTokenRequest(resource string) (func() *http.Request, error) {
+	endpoint, apiVersion, header, secret := o.IMDSEndpoint, "2018-02-01", "Metadata", "true"
+	idParameters := [3]string{"client_id", "object_id", "msi_res_id"}
+	if e, h := os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER"); e != "" && h != "" {
+		endpoint, apiVersion, header, secret = e, "2019-08-01", "X-IDENTITY-HEADER", h
+		idParameters = [3]string{"client_id", "principal_id", "mi_res_id"}
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("api-version", apiVersion)
+	q.Set("resource", resource)
+	for i, id := range []string{o.ClientID, o.ObjectID, o.ResourceID} {
+		if id != "" {
+			q.Set(idParameters[i], id)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return func() *http.Request {
+		request, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+		request.Header.Set(header, secret)
+		return request
+	}, nil
+}
+
+// requestManagedIdentityToken requests a token from the managed identity endpoint, trying again with backoff while
+// it's unavailable.
+func (o ManagedIdentityCredentialOptions) requestManagedIdentityToken(ctx context.Context, t TokenCredentialOptions, newRequest func() *http.Request) (accessToken, error) {
+	delay := o.RetryDelay
+	for try := 1; ; try++ {
+		token, err := t.requestToken(ctx, newRequest())
+		var requestErr *TokenRequestError
+		if errors.As(err, &requestErr) {
+			switch status := requestErr.StatusCode; {
+			case status == http.StatusNotFound, status == http.StatusGone, status == http.StatusTooManyRequests, status >= 500:
+			default:
+				return accessToken{}, err
+			}
+		}
+		if err == nil || try == o.MaxTries || ctx.Err() != nil {
+			return token, err
+		}
+		wait := time.Duration(float32(delay) * (rand.Float32()/2 + 0.8)) // NOTE: We want math/rand; not crypto/rand
+		delay *= 2
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return accessToken{}, ctx.Err()
+		}
+	}
+}
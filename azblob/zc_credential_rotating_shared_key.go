@@ -0,0 +1,158 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// RotatingSharedKeyCredentialOptions identifies options used by NewRotatingSharedKeyCredential.
+type RotatingSharedKeyCredentialOptions struct {
+	// RetryWithOtherKey makes a request that the service rejects with AuthenticationFailed be sent once more, signed
+	// with another key: the primary key if it was replaced while the request was sent, or else the secondary key.
+	RetryWithOtherKey bool
+
+	// OnFallback, if set, is called each time a request is sent again with another key, with whether it was the
+	// secondary key and the request's error (nil if it succeeded). A success with the secondary key means the primary
+	// key is out of date.
+	OnFallback func(secondary bool, err error)
+}
+
+// RotatingSharedKeyCredential is a shared key credential whose keys can be replaced while it is in use, so that an
+// account's keys can be rotated without creating new pipelines. Requests are signed with the primary key; the
+// secondary key is only used if the service rejects a request signed with the primary key (see
+// RotatingSharedKeyCredentialOptions.RetryWithOtherKey). It is safe for concurrent use.
+type RotatingSharedKeyCredential struct {
+	fallbacks int64 // Accessed atomically, so first for alignment
+
+	accountName string
+	o           RotatingSharedKeyCredentialOptions
+	keys        atomic.Value // sharedKeys
+}
+
+type sharedKeys struct {
+	primary   *SharedKeyCredential
+	secondary *SharedKeyCredential // nil if there's no secondary key
+}
+
+// NewRotatingSharedKeyCredential creates a RotatingSharedKeyCredential with the account's name and keys. secondaryKey
+// can be "".
+func NewRotatingSharedKeyCredential(accountName, primaryKey, secondaryKey string, o RotatingSharedKeyCredentialOptions) (*RotatingSharedKeyCredential, error) {
+	c := &RotatingSharedKeyCredential{accountName: accountName, o: o}
+	if err := c.SetKeys(primaryKey, secondaryKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetKeys replaces both keys at once; requests signed from then on use the new keys. secondaryKey can be "". To
+// rotate the account's primary key, set the secondary key as primary, regenerate the primary key and set the keys
+// again.
+func (c *RotatingSharedKeyCredential) SetKeys(primaryKey, secondaryKey string) error {
+	if primaryKey == "" {
+		return errors.New("the primary key is empty")
+	}
+	keys := sharedKeys{}
+	var err error
+	if keys.primary, err = NewSharedKeyCredential(c.accountName, primaryKey); err != nil {
+		return fmt.Errorf("the primary key isn't valid: %w", err)
+	}
+	if secondaryKey != "" {
+		if keys.secondary, err = NewSharedKeyCredential(c.accountName, secondaryKey); err != nil {
+			return fmt.Errorf("the secondary key isn't valid: %w", err)
+		}
+	}
+	c.keys.Store(keys)
+	return nil
+}
+
+func (c *RotatingSharedKeyCredential) current() sharedKeys {
+	return c.keys.Load().(sharedKeys)
+}
+
+// AccountName returns the Storage account's name.
+func (c *RotatingSharedKeyCredential) AccountName() string {
+	return c.accountName
+}
+
+// ComputeHMACSHA256 generates a hash signature for an HTTP request or for a SAS, with the primary key.
+func (c *RotatingSharedKeyCredential) ComputeHMACSHA256(message string) (base64String string) {
+	return c.current().primary.ComputeHMACSHA256(message)
+}
+
+// noop function to satisfy StorageAccountCredential interface
+func (c *RotatingSharedKeyCredential) getUDKParams() *UserDelegationKey {
+	return nil
+}
+
+// Fallbacks returns how many requests have been sent again with another key.
+func (c *RotatingSharedKeyCredential) Fallbacks() int64 {
+	return atomic.LoadInt64(&c.fallbacks)
+}
+
+// New creates a credential policy object.
+func (c *RotatingSharedKeyCredential) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		key := c.current().primary
+		stringToSign, err := key.sign(request)
+		if err != nil {
+			return nil, err
+		}
+		response, err := next.Do(ctx, request)
+		if c.o.RetryWithOtherKey && isAuthenticationFailure(response) {
+			if other, secondary := c.otherKey(key); other != nil && request.RewindBody() == nil {
+				response.Response().Body.Close()
+				if stringToSign, err = other.sign(request); err != nil {
+					return nil, err
+				}
+				response, err = next.Do(ctx, request)
+				atomic.AddInt64(&c.fallbacks, 1)
+				if po.ShouldLog(pipeline.LogWarning) {
+					po.Log(pipeline.LogWarning, fmt.Sprintf("Request failed to authenticate and was sent again with the %s key, err=%v", keyName(secondary), err))
+				}
+				if c.o.OnFallback != nil {
+					c.o.OnFallback(secondary, err)
+				}
+			}
+		}
+		if err != nil && response != nil && response.Response() != nil && response.Response().StatusCode == http.StatusForbidden {
+			// Service failed to authenticate request, log it
+			po.Log(pipeline.LogError, "===== HTTP Forbidden status, String-to-Sign:\n"+stringToSign+"\n===============================\n")
+		}
+		return response, err
+	})
+}
+
+// otherKey returns the key to sign a request with after the service rejected it signed with the key: the primary key
+// if it was replaced since, or else the secondary key. It returns nil if there's no other key.
+func (c *RotatingSharedKeyCredential) otherKey(used *SharedKeyCredential) (key *SharedKeyCredential, secondary bool) {
+	keys := c.current()
+	if !bytes.Equal(keys.primary.accountKey, used.accountKey) {
+		return keys.primary, false
+	}
+	if keys.secondary != nil && !bytes.Equal(keys.secondary.accountKey, used.accountKey) {
+		return keys.secondary, true
+	}
+	return nil, false
+}
+
+func keyName(secondary bool) string {
+	if secondary {
+		return "secondary"
+	}
+	return "primary"
+}
+
+// isAuthenticationFailure reports whether the response is the service's rejection of a request's signature.
+func isAuthenticationFailure(response pipeline.Response) bool {
+	return response != nil && response.Response() != nil && response.Response().StatusCode == http.StatusForbidden &&
+		response.Response().Header.Get("x-ms-error-code") == string(ServiceCodeAuthenticationFailed)
+}
+
+// credentialMarker is a package-internal method that exists just to satisfy the Credential interface.
+func (*RotatingSharedKeyCredential) credentialMarker() {}
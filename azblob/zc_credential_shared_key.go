@@ -51,17 +51,10 @@ func (f SharedKeyCredential) getUDKParams() *UserDelegationKey {
 // New creates a credential policy object.
 func (f *SharedKeyCredential) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
 	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
-		// Add a x-ms-date header if it doesn't already exist
-		if d := request.Header.Get(headerXmsDate); d == "" {
-			request.Header[headerXmsDate] = []string{time.Now().UTC().Format(http.TimeFormat)}
-		}
-		stringToSign, err := f.buildStringToSign(request)
+		stringToSign, err := f.sign(request)
 		if err != nil {
 			return nil, err
 		}
-		signature := f.ComputeHMACSHA256(stringToSign)
-		authHeader := strings.Join([]string{"SharedKey ", f.accountName, ":", signature}, "")
-		request.Header[headerAuthorization] = []string{authHeader}
 
 		response, err := next.Do(ctx, request)
 		if err != nil && response != nil && response.Response() != nil && response.Response().StatusCode == http.StatusForbidden {
@@ -75,6 +68,22 @@ func (f *SharedKeyCredential) New(next pipeline.Policy, po *pipeline.PolicyOptio
 // credentialMarker is a package-internal method that exists just to satisfy the Credential interface.
 func (*SharedKeyCredential) credentialMarker() {}
 
+// sign sets the request's Authorization header to its signature, adding a x-ms-date header if it doesn't already
+// exist. It returns the string that was signed.
+func (f *SharedKeyCredential) sign(request pipeline.Request) (string, error) {
+	if d := request.Header.Get(headerXmsDate); d == "" {
+		request.Header[headerXmsDate] = []string{time.Now().UTC().Format(http.TimeFormat)}
+	}
+	stringToSign, err := f.buildStringToSign(request)
+	if err != nil {
+		return "", err
+	}
+	signature := f.ComputeHMACSHA256(stringToSign)
+	authHeader := strings.Join([]string{"SharedKey ", f.accountName, ":", signature}, "")
+	request.Header[headerAuthorization] = []string{authHeader}
+	return stringToSign, nil
+}
+
 // Constants ensuring that header names are correctly spelled and consistently cased.
 const (
 	headerAuthorization      = "Authorization"
@@ -3,6 +3,10 @@ package azblob
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync/atomic"
 
 	"runtime"
@@ -12,6 +16,10 @@ import (
 	"github.com/Azure/azure-pipeline-go/pipeline"
 )
 
+// rejectionRefreshInterval is how long rejected requests don't refresh the token after a refresh left it unchanged,
+// so that a token that can't be refreshed isn't refreshed for every request sent with it.
+const rejectionRefreshInterval = 5 * time.Second
+
 // TokenRefresher represents a callback method that you write; this method is called periodically
 // so you can refresh the token credential's value.
 type TokenRefresher func(credential TokenCredential) time.Duration
@@ -41,7 +49,36 @@ func tokenCredentialPointers(credential TokenCredential) *string {
 // TokenCredential object from ever invoking tokenRefresher again. Also, one way to deal with failing to refresh a
 // token is to cancel a context.Context object used by requests that have the TokenCredential object in their pipeline.
 func NewTokenCredential(initialToken string, tokenRefresher TokenRefresher) TokenCredential {
-	tc := &tokenCredential{}
+	if tokenRefresher == nil {
+		return newTokenCredential(initialToken, nil, false)
+	}
+	return newTokenCredential(initialToken, func(credential TokenCredential, _ *TokenChallenge) time.Duration {
+		return tokenRefresher(credential)
+	}, false)
+}
+
+// ChallengeTokenRefresher represents a callback method that you write to refresh a token credential's value, like a
+// TokenRefresher. challenge is nil when it is called periodically, and is the service's challenge when it is called
+// because the service rejected the token.
+type ChallengeTokenRefresher func(credential TokenCredential, challenge *TokenChallenge) time.Duration
+
+// NewChallengeTokenCredential creates a token credential like NewTokenCredential, whose token is also refreshed when
+// the service rejects it: when a request fails with 401 (Unauthorized) because its token is invalid or expired, such
+// as after it was revoked or the clock jumped, tokenRefresher is called right away and the request is sent once more
+// with the new token. Requests rejected while the token is being refreshed wait for that refresh instead of
+// refreshing it again. If a refresh leaves the token unchanged, requests rejected in the next few seconds fail
+// without refreshing it again.
+//
+// The challenge passed to tokenRefresher has the authority and tenant the service expects tokens from, which only a
+// custom tokenRefresher receives. The credentials of this package, such as NewClientSecretCredential's, get tokens
+// from their configured authority and tenant even when a tenant-scoped request is rejected, since sending a client's
+// credentials to an authority named by a response would be unsafe.
+func NewChallengeTokenCredential(initialToken string, tokenRefresher ChallengeTokenRefresher) TokenCredential {
+	return newTokenCredential(initialToken, tokenRefresher, tokenRefresher != nil)
+}
+
+func newTokenCredential(initialToken string, tokenRefresher ChallengeTokenRefresher, refreshOnChallenge bool) TokenCredential {
+	tc := &tokenCredential{refreshOnChallenge: refreshOnChallenge}
 	tc.SetToken(initialToken) // We don't set it above to guarantee atomicity
 	if tokenRefresher == nil {
 		return tc // If no callback specified, return the simple tokenCredential
@@ -85,9 +122,17 @@ type tokenCredential struct {
 
 	// The members below are only used if the user specified a tokenRefresher callback function.
 	timer          *time.Timer
-	tokenRefresher TokenRefresher
+	tokenRefresher ChallengeTokenRefresher
 	lock           sync.Mutex
 	stopped        bool
+	refreshing     chan struct{} // closed when the refresh in progress, if any, finishes
+	refreshes      int           // counts refreshes, so that a timer set before the latest refresh does nothing
+
+	// rejectionRefreshFailed is when refreshing a rejected token last left it unchanged.
+	rejectionRefreshFailed time.Time
+
+	// refreshOnChallenge makes requests whose token is rejected refresh it and be sent again.
+	refreshOnChallenge bool
 }
 
 // credentialMarker is a package-internal method that exists just to satisfy the Credential interface.
@@ -101,24 +146,76 @@ func (f *tokenCredential) SetToken(token string) { f.token.Store(token) }
 
 // startRefresh calls refresh which immediately calls tokenRefresher
 // and then starts a timer to call tokenRefresher in the future.
-func (f *tokenCredential) startRefresh(tokenRefresher TokenRefresher) {
+func (f *tokenCredential) startRefresh(tokenRefresher ChallengeTokenRefresher) {
+	f.lock.Lock()
 	f.tokenRefresher = tokenRefresher
 	f.stopped = false // In case user calls StartRefresh, StopRefresh, & then StartRefresh again
-	f.refresh()
-}
-
-// refresh calls the user's tokenRefresher so they can refresh the token (by
-// calling SetToken) and then starts another time (based on the returned duration)
-// in order to refresh the token again in the future.
-func (f *tokenCredential) refresh() {
-	d := f.tokenRefresher(f) // Invoke the user's refresh callback outside of the lock
-	if d > 0 {               // If duration is 0 or negative, refresher wants to not be called again
-		f.lock.Lock()
-		if !f.stopped {
-			f.timer = time.AfterFunc(d, f.refresh)
+	f.refresh(nil)
+}
+
+// refresh, called with the lock held, releases it and calls the user's tokenRefresher
+// so they can refresh the token (by calling SetToken) and then starts another timer
+// (based on the returned duration) in order to refresh the token again in the future.
+func (f *tokenCredential) refresh(challenge *TokenChallenge) {
+	done := make(chan struct{})
+	f.refreshing = done
+	if f.timer != nil {
+		f.timer.Stop() // The next refresh is scheduled below
+	}
+	f.lock.Unlock()
+
+	d := f.tokenRefresher(f, challenge) // Invoke the user's refresh callback outside of the lock
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.refreshing = nil
+	close(done)
+	f.refreshes++
+	if d > 0 && !f.stopped { // If duration is 0 or negative, refresher wants to not be called again
+		refreshes := f.refreshes
+		f.timer = time.AfterFunc(d, func() { f.refreshOnTimer(refreshes) })
+	}
+}
+
+// refreshOnTimer refreshes the token when the timer set after the refreshes-th refresh fires,
+// unless the token was refreshed since because the service rejected it.
+func (f *tokenCredential) refreshOnTimer(refreshes int) {
+	f.lock.Lock()
+	if f.refreshes != refreshes || f.refreshing != nil || f.stopped {
+		f.lock.Unlock()
+		return
+	}
+	f.refresh(nil)
+}
+
+// refreshOnRejection refreshes the token after the service rejected it with the challenge. If the token is being
+// refreshed already, it waits for that refresh instead, so that requests rejected together refresh the token once.
+// It doesn't refresh the token within rejectionRefreshInterval of a refresh that left it unchanged.
+func (f *tokenCredential) refreshOnRejection(ctx context.Context, challenge *TokenChallenge) error {
+	f.lock.Lock()
+	if done := f.refreshing; done != nil {
+		f.lock.Unlock()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
+	if !f.rejectionRefreshFailed.IsZero() && time.Since(f.rejectionRefreshFailed) < rejectionRefreshInterval {
 		f.lock.Unlock()
+		return nil
 	}
+	token := f.Token()
+	f.refresh(challenge)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Token() == token {
+		f.rejectionRefreshFailed = time.Now()
+	} else {
+		f.rejectionRefreshFailed = time.Time{}
+	}
+	return nil
 }
 
 // stopRefresh stops any pending timer and sets stopped field to true to prevent
@@ -140,7 +237,143 @@ func (f *tokenCredential) New(next pipeline.Policy, po *pipeline.PolicyOptions)
 			// HTTPS must be used, otherwise the tokens are at the risk of being exposed
 			return nil, errors.New("token credentials require a URL using the https protocol scheme")
 		}
-		request.Header[headerAuthorization] = []string{"Bearer " + f.Token()}
-		return next.Do(ctx, request)
+		token := f.Token()
+		request.Header[headerAuthorization] = []string{"Bearer " + token}
+		response, err := next.Do(ctx, request)
+		if !f.refreshOnChallenge {
+			return response, err
+		}
+		challenge := rejectedTokenChallenge(response)
+		if challenge == nil || request.RewindBody() != nil {
+			return response, err
+		}
+		if f.Token() == token { // Unless the token was refreshed while the request was sent
+			if err := f.refreshOnRejection(ctx, challenge); err != nil {
+				response.Response().Body.Close()
+				return nil, err
+			}
+			if f.Token() == token {
+				return response, err // Refreshing the token failed, so sending the request again would fail too
+			}
+		}
+		response.Response().Body.Close()
+		token = f.Token()
+		request.Header[headerAuthorization] = []string{"Bearer " + token}
+		response, err = next.Do(ctx, request)
+		if po.ShouldLog(pipeline.LogWarning) {
+			po.Log(pipeline.LogWarning, fmt.Sprintf("Request's token was rejected (%s) and the request was sent again with a refreshed token, err=%v", challenge.Error, err))
+		}
+		return response, err
 	})
 }
+
+// /////////////////////////////////////////////////////////////////////////////
+
+// TokenChallenge is the Bearer challenge in the WWW-Authenticate header of a response that rejected a request's
+// token, which tells where to get a valid token.
+type TokenChallenge struct {
+	// AuthorizationURI is the authorization endpoint of the Azure AD tenant that issues tokens for the account, such
+	// as https://login.microsoftonline.com/{tenant}/oauth2/authorize; AuthorityHost and TenantID are parsed from it.
+	AuthorizationURI string
+	AuthorityHost    string
+	TenantID         string
+
+	// Resource is the resource that tokens must be for, such as https://storage.azure.com.
+	Resource string
+
+	// Error and ErrorDescription describe why the token was rejected, such as "invalid_token", if the service says.
+	Error            string
+	ErrorDescription string
+}
+
+// rejectedTokenChallenge returns the challenge of a response that rejected a request's token as invalid or expired,
+// or nil if it didn't: a 401 response with a Bearer challenge whose error is invalid_token or, as the service
+// doesn't always give one, whose error code is InvalidAuthenticationInfo.
+func rejectedTokenChallenge(response pipeline.Response) *TokenChallenge {
+	if response == nil || response.Response() == nil || response.Response().StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	header := response.Response().Header
+	for _, wwwAuthenticate := range header.Values("WWW-Authenticate") {
+		if challenge, ok := parseBearerChallenge(wwwAuthenticate); ok {
+			if challenge.Error == "invalid_token" ||
+				(challenge.Error == "" && header.Get("x-ms-error-code") == string(ServiceCodeInvalidAuthenticationInfo)) {
+				return &challenge
+			}
+		}
+	}
+	return nil
+}
+
+// parseBearerChallenge parses the Bearer challenge of a WWW-Authenticate header, whose parameters are separated by
+// spaces or commas and whose values may be quoted, as in
+//
+//	Bearer authorization_uri=https://login.microsoftonline.com/{tenant}/oauth2/authorize resource_id=https://storage.azure.com
+//
+// It returns false if there's no Bearer challenge.
+func parseBearerChallenge(wwwAuthenticate string) (TokenChallenge, bool) {
+	const separators = " ,\t"
+	params := map[string]string{}
+	bearer, inBearer := false, false
+	for s := wwwAuthenticate; ; {
+		s = strings.TrimLeft(s, separators)
+		if s == "" {
+			break
+		}
+		end := strings.IndexAny(s, separators+"=")
+		if end < 0 {
+			end = len(s)
+		}
+		name := s[:end]
+		s = s[end:]
+		if !strings.HasPrefix(s, "=") { // An authentication scheme, which starts a challenge
+			if inBearer {
+				break // The Bearer challenge is followed by another one
+			}
+			inBearer = strings.EqualFold(name, "Bearer")
+			bearer = bearer || inBearer
+			continue
+		}
+		s = s[1:]
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++ // An escaped character
+				}
+				value.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // The closing quote
+			}
+			s = s[i:]
+		} else {
+			end = strings.IndexAny(s, separators)
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		if inBearer {
+			params[strings.ToLower(name)] = value.String()
+		}
+	}
+	if !bearer {
+		return TokenChallenge{}, false
+	}
+	c := TokenChallenge{Resource: params["resource_id"], Error: params["error"], ErrorDescription: params["error_description"]}
+	if c.Resource == "" {
+		c.Resource = params["resource"]
+	}
+	c.AuthorizationURI = params["authorization_uri"]
+	if c.AuthorizationURI == "" {
+		c.AuthorizationURI = params["authorization"]
+	}
+	if u, err := url.Parse(c.AuthorizationURI); err == nil && u.Host != "" {
+		c.AuthorityHost = u.Scheme + "://" + u.Host + "/"
+		c.TenantID = strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	}
+	return c, true
+}
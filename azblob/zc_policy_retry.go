@@ -207,6 +207,9 @@ func NewRetryPolicyFactory(o RetryOptions) pipeline.Factory {
 					response.Response().Body = &deadlineExceededReadCloser{r: response.Response().Body}
 				}*/
 				logf("Err=%v, response=%v\n", err, response)
+				if stErr, ok := err.(StorageError); ok && stErr.Response() != nil && stErr.Response().StatusCode == http.StatusServiceUnavailable {
+					notifyServerBusy(ctx) // Lets auto-tuned transfers lower their parallelism
+				}
 
 				action := "" // This MUST get changed within the switch code below
 				switch {
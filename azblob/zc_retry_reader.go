@@ -58,6 +58,19 @@ type RetryReaderOptions struct {
 	TreatEarlyCloseAsError bool
 
 	ClientProvidedKeyOptions ClientProvidedKeyOptions
+
+	// Decompress, if true, makes DownloadResponse.Body decode the blob's content with the Compression registered for
+	// its Content-Encoding (see RegisterCompression). Content without a Content-Encoding is returned as is; a
+	// Content-Encoding without a registered Compression makes reading the body fail. Only decode the body of a
+	// download of the whole blob, since a range of compressed content can't be decoded on its own.
+	Decompress bool
+
+	// ClientSideEncryption, if its KeyWrapper or KeyResolver is set, makes DownloadResponse.Body decrypt a
+	// client-side encrypted blob; otherwise the body of such a blob is its encrypted content. Reading the body fails
+	// if the blob isn't client-side encrypted, or if the download doesn't start at an encrypted region, as a download
+	// of the whole blob does. DownloadBlobToBuffer and DownloadBlobToFile decrypt with
+	// DownloadFromBlobOptions.ClientSideEncryption instead.
+	ClientSideEncryption ClientSideEncryptionOptions
 }
 
 // retryReader implements io.ReaderCloser methods.
@@ -3,6 +3,7 @@ package azblob
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -109,3 +110,9 @@ func (e *storageError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) (err
 	}
 	return nil
 }
+
+// isNotFound returns true if the error is a StorageError for a blob or container that doesn't exist.
+func isNotFound(err error) bool {
+	var stgErr StorageError
+	return errors.As(err, &stgErr) && stgErr.Response() != nil && stgErr.Response().StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,286 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+// uploadFakeBlob overwrites the blob with the content.
+func uploadFakeBlob(c *chk.C, blobURL BlockBlobURL, content string, tags BlobTagsMap) {
+	_, err := blobURL.Upload(ctx, strings.NewReader(content), BlobHTTPHeaders{}, Metadata{"content": content},
+		BlobAccessConditions{}, DefaultAccessTier, tags, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+}
+
+// downloadFakeBlob returns the content of the blob.
+func downloadFakeBlob(c *chk.C, blobURL BlobURL) string {
+	dr, err := blobURL.Download(ctx, 0, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	body := dr.Body(RetryReaderOptions{})
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	c.Assert(err, chk.IsNil)
+	return string(data)
+}
+
+func (s *aztestsSuite) TestListHistoryOfVersionedBlob(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	fake.versioning = true
+	containerURL := newFakeContainer(c, fake, "docs")
+	blobURL := containerURL.NewBlockBlobURL("doc")
+	uploadFakeBlob(c, blobURL, "one", nil)
+	uploadFakeBlob(c, blobURL, "two", nil)
+	_, err := blobURL.CreateSnapshot(ctx, nil, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	_, err = blobURL.SetMetadata(ctx, Metadata{"content": "two, again"}, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	// Blobs whose names start with the blob's name aren't part of its history.
+	uploadFakeBlob(c, containerURL.NewBlockBlobURL("doc.bak"), "other", nil)
+	uploadFakeBlob(c, containerURL.NewBlockBlobURL("doc/part"), "other", nil)
+
+	history, err := blobURL.ListHistory(ctx, BlobListingDetails{Metadata: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(history, chk.HasLen, 4)
+	metadata := []string{}
+	for i, item := range history {
+		if i > 0 {
+			c.Assert(item.Time().After(history[i-1].Time()), chk.Equals, true)
+		}
+		c.Assert(item.IsCurrentVersion, chk.Equals, i == len(history)-1)
+		metadata = append(metadata, item.Metadata["content"])
+	}
+	c.Assert(metadata, chk.DeepEquals, []string{"one", "two", "two", "two, again"})
+	c.Assert(history[0].VersionID, chk.Not(chk.Equals), "")
+	c.Assert(history[2].Snapshot, chk.Not(chk.Equals), "")
+
+	c.Assert(downloadFakeBlob(c, history[0].URL()), chk.Equals, "one")
+	c.Assert(downloadFakeBlob(c, history[2].URL()), chk.Equals, "two")
+	c.Assert(NewBlobURLParts(history[0].URL().URL()).VersionID, chk.Equals, history[0].VersionID)
+	c.Assert(NewBlobURLParts(history[2].URL().URL()).Snapshot, chk.Equals, history[2].Snapshot)
+	c.Assert(history[3].URL().URL(), chk.DeepEquals, blobURL.URL())
+
+	// The history is the same from a URL of one of the versions.
+	fromVersion, err := history[0].URL().ListHistory(ctx, BlobListingDetails{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fromVersion, chk.HasLen, 4)
+}
+
+func (s *aztestsSuite) TestListHistoryWithoutVersioning(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "docs")
+	blobURL := containerURL.NewBlockBlobURL("doc")
+	uploadFakeBlob(c, blobURL, "one", nil)
+	snapshot, err := blobURL.CreateSnapshot(ctx, nil, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	_, err = blobURL.Upload(ctx, bytes.NewReader([]byte("two")), BlobHTTPHeaders{}, nil, BlobAccessConditions{},
+		DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	history, err := blobURL.ListHistory(ctx, BlobListingDetails{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(history, chk.HasLen, 2)
+	c.Assert(history[0].Snapshot, chk.Equals, snapshot.Snapshot())
+	c.Assert(history[0].IsCurrentVersion, chk.Equals, false)
+	c.Assert(history[1].IsCurrentVersion, chk.Equals, true)
+	c.Assert(history[1].VersionID, chk.Equals, "")
+	c.Assert(downloadFakeBlob(c, history[0].URL()), chk.Equals, "one")
+	c.Assert(downloadFakeBlob(c, history[1].URL()), chk.Equals, "two")
+}
+
+// fakeBlobTags returns the index tags of the blob.
+func fakeBlobTags(c *chk.C, blobURL BlobURL) BlobTagsMap {
+	tags, err := blobURL.getTagsMap(ctx)
+	c.Assert(err, chk.IsNil)
+	return tags
+}
+
+func (s *aztestsSuite) TestRestoreFromVersionPollsCopy(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	fake.versioning = true
+	fake.copyPolls = 2
+	blobURL := newFakeContainer(c, fake, "docs").NewBlockBlobURL("doc")
+	uploadFakeBlob(c, blobURL, "one", BlobTagsMap{"v": "1"})
+	uploadFakeBlob(c, blobURL, "two", BlobTagsMap{"v": "2"})
+	history, err := blobURL.ListHistory(ctx, BlobListingDetails{})
+	c.Assert(err, chk.IsNil)
+
+	etag, err := blobURL.RestoreFrom(ctx, history[0].VersionID, "", RestoreOptions{PollInterval: time.Millisecond})
+	c.Assert(err, chk.IsNil)
+	props, err := blobURL.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.ETag(), chk.Equals, etag)
+	c.Assert(props.NewMetadata(), chk.DeepEquals, Metadata{"content": "one"})
+	c.Assert(downloadFakeBlob(c, blobURL.BlobURL), chk.Equals, "one")
+	c.Assert(fakeBlobTags(c, blobURL.BlobURL), chk.DeepEquals, BlobTagsMap{"v": "1"})
+	// The source's properties, the polls until the copy succeeds, and the properties above
+	c.Assert(fake.requestCount(http.MethodHead, ""), chk.Equals, 1+(fake.copyPolls+1)+1)
+
+	// The restore is a new version; the one it replaced is kept.
+	history, err = blobURL.ListHistory(ctx, BlobListingDetails{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(history, chk.HasLen, 3)
+
+	_, err = blobURL.RestoreFrom(ctx, history[1].VersionID, "", RestoreOptions{AccessConditions: BlobAccessConditions{
+		ModifiedAccessConditions: ModifiedAccessConditions{IfMatch: history[1].Properties.Etag}}})
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	_, err = blobURL.RestoreFrom(ctx, history[1].VersionID, history[1].VersionID, RestoreOptions{})
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *aztestsSuite) TestRestoreFromSnapshotKeepsCurrentMetadataAndTags(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	blobURL := newFakeContainer(c, fake, "docs").NewBlockBlobURL("doc")
+	uploadFakeBlob(c, blobURL, "one", BlobTagsMap{"v": "1"})
+	snapshot, err := blobURL.CreateSnapshot(ctx, nil, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	_, err = blobURL.Upload(ctx, strings.NewReader("two"), BlobHTTPHeaders{}, nil, BlobAccessConditions{},
+		DefaultAccessTier, BlobTagsMap{"v": "2"}, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+	requiresSync := false
+	fake.beforeRequest = func(r *http.Request) {
+		if r.Header.Get("x-ms-copy-source") != "" {
+			requiresSync = r.Header.Get("x-ms-requires-sync") == "true"
+		}
+	}
+
+	// A source authorization allows a synchronous copy.
+	_, err = blobURL.RestoreFrom(ctx, "", snapshot.Snapshot(), RestoreOptions{KeepCurrentMetadata: true, KeepCurrentTags: true,
+		SourceAuthorization: NewTokenCredential("token", nil)})
+	c.Assert(err, chk.IsNil)
+	c.Assert(requiresSync, chk.Equals, true)
+	c.Assert(downloadFakeBlob(c, blobURL.BlobURL), chk.Equals, "one")
+	props, err := blobURL.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.NewMetadata(), chk.HasLen, 0)
+	c.Assert(fakeBlobTags(c, blobURL.BlobURL), chk.DeepEquals, BlobTagsMap{"v": "2"})
+}
+
+func (s *aztestsSuite) TestRestoreToTime(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	fake.versioning = true
+	containerURL := newFakeContainer(c, fake, "docs")
+	blob := func(name string) BlockBlobURL {
+		return containerURL.NewBlockBlobURL(name)
+	}
+	uploadFakeBlob(c, blob("logs/changed"), "before", nil)
+	uploadFakeBlob(c, blob("logs/unchanged"), "before", nil)
+	uploadFakeBlob(c, blob("logs/deleted"), "before", nil)
+	uploadFakeBlob(c, blob("logs/deleted-before"), "before", nil)
+	_, err := blob("logs/deleted-before").Delete(ctx, DeleteSnapshotsOptionNone, BlobAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	uploadFakeBlob(c, blob("logs/deleted-unchanged"), "before", nil)
+	uploadFakeBlob(c, blob("other"), "before", nil)
+	restoreTime := time.Now()
+	// Creation times are reported to the second, so the blobs below are created in the next one.
+	time.Sleep(restoreTime.Truncate(time.Second).Add(time.Second).Sub(restoreTime))
+	uploadFakeBlob(c, blob("logs/changed"), "after", nil)
+	uploadFakeBlob(c, blob("logs/deleted"), "after", nil)
+	uploadFakeBlob(c, blob("logs/created"), "after", nil)
+	uploadFakeBlob(c, blob("logs/created-and-deleted"), "after", nil)
+	uploadFakeBlob(c, blob("other"), "after", nil)
+	for _, name := range []string{"logs/deleted", "logs/deleted-unchanged", "logs/created-and-deleted"} {
+		_, err := blob(name).Delete(ctx, DeleteSnapshotsOptionNone, BlobAccessConditions{})
+		c.Assert(err, chk.IsNil)
+	}
+
+	results, err := containerURL.RestoreToTime(ctx, "logs/", restoreTime, RestoreToTimeOptions{})
+	c.Assert(err, chk.IsNil)
+	actions := map[string]BlobRestoreAction{}
+	for _, r := range results {
+		c.Assert(r.Err, chk.IsNil)
+		actions[r.Name] = r.Action
+	}
+	c.Assert(actions, chk.DeepEquals, map[string]BlobRestoreAction{
+		"logs/changed":             BlobRestoreRestored,
+		"logs/created":             BlobRestoreSkipped,
+		"logs/created-and-deleted": BlobRestoreUnchanged,
+		"logs/deleted":             BlobRestoreRestored,
+		"logs/deleted-before":      BlobRestoreSkipped,
+		"logs/deleted-unchanged":   BlobRestoreSkipped,
+		"logs/unchanged":           BlobRestoreUnchanged,
+	})
+	c.Assert(results[0].From.Time().After(restoreTime), chk.Equals, false)
+	c.Assert(downloadFakeBlob(c, blob("logs/changed").BlobURL), chk.Equals, "before")
+	c.Assert(downloadFakeBlob(c, blob("logs/deleted").BlobURL), chk.Equals, "before")
+	c.Assert(fake.blob("docs", "logs/deleted-before"), chk.IsNil)
+	c.Assert(downloadFakeBlob(c, blob("other").BlobURL), chk.Equals, "after")
+
+	results, err = containerURL.RestoreToTime(ctx, "logs/", restoreTime, RestoreToTimeOptions{DeleteCreatedAfter: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(results[1].Name, chk.Equals, "logs/created")
+	c.Assert(results[1].Action, chk.Equals, BlobRestoreDeleted)
+	c.Assert(results[1].Err, chk.IsNil)
+	c.Assert(fake.blob("docs", "logs/created"), chk.IsNil)
+
+	// Deleted blobs that didn't change after the time are only restored when asked to, since listing their versions
+	// doesn't tell whether they were deleted before the time.
+	results, err = containerURL.RestoreToTime(ctx, "logs/deleted-", restoreTime, RestoreToTimeOptions{RestoreDeletedUnchanged: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(results, chk.HasLen, 2)
+	for _, r := range results {
+		c.Assert(r.Action, chk.Equals, BlobRestoreRestored)
+		c.Assert(r.Err, chk.IsNil)
+		c.Assert(downloadFakeBlob(c, blob(r.Name).BlobURL), chk.Equals, "before")
+	}
+}
+
+func (s *aztestsSuite) TestRestoreToTimeStopsWhenCancelled(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "docs")
+	restoreTime := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		uploadFakeBlob(c, containerURL.NewBlockBlobURL(fmt.Sprintf("blob-%d", i)), "after", nil)
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fake.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodDelete {
+			cancel()
+		}
+	}
+
+	// Deleting the first blob cancels the restore while the next one waits for it, so the others aren't started.
+	results, err := containerURL.RestoreToTime(cancelCtx, "", restoreTime, RestoreToTimeOptions{DeleteCreatedAfter: true, Parallelism: 1})
+	c.Assert(err, chk.Equals, context.Canceled)
+	c.Assert(results, chk.HasLen, 1)
+	c.Assert(results[0].Name, chk.Equals, "blob-0")
+}
+
+func (s *aztestsSuite) TestRestoreToTimeKeepsBlobsModifiedAfterTime(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "docs")
+	blob := func(name string) BlockBlobURL {
+		return containerURL.NewBlockBlobURL(name)
+	}
+	// Without versioning or snapshots, a blob modified after the time can't be restored, and must not be deleted.
+	uploadFakeBlob(c, blob("modified"), "before", nil)
+	restoreTime := time.Now()
+	time.Sleep(restoreTime.Truncate(time.Second).Add(time.Second).Sub(restoreTime))
+	uploadFakeBlob(c, blob("modified"), "after", nil)
+	uploadFakeBlob(c, blob("created"), "after", nil)
+
+	results, err := containerURL.RestoreToTime(ctx, "", restoreTime, RestoreToTimeOptions{DeleteCreatedAfter: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(results, chk.HasLen, 2)
+	c.Assert(results[0].Name, chk.Equals, "created")
+	c.Assert(results[0].Action, chk.Equals, BlobRestoreDeleted)
+	c.Assert(results[1].Name, chk.Equals, "modified")
+	c.Assert(results[1].Action, chk.Equals, BlobRestoreSkipped)
+	c.Assert(results[1].Err, chk.IsNil)
+	c.Assert(fake.blob("docs", "created"), chk.IsNil)
+	c.Assert(downloadFakeBlob(c, blob("modified").BlobURL), chk.Equals, "after")
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -650,3 +651,126 @@ func (s *aztestsSuite) TestFilterBlobsUsingAccountSAS(c *chk.C) {
 	_, err = serviceURL.FindBlobsByTags(ctx, nil, nil, &where, Marker{}, nil)
 	c.Assert(err, chk.IsNil)
 }
+
+func (s *aztestsSuite) TestTagFilterSerializes(c *chk.C) {
+	where, err := Tag("env").Eq("prod").And(Tag("date").Gt("2024-01-01"), ContainerIs("logs")).Where()
+	c.Assert(err, chk.IsNil)
+	c.Assert(where, chk.Equals, `"env" = 'prod' AND "date" > '2024-01-01' AND @container = 'logs'`)
+
+	ifTags, err := Tag("owner").Ne("ops").And(Tag("tier").Eq("hot").Or(Tag("tier").Le("warm"))).IfTags()
+	c.Assert(err, chk.IsNil)
+	c.Assert(ifTags, chk.Equals, `"owner" <> 'ops' AND ("tier" = 'hot' OR "tier" <= 'warm')`)
+
+	ifTags, err = Tag("a").Eq("1").And(Tag("b").Ge("2")).Or(Tag("c").Lt("3")).IfTags()
+	c.Assert(err, chk.IsNil)
+	c.Assert(ifTags, chk.Equals, `"a" = '1' AND "b" >= '2' OR "c" < '3'`)
+
+	// Values that could end the quoted string, and expressions a kind of request doesn't support, are rejected
+	_, err = Tag("env").Eq("prod' OR 'a' = 'a").Where()
+	c.Assert(err, chk.ErrorMatches, `tag value .* has the character '\\'', .*`)
+	_, err = Tag(`env" = 'x`).Eq("prod").IfTags()
+	c.Assert(err, chk.NotNil)
+	_, err = Tag("").Eq("prod").Where()
+	c.Assert(err, chk.NotNil)
+	_, err = Tag(strings.Repeat("k", TagKeyMaxLength+1)).Eq("prod").Where()
+	c.Assert(err, chk.NotNil)
+	_, err = Tag("env").Eq(strings.Repeat("v", TagValueMaxLength+1)).Where()
+	c.Assert(err, chk.NotNil)
+	_, err = Tag("env").Eq("prod").Or(Tag("env").Eq("dev")).Where()
+	c.Assert(err, chk.NotNil)
+	_, err = Tag("env").Ne("prod").Where()
+	c.Assert(err, chk.NotNil)
+	_, err = Tag("env").Eq("prod").And(ContainerIs("logs")).IfTags()
+	c.Assert(err, chk.NotNil)
+	_, err = ContainerIs("Logs").Where()
+	c.Assert(err, chk.NotNil)
+	_, err = TagFilter{}.Where()
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *aztestsSuite) TestFindBlobsByTagFilter(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	for _, container := range []string{"logs", "metrics"} {
+		containerURL := newFakeContainer(c, fake, container)
+		createFakeBlobs(c, containerURL, BlobTagsMap{"env": "prod", "date": "2023-12-31"}, "old")
+		createFakeBlobs(c, containerURL, BlobTagsMap{"env": "prod", "date": "2024-02-01"}, "new")
+		createFakeBlobs(c, containerURL, BlobTagsMap{"env": "dev", "date": "2024-02-01"}, "dev")
+	}
+
+	where, err := Tag("env").Eq("prod").And(Tag("date").Gt("2024"), ContainerIs("metrics")).Where()
+	c.Assert(err, chk.IsNil)
+	pager := fake.serviceURL().NewBlobsByTagsPager(where, 0)
+	found := []string{}
+	for pager.Next(ctx) {
+		found = append(found, pager.Item().ContainerName+"/"+pager.Item().Name)
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(found, chk.DeepEquals, []string{"metrics/new"})
+}
+
+func (s *aztestsSuite) TestBlobAccessConditionsIfTags(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, BlobTagsMap{"env": "prod", "stage": "2"}, "blob")
+	blobURL := containerURL.NewBlockBlobURL("blob")
+
+	notMatched, err := Tag("env").Eq("dev").IfTags()
+	c.Assert(err, chk.IsNil)
+	matched, err := Tag("env").Eq("dev").Or(Tag("env").Eq("prod").And(Tag("stage").Ge("2"))).IfTags()
+	c.Assert(err, chk.IsNil)
+	conditions := func(ifTags string) BlobAccessConditions {
+		return BlobAccessConditions{ModifiedAccessConditions: ModifiedAccessConditions{IfTags: ifTags}}
+	}
+
+	_, err = blobURL.Download(ctx, 0, CountToEnd, conditions(notMatched), false, ClientProvidedKeyOptions{})
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	dr, err := blobURL.Download(ctx, 0, CountToEnd, conditions(matched), false, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	dr.Body(RetryReaderOptions{}).Close()
+
+	_, err = blobURL.SetMetadata(ctx, Metadata{"a": "b"}, conditions(notMatched), ClientProvidedKeyOptions{})
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	_, err = blobURL.SetMetadata(ctx, Metadata{"a": "b"}, conditions(matched), ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	blockID := base64.StdEncoding.EncodeToString([]byte("block"))
+	_, err = blobURL.StageBlock(ctx, blockID, strings.NewReader("data"), LeaseAccessConditions{}, nil, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	_, err = blobURL.CommitBlockList(ctx, []string{blockID}, BlobHTTPHeaders{}, nil, conditions(notMatched), DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	_, err = blobURL.CommitBlockList(ctx, []string{blockID}, BlobHTTPHeaders{}, nil, conditions(matched), DefaultAccessTier, BlobTagsMap{"env": "prod"}, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	// The committed blob no longer has the stage tag.
+	_, err = blobURL.Delete(ctx, DeleteSnapshotsOptionNone, conditions(matched))
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	notDev, err := Tag("env").Ne("dev").IfTags()
+	c.Assert(err, chk.IsNil)
+	_, err = blobURL.Delete(ctx, DeleteSnapshotsOptionNone, conditions(notDev))
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *aztestsSuite) TestCopyIfTagsAreSent(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	var ifTags, sourceIfTags string
+	fake.beforeRequest = func(r *http.Request) {
+		ifTags, sourceIfTags = r.Header.Get("x-ms-if-tags"), r.Header.Get("x-ms-source-if-tags")
+	}
+
+	source := containerURL.NewBlobURL("source").URL()
+	srcac := ModifiedAccessConditions{IfTags: `"env" = 'prod'`}
+	dstac := BlobAccessConditions{ModifiedAccessConditions: ModifiedAccessConditions{IfTags: `"copy" = 'allowed'`}}
+	containerURL.NewBlobURL("destination").StartCopyFromURL(ctx, source, nil, srcac, dstac, DefaultAccessTier, nil)
+	c.Assert(ifTags, chk.Equals, dstac.IfTags)
+	c.Assert(sourceIfTags, chk.Equals, srcac.IfTags)
+
+	// Operations the service doesn't support source tag conditions on reject them instead of ignoring them.
+	_, err := containerURL.NewBlockBlobURL("destination").CopyFromURL(ctx, source, nil, srcac, dstac, nil, DefaultAccessTier, nil, ImmutabilityPolicyOptions{}, nil)
+	c.Assert(err, chk.NotNil)
+	_, err = containerURL.Delete(ctx, ContainerAccessConditions{ModifiedAccessConditions: srcac})
+	c.Assert(err, chk.NotNil)
+}
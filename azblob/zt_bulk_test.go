@@ -0,0 +1,142 @@
+package azblob
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	chk "gopkg.in/check.v1"
+)
+
+func bulkStatuses(results []BulkResult) map[string]BulkStatus {
+	statuses := map[string]BulkStatus{}
+	for _, r := range results {
+		statuses[r.Name] = r.Status
+	}
+	return statuses
+}
+
+func (s *aztestsSuite) TestBulkDeleteSkipsChangedBlobs(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, nil, "2023/a", "2023/b", "2023/keep", "2024/a")
+
+	// A blob that changes after it's listed is skipped.
+	changed := false
+	fake.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/2023/b") && !changed {
+			changed = true
+			uploadFakeBlob(c, containerURL.NewBlockBlobURL("2023/b"), "new", nil)
+		}
+	}
+	results, err := containerURL.Bulk(ctx, BulkDelete(DeleteSnapshotsOptionNone), BulkOptions{
+		Prefix: "2023/",
+		Match:  func(item *BlobItemInternal) bool { return !strings.HasSuffix(item.Name, "keep") },
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(results, chk.HasLen, 2)
+	c.Assert(results[0].ETag, chk.Not(chk.Equals), ETagNone)
+	c.Assert(bulkStatuses(results), chk.DeepEquals, map[string]BulkStatus{"2023/a": BulkDone, "2023/b": BulkSkipped})
+	validateStorageError(c, results[1].Err, ServiceCodeConditionNotMet)
+
+	fake.beforeRequest = nil
+	for name, exists := range map[string]bool{"2023/a": false, "2023/b": true, "2023/keep": true, "2024/a": true} {
+		c.Assert(fake.blob("logs", name).exists(), chk.Equals, exists)
+	}
+}
+
+func (s *aztestsSuite) TestBulkSetTierUsesBatch(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	names := []string{}
+	for i := 0; i < BlobBatchMaxOperations+10; i++ {
+		names = append(names, fmt.Sprintf("%03d", i))
+	}
+	createFakeBlobs(c, containerURL, nil, names...)
+
+	results, err := containerURL.Bulk(ctx, BulkSetTier(AccessTierCool, RehydratePriorityNone), BulkOptions{UseBatch: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(results, chk.HasLen, len(names))
+	for _, r := range results {
+		c.Assert(r.Status, chk.Equals, BulkDone)
+		c.Assert(fake.blob("logs", r.Name).tier, chk.Equals, AccessTierCool)
+	}
+	c.Assert(fake.requestCount(http.MethodPost, "batch"), chk.Equals, 2)
+	c.Assert(fake.requestCount(http.MethodPut, "tier"), chk.Equals, 0)
+
+	// Without Blob Batch, each blob gets a request of its own.
+	fake.noBatch = true
+	results, err = containerURL.Bulk(ctx, BulkSetTier(AccessTierHot, RehydratePriorityNone), BulkOptions{UseBatch: true, Parallelism: 1})
+	c.Assert(err, chk.IsNil)
+	for _, r := range results {
+		c.Assert(r.Status, chk.Equals, BulkDone)
+	}
+	c.Assert(fake.requestCount(http.MethodPost, "batch"), chk.Equals, 3)
+	c.Assert(fake.requestCount(http.MethodPut, "tier"), chk.Equals, len(names))
+}
+
+func (s *aztestsSuite) TestBulkBatchDeleteReportsEachBlob(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, nil, "a", "b", "c")
+	_, err := containerURL.NewBlobURL("c").CreateSnapshot(ctx, nil, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	fake.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodPost {
+			uploadFakeBlob(c, containerURL.NewBlockBlobURL("b"), "new", nil)
+		}
+	}
+
+	results, err := containerURL.Bulk(ctx, BulkDelete(DeleteSnapshotsOptionNone), BulkOptions{UseBatch: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(bulkStatuses(results), chk.DeepEquals, map[string]BulkStatus{"a": BulkDone, "b": BulkSkipped, "c": BulkFailed})
+	validateStorageError(c, results[2].Err, ServiceCodeSnapshotsPresent)
+	c.Assert(fake.requestCount(http.MethodDelete, ""), chk.Equals, 0)
+}
+
+func (s *aztestsSuite) TestBulkDryRun(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, nil, "b", "a")
+
+	results, err := containerURL.Bulk(ctx, BulkSetMetadata(Metadata{"archived": "true"}), BulkOptions{DryRun: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(bulkStatuses(results), chk.DeepEquals, map[string]BulkStatus{"a": BulkPlanned, "b": BulkPlanned})
+	c.Assert(results[0].Name, chk.Equals, "a")
+	c.Assert(fake.requestCount(http.MethodPut, "metadata"), chk.Equals, 0)
+
+	results, err = containerURL.Bulk(ctx, BulkSetMetadata(Metadata{"archived": "true"}), BulkOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(bulkStatuses(results), chk.DeepEquals, map[string]BulkStatus{"a": BulkDone, "b": BulkDone})
+	c.Assert(fake.blob("logs", "a").metadata, chk.DeepEquals, Metadata{"archived": "true"})
+}
+
+func (s *aztestsSuite) TestBulkSetTagsWhere(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, BlobTagsMap{"env": "prod"}, "prod/1", "prod/2", "other/1")
+	createFakeBlobs(c, containerURL, BlobTagsMap{"env": "dev"}, "prod/dev")
+	createFakeBlobs(c, newFakeContainer(c, fake, "metrics"), BlobTagsMap{"env": "prod"}, "prod/1")
+	where, err := Tag("env").Eq("prod").Where()
+	c.Assert(err, chk.IsNil)
+
+	// A blob whose tags change after it's found is skipped.
+	changed := false
+	fake.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/prod/2") && !changed {
+			changed = true
+			_, err := containerURL.NewBlobURL("prod/2").SetTags(ctx, nil, nil, nil, BlobTagsMap{"env": "dev"})
+			c.Assert(err, chk.IsNil)
+		}
+	}
+	results, err := containerURL.Bulk(ctx, BulkSetTags(BlobTagsMap{"env": "prod", "retain": "no"}), BulkOptions{Prefix: "prod/", Where: where})
+	c.Assert(err, chk.IsNil)
+	c.Assert(bulkStatuses(results), chk.DeepEquals, map[string]BulkStatus{"prod/1": BulkDone, "prod/2": BulkSkipped})
+	c.Assert(fake.blob("logs", "prod/1").tags, chk.DeepEquals, BlobTagsMap{"env": "prod", "retain": "no"})
+	c.Assert(fake.blob("metrics", "prod/1").tags, chk.DeepEquals, BlobTagsMap{"env": "prod"})
+}
@@ -0,0 +1,253 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	chk "gopkg.in/check.v1"
+)
+
+func (s *aztestsSuite) TestAESKeyWrapRFC3394Vectors(c *chk.C) {
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	tests := []struct {
+		key, wrapped string
+	}{
+		{"00112233445566778899AABBCCDDEEFF", "64E8C3F9CE0F5BA263E9777905818A2A93C8191E7D6E8AE7"},
+		{"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F", "28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21"},
+	}
+	kw, err := NewAESKeyWrapper("kek", kek)
+	c.Assert(err, chk.IsNil)
+	for _, test := range tests {
+		key, _ := hex.DecodeString(test.key)
+		wrapped, algorithm, err := kw.WrapKey(ctx, key)
+		c.Assert(err, chk.IsNil)
+		c.Assert(algorithm, chk.Equals, "A256KW")
+		c.Assert(fmt.Sprintf("%X", wrapped), chk.Equals, test.wrapped)
+
+		unwrapped, err := kw.UnwrapKey(ctx, wrapped, algorithm)
+		c.Assert(err, chk.IsNil)
+		c.Assert(unwrapped, chk.DeepEquals, key)
+
+		wrapped[0]++
+		_, err = kw.UnwrapKey(ctx, wrapped, algorithm)
+		c.Assert(err, chk.NotNil)
+	}
+}
+
+func (s *aztestsSuite) TestClientSideEncryptionRoundTrip(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("secure")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("records")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, chk.IsNil)
+	cse := ClientSideEncryptionOptions{KeyWrapper: NewRSAKeyWrapper("local-rsa", rsaKey)}
+
+	_, data := getRandomDataAndReader(2*clientSideEncryptionRegionDataLength + 123)
+	_, err = UploadBufferToBlockBlob(ctx, data, blobURL, UploadToBlockBlobOptions{Metadata: Metadata{"owner": "compliance"}, ClientSideEncryption: cse})
+	c.Assert(err, chk.IsNil)
+
+	stored := fake.blob("secure", "records")
+	c.Assert(int64(len(stored.data)), chk.Equals, clientSideEncryptedSize(int64(len(data))))
+	c.Assert(bytes.Contains(stored.data, data[:64]), chk.Equals, false)
+	c.Assert(stored.metadata["owner"], chk.Equals, "compliance")
+	var encryptionData map[string]map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(stored.metadata["encryptiondata"]), &encryptionData), chk.IsNil)
+	c.Assert(encryptionData["WrappedContentKey"]["KeyId"], chk.Equals, "local-rsa")
+	c.Assert(encryptionData["WrappedContentKey"]["Algorithm"], chk.Equals, "RSA-OAEP")
+	c.Assert(encryptionData["EncryptionAgent"]["Protocol"], chk.Equals, "2.0")
+	c.Assert(encryptionData["EncryptionAgent"]["EncryptionAlgorithm"], chk.Equals, "AES_GCM_256")
+	c.Assert(encryptionData["EncryptedRegionInfo"]["DataLength"], chk.Equals, float64(clientSideEncryptionRegionDataLength))
+	c.Assert(encryptionData["EncryptedRegionInfo"]["NonceLength"], chk.Equals, float64(12))
+
+	buffer := make([]byte, len(data))
+	err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, 0, CountToEnd, buffer, DownloadFromBlobOptions{ClientSideEncryption: cse})
+	c.Assert(err, chk.IsNil)
+	c.Assert(buffer, chk.DeepEquals, data)
+
+	// A range only downloads the regions that hold it
+	for _, test := range []struct {
+		offset, count int64
+		regions       int
+	}{
+		{clientSideEncryptionRegionDataLength - 10, 20, 2},
+		{clientSideEncryptionRegionDataLength + 5, 100, 1},
+		{2*clientSideEncryptionRegionDataLength + 100, CountToEnd, 1},
+	} {
+		gets := fake.requestCount(http.MethodGet, "")
+		count := test.count
+		if count == CountToEnd {
+			count = int64(len(data)) - test.offset
+		}
+		buffer := make([]byte, count)
+		err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, test.offset, test.count, buffer, DownloadFromBlobOptions{ClientSideEncryption: cse})
+		c.Assert(err, chk.IsNil)
+		c.Assert(buffer, chk.DeepEquals, data[test.offset:test.offset+count])
+		c.Assert(fake.requestCount(http.MethodGet, "")-gets, chk.Equals, test.regions)
+	}
+
+	// The content key can only be unwrapped with the key it was wrapped with
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, chk.IsNil)
+	err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, 0, CountToEnd, buffer, DownloadFromBlobOptions{
+		ClientSideEncryption: ClientSideEncryptionOptions{KeyWrapper: NewRSAKeyWrapper("other-rsa", otherKey)},
+	})
+	c.Assert(err, chk.NotNil)
+
+	// Tampering with the content fails authentication
+	stored.data[clientSideEncryptionRegionLength+100]++
+	err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, 0, CountToEnd, buffer, DownloadFromBlobOptions{ClientSideEncryption: cse})
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *aztestsSuite) TestClientSideEncryptionDecryptsDownloadBody(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("secure")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("records")
+
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	kw, err := NewAESKeyWrapper("local-aes", kek)
+	c.Assert(err, chk.IsNil)
+	cse := ClientSideEncryptionOptions{KeyWrapper: kw}
+	_, data := getRandomDataAndReader(2*clientSideEncryptionRegionDataLength + 123)
+	_, err = UploadBufferToBlockBlob(ctx, data, blobURL, UploadToBlockBlobOptions{ClientSideEncryption: cse})
+	c.Assert(err, chk.IsNil)
+
+	read := func(offset int64, o RetryReaderOptions) ([]byte, error) {
+		dr, err := blobURL.Download(ctx, offset, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+		c.Assert(err, chk.IsNil)
+		body := dr.Body(o)
+		defer body.Close()
+		return ioutil.ReadAll(body)
+	}
+
+	// Without ClientSideEncryption, the body is the encrypted content.
+	content, err := read(0, RetryReaderOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(content, chk.DeepEquals, fake.blob("secure", "records").data)
+
+	content, err = read(0, RetryReaderOptions{MaxRetryRequests: 2, ClientSideEncryption: cse})
+	c.Assert(err, chk.IsNil)
+	c.Assert(content, chk.DeepEquals, data)
+
+	// A download from the start of an encrypted region is decrypted from there.
+	content, err = read(clientSideEncryptionRegionLength, RetryReaderOptions{ClientSideEncryption: cse})
+	c.Assert(err, chk.IsNil)
+	c.Assert(content, chk.DeepEquals, data[clientSideEncryptionRegionDataLength:])
+
+	_, err = read(10, RetryReaderOptions{ClientSideEncryption: cse})
+	c.Assert(err, chk.ErrorMatches, ".*must start at an encrypted region.*")
+
+	// Tampering with the content fails authentication.
+	fake.blob("secure", "records").data[100]++
+	_, err = read(0, RetryReaderOptions{ClientSideEncryption: cse})
+	c.Assert(err, chk.ErrorMatches, "cannot decrypt client-side encrypted region.*")
+	fake.blob("secure", "records").data[100]--
+
+	// The high-level download decrypts its blocks once, with its own ClientSideEncryption.
+	buffer := make([]byte, len(data))
+	err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, 0, CountToEnd, buffer, DownloadFromBlobOptions{
+		ClientSideEncryption: cse, RetryReaderOptionsPerBlock: RetryReaderOptions{ClientSideEncryption: cse}})
+	c.Assert(err, chk.IsNil)
+	c.Assert(buffer, chk.DeepEquals, data)
+
+	// A blob that isn't client-side encrypted can't be decrypted.
+	plainURL := containerURL.NewBlockBlobURL("plain")
+	_, err = UploadBufferToBlockBlob(ctx, data[:100], plainURL, UploadToBlockBlobOptions{})
+	c.Assert(err, chk.IsNil)
+	dr, err := plainURL.Download(ctx, 0, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	_, err = ioutil.ReadAll(dr.Body(RetryReaderOptions{ClientSideEncryption: cse}))
+	c.Assert(err, chk.ErrorMatches, "the blob is not client-side encrypted")
+}
+
+func (s *aztestsSuite) TestClientSideEncryptionStreamAndKeyResolver(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("secure")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("stream")
+
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	kw, err := NewAESKeyWrapper("local-aes", kek)
+	c.Assert(err, chk.IsNil)
+
+	_, data := getRandomDataAndReader(clientSideEncryptionRegionDataLength + 1)
+	_, err = UploadStreamToBlockBlob(ctx, bytes.NewReader(data), blobURL, UploadStreamToBlockBlobOptions{
+		ClientSideEncryption: ClientSideEncryptionOptions{KeyWrapper: kw},
+		Compression:          CompressionGzip,
+	})
+	c.Assert(err, chk.NotNil) // Encrypted data doesn't compress
+	_, err = UploadStreamToBlockBlob(ctx, bytes.NewReader(data), blobURL, UploadStreamToBlockBlobOptions{ClientSideEncryption: ClientSideEncryptionOptions{KeyWrapper: kw}})
+	c.Assert(err, chk.IsNil)
+
+	resolved := ""
+	resolver := ClientSideEncryptionOptions{KeyResolver: func(ctx context.Context, keyID string) (KeyWrapper, error) {
+		resolved = keyID
+		return kw, nil
+	}}
+	file, err := ioutil.TempFile("", "decrypted")
+	c.Assert(err, chk.IsNil)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	err = DownloadBlobToFile(ctx, blobURL.BlobURL, 0, CountToEnd, file, DownloadFromBlobOptions{ClientSideEncryption: resolver})
+	c.Assert(err, chk.IsNil)
+	c.Assert(resolved, chk.Equals, "local-aes")
+	fileData, err := ioutil.ReadFile(file.Name())
+	c.Assert(err, chk.IsNil)
+	c.Assert(fileData, chk.DeepEquals, data)
+}
+
+func (s *aztestsSuite) TestClientSideEncryptionDecryptsOtherSDKFormat(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("secure")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("from-python")
+
+	// Encrypt the way the other SDKs do: a random nonce per region and the metadata they write
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	kw, err := NewAESKeyWrapper("python-kek", kek)
+	c.Assert(err, chk.IsNil)
+	cek := make([]byte, 32)
+	rand.Read(cek)
+	wrapped, _, err := kw.WrapKey(ctx, append([]byte("2.0\x00\x00\x00\x00\x00"), cek...))
+	c.Assert(err, chk.IsNil)
+	aead, err := newContentCipher(cek)
+	c.Assert(err, chk.IsNil)
+	data := []byte("content encrypted by another Azure Storage SDK")
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	encrypted := aead.Seal(append([]byte{}, nonce...), nonce, data, nil)
+	metadata := Metadata{"encryptiondata": `{"WrappedContentKey": {"KeyId": "python-kek", "EncryptedKey": "` +
+		base64.StdEncoding.EncodeToString(wrapped) + `", "Algorithm": "A256KW"}, "EncryptionAgent": {"Protocol": "2.0", ` +
+		`"EncryptionAlgorithm": "AES_GCM_256"}, "EncryptedRegionInfo": {"DataLength": 4194304, "NonceLength": 12}, ` +
+		`"KeyWrappingMetadata": {"EncryptionLibrary": "Python 12.14.0"}}`}
+	_, err = blobURL.Upload(ctx, bytes.NewReader(encrypted), BlobHTTPHeaders{}, metadata, BlobAccessConditions{}, DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	buffer := make([]byte, len(data))
+	err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, 0, CountToEnd, buffer, DownloadFromBlobOptions{ClientSideEncryption: ClientSideEncryptionOptions{KeyWrapper: kw}})
+	c.Assert(err, chk.IsNil)
+	c.Assert(buffer, chk.DeepEquals, data)
+}
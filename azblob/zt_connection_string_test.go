@@ -0,0 +1,109 @@
+package azblob
+
+import (
+	"net/http"
+	"strings"
+
+	chk "gopkg.in/check.v1"
+)
+
+const testAccountKey = "c2VjcmV0IGtleSBmb3IgdGVzdHMgMTIzNDU2Nzg5MA=="
+
+func (s *aztestsSuite) TestParseConnectionString(c *chk.C) {
+	tests := []struct {
+		connectionString string
+		endpoint         string
+		accountName      string
+		sharedKey        bool
+	}{
+		{"DefaultEndpointsProtocol=https;AccountName=myaccount;AccountKey=" + testAccountKey + ";EndpointSuffix=core.windows.net",
+			"https://myaccount.blob.core.windows.net", "myaccount", true},
+		{"accountname=myaccount; accountkey=" + testAccountKey + ";", "https://myaccount.blob.core.windows.net", "myaccount", true},
+		{"DefaultEndpointsProtocol=HTTP;AccountName=myaccount;EndpointSuffix=core.chinacloudapi.cn",
+			"http://myaccount.blob.core.chinacloudapi.cn", "myaccount", false},
+		{"BlobEndpoint=https://myaccount.blob.core.windows.net/;QueueEndpoint=https://myaccount.queue.core.windows.net/;SharedAccessSignature=?sv=2020-02-10&ss=b&sig=abc%3D",
+			"https://myaccount.blob.core.windows.net?sv=2020-02-10&ss=b&sig=abc%3D", "", false},
+		{"BlobEndpoint=https://cdn.example.com;AccountName=myaccount;AccountKey=" + testAccountKey,
+			"https://cdn.example.com", "myaccount", true},
+		{"UseDevelopmentStorage=true", "http://127.0.0.1:10000/devstoreaccount1", "devstoreaccount1", true},
+		{"UseDevelopmentStorage=true;DevelopmentStorageProxyUri=http://azurite", "http://azurite:10000/devstoreaccount1", "devstoreaccount1", true},
+		{"DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=" + DevelopmentStorageAccountKey + ";BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;",
+			"http://127.0.0.1:10000/devstoreaccount1", "devstoreaccount1", true},
+	}
+	for _, test := range tests {
+		cs, err := ParseConnectionString(test.connectionString)
+		c.Assert(err, chk.IsNil, chk.Commentf("%s", test.connectionString))
+		c.Assert(cs.BlobEndpoint.String(), chk.Equals, test.endpoint)
+		c.Assert(cs.AccountName, chk.Equals, test.accountName)
+		credential, sharedKey := cs.Credential.(*SharedKeyCredential)
+		c.Assert(sharedKey, chk.Equals, test.sharedKey)
+		if sharedKey {
+			c.Assert(credential.AccountName(), chk.Equals, test.accountName)
+		}
+	}
+
+	// Azurite's IP endpoint style keeps the account name out of the container name.
+	cs, _ := ParseConnectionString("UseDevelopmentStorage=true")
+	parts := NewBlobURLParts(cs.BlobEndpoint)
+	c.Assert(parts.IPEndpointStyleInfo.AccountName, chk.Equals, DevelopmentStorageAccountName)
+	c.Assert(parts.ContainerName, chk.Equals, "")
+}
+
+func (s *aztestsSuite) TestParseConnectionStringErrors(c *chk.C) {
+	tests := []struct {
+		connectionString string
+		err              string
+	}{
+		{"", "connection string is empty"},
+		{"AccountName=a;" + testAccountKey, "connection string has a setting that isn't of the form name=value"},
+		{"AccountName=a;Key=b", `connection string has the unknown setting "Key"`},
+		{"AccountName=a;accountName=b", "connection string has the setting AccountName more than once"},
+		{"AccountName=", "connection string setting AccountName is empty"},
+		{"AccountKey=" + testAccountKey, "connection string setting AccountKey requires AccountName"},
+		{"AccountName=a;AccountKey=not base64!", "connection string setting AccountKey isn't valid base64"},
+		{"AccountName=a;AccountKey=" + testAccountKey + ";SharedAccessSignature=sig=a", "connection string can't have both AccountKey and SharedAccessSignature"},
+		{"AccountName=a;SharedAccessSignature=sv=2020-02-10", "connection string setting SharedAccessSignature isn't a signed SAS query"},
+		{"EndpointSuffix=core.windows.net", "connection string requires BlobEndpoint or AccountName"},
+		{"AccountName=a;DefaultEndpointsProtocol=ftp", `connection string setting DefaultEndpointsProtocol "ftp" isn't http or https`},
+		{"AccountName=a;EndpointSuffix=example.com/path", `connection string setting EndpointSuffix "example.com/path" isn't a domain name`},
+		{"BlobEndpoint=myaccount.blob.core.windows.net", `connection string setting BlobEndpoint .* isn't an http or https URL without a query`},
+		{"BlobEndpoint=https://a.blob.core.windows.net?sig=a", `connection string setting BlobEndpoint .* isn't an http or https URL without a query`},
+		{"BlobEndpoint=https://a.blob.core.windows.net;EndpointSuffix=core.windows.net", "connection string can't have both BlobEndpoint and EndpointSuffix"},
+		{"UseDevelopmentStorage=false", `connection string setting UseDevelopmentStorage "false" isn't true`},
+		{"UseDevelopmentStorage=true;AccountName=a", "connection string can't have both UseDevelopmentStorage and AccountName"},
+		{"UseDevelopmentStorage=true;DevelopmentStorageProxyUri=azurite", `connection string setting DevelopmentStorageProxyUri "azurite" isn't an http or https URL`},
+		{"AccountName=a;DevelopmentStorageProxyUri=http://azurite", "connection string setting DevelopmentStorageProxyUri requires UseDevelopmentStorage=true"},
+	}
+	for _, test := range tests {
+		_, err := ParseConnectionString(test.connectionString)
+		c.Assert(err, chk.ErrorMatches, test.err, chk.Commentf("%s", test.connectionString))
+		c.Assert(strings.Contains(err.Error(), strings.TrimRight(testAccountKey, "=")), chk.Equals, false)
+	}
+}
+
+func (s *aztestsSuite) TestNewServiceURLFromConnectionString(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	var authorization, sig string
+	fake.beforeRequest = func(r *http.Request) {
+		authorization, sig = r.Header.Get("Authorization"), r.URL.Query().Get("sig")
+	}
+
+	serviceURL, err := NewServiceURLFromConnectionString("BlobEndpoint="+fake.server.URL+"/devstoreaccount1;AccountName=devstoreaccount1;AccountKey="+DevelopmentStorageAccountKey,
+		PipelineOptions{Retry: RetryOptions{MaxTries: 1}, RequestLog: RequestLogOptions{SyslogDisabled: true}})
+	c.Assert(err, chk.IsNil)
+	_, err = serviceURL.NewContainerURL("docs").Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	c.Assert(authorization, chk.Matches, "SharedKey devstoreaccount1:.+")
+
+	serviceURL, err = NewServiceURLFromConnectionString("BlobEndpoint="+fake.server.URL+"/devstoreaccount1;SharedAccessSignature=sv=2020-02-10&sig=abc",
+		PipelineOptions{Retry: RetryOptions{MaxTries: 1}, RequestLog: RequestLogOptions{SyslogDisabled: true}})
+	c.Assert(err, chk.IsNil)
+	_, err = serviceURL.NewContainerURL("docs").GetProperties(ctx, LeaseAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(authorization, chk.Equals, "")
+	c.Assert(sig, chk.Equals, "abc")
+
+	_, err = NewServiceURLFromConnectionString("AccountName=a;Key=b", PipelineOptions{})
+	c.Assert(err, chk.NotNil)
+}
@@ -0,0 +1,65 @@
+//go:build go1.16
+// +build go1.16
+
+package azblob
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing/fstest"
+
+	chk "gopkg.in/check.v1"
+)
+
+func (s *aztestsSuite) TestContainerFSPassesFSTest(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "web")
+	files := map[string]string{
+		"site/index.html":         "<h1>{{.}}</h1>",
+		"site/about.html":         "<p>about</p>",
+		"site/css/site.css":       "body {}",
+		"site/js/app.js":          "app()",
+		"site/js/lib/vendor.js":   "vendor()",
+		"site/empty.txt":          "",
+		"site/js-old/app.js":      "old()",
+		"site/notes//skipped.txt": "names with empty elements aren't FS paths",
+		"other/readme.txt":        "outside the FS",
+	}
+	for name, content := range files {
+		_, err := containerURL.NewBlockBlobURL(name).Upload(ctx, bytes.NewReader([]byte(content)), BlobHTTPHeaders{}, nil,
+			BlobAccessConditions{}, DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+		c.Assert(err, chk.IsNil)
+	}
+
+	fsys := NewContainerFS(ctx, containerURL, "site")
+	err := fstest.TestFS(fsys, "index.html", "about.html", "css/site.css", "js/app.js", "js/lib/vendor.js", "empty.txt", "js-old/app.js")
+	c.Assert(err, chk.IsNil)
+
+	info, err := fs.Stat(fsys, "js/lib/vendor.js")
+	c.Assert(err, chk.IsNil)
+	c.Assert(info.Size(), chk.Equals, int64(len("vendor()")))
+	c.Assert(info.ModTime().Equal(fake.blob("web", "site/js/lib/vendor.js").lastModified.Truncate(1e9)), chk.Equals, true)
+	_, err = fs.Stat(fsys, "missing.txt")
+	c.Assert(err, chk.ErrorMatches, ".*file does not exist")
+	_, err = fsys.ReadDir("index.html")
+	c.Assert(err, chk.NotNil)
+
+	tmpl, err := template.ParseFS(fsys, "*.html")
+	c.Assert(err, chk.IsNil)
+	out := &bytes.Buffer{}
+	c.Assert(tmpl.ExecuteTemplate(out, "index.html", "hello"), chk.IsNil)
+	c.Assert(out.String(), chk.Equals, "<h1>hello</h1>")
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/css/site.css", nil)
+	request.Header.Set("Range", "bytes=2-4")
+	http.FileServer(http.FS(fsys)).ServeHTTP(recorder, request)
+	body, _ := ioutil.ReadAll(recorder.Result().Body)
+	c.Assert(recorder.Code, chk.Equals, http.StatusPartialContent)
+	c.Assert(string(body), chk.Equals, "dy ")
+}
@@ -0,0 +1,314 @@
+package azblob
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+// fakeTokenEndpoint is a stand-in for Azure AD's or a managed identity's token endpoint. respond returns the status
+// and body of the response to the nth request, starting at 1.
+type fakeTokenEndpoint struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	requests []*http.Request
+	respond  func(r *http.Request, n int) (int, string)
+}
+
+func newFakeTokenEndpoint(respond func(r *http.Request, n int) (int, string)) *fakeTokenEndpoint {
+	e := &fakeTokenEndpoint{respond: respond}
+	e.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		e.lock.Lock()
+		e.requests = append(e.requests, r)
+		status, body := e.respond(r, len(e.requests))
+		e.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return e
+}
+
+func (e *fakeTokenEndpoint) requestCount() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.requests)
+}
+
+// azureADToken returns Azure AD's response with a token that expires in the seconds.
+func azureADToken(token string, expiresIn int) string {
+	return fmt.Sprintf(`{"token_type":"Bearer","expires_in":%d,"ext_expires_in":%d,"access_token":%q}`, expiresIn, expiresIn, token)
+}
+
+// waitForToken waits until the credential has the token.
+func waitForToken(c *chk.C, credential TokenCredential, token string) {
+	for start := time.Now(); credential.Token() != token; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			c.Fatalf("the token is %q instead of %q", credential.Token(), token)
+		}
+	}
+}
+
+func (s *aztestsSuite) TestClientSecretCredentialRefreshesToken(c *chk.C) {
+	endpoint := newFakeTokenEndpoint(func(r *http.Request, n int) (int, string) {
+		if r.Method != http.MethodPost || r.URL.Path != "/tenant-1/oauth2/v2.0/token" || r.PostForm.Get("client_id") != "app-1" ||
+			r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("scope") != "https://storage.azure.com/.default" {
+			return http.StatusBadRequest, `{"error":"invalid_request","error_description":"unexpected request"}`
+		}
+		if r.PostForm.Get("client_secret") != "secret" {
+			return http.StatusUnauthorized, `{"error":"invalid_client","error_description":"AADSTS7000215: Invalid client secret provided."}`
+		}
+		if n == 3 {
+			return http.StatusServiceUnavailable, ""
+		}
+		// The tokens expire soon, so they're refreshed in about a second.
+		return http.StatusOK, azureADToken(fmt.Sprintf("token-%d", n), 2)
+	})
+	defer endpoint.server.Close()
+
+	_, err := NewClientSecretCredential(ctx, "tenant-1", "app-1", "wrong", TokenCredentialOptions{AuthorityHost: endpoint.server.URL})
+	var requestErr *TokenRequestError
+	c.Assert(errors.As(err, &requestErr), chk.Equals, true)
+	c.Assert(requestErr.StatusCode, chk.Equals, http.StatusUnauthorized)
+	c.Assert(requestErr.Code, chk.Equals, "invalid_client")
+	c.Assert(err, chk.ErrorMatches, "token request failed with status 401: invalid_client: AADSTS7000215.*")
+
+	refreshErrors := make(chan error, 10)
+	credential, err := NewClientSecretCredential(ctx, "tenant-1", "app-1", "secret", TokenCredentialOptions{
+		AuthorityHost: endpoint.server.URL + "/",
+		OnRefreshError: func(err error) {
+			select {
+			case refreshErrors <- err:
+			default:
+			}
+		},
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(credential.Token(), chk.Equals, "token-2")
+
+	// Refreshing fails once, and is tried again before the token expires.
+	waitForToken(c, credential, "token-4")
+	c.Assert(<-refreshErrors, chk.ErrorMatches, "token request failed with status 503")
+}
+
+func (s *aztestsSuite) TestTokenRefreshKeepsBackoffWhenRejected(c *chk.C) {
+	fetches := 0
+	r := &tokenRefresh{
+		fetch: func(ctx context.Context) (accessToken, error) {
+			fetches++
+			return accessToken{}, errors.New("unavailable")
+		},
+		expiresOn: time.Now().Add(time.Hour),
+	}
+	credential := NewTokenCredential("token-1", nil)
+	delay := r.refresh(credential, nil)
+	c.Assert(fetches, chk.Equals, 1)
+	c.Assert(delay >= tokenRetryDelay*3/4, chk.Equals, true)
+
+	// A rejected request during the backoff doesn't fetch the token again, nor move the retry.
+	d := r.refresh(credential, &TokenChallenge{Error: "invalid_token"})
+	c.Assert(fetches, chk.Equals, 1)
+	c.Assert(d > 0 && d <= delay, chk.Equals, true)
+	c.Assert(credential.Token(), chk.Equals, "token-1")
+
+	// The scheduled retry fetches it.
+	r.refresh(credential, nil)
+	c.Assert(fetches, chk.Equals, 2)
+}
+
+func (s *aztestsSuite) TestClientCertificateCredentialSignsAssertion(c *chk.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, chk.IsNil)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "app-1"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, chk.IsNil)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, chk.IsNil)
+	pemData := append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	certificate, privateKey, err := ParseClientCertificate(pemData)
+	c.Assert(err, chk.IsNil)
+	c.Assert(certificate.Raw, chk.DeepEquals, der)
+	_, _, err = ParseClientCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	c.Assert(err, chk.ErrorMatches, "the PEM data has no private key")
+
+	var endpoint *fakeTokenEndpoint
+	endpoint = newFakeTokenEndpoint(func(r *http.Request, n int) (int, string) {
+		// Azure AD checks the assertion's signature with the registered certificate, identified by its thumbprint.
+		parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+		if r.PostForm.Get("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" || len(parts) != 3 {
+			return http.StatusBadRequest, `{"error":"invalid_request"}`
+		}
+		var header, claims map[string]interface{}
+		headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		json.Unmarshal(headerJSON, &header)
+		json.Unmarshal(claimsJSON, &claims)
+		thumbprint := sha1.Sum(der)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		c.Check(header["alg"], chk.Equals, "RS256")
+		c.Check(header["x5t"], chk.Equals, base64.RawURLEncoding.EncodeToString(thumbprint[:]))
+		c.Check(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature), chk.IsNil)
+		c.Check(claims["aud"], chk.Equals, endpoint.server.URL+"/tenant-1/oauth2/v2.0/token")
+		c.Check(claims["iss"], chk.Equals, "app-1")
+		c.Check(claims["sub"], chk.Equals, "app-1")
+		c.Check(claims["exp"].(float64) > float64(time.Now().Unix()), chk.Equals, true)
+		return http.StatusOK, azureADToken("certificate-token", 3600)
+	})
+	defer endpoint.server.Close()
+
+	credential, err := NewClientCertificateCredential(ctx, "tenant-1", "app-1", certificate, privateKey, TokenCredentialOptions{AuthorityHost: endpoint.server.URL})
+	c.Assert(err, chk.IsNil)
+	c.Assert(credential.Token(), chk.Equals, "certificate-token")
+	_, err = NewClientCertificateCredential(ctx, "tenant-1", "app-1", nil, privateKey, TokenCredentialOptions{})
+	c.Assert(err, chk.NotNil)
+}
+
+// setEnv sets environment variables, and returns a function that restores them.
+func setEnv(env map[string]string) func() {
+	previous := map[string]*string{}
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			previous[k] = &old
+		} else {
+			previous[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range previous {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func (s *aztestsSuite) TestWorkloadIdentityCredentialReadsRotatedToken(c *chk.C) {
+	endpoint := newFakeTokenEndpoint(func(r *http.Request, n int) (int, string) {
+		if r.URL.Path != "/tenant-1/oauth2/v2.0/token" || r.PostForm.Get("client_id") != "app-1" {
+			return http.StatusBadRequest, `{"error":"invalid_request"}`
+		}
+		return http.StatusOK, azureADToken("token-for-"+r.PostForm.Get("client_assertion"), 2)
+	})
+	defer endpoint.server.Close()
+	dir, err := ioutil.TempDir("", "workload-identity")
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("kubernetes-token-1\n"), 0600), chk.IsNil)
+
+	restore := setEnv(map[string]string{"AZURE_TENANT_ID": "", "AZURE_CLIENT_ID": "app-1", "AZURE_FEDERATED_TOKEN_FILE": tokenFile,
+		"AZURE_AUTHORITY_HOST": endpoint.server.URL})
+	defer restore()
+	_, err = NewWorkloadIdentityCredential(ctx, WorkloadIdentityCredentialOptions{})
+	c.Assert(err, chk.ErrorMatches, "workload identity requires the AZURE_TENANT_ID environment variable or option")
+
+	credential, err := NewWorkloadIdentityCredential(ctx, WorkloadIdentityCredentialOptions{TenantID: "tenant-1"})
+	c.Assert(err, chk.IsNil)
+	c.Assert(credential.Token(), chk.Equals, "token-for-kubernetes-token-1")
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("kubernetes-token-2"), 0600), chk.IsNil)
+	waitForToken(c, credential, "token-for-kubernetes-token-2")
+}
+
+// managedIdentityToken returns a managed identity endpoint's response with a token that expires in an hour.
+func managedIdentityToken(token string) string {
+	expiresOn := time.Now().Add(time.Hour).Unix()
+	return fmt.Sprintf(`{"access_token":%q,"expires_in":"3600","expires_on":"%d","resource":"https://storage.azure.com/","token_type":"Bearer"}`, token, expiresOn)
+}
+
+func (s *aztestsSuite) TestManagedIdentityCredentialRetriesIMDS(c *chk.C) {
+	restore := setEnv(map[string]string{"IDENTITY_ENDPOINT": "", "IDENTITY_HEADER": ""})
+	defer restore()
+	endpoint := newFakeTokenEndpoint(func(r *http.Request, n int) (int, string) {
+		q := r.URL.Query()
+		switch {
+		case r.Header.Get("Metadata") != "true" || q.Get("api-version") != "2018-02-01" || q.Get("resource") != "https://storage.azure.com/":
+			return http.StatusBadRequest, `{"error":"invalid_request","error_description":"unexpected request"}`
+		case q.Get("client_id") == "unknown":
+			return http.StatusBadRequest, `{"error":"invalid_request","error_description":"Identity not found"}`
+		case q.Get("client_id") == "unavailable":
+			return http.StatusInternalServerError, ""
+		case n == 1:
+			return http.StatusGone, ""
+		case n == 2:
+			return http.StatusTooManyRequests, ""
+		}
+		return http.StatusOK, managedIdentityToken("token-" + q.Get("client_id"))
+	})
+	defer endpoint.server.Close()
+	o := ManagedIdentityCredentialOptions{IMDSEndpoint: endpoint.server.URL + "/metadata/identity/oauth2/token", RetryDelay: time.Millisecond, ClientID: "app-1"}
+
+	credential, err := NewManagedIdentityCredential(ctx, o)
+	c.Assert(err, chk.IsNil)
+	c.Assert(credential.Token(), chk.Equals, "token-app-1")
+	c.Assert(endpoint.requestCount(), chk.Equals, 3)
+
+	// Other errors aren't tried again.
+	o.ClientID = "unknown"
+	_, err = NewManagedIdentityCredential(ctx, o)
+	c.Assert(err, chk.ErrorMatches, "token request failed with status 400: invalid_request: Identity not found")
+	c.Assert(endpoint.requestCount(), chk.Equals, 4)
+
+	o.ClientID, o.MaxTries = "unavailable", 3
+	_, err = NewManagedIdentityCredential(ctx, o)
+	c.Assert(err, chk.ErrorMatches, "token request failed with status 500")
+	c.Assert(endpoint.requestCount(), chk.Equals, 7)
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	o.MaxTries, o.RetryDelay = 100, time.Second
+	_, err = NewManagedIdentityCredential(timeout, o)
+	c.Assert(err, chk.Equals, context.DeadlineExceeded)
+
+	o.ObjectID = "object-1"
+	_, err = NewManagedIdentityCredential(ctx, o)
+	c.Assert(err, chk.ErrorMatches, "only one of ClientID, ObjectID and ResourceID can be set")
+}
+
+func (s *aztestsSuite) TestManagedIdentityCredentialUsesAppServiceEndpoint(c *chk.C) {
+	endpoint := newFakeTokenEndpoint(func(r *http.Request, n int) (int, string) {
+		q := r.URL.Query()
+		if r.Header.Get("X-IDENTITY-HEADER") != "header-secret" || q.Get("api-version") != "2019-08-01" ||
+			q.Get("resource") != "https://example.com/" || q.Get("principal_id") != "object-1" {
+			return http.StatusBadRequest, `{"error":"invalid_request"}`
+		}
+		return http.StatusOK, managedIdentityToken("app-service-token")
+	})
+	defer endpoint.server.Close()
+	restore := setEnv(map[string]string{"IDENTITY_ENDPOINT": endpoint.server.URL + "/msi/token", "IDENTITY_HEADER": "header-secret"})
+	defer restore()
+
+	credential, err := NewManagedIdentityCredential(ctx, ManagedIdentityCredentialOptions{
+		TokenCredentialOptions: TokenCredentialOptions{Resource: "https://example.com/"},
+		ObjectID:               "object-1",
+		IMDSEndpoint:           "http://127.0.0.1:1/unused",
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(credential.Token(), chk.Equals, "app-service-token")
+}
@@ -0,0 +1,127 @@
+package azblob
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	chk "gopkg.in/check.v1"
+)
+
+// rotatingKeyServiceURL returns a ServiceURL for the fake's account whose requests are signed by the credential.
+func rotatingKeyServiceURL(fake *fakeBlobService, credential Credential) ServiceURL {
+	u, _ := url.Parse(fake.server.URL + "/devstoreaccount1")
+	return NewServiceURL(*u, NewPipeline(credential, PipelineOptions{Retry: RetryOptions{MaxTries: 1}, RequestLog: RequestLogOptions{SyslogDisabled: true}}))
+}
+
+// testKeys returns account keys for the fake's account.
+func testKeys(names ...string) ([]string, []*SharedKeyCredential) {
+	keys, credentials := []string{}, []*SharedKeyCredential{}
+	for _, name := range names {
+		key := base64.StdEncoding.EncodeToString([]byte("account key " + name))
+		credential, _ := NewSharedKeyCredential("devstoreaccount1", key)
+		keys, credentials = append(keys, key), append(credentials, credential)
+	}
+	return keys, credentials
+}
+
+type fallbackRecorder struct {
+	lock      sync.Mutex
+	secondary []bool
+	errs      []error
+}
+
+func (r *fallbackRecorder) onFallback(secondary bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.secondary, r.errs = append(r.secondary, secondary), append(r.errs, err)
+}
+
+func (s *aztestsSuite) TestRotatingSharedKeyCredentialFallsBackToSecondaryKey(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	keys, credentials := testKeys("1", "2", "3", "4")
+	// The primary key has been regenerated.
+	fake.accountKeys = []*SharedKeyCredential{credentials[1], credentials[2]}
+
+	strict, err := NewRotatingSharedKeyCredential("devstoreaccount1", keys[0], keys[1], RotatingSharedKeyCredentialOptions{})
+	c.Assert(err, chk.IsNil)
+	_, err = rotatingKeyServiceURL(fake, strict).NewContainerURL("docs").Create(ctx, nil, PublicAccessNone)
+	validateStorageError(c, err, ServiceCodeAuthenticationFailed)
+
+	recorder := &fallbackRecorder{}
+	credential, err := NewRotatingSharedKeyCredential("devstoreaccount1", keys[0], keys[1],
+		RotatingSharedKeyCredentialOptions{RetryWithOtherKey: true, OnFallback: recorder.onFallback})
+	c.Assert(err, chk.IsNil)
+	containerURL := rotatingKeyServiceURL(fake, credential).NewContainerURL("docs")
+	_, err = containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	// The request's body is sent again.
+	blobURL := containerURL.NewBlockBlobURL("a")
+	_, err = blobURL.Upload(ctx, strings.NewReader("hello"), BlobHTTPHeaders{}, nil, BlobAccessConditions{}, DefaultAccessTier, nil,
+		ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(fake.blob("docs", "a").data), chk.Equals, "hello")
+	c.Assert(credential.Fallbacks(), chk.Equals, int64(2))
+	c.Assert(recorder.secondary, chk.DeepEquals, []bool{true, true})
+	c.Assert(recorder.errs, chk.DeepEquals, []error{nil, nil})
+
+	// Once the keys are replaced, the primary key is used.
+	c.Assert(credential.SetKeys(keys[2], keys[1]), chk.IsNil)
+	c.Assert(credential.ComputeHMACSHA256("message"), chk.Equals, credentials[2].ComputeHMACSHA256("message"))
+	_, err = containerURL.GetProperties(ctx, LeaseAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(credential.Fallbacks(), chk.Equals, int64(2))
+
+	// A request that fails with both keys is sent twice.
+	fake.lock.Lock()
+	fake.accountKeys = []*SharedKeyCredential{credentials[3]}
+	fake.lock.Unlock()
+	_, err = containerURL.GetProperties(ctx, LeaseAccessConditions{})
+	validateStorageError(c, err, ServiceCodeAuthenticationFailed)
+	c.Assert(credential.Fallbacks(), chk.Equals, int64(3))
+	c.Assert(recorder.secondary, chk.DeepEquals, []bool{true, true, true})
+	c.Assert(recorder.errs[2], chk.NotNil)
+
+	// Without a secondary key, there's nothing to fall back to.
+	c.Assert(credential.SetKeys(keys[2], ""), chk.IsNil)
+	_, err = containerURL.GetProperties(ctx, LeaseAccessConditions{})
+	validateStorageError(c, err, ServiceCodeAuthenticationFailed)
+	c.Assert(credential.Fallbacks(), chk.Equals, int64(3))
+
+	c.Assert(credential.SetKeys("not base64!", ""), chk.ErrorMatches, "the primary key isn't valid: .*")
+	c.Assert(credential.SetKeys(keys[0], "not base64!"), chk.ErrorMatches, "the secondary key isn't valid: .*")
+	_, err = NewRotatingSharedKeyCredential("devstoreaccount1", "", keys[1], RotatingSharedKeyCredentialOptions{})
+	c.Assert(err, chk.ErrorMatches, "the primary key is empty")
+}
+
+func (s *aztestsSuite) TestRotatingSharedKeyCredentialRetriesRequestsInFlightWithNewPrimaryKey(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	keys, credentials := testKeys("1", "2")
+	fake.accountKeys = credentials[:1]
+	recorder := &fallbackRecorder{}
+	credential, err := NewRotatingSharedKeyCredential("devstoreaccount1", keys[0], "",
+		RotatingSharedKeyCredentialOptions{RetryWithOtherKey: true, OnFallback: recorder.onFallback})
+	c.Assert(err, chk.IsNil)
+	containerURL := rotatingKeyServiceURL(fake, credential).NewContainerURL("docs")
+
+	// The key is rotated while the request is sent.
+	rotated := false
+	fake.beforeRequest = func(r *http.Request) {
+		if !rotated {
+			rotated = true
+			c.Check(credential.SetKeys(keys[1], ""), chk.IsNil)
+			fake.lock.Lock()
+			fake.accountKeys = credentials[1:]
+			fake.lock.Unlock()
+		}
+	}
+	_, err = containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requestCount(http.MethodPut, ""), chk.Equals, 2)
+	c.Assert(recorder.secondary, chk.DeepEquals, []bool{false})
+	c.Assert(recorder.errs, chk.DeepEquals, []error{nil})
+}
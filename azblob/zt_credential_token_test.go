@@ -0,0 +1,167 @@
+package azblob
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+// tokenServiceURL returns a ServiceURL for the fake's account, served over HTTPS as token credentials require,
+// whose requests carry the credential's token. Call close when done with the returned server.
+func tokenServiceURL(fake *fakeBlobService, credential TokenCredential) (ServiceURL, *httptest.Server) {
+	server := httptest.NewTLSServer(fake)
+	u, _ := url.Parse(server.URL + "/devstoreaccount1")
+	p := NewPipeline(credential, PipelineOptions{Retry: RetryOptions{MaxTries: 1}, RequestLog: RequestLogOptions{SyslogDisabled: true},
+		HTTPSender: newClientSender(server.Client())})
+	return NewServiceURL(*u, p), server
+}
+
+// challengeRecorder is a ChallengeTokenRefresher that refreshes the token to next when the service rejects it.
+type challengeRecorder struct {
+	lock       sync.Mutex
+	next       string
+	delay      time.Duration
+	challenges []TokenChallenge
+}
+
+func (r *challengeRecorder) refresh(credential TokenCredential, challenge *TokenChallenge) time.Duration {
+	if challenge != nil {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		time.Sleep(r.delay)
+		r.challenges = append(r.challenges, *challenge)
+		credential.SetToken(r.next)
+	}
+	return time.Hour
+}
+
+func (r *challengeRecorder) refreshes() []TokenChallenge {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]TokenChallenge(nil), r.challenges...)
+}
+
+func (s *aztestsSuite) TestChallengeTokenCredentialRefreshesRejectedToken(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	fake.bearerToken = "token-2"
+
+	serviceURL, server := tokenServiceURL(fake, NewTokenCredential("token-1", nil))
+	_, err := serviceURL.NewContainerURL("docs").Create(ctx, nil, PublicAccessNone)
+	validateStorageError(c, err, ServiceCodeInvalidAuthenticationInfo)
+	server.Close()
+
+	recorder := &challengeRecorder{next: "token-2"}
+	credential := NewChallengeTokenCredential("token-1", recorder.refresh)
+	serviceURL, server = tokenServiceURL(fake, credential)
+	defer server.Close()
+	containerURL := serviceURL.NewContainerURL("docs")
+	_, err = containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requestCount(http.MethodPut, ""), chk.Equals, 3)
+	c.Assert(recorder.refreshes(), chk.DeepEquals, []TokenChallenge{{
+		AuthorizationURI: "https://login.microsoftonline.com/tenant-1/oauth2/authorize",
+		AuthorityHost:    "https://login.microsoftonline.com/",
+		TenantID:         "tenant-1",
+		Resource:         "https://storage.azure.com",
+	}})
+
+	// A request with a body is sent again with it.
+	fake.lock.Lock()
+	fake.bearerToken = "token-3"
+	fake.lock.Unlock()
+	recorder.lock.Lock()
+	recorder.next = "token-3"
+	recorder.lock.Unlock()
+	blobURL := containerURL.NewBlockBlobURL("a.txt")
+	_, err = blobURL.Upload(ctx, bytes.NewReader([]byte("content")), BlobHTTPHeaders{}, nil, BlobAccessConditions{}, DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(string(fake.blob("docs", "a.txt").data), chk.Equals, "content")
+	c.Assert(credential.Token(), chk.Equals, "token-3")
+
+	// Requests rejected together refresh the token once.
+	fake.lock.Lock()
+	fake.bearerToken = "token-4"
+	fake.lock.Unlock()
+	recorder.lock.Lock()
+	recorder.next, recorder.delay = "token-4", 100*time.Millisecond
+	recorder.lock.Unlock()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := blobURL.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, chk.IsNil)
+	}
+	c.Assert(recorder.refreshes(), chk.HasLen, 3)
+
+	// If the token isn't refreshed, the request isn't sent again.
+	fake.lock.Lock()
+	fake.bearerToken = "token-5"
+	fake.lock.Unlock()
+	heads := fake.requestCount(http.MethodHead, "")
+	_, err = blobURL.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	validateStorageError(c, err, ServiceCodeInvalidAuthenticationInfo)
+	c.Assert(fake.requestCount(http.MethodHead, ""), chk.Equals, heads+1)
+}
+
+func (s *aztestsSuite) TestChallengeTokenCredentialThrottlesFailedRefreshes(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	fake.bearerToken = "token-2"
+
+	var refreshes int32
+	credential := NewChallengeTokenCredential("token-1", func(credential TokenCredential, challenge *TokenChallenge) time.Duration {
+		if challenge != nil {
+			atomic.AddInt32(&refreshes, 1) // Refreshing fails, so the token stays the same
+		}
+		return time.Hour
+	})
+	serviceURL, server := tokenServiceURL(fake, credential)
+	defer server.Close()
+
+	// Requests rejected one after another within a few seconds of the failed refresh don't refresh the token again.
+	for i := 0; i < 5; i++ {
+		_, err := serviceURL.NewContainerURL("docs").Create(ctx, nil, PublicAccessNone)
+		validateStorageError(c, err, ServiceCodeInvalidAuthenticationInfo)
+	}
+	c.Assert(atomic.LoadInt32(&refreshes), chk.Equals, int32(1))
+	c.Assert(fake.requestCount(http.MethodPut, ""), chk.Equals, 5)
+}
+
+func (s *aztestsSuite) TestParseBearerChallenge(c *chk.C) {
+	challenge, ok := parseBearerChallenge(`Basic realm="storage", Bearer authorization_uri="https://login.example.com/tenant-2/oauth2/authorize",` +
+		` error="invalid_token", error_description="The token is expired, \"exp\" is past", Negotiate`)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(challenge, chk.DeepEquals, TokenChallenge{
+		AuthorizationURI: "https://login.example.com/tenant-2/oauth2/authorize",
+		AuthorityHost:    "https://login.example.com/",
+		TenantID:         "tenant-2",
+		Error:            "invalid_token",
+		ErrorDescription: `The token is expired, "exp" is past`,
+	})
+
+	challenge, ok = parseBearerChallenge("bearer authorization=https://login.microsoftonline.com/tenant-3 resource=https://storage.azure.com/")
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(challenge.TenantID, chk.Equals, "tenant-3")
+	c.Assert(challenge.Resource, chk.Equals, "https://storage.azure.com/")
+
+	_, ok = parseBearerChallenge(`Basic realm="storage"`)
+	c.Assert(ok, chk.Equals, false)
+	_, ok = parseBearerChallenge(`Bearer error="unterminated`)
+	c.Assert(ok, chk.Equals, true)
+}
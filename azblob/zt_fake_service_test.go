@@ -0,0 +1,1461 @@
+package azblob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// fakeBlobService is an in-memory implementation of the subset of the Blob service REST API used by the
+// hermetic tests. It serves IP-style URLs (http://127.0.0.1:port/account/container/blob) like the storage emulator.
+type fakeBlobService struct {
+	lock       sync.Mutex
+	server     *httptest.Server
+	containers map[string]*fakeContainer
+	etagSeq    int64
+
+	// requests counts the requests served, keyed by "METHOD comp" (e.g. "PUT block").
+	requests map[string]int
+
+	// beforeRequest, if set, is called before each request is served.
+	beforeRequest func(r *http.Request)
+
+	// fail, if set, is called with the lock held before each request is served; the request fails with the error
+	// it returns, if any, to simulate transient failures.
+	fail func(r *http.Request) *fakeServiceError
+
+	// versioning, if set, keeps the previous versions of blobs when they're overwritten or deleted.
+	versioning bool
+
+	// copyPolls is how many times Get Blob Properties reports an asynchronous copy as pending.
+	copyPolls int
+
+	// clock, if set, is the time used for leases, to simulate a service clock that's ahead or behind.
+	clock func() time.Time
+
+	// noBatch, if set, rejects Blob Batch requests, as the storage emulator does.
+	noBatch bool
+
+	// accountKeys, if set, are the keys that requests must be signed with; others fail with AuthenticationFailed.
+	accountKeys []*SharedKeyCredential
+
+	// bearerToken, if set, is the token that requests must carry; others fail with 401 and a Bearer challenge, as
+	// the service rejects expired tokens.
+	bearerToken string
+
+	// lastTimestamp is the last version ID or snapshot timestamp handed out, so that they always increase.
+	lastTimestamp time.Time
+}
+
+type fakeContainer struct {
+	blobs        map[string]*fakeBlob
+	history      map[string][]*fakeBlob // previous versions and snapshots of blobs, oldest first
+	leases       map[string]*fakeLease  // leases of blobs, which outlive overwriting them
+	lease        fakeLease
+	metadata     Metadata
+	etag         ETag
+	lastModified time.Time
+}
+
+// fakeLease is the lease of a blob or container.
+type fakeLease struct {
+	id       string
+	duration time.Duration // 0 for an infinite lease
+	expiry   time.Time     // when a fixed lease expires or a broken lease finishes breaking
+	broken   bool
+}
+
+type fakeBlock struct {
+	id   string
+	data []byte
+}
+
+type fakeBlob struct {
+	blobType     BlobType
+	data         []byte
+	committed    []fakeBlock
+	uncommitted  map[string][]byte
+	headers      BlobHTTPHeaders
+	metadata     Metadata
+	tags         BlobTagsMap
+	tier         AccessTierType
+	etag         ETag
+	creationTime time.Time
+	lastModified time.Time
+	versionID    string
+	snapshot     string
+
+	copyID      string
+	copyPending int // number of times the copy is still reported as pending
+}
+
+// newFakeBlobService starts a fake Blob service. Call close when done with it.
+func newFakeBlobService() *fakeBlobService {
+	f := &fakeBlobService{containers: map[string]*fakeContainer{}, requests: map[string]int{}}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeBlobService) close() {
+	f.server.Close()
+}
+
+// serviceURL returns a ServiceURL for the fake's account that doesn't retry failed requests.
+func (f *fakeBlobService) serviceURL() ServiceURL {
+	return f.serviceURLWithOptions(PipelineOptions{Retry: RetryOptions{MaxTries: 1}})
+}
+
+// serviceURLWithOptions returns a ServiceURL for the fake's account with a pipeline created with o.
+func (f *fakeBlobService) serviceURLWithOptions(o PipelineOptions) ServiceURL {
+	u, _ := url.Parse(f.server.URL + "/devstoreaccount1")
+	return NewServiceURL(*u, NewPipeline(NewAnonymousCredential(), o))
+}
+
+// newClientSender returns an HTTPSender for PipelineOptions that sends requests with the client.
+func newClientSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := client.Do(request.WithContext(ctx))
+			return pipeline.NewHTTPResponse(resp), err
+		}
+	})
+}
+
+// requestCount returns how many requests were served for the method and comp query parameter.
+func (f *fakeBlobService) requestCount(method, comp string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests[method+" "+comp]
+}
+
+// blob returns the blob with the name in the container, or nil.
+func (f *fakeBlobService) blob(container, name string) *fakeBlob {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if c := f.containers[container]; c != nil {
+		return c.blobs[name]
+	}
+	return nil
+}
+
+// nextTimestamp returns a version ID or snapshot timestamp later than the previous one.
+func (f *fakeBlobService) nextTimestamp() string {
+	t := time.Now().UTC().Truncate(100 * time.Nanosecond)
+	if !t.After(f.lastTimestamp) {
+		t = f.lastTimestamp.Add(100 * time.Nanosecond)
+	}
+	f.lastTimestamp = t
+	return t.Format(SnapshotTimeFormat)
+}
+
+func (f *fakeBlobService) nextETag() ETag {
+	f.etagSeq++
+	return ETag(fmt.Sprintf("\"0x8D%013X\"", f.etagSeq))
+}
+
+// fakeServiceError is an error response from the fake service.
+type fakeServiceError struct {
+	status int
+	code   ServiceCodeType
+}
+
+func (e *fakeServiceError) Error() string {
+	return string(e.code)
+}
+
+func fakeError(status int, code ServiceCodeType) *fakeServiceError {
+	return &fakeServiceError{status: status, code: code}
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3) // account, container, blob
+	if f.beforeRequest != nil {
+		f.beforeRequest(r)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests[r.Method+" "+q.Get("comp")]++
+	if f.fail != nil {
+		if err := f.fail(r); err != nil {
+			writeFakeError(w, r, err)
+			return
+		}
+	}
+	if len(f.accountKeys) > 0 && !f.authenticated(r) {
+		writeFakeError(w, r, fakeError(http.StatusForbidden, ServiceCodeAuthenticationFailed))
+		return
+	}
+	if f.bearerToken != "" && r.Header.Get(headerAuthorization) != "Bearer "+f.bearerToken {
+		w.Header().Set("WWW-Authenticate", "Bearer authorization_uri=https://login.microsoftonline.com/tenant-1/oauth2/authorize resource_id=https://storage.azure.com")
+		writeFakeError(w, r, fakeError(http.StatusUnauthorized, ServiceCodeInvalidAuthenticationInfo))
+		return
+	}
+
+	if id := r.Header.Get(xMsClientRequestID); id != "" {
+		w.Header().Set(xMsClientRequestID, id)
+	}
+	var err *fakeServiceError
+	switch len(path) {
+	case 1:
+		err = f.serveAccount(w, r, q)
+	case 2:
+		err = f.serveContainer(w, r, q, body, path[1])
+	case 3:
+		err = f.serveBlob(w, r, q, body, path[1], path[2])
+	default:
+		err = fakeError(http.StatusBadRequest, ServiceCodeUnsupportedQueryParameter)
+	}
+	if err != nil {
+		writeFakeError(w, r, err)
+	}
+}
+
+// authenticated reports whether the request is signed with one of the account keys.
+func (f *fakeBlobService) authenticated(r *http.Request) bool {
+	for _, key := range f.accountKeys {
+		stringToSign, err := key.buildStringToSign(pipeline.Request{Request: r})
+		if err == nil && r.Header.Get(headerAuthorization) == "SharedKey "+key.AccountName()+":"+key.ComputeHMACSHA256(stringToSign) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFakeError(w http.ResponseWriter, r *http.Request, err *fakeServiceError) {
+	w.Header().Set("x-ms-error-code", string(err.code))
+	w.WriteHeader(err.status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", err.code, err.code)
+	}
+}
+
+func (f *fakeBlobService) serveContainer(w http.ResponseWriter, r *http.Request, q url.Values, body []byte, name string) *fakeServiceError {
+	if q.Get("restype") != "container" {
+		return fakeError(http.StatusBadRequest, ServiceCodeUnsupportedQueryParameter)
+	}
+	c := f.containers[name]
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "":
+		if c != nil {
+			return fakeError(http.StatusConflict, ServiceCodeContainerAlreadyExists)
+		}
+		c = &fakeContainer{blobs: map[string]*fakeBlob{}, history: map[string][]*fakeBlob{}, leases: map[string]*fakeLease{}, metadata: fakeMetadata(r.Header), etag: f.nextETag(), lastModified: time.Now().UTC()}
+		f.containers[name] = c
+		writeFakeETag(w, c.etag, c.lastModified)
+		w.WriteHeader(http.StatusCreated)
+	case c == nil:
+		return fakeError(http.StatusNotFound, ServiceCodeContainerNotFound)
+	case r.Method == http.MethodPut && q.Get("comp") == "lease":
+		return f.serveLease(w, r, &c.lease)
+	case r.Method == http.MethodDelete:
+		if err := c.lease.check(r, f.now(), true, ServiceCodeLeaseIDMismatchWithContainerOperation, ServiceCodeLeaseNotPresentWithContainerOperation); err != nil {
+			return err
+		}
+		delete(f.containers, name)
+		w.WriteHeader(http.StatusAccepted)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && q.Get("comp") == "":
+		writeFakeETag(w, c.etag, c.lastModified)
+		writeFakeMetadata(w, c.metadata)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && q.Get("comp") == "list":
+		return f.listBlobs(w, q, name, c)
+	case r.Method == http.MethodPost && q.Get("comp") == "batch" && !f.noBatch:
+		return f.submitBatch(w, r, body, name)
+	default:
+		return fakeError(http.StatusBadRequest, ServiceCodeUnsupportedQueryParameter)
+	}
+	return nil
+}
+
+func (f *fakeBlobService) serveBlob(w http.ResponseWriter, r *http.Request, q url.Values, body []byte, container, name string) *fakeServiceError {
+	c := f.containers[container]
+	if c == nil {
+		return fakeError(http.StatusNotFound, ServiceCodeContainerNotFound)
+	}
+	if q.Get("versionid") != "" || q.Get("snapshot") != "" {
+		return f.serveBlobHistory(w, r, q, c, name)
+	}
+	b := c.blobs[name]
+	comp := q.Get("comp")
+	if b.exists() && comp != "lease" {
+		// Taking a snapshot doesn't need the lease.
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead && comp != "snapshot"
+		if err := c.leases[name].check(r, f.now(), write, ServiceCodeLeaseIDMismatchWithBlobOperation, ServiceCodeLeaseNotPresentWithBlobOperation); err != nil {
+			return err
+		}
+	}
+
+	// Creating a blob or staging a block doesn't require the blob to exist.
+	switch {
+	case r.Method == http.MethodPut && comp == "" && r.Header.Get("x-ms-copy-source") != "":
+		if err := checkFakeConditions(r, b.visible()); err != nil {
+			return err
+		}
+		return f.copyBlob(w, r, c, name, b)
+	case r.Method == http.MethodPut && comp == "":
+		if err := checkFakeConditions(r, b.visible()); err != nil {
+			return err
+		}
+		nb := &fakeBlob{blobType: BlobType(r.Header.Get("x-ms-blob-type")), data: body, creationTime: time.Now().UTC()}
+		nb.setProperties(r)
+		if b.exists() {
+			nb.creationTime = b.creationTime
+		}
+		f.commitBlob(c, name, nb)
+		writeFakeETag(w, nb.etag, nb.lastModified)
+		writeFakeVersionID(w, nb)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case r.Method == http.MethodPut && comp == "block":
+		id := q.Get("blockid")
+		if _, err := base64.StdEncoding.DecodeString(id); err != nil || id == "" {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidQueryParameterValue)
+		}
+		if b == nil {
+			// Staging a block creates an uncommitted blob that isn't visible until its block list is committed.
+			b = &fakeBlob{blobType: BlobBlockBlob, uncommitted: map[string][]byte{}}
+			c.blobs[name] = b
+		}
+		if b.uncommitted == nil {
+			b.uncommitted = map[string][]byte{}
+		}
+		// All of a blob's block IDs must have the same length.
+		for existing := range b.uncommitted {
+			if len(existing) != len(id) {
+				return fakeError(http.StatusBadRequest, ServiceCodeInvalidBlobOrBlock)
+			}
+		}
+		for _, block := range b.committed {
+			if len(block.id) != len(id) {
+				return fakeError(http.StatusBadRequest, ServiceCodeInvalidBlobOrBlock)
+			}
+		}
+		b.uncommitted[id] = body
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case r.Method == http.MethodPut && comp == "blocklist":
+		if err := checkFakeConditions(r, b.visible()); err != nil {
+			return err
+		}
+		return f.commitBlockList(w, r, c, name, b, body)
+	case r.Method == http.MethodGet && comp == "blocklist" && b != nil:
+		// The block list of a blob that only has uncommitted blocks can be read.
+		return b.writeBlockList(w, q.Get("blocklisttype"))
+	}
+
+	if !b.exists() {
+		return fakeError(http.StatusNotFound, ServiceCodeBlobNotFound)
+	}
+	if err := checkFakeConditions(r, b); err != nil {
+		return err
+	}
+	switch {
+	case r.Method == http.MethodGet && comp == "":
+		return b.download(w, r)
+	case r.Method == http.MethodHead && comp == "":
+		b.writeProperties(w)
+		if b.copyPending > 0 {
+			b.copyPending--
+			w.Header().Set("x-ms-copy-status", string(CopyStatusPending))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && comp == "":
+		snapshots := []*fakeBlob{}
+		others := []*fakeBlob{}
+		for _, old := range c.history[name] {
+			if old.snapshot != "" {
+				snapshots = append(snapshots, old)
+			} else {
+				others = append(others, old)
+			}
+		}
+		switch r.Header.Get("x-ms-delete-snapshots") {
+		case "":
+			if len(snapshots) > 0 {
+				return fakeError(http.StatusConflict, ServiceCodeSnapshotsPresent)
+			}
+		case string(DeleteSnapshotsOptionOnly):
+			c.history[name] = others
+			w.WriteHeader(http.StatusAccepted)
+			return nil
+		default:
+			c.history[name] = others
+		}
+		if f.versioning {
+			c.history[name] = append(c.history[name], b)
+		}
+		delete(c.blobs, name)
+		delete(c.leases, name)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && comp == "metadata":
+		f.newVersion(c, name, b)
+		b.metadata = fakeMetadata(r.Header)
+		b.touch(f.nextETag())
+		writeFakeETag(w, b.etag, b.lastModified)
+		writeFakeVersionID(w, b)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && comp == "snapshot":
+		snapshot := *b
+		snapshot.versionID, snapshot.snapshot = "", f.nextTimestamp()
+		if md := fakeMetadata(r.Header); len(md) > 0 {
+			snapshot.metadata = md
+		}
+		c.history[name] = append(c.history[name], &snapshot)
+		writeFakeETag(w, b.etag, b.lastModified)
+		w.Header().Set("x-ms-snapshot", snapshot.snapshot)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && comp == "lease":
+		if c.leases[name] == nil {
+			c.leases[name] = &fakeLease{}
+		}
+		return f.serveLease(w, r, c.leases[name])
+	case r.Method == http.MethodPut && comp == "tier":
+		b.tier = AccessTierType(r.Header.Get("x-ms-access-tier"))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && comp == "tags":
+		writeFakeXML(w, http.StatusOK, SerializeBlobTags(b.tags))
+	case r.Method == http.MethodPut && comp == "tags":
+		var tags BlobTags
+		if err := xml.Unmarshal(body, &tags); err != nil {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidXMLDocument)
+		}
+		b.tags = BlobTagsMap{}
+		for _, t := range tags.BlobTagSet {
+			b.tags[t.Key] = t.Value
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return fakeError(http.StatusBadRequest, ServiceCodeUnsupportedQueryParameter)
+	}
+	return nil
+}
+
+// now returns the time used for leases.
+func (f *fakeBlobService) now() time.Time {
+	if f.clock != nil {
+		return f.clock()
+	}
+	return time.Now()
+}
+
+// state returns the lease's state at the time: "available", "leased", "breaking", "broken" or "expired".
+func (l *fakeLease) state(now time.Time) string {
+	switch {
+	case l == nil || l.id == "":
+		return "available"
+	case l.broken && now.Before(l.expiry):
+		return "breaking"
+	case l.broken:
+		return "broken"
+	case l.duration != 0 && !now.Before(l.expiry):
+		return "expired"
+	}
+	return "leased"
+}
+
+// check evaluates a request's lease ID against the lease, which is required for writes while it's held.
+func (l *fakeLease) check(r *http.Request, now time.Time, write bool, mismatch, notPresent ServiceCodeType) *fakeServiceError {
+	id := r.Header.Get("x-ms-lease-id")
+	state := l.state(now)
+	held := state == "leased" || state == "breaking"
+	switch {
+	case id == "" && held && write:
+		return fakeError(http.StatusPreconditionFailed, ServiceCodeLeaseIDMissing)
+	case id == "":
+		return nil
+	case !held && l != nil && l.id == id:
+		return fakeError(http.StatusPreconditionFailed, ServiceCodeLeaseLost)
+	case !held:
+		return fakeError(http.StatusPreconditionFailed, notPresent)
+	case l.id != id:
+		return fakeError(http.StatusPreconditionFailed, mismatch)
+	}
+	return nil
+}
+
+// serveLease serves a Lease Blob or Lease Container request.
+func (f *fakeBlobService) serveLease(w http.ResponseWriter, r *http.Request, l *fakeLease) *fakeServiceError {
+	now := f.now()
+	state := l.state(now)
+	id := r.Header.Get("x-ms-lease-id")
+	switch r.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		seconds, err := strconv.Atoi(r.Header.Get("x-ms-lease-duration"))
+		if err != nil || (seconds != -1 && (seconds < 15 || seconds > 60)) {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidHeaderValue)
+		}
+		proposed := r.Header.Get("x-ms-proposed-lease-id")
+		if proposed == "" {
+			proposed = newUUID().String()
+		}
+		switch {
+		case state == "breaking":
+			return fakeError(http.StatusConflict, ServiceCodeLeaseIsBreakingAndCannotBeAcquired)
+		case state == "leased" && l.id != proposed:
+			return fakeError(http.StatusConflict, ServiceCodeLeaseAlreadyPresent)
+		}
+		*l = fakeLease{id: proposed}
+		if seconds != -1 {
+			l.duration = time.Duration(seconds) * time.Second
+			l.expiry = now.Add(l.duration)
+		}
+		w.Header().Set("x-ms-lease-id", l.id)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case "renew":
+		switch {
+		case l.id != id:
+			return fakeError(http.StatusConflict, ServiceCodeLeaseIDMismatchWithLeaseOperation)
+		case l.broken:
+			return fakeError(http.StatusConflict, ServiceCodeLeaseIsBrokenAndCannotBeRenewed)
+		}
+		l.expiry = now.Add(l.duration)
+	case "release":
+		if l.id != id {
+			return fakeError(http.StatusConflict, ServiceCodeLeaseIDMismatchWithLeaseOperation)
+		}
+		*l = fakeLease{}
+	case "change":
+		if l.id != id || (state != "leased" && state != "breaking") {
+			return fakeError(http.StatusConflict, ServiceCodeLeaseIDMismatchWithLeaseOperation)
+		}
+		l.id = r.Header.Get("x-ms-proposed-lease-id")
+	case "break":
+		if state != "leased" && state != "breaking" {
+			return fakeError(http.StatusConflict, ServiceCodeLeaseNotPresentWithLeaseOperation)
+		}
+		if state == "leased" {
+			// A fixed lease breaks when it expires, or after the break period if that's sooner; an infinite lease
+			// breaks after the break period, or at once.
+			period := time.Duration(0)
+			if l.duration != 0 {
+				period = l.expiry.Sub(now)
+			}
+			if seconds, err := strconv.Atoi(r.Header.Get("x-ms-lease-break-period")); err == nil && (l.duration == 0 || time.Duration(seconds)*time.Second < period) {
+				period = time.Duration(seconds) * time.Second
+			}
+			l.broken, l.expiry = true, now.Add(period)
+		}
+		w.Header().Set("x-ms-lease-time", strconv.Itoa(int(l.expiry.Sub(now)/time.Second)))
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	default:
+		return fakeError(http.StatusBadRequest, ServiceCodeInvalidHeaderValue)
+	}
+	w.Header().Set("x-ms-lease-id", l.id)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// submitBatch serves the subrequests of a Blob Batch request to the container's blobs, and writes their responses.
+func (f *fakeBlobService) submitBatch(w http.ResponseWriter, r *http.Request, body []byte, container string) *fakeServiceError {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return fakeError(http.StatusBadRequest, ServiceCodeInvalidHeaderValue)
+	}
+	responses := &bytes.Buffer{}
+	rw := multipart.NewWriter(responses)
+	parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for n := 0; ; n++ {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil || n == BlobBatchMaxOperations {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidInput)
+		}
+		sub, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidInput)
+		}
+		rec := httptest.NewRecorder()
+		path := strings.SplitN(strings.TrimPrefix(sub.URL.Path, "/"), "/", 3) // account, container, blob
+		if len(path) != 3 || path[1] != container || !(sub.Method == http.MethodDelete || sub.URL.Query().Get("comp") == "tier") {
+			writeFakeError(rec, sub, fakeError(http.StatusBadRequest, ServiceCodeInvalidInput))
+		} else if err := f.serveBlob(rec, sub, sub.URL.Query(), nil, container, path[2]); err != nil {
+			writeFakeError(rec, sub, err)
+		}
+		resp := rec.Result()
+		resp.ContentLength = int64(rec.Body.Len())
+		out, _ := rw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {part.Header.Get("Content-ID")},
+		})
+		resp.Write(out)
+	}
+	rw.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+rw.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(responses.Bytes())
+	return nil
+}
+
+// commitBlob makes nb the current version of the blob with the name.
+func (f *fakeBlobService) commitBlob(c *fakeContainer, name string, nb *fakeBlob) {
+	nb.touch(f.nextETag())
+	if f.versioning {
+		if old := c.blobs[name]; old.exists() {
+			c.history[name] = append(c.history[name], old)
+		}
+		nb.versionID = f.nextTimestamp()
+	}
+	c.blobs[name] = nb
+}
+
+func (f *fakeBlobService) commitBlockList(w http.ResponseWriter, r *http.Request, c *fakeContainer, name string, b *fakeBlob, body []byte) *fakeServiceError {
+	var committed []fakeBlock
+	var uncommitted map[string][]byte
+	if b != nil {
+		committed, uncommitted = b.committed, b.uncommitted
+	}
+	lookup := func(list, id string) ([]byte, bool) {
+		if list != "Committed" {
+			if data, ok := uncommitted[id]; ok {
+				return data, true
+			}
+			if list == "Uncommitted" {
+				return nil, false
+			}
+		}
+		for _, block := range committed {
+			if block.id == id {
+				return block.data, true
+			}
+		}
+		return nil, false
+	}
+
+	// Walk the tokens rather than unmarshaling a BlockLookupList since the order of the entries matters.
+	nb := &fakeBlob{blobType: BlobBlockBlob, creationTime: time.Now().UTC()}
+	if b.exists() {
+		nb.creationTime = b.creationTime
+	}
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidXMLDocument)
+		}
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local != "BlockList" {
+			var id string
+			if err := d.DecodeElement(&id, &se); err != nil {
+				return fakeError(http.StatusBadRequest, ServiceCodeInvalidXMLDocument)
+			}
+			data, ok := lookup(se.Name.Local, id)
+			if !ok {
+				return fakeError(http.StatusBadRequest, ServiceCodeInvalidBlockList)
+			}
+			nb.committed = append(nb.committed, fakeBlock{id: id, data: data})
+			nb.data = append(nb.data, data...)
+		}
+	}
+	nb.setProperties(r)
+	f.commitBlob(c, name, nb)
+	writeFakeETag(w, nb.etag, nb.lastModified)
+	writeFakeVersionID(w, nb)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// newVersion keeps the blob's current state as a previous version before it's changed in place.
+func (f *fakeBlobService) newVersion(c *fakeContainer, name string, b *fakeBlob) {
+	if f.versioning {
+		old := *b
+		c.history[name] = append(c.history[name], &old)
+		b.versionID = f.nextTimestamp()
+	}
+}
+
+// findBlob returns the blob's version or snapshot, which may be its current version, or nil.
+func (c *fakeContainer) findBlob(name, versionID, snapshot string) *fakeBlob {
+	if b := c.blobs[name]; b.exists() && snapshot == "" && (versionID == "" || b.versionID == versionID) {
+		return b
+	}
+	if versionID == "" && snapshot == "" {
+		return nil
+	}
+	for _, old := range c.history[name] {
+		if old.versionID == versionID && old.snapshot == snapshot {
+			return old
+		}
+	}
+	return nil
+}
+
+// serveBlobHistory serves the requests for a previous version or snapshot of a blob.
+func (f *fakeBlobService) serveBlobHistory(w http.ResponseWriter, r *http.Request, q url.Values, c *fakeContainer, name string) *fakeServiceError {
+	versionID, snapshot := q.Get("versionid"), q.Get("snapshot")
+	b := c.findBlob(name, versionID, snapshot)
+	if b == nil {
+		return fakeError(http.StatusNotFound, ServiceCodeBlobNotFound)
+	}
+	if err := checkFakeConditions(r, b); err != nil {
+		return err
+	}
+	comp := q.Get("comp")
+	switch {
+	case r.Method == http.MethodGet && comp == "":
+		return b.download(w, r)
+	case r.Method == http.MethodHead && comp == "":
+		b.writeProperties(w)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && comp == "tier":
+		b.tier = AccessTierType(r.Header.Get("x-ms-access-tier"))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && comp == "tags":
+		writeFakeXML(w, http.StatusOK, SerializeBlobTags(b.tags))
+	case r.Method == http.MethodDelete && comp == "":
+		if b == c.blobs[name] {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidQueryParameterValue)
+		}
+		kept := []*fakeBlob{}
+		for _, old := range c.history[name] {
+			if old != b {
+				kept = append(kept, old)
+			}
+		}
+		c.history[name] = kept
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		return fakeError(http.StatusBadRequest, ServiceCodeUnsupportedQueryParameter)
+	}
+	return nil
+}
+
+// copyBlob serves Copy Blob and Copy Blob From URL from a blob of the fake.
+func (f *fakeBlobService) copyBlob(w http.ResponseWriter, r *http.Request, c *fakeContainer, name string, b *fakeBlob) *fakeServiceError {
+	source, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+	if err != nil {
+		return fakeError(http.StatusBadRequest, ServiceCodeInvalidHeaderValue)
+	}
+	path := strings.SplitN(strings.TrimPrefix(source.Path, "/"), "/", 3)
+	if len(path) != 3 || f.containers[path[1]] == nil {
+		return fakeError(http.StatusNotFound, ServiceCodeCannotVerifyCopySource)
+	}
+	sq := source.Query()
+	src := f.containers[path[1]].findBlob(path[2], sq.Get("versionid"), sq.Get("snapshot"))
+	if src == nil {
+		return fakeError(http.StatusNotFound, ServiceCodeCannotVerifyCopySource)
+	}
+
+	// Check the source conditions with the fake's destination condition checks.
+	sr := &http.Request{Method: http.MethodGet, Header: http.Header{}}
+	for _, h := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		sr.Header.Set(h, r.Header.Get("x-ms-source-"+strings.ToLower(h)))
+	}
+	sr.Header.Set("x-ms-if-tags", r.Header.Get("x-ms-source-if-tags"))
+	if err := checkFakeConditions(sr, src); err != nil {
+		return fakeError(http.StatusPreconditionFailed, ServiceCodeSourceConditionNotMet)
+	}
+
+	nb := &fakeBlob{blobType: src.blobType, data: src.data, committed: src.committed, headers: src.headers,
+		metadata: fakeMetadata(r.Header), tags: BlobTagsMap{}, creationTime: time.Now().UTC()}
+	if len(nb.metadata) == 0 {
+		nb.metadata = src.metadata
+	}
+	if tags, err := url.ParseQuery(r.Header.Get("x-ms-tags")); err == nil {
+		for k := range tags {
+			nb.tags[k] = tags.Get(k)
+		}
+	}
+	if tier := r.Header.Get("x-ms-access-tier"); tier != "" {
+		nb.tier = AccessTierType(tier)
+	}
+	if b.exists() {
+		nb.creationTime = b.creationTime
+	}
+	requiresSync := r.Header.Get("x-ms-requires-sync") == "true"
+	nb.copyID = fmt.Sprintf("copy-%d", f.etagSeq)
+	if !requiresSync {
+		nb.copyPending = f.copyPolls
+	}
+	f.commitBlob(c, name, nb)
+	writeFakeETag(w, nb.etag, nb.lastModified)
+	writeFakeVersionID(w, nb)
+	w.Header().Set("x-ms-copy-id", nb.copyID)
+	if requiresSync || nb.copyPending == 0 {
+		w.Header().Set("x-ms-copy-status", string(CopyStatusSuccess))
+	} else {
+		w.Header().Set("x-ms-copy-status", string(CopyStatusPending))
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// exists reports whether the blob was created, as opposed to only having uncommitted blocks.
+func (b *fakeBlob) exists() bool {
+	return b != nil && b.etag != ""
+}
+
+// visible returns the blob if it exists, or nil.
+func (b *fakeBlob) visible() *fakeBlob {
+	if b.exists() {
+		return b
+	}
+	return nil
+}
+
+func (b *fakeBlob) touch(etag ETag) {
+	b.etag = etag
+	b.lastModified = time.Now().UTC()
+}
+
+// setProperties sets the blob's HTTP headers, metadata, tags and tier from a Put Blob or Put Block List request.
+func (b *fakeBlob) setProperties(r *http.Request) {
+	md5, _ := base64.StdEncoding.DecodeString(r.Header.Get("x-ms-blob-content-md5"))
+	b.headers = BlobHTTPHeaders{
+		ContentType:        r.Header.Get("x-ms-blob-content-type"),
+		ContentEncoding:    r.Header.Get("x-ms-blob-content-encoding"),
+		ContentLanguage:    r.Header.Get("x-ms-blob-content-language"),
+		ContentDisposition: r.Header.Get("x-ms-blob-content-disposition"),
+		CacheControl:       r.Header.Get("x-ms-blob-cache-control"),
+		ContentMD5:         md5,
+	}
+	b.metadata = fakeMetadata(r.Header)
+	b.tags = BlobTagsMap{}
+	if tags, err := url.ParseQuery(r.Header.Get("x-ms-tags")); err == nil {
+		for k := range tags {
+			b.tags[k] = tags.Get(k)
+		}
+	}
+	b.tier = AccessTierType(r.Header.Get("x-ms-access-tier"))
+}
+
+func (b *fakeBlob) writeProperties(w http.ResponseWriter) {
+	h := w.Header()
+	writeFakeETag(w, b.etag, b.lastModified)
+	writeFakeMetadata(w, b.metadata)
+	h.Set("x-ms-blob-type", string(b.blobType))
+	h.Set("x-ms-creation-time", b.creationTime.Format(http.TimeFormat))
+	if b.headers.ContentType != "" {
+		h.Set("Content-Type", b.headers.ContentType)
+	}
+	if b.headers.ContentEncoding != "" {
+		h.Set("Content-Encoding", b.headers.ContentEncoding)
+	}
+	if b.headers.ContentLanguage != "" {
+		h.Set("Content-Language", b.headers.ContentLanguage)
+	}
+	if b.headers.ContentDisposition != "" {
+		h.Set("Content-Disposition", b.headers.ContentDisposition)
+	}
+	if b.headers.CacheControl != "" {
+		h.Set("Cache-Control", b.headers.CacheControl)
+	}
+	if b.headers.ContentMD5 != nil {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(b.headers.ContentMD5))
+	}
+	if len(b.tags) > 0 {
+		h.Set("x-ms-tag-count", strconv.Itoa(len(b.tags)))
+	}
+	if b.versionID != "" {
+		h.Set("x-ms-version-id", b.versionID)
+	}
+	if b.copyID != "" {
+		h.Set("x-ms-copy-id", b.copyID)
+		h.Set("x-ms-copy-status", string(CopyStatusSuccess))
+	}
+	if b.tier != "" {
+		h.Set("x-ms-access-tier", string(b.tier))
+	} else if b.blobType == BlobBlockBlob {
+		h.Set("x-ms-access-tier", string(AccessTierHot))
+		h.Set("x-ms-access-tier-inferred", "true")
+	}
+}
+
+func (b *fakeBlob) download(w http.ResponseWriter, r *http.Request) *fakeServiceError {
+	rng := r.Header.Get("x-ms-range")
+	if rng == "" {
+		rng = r.Header.Get("Range")
+	}
+	start, end := int64(0), int64(len(b.data))-1
+	if rng != "" {
+		var err error
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		if start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || len(bounds) != 2 || start >= int64(len(b.data)) {
+			return fakeError(http.StatusRequestedRangeNotSatisfiable, ServiceCodeInvalidRange)
+		}
+		if bounds[1] != "" {
+			if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+				return fakeError(http.StatusRequestedRangeNotSatisfiable, ServiceCodeInvalidRange)
+			}
+			if end >= int64(len(b.data)) {
+				end = int64(len(b.data)) - 1
+			}
+		}
+	}
+	b.writeProperties(w)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if rng != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b.data)))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(b.data[start : end+1])
+	return nil
+}
+
+func (b *fakeBlob) writeBlockList(w http.ResponseWriter, listType string) *fakeServiceError {
+	var bl BlockList
+	if listType == "" || listType == string(BlockListCommitted) || listType == string(BlockListAll) {
+		for _, block := range b.committed {
+			bl.CommittedBlocks = append(bl.CommittedBlocks, Block{Name: block.id, Size: int64(len(block.data))})
+		}
+	}
+	if listType == string(BlockListUncommitted) || listType == string(BlockListAll) {
+		ids := make([]string, 0, len(b.uncommitted))
+		for id := range b.uncommitted {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			bl.UncommittedBlocks = append(bl.UncommittedBlocks, Block{Name: id, Size: int64(len(b.uncommitted[id]))})
+		}
+	}
+	writeFakeETag(w, b.etag, b.lastModified)
+	w.Header().Set("x-ms-blob-content-length", strconv.Itoa(len(b.data)))
+	writeFakeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"BlockList"`
+		BlockList
+	}{BlockList: bl})
+	return nil
+}
+
+// checkFakeConditions evaluates a request's conditional headers against the blob, which is nil if it doesn't exist.
+func checkFakeConditions(r *http.Request, b *fakeBlob) *fakeServiceError {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	etag := ETagNone
+	if b != nil {
+		etag = b.etag
+	}
+	if m := ETag(r.Header.Get("If-Match")); m != ETagNone && (b == nil || (m != ETagAny && m != etag)) {
+		return fakeError(http.StatusPreconditionFailed, ServiceCodeConditionNotMet)
+	}
+	if m := ETag(r.Header.Get("If-None-Match")); m != ETagNone && b != nil && (m == ETagAny || m == etag) {
+		if read {
+			return fakeError(http.StatusNotModified, ServiceCodeConditionNotMet)
+		}
+		if m == ETagAny {
+			return fakeError(http.StatusConflict, ServiceCodeBlobAlreadyExists)
+		}
+		return fakeError(http.StatusPreconditionFailed, ServiceCodeConditionNotMet)
+	}
+	if expr := r.Header.Get("x-ms-if-tags"); expr != "" {
+		var tags BlobTagsMap
+		if b != nil {
+			tags = b.tags
+		}
+		matched, ok := evalFakeIfTags(expr, tags)
+		if !ok {
+			return fakeError(http.StatusBadRequest, ServiceCodeInvalidHeaderValue)
+		}
+		if !matched {
+			return fakeError(http.StatusPreconditionFailed, ServiceCodeConditionNotMet)
+		}
+	}
+	if b == nil {
+		return nil
+	}
+	if s := r.Header.Get("If-Modified-Since"); s != "" {
+		if t, err := time.Parse(http.TimeFormat, s); err == nil && !b.lastModified.Truncate(time.Second).After(t) {
+			return fakeError(http.StatusPreconditionFailed, ServiceCodeConditionNotMet)
+		}
+	}
+	if s := r.Header.Get("If-Unmodified-Since"); s != "" {
+		if t, err := time.Parse(http.TimeFormat, s); err == nil && b.lastModified.Truncate(time.Second).After(t) {
+			return fakeError(http.StatusPreconditionFailed, ServiceCodeConditionNotMet)
+		}
+	}
+	return nil
+}
+
+func fakeMetadata(h http.Header) Metadata {
+	md := Metadata{}
+	for k := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			md[strings.ToLower(k[len("x-ms-meta-"):])] = h.Get(k)
+		}
+	}
+	return md
+}
+
+func writeFakeMetadata(w http.ResponseWriter, md Metadata) {
+	for k, v := range md {
+		w.Header().Set("x-ms-meta-"+k, v)
+	}
+}
+
+func writeFakeVersionID(w http.ResponseWriter, b *fakeBlob) {
+	if b.versionID != "" {
+		w.Header().Set("x-ms-version-id", b.versionID)
+	}
+}
+
+func writeFakeETag(w http.ResponseWriter, etag ETag, lastModified time.Time) {
+	w.Header().Set("ETag", string(etag))
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+}
+
+func writeFakeXML(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+func (f *fakeBlobService) serveAccount(w http.ResponseWriter, r *http.Request, q url.Values) *fakeServiceError {
+	switch {
+	case r.Method == http.MethodGet && q.Get("comp") == "list":
+		return f.listContainers(w, q)
+	case r.Method == http.MethodGet && q.Get("comp") == "blobs":
+		return f.findBlobsByTags(w, q)
+	}
+	return fakeError(http.StatusBadRequest, ServiceCodeUnsupportedQueryParameter)
+}
+
+// fakePage returns the page of the sorted names that starts at the marker, and the marker of the next page.
+func fakePage(names []string, q url.Values) ([]string, string, *fakeServiceError) {
+	maxResults := 5000
+	if s := q.Get("maxresults"); s != "" {
+		var err error
+		if maxResults, err = strconv.Atoi(s); err != nil || maxResults < 1 {
+			return nil, "", fakeError(http.StatusBadRequest, ServiceCodeOutOfRangeQueryParameterValue)
+		}
+	}
+	start := sort.SearchStrings(names, q.Get("marker"))
+	names = names[start:]
+	if len(names) > maxResults {
+		return names[:maxResults], names[maxResults], nil
+	}
+	return names, "", nil
+}
+
+// fakeXMLMetadata marshals metadata the way the service lists it.
+type fakeXMLMetadata Metadata
+
+func (m fakeXMLMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := e.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+type fakeXMLBlobProperties struct {
+	CreationTime       string         `xml:"Creation-Time"`
+	LastModified       string         `xml:"Last-Modified"`
+	Etag               ETag           `xml:"Etag"`
+	ContentLength      int            `xml:"Content-Length"`
+	ContentType        string         `xml:"Content-Type,omitempty"`
+	ContentEncoding    string         `xml:"Content-Encoding,omitempty"`
+	BlobType           BlobType       `xml:"BlobType"`
+	AccessTier         AccessTierType `xml:"AccessTier,omitempty"`
+	AccessTierInferred bool           `xml:"AccessTierInferred,omitempty"`
+	TagCount           int            `xml:"TagCount,omitempty"`
+}
+
+type fakeXMLBlob struct {
+	XMLName          xml.Name              `xml:"Blob"`
+	Name             string                `xml:"Name"`
+	Snapshot         string                `xml:"Snapshot,omitempty"`
+	VersionID        string                `xml:"VersionId,omitempty"`
+	IsCurrentVersion *bool                 `xml:"IsCurrentVersion,omitempty"`
+	Properties       fakeXMLBlobProperties `xml:"Properties"`
+	Metadata         fakeXMLMetadata       `xml:"Metadata,omitempty"`
+	Tags             *BlobTags             `xml:"Tags,omitempty"`
+}
+
+type fakeXMLBlobPrefix struct {
+	XMLName xml.Name `xml:"BlobPrefix"`
+	Name    string   `xml:"Name"`
+}
+
+func (f *fakeBlobService) listBlobs(w http.ResponseWriter, q url.Values, container string, c *fakeContainer) *fakeServiceError {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	include := map[string]bool{}
+	for _, i := range strings.Split(q.Get("include"), ",") {
+		include[i] = true
+	}
+
+	// With a delimiter, the blobs under a virtual directory are listed as a single BlobPrefix.
+	// With versions or snapshots, a blob's previous versions or snapshots are listed before it, and are listed even
+	// if it was deleted.
+	history := func(name string) []*fakeBlob {
+		listed := []*fakeBlob{}
+		for _, old := range c.history[name] {
+			if old.snapshot != "" && include[string(ListBlobsIncludeItemSnapshots)] ||
+				old.snapshot == "" && include[string(ListBlobsIncludeItemVersions)] {
+				listed = append(listed, old)
+			}
+		}
+		return listed
+	}
+	isPrefix := map[string]bool{}
+	names := []string{}
+	for name := range c.history {
+		if !c.blobs[name].exists() && len(history(name)) > 0 && strings.HasPrefix(name, prefix) && delimiter == "" {
+			names = append(names, name)
+		}
+	}
+	for name, b := range c.blobs {
+		if !b.exists() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			name = name[:len(prefix)+i+len(delimiter)]
+			if isPrefix[name] {
+				continue
+			}
+			isPrefix[name] = true
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	page, nextMarker, err := fakePage(names, q)
+	if err != nil {
+		return err
+	}
+
+	entries := []interface{}{}
+	for _, name := range page {
+		if isPrefix[name] {
+			entries = append(entries, fakeXMLBlobPrefix{Name: name})
+			continue
+		}
+		blobs := []*fakeBlob{}
+		if delimiter == "" {
+			blobs = history(name)
+		}
+		if b := c.blobs[name]; b.exists() {
+			blobs = append(blobs, b)
+		}
+		for _, b := range blobs {
+			entries = append(entries, fakeListedBlob(name, b, c.blobs[name] == b, include))
+		}
+	}
+	writeFakeXML(w, http.StatusOK, struct {
+		XMLName         xml.Name `xml:"EnumerationResults"`
+		ServiceEndpoint string   `xml:"ServiceEndpoint,attr"`
+		ContainerName   string   `xml:"ContainerName,attr"`
+		Prefix          string   `xml:"Prefix,omitempty"`
+		Marker          string   `xml:"Marker,omitempty"`
+		MaxResults      string   `xml:"MaxResults,omitempty"`
+		Delimiter       string   `xml:"Delimiter,omitempty"`
+		Blobs           struct {
+			Entries []interface{} // Blob and BlobPrefix elements, in name order
+		} `xml:"Blobs"`
+		NextMarker string `xml:"NextMarker"`
+	}{ServiceEndpoint: f.server.URL, ContainerName: container, Prefix: prefix, Marker: q.Get("marker"),
+		MaxResults: q.Get("maxresults"), Delimiter: delimiter, Blobs: struct{ Entries []interface{} }{entries}, NextMarker: nextMarker})
+	return nil
+}
+
+// fakeListedBlob returns the listing entry of a blob, or of one of its previous versions or snapshots.
+func fakeListedBlob(name string, b *fakeBlob, current bool, include map[string]bool) fakeXMLBlob {
+	entry := fakeXMLBlob{Name: name, Snapshot: b.snapshot, VersionID: b.versionID, Properties: fakeXMLBlobProperties{
+		CreationTime:    b.creationTime.Format(http.TimeFormat),
+		LastModified:    b.lastModified.Format(http.TimeFormat),
+		Etag:            b.etag,
+		ContentLength:   len(b.data),
+		ContentType:     b.headers.ContentType,
+		ContentEncoding: b.headers.ContentEncoding,
+		BlobType:        b.blobType,
+		AccessTier:      b.tier,
+		TagCount:        len(b.tags),
+	}}
+	if b.tier == "" && b.blobType == BlobBlockBlob {
+		entry.Properties.AccessTier, entry.Properties.AccessTierInferred = AccessTierHot, true
+	}
+	if include[string(ListBlobsIncludeItemMetadata)] {
+		entry.Metadata = fakeXMLMetadata(b.metadata)
+	}
+	if include[string(ListBlobsIncludeItemTags)] && len(b.tags) > 0 {
+		tags := SerializeBlobTags(b.tags)
+		entry.Tags = &tags
+	}
+	if b.versionID != "" && current {
+		entry.IsCurrentVersion = &current
+	}
+	return entry
+}
+
+func (f *fakeBlobService) listContainers(w http.ResponseWriter, q url.Values) *fakeServiceError {
+	names := []string{}
+	for name := range f.containers {
+		if strings.HasPrefix(name, q.Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	page, nextMarker, err := fakePage(names, q)
+	if err != nil {
+		return err
+	}
+
+	type fakeXMLContainer struct {
+		XMLName    xml.Name `xml:"Container"`
+		Name       string   `xml:"Name"`
+		Properties struct {
+			LastModified string `xml:"Last-Modified"`
+			Etag         ETag   `xml:"Etag"`
+		} `xml:"Properties"`
+		Metadata fakeXMLMetadata `xml:"Metadata,omitempty"`
+	}
+	containers := []fakeXMLContainer{}
+	for _, name := range page {
+		c := f.containers[name]
+		entry := fakeXMLContainer{Name: name}
+		entry.Properties.LastModified = c.lastModified.Format(http.TimeFormat)
+		entry.Properties.Etag = c.etag
+		if q.Get("include") == string(ListContainersIncludeMetadata) {
+			entry.Metadata = fakeXMLMetadata(c.metadata)
+		}
+		containers = append(containers, entry)
+	}
+	writeFakeXML(w, http.StatusOK, struct {
+		XMLName         xml.Name           `xml:"EnumerationResults"`
+		ServiceEndpoint string             `xml:"ServiceEndpoint,attr"`
+		Prefix          string             `xml:"Prefix,omitempty"`
+		Marker          string             `xml:"Marker,omitempty"`
+		MaxResults      string             `xml:"MaxResults,omitempty"`
+		Containers      []fakeXMLContainer `xml:"Containers>Container"`
+		NextMarker      string             `xml:"NextMarker"`
+	}{ServiceEndpoint: f.server.URL, Prefix: q.Get("prefix"), Marker: q.Get("marker"), MaxResults: q.Get("maxresults"),
+		Containers: containers, NextMarker: nextMarker})
+	return nil
+}
+
+// fakeTagCondition is a single comparison of a Find Blobs by Tags expression.
+type fakeTagCondition struct {
+	key, op, value string
+}
+
+func (t fakeTagCondition) matches(value string) bool {
+	switch t.op {
+	case "=":
+		return value == t.value
+	case "<>":
+		return value != t.value
+	case ">":
+		return value > t.value
+	case ">=":
+		return value >= t.value
+	case "<":
+		return value < t.value
+	case "<=":
+		return value <= t.value
+	}
+	return false
+}
+
+// parseFakeTagFilter parses a Find Blobs by Tags expression: comparisons joined with AND.
+func parseFakeTagFilter(where string) ([]fakeTagCondition, bool) {
+	var conditions []fakeTagCondition
+	s := strings.TrimSpace(where)
+	for {
+		var t fakeTagCondition
+		switch {
+		case strings.HasPrefix(s, `"`):
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			t.key, s = s[1:end+1], s[end+2:]
+		default:
+			end := strings.IndexAny(s, " =<>")
+			if end <= 0 {
+				return nil, false
+			}
+			t.key, s = s[:end], s[end:]
+		}
+		s = strings.TrimSpace(s)
+		for _, op := range []string{">=", "<=", "=", ">", "<"} {
+			if strings.HasPrefix(s, op) {
+				t.op, s = op, strings.TrimSpace(s[len(op):])
+				break
+			}
+		}
+		if t.op == "" || !strings.HasPrefix(s, "'") {
+			return nil, false
+		}
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return nil, false
+		}
+		t.value, s = s[1:end+1], strings.TrimSpace(s[end+2:])
+		conditions = append(conditions, t)
+		if s == "" {
+			return conditions, true
+		}
+		if len(s) < 4 || !strings.EqualFold(s[:4], "and ") {
+			return nil, false
+		}
+		s = strings.TrimSpace(s[4:])
+	}
+}
+
+// evalFakeIfTags evaluates a tag condition (x-ms-if-tags): comparisons joined with AND and OR, with parentheses.
+func evalFakeIfTags(expr string, tags BlobTagsMap) (matched bool, ok bool) {
+	p := &fakeIfTagsParser{s: strings.TrimSpace(expr), tags: tags}
+	matched, ok = p.or()
+	return matched, ok && p.s == ""
+}
+
+type fakeIfTagsParser struct {
+	s    string
+	tags BlobTagsMap
+}
+
+// keyword consumes the keyword (AND or OR) if the expression continues with it.
+func (p *fakeIfTagsParser) keyword(k string) bool {
+	if len(p.s) > len(k) && strings.EqualFold(p.s[:len(k)], k) && (p.s[len(k)] == ' ' || p.s[len(k)] == '(') {
+		p.s = strings.TrimSpace(p.s[len(k):])
+		return true
+	}
+	return false
+}
+
+func (p *fakeIfTagsParser) or() (bool, bool) {
+	matched, ok := p.and()
+	for ok && p.keyword("or") {
+		var m bool
+		m, ok = p.and()
+		matched = matched || m
+	}
+	return matched, ok
+}
+
+func (p *fakeIfTagsParser) and() (bool, bool) {
+	matched, ok := p.term()
+	for ok && p.keyword("and") {
+		var m bool
+		m, ok = p.term()
+		matched = matched && m
+	}
+	return matched, ok
+}
+
+func (p *fakeIfTagsParser) term() (bool, bool) {
+	if strings.HasPrefix(p.s, "(") {
+		p.s = strings.TrimSpace(p.s[1:])
+		matched, ok := p.or()
+		if !ok || !strings.HasPrefix(p.s, ")") {
+			return false, false
+		}
+		p.s = strings.TrimSpace(p.s[1:])
+		return matched, true
+	}
+	if !strings.HasPrefix(p.s, `"`) {
+		return false, false
+	}
+	end := strings.Index(p.s[1:], `"`)
+	if end < 0 {
+		return false, false
+	}
+	t := fakeTagCondition{key: p.s[1 : end+1]}
+	p.s = strings.TrimSpace(p.s[end+2:])
+	for _, op := range []string{"<>", ">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(p.s, op) {
+			t.op, p.s = op, strings.TrimSpace(p.s[len(op):])
+			break
+		}
+	}
+	if t.op == "" || !strings.HasPrefix(p.s, "'") {
+		return false, false
+	}
+	end = strings.Index(p.s[1:], "'")
+	if end < 0 {
+		return false, false
+	}
+	t.value, p.s = p.s[1:end+1], strings.TrimSpace(p.s[end+2:])
+	value, found := p.tags[t.key]
+	return found && t.matches(value), true
+}
+
+func (f *fakeBlobService) findBlobsByTags(w http.ResponseWriter, q url.Values) *fakeServiceError {
+	conditions, ok := parseFakeTagFilter(q.Get("where"))
+	if !ok {
+		return fakeError(http.StatusBadRequest, ServiceCodeInvalidQueryParameterValue)
+	}
+	matches := map[string]FilterBlobItem{}
+	names := []string{}
+	for containerName, c := range f.containers {
+	blobs:
+		for name, b := range c.blobs {
+			if !b.exists() {
+				continue
+			}
+			item := FilterBlobItem{Name: name, ContainerName: containerName, Tags: &BlobTags{}}
+			for _, t := range conditions {
+				if t.key == "@container" {
+					if !t.matches(containerName) {
+						continue blobs
+					}
+					continue
+				}
+				value, ok := b.tags[t.key]
+				if !ok || !t.matches(value) {
+					continue blobs
+				}
+				item.Tags.BlobTagSet = append(item.Tags.BlobTagSet, BlobTag{Key: t.key, Value: value})
+			}
+			matches[containerName+"/"+name] = item
+			names = append(names, containerName+"/"+name)
+		}
+	}
+	sort.Strings(names)
+	page, nextMarker, err := fakePage(names, q)
+	if err != nil {
+		return err
+	}
+	blobs := []FilterBlobItem{}
+	for _, name := range page {
+		blobs = append(blobs, matches[name])
+	}
+	writeFakeXML(w, http.StatusOK, struct {
+		XMLName         xml.Name         `xml:"EnumerationResults"`
+		ServiceEndpoint string           `xml:"ServiceEndpoint,attr"`
+		Where           string           `xml:"Where"`
+		Blobs           []FilterBlobItem `xml:"Blobs>Blob"`
+		NextMarker      string           `xml:"NextMarker"`
+	}{ServiceEndpoint: f.server.URL, Where: q.Get("where"), Blobs: blobs, NextMarker: nextMarker})
+	return nil
+}
@@ -1,10 +1,21 @@
 package azblob
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -433,6 +444,660 @@ func (s *aztestsSuite) TestDoBatchTransferWithError(c *chk.C) {
 	time.Sleep(time.Second * 5)
 }
 
+func (s *aztestsSuite) TestDoBatchTransferMoreThanUint16Chunks(c *chk.C) {
+	const numChunks = 70000 // Used to wrap around when the chunk count was a uint16
+	totalSizeCount := int64(0)
+	runCount := int64(0)
+
+	err := DoBatchTransfer(ctx, BatchTransferOptions{
+		TransferSize: numChunks*2 - 1,
+		ChunkSize:    2,
+		Parallelism:  16,
+		Operation: func(offset int64, chunkSize int64, ctx context.Context) error {
+			atomic.AddInt64(&totalSizeCount, chunkSize)
+			atomic.AddInt64(&runCount, 1)
+			return nil
+		},
+		OperationName: "TestManyChunks",
+	})
+
+	c.Assert(err, chk.IsNil)
+	c.Assert(runCount, chk.Equals, int64(numChunks))
+	c.Assert(totalSizeCount, chk.Equals, int64(numChunks*2-1))
+}
+
+func (s *aztestsSuite) TestDoBatchTransferRetriesChunk(c *chk.C) {
+	tries := make([]int32, 4)
+
+	err := DoBatchTransfer(ctx, BatchTransferOptions{
+		TransferSize:    4,
+		ChunkSize:       1,
+		Parallelism:     2,
+		MaxChunkTries:   3,
+		ChunkRetryDelay: time.Millisecond,
+		Operation: func(offset int64, chunkSize int64, ctx context.Context) error {
+			// Chunk 2 fails twice before succeeding
+			if atomic.AddInt32(&tries[offset], 1) < 3 && offset == 2 {
+				return errors.New("transient failure")
+			}
+			return nil
+		},
+		OperationName: "TestChunkRetry",
+	})
+
+	c.Assert(err, chk.IsNil)
+	c.Assert(tries, chk.DeepEquals, []int32{1, 1, 3, 1})
+}
+
+func (s *aztestsSuite) TestDoBatchTransferChunkRetryDelayDefaultsMax(c *chk.C) {
+	var tries []time.Time
+
+	// Only ChunkRetryDelay is set, so MaxChunkRetryDelay is the default rather than capping the delays to 0.
+	err := DoBatchTransfer(ctx, BatchTransferOptions{
+		TransferSize:    1,
+		ChunkSize:       1,
+		MaxChunkTries:   3,
+		ChunkRetryDelay: 50 * time.Millisecond,
+		Operation: func(offset int64, chunkSize int64, ctx context.Context) error {
+			tries = append(tries, time.Now())
+			if len(tries) < 3 {
+				return errors.New("transient failure")
+			}
+			return nil
+		},
+		OperationName: "TestChunkRetryDelay",
+	})
+
+	c.Assert(err, chk.IsNil)
+	c.Assert(tries, chk.HasLen, 3)
+	// The delays are 50ms and 150ms, each with jitter of at most -20%.
+	c.Assert(tries[1].Sub(tries[0]) >= 40*time.Millisecond, chk.Equals, true)
+	c.Assert(tries[2].Sub(tries[1]) >= 120*time.Millisecond, chk.Equals, true)
+}
+
+func (s *aztestsSuite) TestDoBatchTransferWithResultRetryFailedChunks(c *chk.C) {
+	failing := map[int64]bool{1: true, 3: true}
+	o := BatchTransferOptions{
+		TransferSize:    10,
+		ChunkSize:       2,
+		Parallelism:     5,
+		ContinueOnError: true,
+		Operation: func(offset int64, chunkSize int64, ctx context.Context) error {
+			if failing[offset/2] {
+				return fmt.Errorf("chunk at offset %d failed", offset)
+			}
+			return nil
+		},
+		OperationName: "TestFailedChunks",
+	}
+
+	result, err := DoBatchTransferWithResult(ctx, o)
+	c.Assert(err, chk.NotNil)
+	c.Assert(result.FailedChunkIndexes(), chk.DeepEquals, []int64{1, 3})
+	c.Assert(result.FailedChunks[1].Offset, chk.Equals, int64(6))
+	c.Assert(result.FailedChunks[1].Count, chk.Equals, int64(2))
+
+	// Retry only the failed chunks once the failure has cleared up
+	failing = map[int64]bool{}
+	retried := int64(0)
+	operation := o.Operation
+	o.Operation = func(offset int64, chunkSize int64, ctx context.Context) error {
+		atomic.AddInt64(&retried, 1)
+		return operation(offset, chunkSize, ctx)
+	}
+	o.Chunks = result.FailedChunkIndexes()
+	result, err = DoBatchTransferWithResult(ctx, o)
+	c.Assert(err, chk.IsNil)
+	c.Assert(result.FailedChunks, chk.HasLen, 0)
+	c.Assert(retried, chk.Equals, int64(2))
+
+	o.Chunks = []int64{5}
+	_, err = DoBatchTransferWithResult(ctx, o)
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *aztestsSuite) TestTransferBudgetSharesBuffersFairly(c *chk.C) {
+	budget, err := NewTransferBudget(_1MiB, 4*_1MiB)
+	c.Assert(err, chk.IsNil)
+
+	first := budget.NewTransferManager()
+	defer first.Close()
+	held := [][]byte{first.Get(), first.Get(), first.Get(), first.Get()} // Alone, the first upload may use the whole budget
+	c.Assert(budget.Stats().BuffersInUse, chk.Equals, 4)
+
+	second := budget.NewTransferManager()
+	defer second.Close()
+	got := make(chan []byte)
+	go func() { got <- second.Get() }()
+
+	select {
+	case <-got:
+		c.Fatal("the budget was exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Put(held[3])
+	b := <-got
+	c.Assert(b, chk.HasLen, _1MiB)
+
+	// Both uploads are active now, so the first one is limited to its fair share of 2 buffers
+	go func() { got <- first.Get() }()
+	first.Put(held[2])
+	select {
+	case <-got:
+		c.Fatal("the first upload exceeded its fair share")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Put(held[1])
+	<-got
+
+	stats := budget.Stats()
+	c.Assert(stats.MaxBuffers, chk.Equals, 4)
+	c.Assert(stats.BuffersAllocated, chk.Equals, 4)
+	c.Assert(stats.BuffersInUse, chk.Equals, 3)
+	c.Assert(stats.ActiveTransfers, chk.Equals, 2)
+	c.Assert(stats.Waits, chk.Equals, int64(2))
+	c.Assert(stats.WaitTime > 0, chk.Equals, true)
+
+	_, err = NewTransferBudget(_1MiB, _1MiB-1)
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *aztestsSuite) TestTransferBudgetConcurrentUploads(c *chk.C) {
+	budget, err := NewTransferBudget(_1MiB, 3*_1MiB)
+	c.Assert(err, chk.IsNil)
+
+	const uploads = 5
+	errs := make(chan error, uploads)
+	for i := 0; i < uploads; i++ {
+		go func() {
+			errs <- func() error {
+				p, err := createSrcFile(4*_1MiB + 100)
+				if err != nil {
+					return err
+				}
+				defer os.Remove(p)
+				from, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				defer from.Close()
+
+				br := newFakeBlockWriter()
+				defer br.cleanup()
+				tm := budget.NewTransferManager()
+				defer tm.Close()
+				if _, err = copyFromReader(ctx, from, br, UploadStreamToBlockBlobOptions{TransferManager: tm}); err != nil {
+					return err
+				}
+				if fileMD5(p) != fileMD5(br.final()) {
+					return errors.New("uploaded content does not match the source")
+				}
+				return nil
+			}()
+		}()
+	}
+	for i := 0; i < uploads; i++ {
+		c.Assert(<-errs, chk.IsNil)
+	}
+
+	stats := budget.Stats()
+	c.Assert(stats.BuffersAllocated <= 3, chk.Equals, true)
+	c.Assert(stats.BuffersInUse, chk.Equals, 0)
+	c.Assert(stats.ActiveTransfers, chk.Equals, 0)
+}
+
+func (s *aztestsSuite) TestAutoTuneBlockSize(c *chk.C) {
+	c.Assert(autoTuneBlockSize(1), chk.Equals, int64(autoTuneMinBlockSize))
+	c.Assert(autoTuneBlockSize(autoTuneMinBlockSize*BlockBlobMaxBlocks), chk.Equals, int64(autoTuneMinBlockSize))
+	c.Assert(autoTuneBlockSize(autoTuneMinBlockSize*BlockBlobMaxBlocks+1), chk.Equals, int64(2*autoTuneMinBlockSize))
+	c.Assert(autoTuneBlockSize(BlockBlobMaxStageBlockBytes*BlockBlobMaxBlocks), chk.Equals, int64(BlockBlobMaxStageBlockBytes))
+}
+
+// fakeTunerClock is a clock for a concurrencyTuner that only moves when it is advanced.
+type fakeTunerClock struct{ t time.Time }
+
+func (c *fakeTunerClock) now() time.Time          { return c.t }
+func (c *fakeTunerClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newFakeClockTuner returns a concurrencyTuner measured with a fakeTunerClock.
+func newFakeClockTuner(max int) (*concurrencyTuner, *fakeTunerClock) {
+	clock := &fakeTunerClock{t: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tuner := newConcurrencyTuner(max)
+	tuner.now = clock.now
+	return tuner, clock
+}
+
+// runTunerWindow runs as many operations of bytes each as the tuner allows at once, which all take latency, and
+// returns the tuner's limit afterwards.
+func runTunerWindow(tuner *concurrencyTuner, clock *fakeTunerClock, bytes int64, latency time.Duration) int {
+	n := tuner.currentLimit()
+	for i := 0; i < n; i++ {
+		tuner.acquire()
+	}
+	clock.advance(latency)
+	for i := 0; i < n; i++ {
+		tuner.release(bytes, latency, nil)
+	}
+	return tuner.currentLimit()
+}
+
+func (s *aztestsSuite) TestAutoTuneParallelismGrowsWithThroughput(c *chk.C) {
+	// Latency doesn't depend on parallelism, so throughput grows with it up to the maximum.
+	tuner, clock := newFakeClockTuner(8)
+	c.Assert(tuner.currentLimit(), chk.Equals, autoTuneInitialParallelism)
+	var limits []int
+	for i := 0; i < 6; i++ {
+		limits = append(limits, runTunerWindow(tuner, clock, _1MiB, 10*time.Millisecond))
+	}
+	c.Assert(limits, chk.DeepEquals, []int{5, 6, 7, 8, 8, 8})
+
+	// Latency grows with parallelism, so throughput stops growing after the first window.
+	tuner, clock = newFakeClockTuner(8)
+	limits = nil
+	for i := 0; i < 3; i++ {
+		limit := tuner.currentLimit()
+		limits = append(limits, runTunerWindow(tuner, clock, _1MiB, time.Duration(limit)*10*time.Millisecond))
+	}
+	c.Assert(limits, chk.DeepEquals, []int{5, 5, 5})
+
+	// Latency more than doubles without a throughput gain, so parallelism is reduced.
+	c.Assert(runTunerWindow(tuner, clock, _1MiB, 150*time.Millisecond), chk.Equals, 4)
+
+	// Failed operations aren't measured.
+	tuner.acquire()
+	tuner.release(_1MiB, time.Millisecond, errors.New("failed"))
+	c.Assert(tuner.currentLimit(), chk.Equals, 4)
+}
+
+func (s *aztestsSuite) TestAutoTuneBatchTransfer(c *chk.C) {
+	done, tuned := int32(0), int32(0)
+	err := DoBatchTransfer(ctx, BatchTransferOptions{
+		TransferSize:        300,
+		ChunkSize:           1,
+		Parallelism:         12,
+		AutoTuneParallelism: true,
+		Operation: func(offset int64, chunkSize int64, ctx context.Context) error {
+			atomic.AddInt32(&done, 1)
+			if _, ok := ctx.Value(serverBusyNotifierKey{}).(func()); ok {
+				atomic.AddInt32(&tuned, 1)
+			}
+			return nil
+		},
+		OperationName: "TestAutoTune",
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(done, chk.Equals, int32(300))
+	c.Assert(tuned, chk.Equals, int32(300))
+}
+
+// autoTuneCheckingBlockWriter is a blockWriter that discards the blocks, and counts those staged with a context
+// that reports ServerBusy responses to an auto-tuner.
+type autoTuneCheckingBlockWriter struct {
+	staged, tuned int32
+}
+
+func (w *autoTuneCheckingBlockWriter) StageBlock(ctx context.Context, blockID string, r io.ReadSeeker, cond LeaseAccessConditions, md5 []byte, cpk ClientProvidedKeyOptions) (*BlockBlobStageBlockResponse, error) {
+	atomic.AddInt32(&w.staged, 1)
+	if _, ok := ctx.Value(serverBusyNotifierKey{}).(func()); ok {
+		atomic.AddInt32(&w.tuned, 1)
+	}
+	return &BlockBlobStageBlockResponse{}, nil
+}
+
+func (w *autoTuneCheckingBlockWriter) CommitBlockList(ctx context.Context, blockIDs []string, headers BlobHTTPHeaders, meta Metadata, access BlobAccessConditions, tier AccessTierType, blobTagsMap BlobTagsMap, options ClientProvidedKeyOptions, immutability ImmutabilityPolicyOptions) (*BlockBlobCommitBlockListResponse, error) {
+	return &BlockBlobCommitBlockListResponse{}, nil
+}
+
+func (w *autoTuneCheckingBlockWriter) GetBlockList(ctx context.Context, listType BlockListType, ac LeaseAccessConditions) (*BlockList, error) {
+	return &BlockList{}, nil
+}
+
+func (s *aztestsSuite) TestAutoTuneStreamUpload(c *chk.C) {
+	w := &autoTuneCheckingBlockWriter{}
+	_, err := copyFromReader(ctx, bytes.NewReader(make([]byte, 10*_1MiB)), w, UploadStreamToBlockBlobOptions{MaxBuffers: 4, AutoTune: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(w.staged, chk.Equals, int32(10))
+	c.Assert(w.tuned, chk.Equals, int32(10))
+
+	w = &autoTuneCheckingBlockWriter{}
+	_, err = copyFromReader(ctx, bytes.NewReader(make([]byte, 10*_1MiB)), w, UploadStreamToBlockBlobOptions{MaxBuffers: 4})
+	c.Assert(err, chk.IsNil)
+	c.Assert(w.staged, chk.Equals, int32(10))
+	c.Assert(w.tuned, chk.Equals, int32(0))
+
+	// MaxBuffers defaults to the upper bound of auto-tuned parallelism.
+	o := UploadStreamToBlockBlobOptions{AutoTune: true}
+	c.Assert(o.defaults(), chk.IsNil)
+	o.TransferManager.Close()
+	c.Assert(o.MaxBuffers, chk.Equals, autoTuneMaxParallelism)
+}
+
+func (s *aztestsSuite) TestAutoTuneBacksOffOnServerBusy(c *chk.C) {
+	tuner, clock := newFakeClockTuner(16)
+	c.Assert(tuner.currentLimit(), chk.Equals, autoTuneInitialParallelism)
+	tuner.serverBusy()
+	c.Assert(tuner.currentLimit(), chk.Equals, autoTuneInitialParallelism/2)
+	clock.advance(autoTuneBackoffCooldown / 2)
+	tuner.serverBusy() // A burst of ServerBusy responses only backs off once
+	c.Assert(tuner.currentLimit(), chk.Equals, autoTuneInitialParallelism/2)
+	clock.advance(autoTuneBackoffCooldown)
+	tuner.serverBusy()
+	c.Assert(tuner.currentLimit(), chk.Equals, autoTuneInitialParallelism/4)
+
+	// The retry policy reports every ServerBusy response to the transfer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(ServiceCodeServerBusy))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL + "/account/container/blob")
+	p := NewPipeline(NewAnonymousCredential(), PipelineOptions{Retry: RetryOptions{MaxTries: 3, RetryDelay: time.Millisecond, MaxRetryDelay: time.Millisecond}})
+
+	notified := int32(0)
+	busyCtx := withServerBusyNotifier(ctx, func() { atomic.AddInt32(&notified, 1) })
+	_, err := NewBlobURL(*u, p).GetProperties(busyCtx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.NotNil)
+	c.Assert(notified, chk.Equals, int32(3))
+}
+
+// uploadInBlocks stages data in blocks of blockSize bytes and commits them.
+func uploadInBlocks(c *chk.C, blobURL BlockBlobURL, data []byte, blockSize int, h BlobHTTPHeaders, metadata Metadata, tags BlobTagsMap) {
+	var ids []string
+	for offset := 0; offset < len(data); offset += blockSize {
+		end := offset + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ids = append(ids, base64.StdEncoding.EncodeToString(newUUID().bytes()))
+		_, err := blobURL.StageBlock(ctx, ids[len(ids)-1], bytes.NewReader(data[offset:end]), LeaseAccessConditions{}, nil, ClientProvidedKeyOptions{})
+		c.Assert(err, chk.IsNil)
+	}
+	_, err := blobURL.CommitBlockList(ctx, ids, h, metadata, BlobAccessConditions{}, DefaultAccessTier, tags, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+}
+
+func (s *aztestsSuite) TestPatchBlockBlobRestagesOnlyChangedBlocks(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("patch")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("index")
+
+	_, data := getRandomDataAndReader(10 * 1024)
+	uploadInBlocks(c, blobURL, data, 1024,
+		BlobHTTPHeaders{ContentType: "application/octet-stream", ContentMD5: []byte{1, 2, 3}}, Metadata{"kind": "index"}, BlobTagsMap{"project": "patch"})
+	before, err := blobURL.GetBlockList(ctx, BlockListCommitted, LeaseAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(before.CommittedBlocks, chk.HasLen, 10)
+	staged := fake.requestCount(http.MethodPut, "block")
+
+	// The first patch is within block 1, the second spans blocks 2 and 3
+	patches := []BlockBlobPatch{
+		{Offset: 1500, Data: bytes.Repeat([]byte{'a'}, 100)},
+		{Offset: 3000, Data: bytes.Repeat([]byte{'b'}, 100)},
+	}
+	_, err = PatchBlockBlob(ctx, blobURL, patches, PatchBlockBlobOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requestCount(http.MethodPut, "block")-staged, chk.Equals, 3)
+
+	after, err := blobURL.GetBlockList(ctx, BlockListCommitted, LeaseAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(after.CommittedBlocks, chk.HasLen, 10)
+	for i := range after.CommittedBlocks {
+		changed := i >= 1 && i <= 3
+		c.Assert(after.CommittedBlocks[i].Name != before.CommittedBlocks[i].Name, chk.Equals, changed)
+		c.Assert(after.CommittedBlocks[i].Size, chk.Equals, int64(1024))
+	}
+
+	for _, p := range patches {
+		copy(data[p.Offset:], p.Data)
+	}
+	c.Assert(fake.blob("patch", "index").data, chk.DeepEquals, data)
+
+	props, err := blobURL.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.ContentType(), chk.Equals, "application/octet-stream")
+	c.Assert(props.ContentMD5(), chk.IsNil)
+	c.Assert(props.NewMetadata(), chk.DeepEquals, Metadata{"kind": "index"})
+	c.Assert(fake.blob("patch", "index").tags, chk.DeepEquals, BlobTagsMap{"project": "patch"})
+}
+
+func (s *aztestsSuite) TestPatchBlockBlobExtendsAndRestagesPutBlob(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("patch")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("records")
+
+	// A blob created by a single Put Blob has no committed blocks, so all of it is staged as new blocks
+	_, data := getRandomDataAndReader(2500)
+	_, err = blobURL.Upload(ctx, bytes.NewReader(data), BlobHTTPHeaders{}, nil, BlobAccessConditions{}, DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	patch := BlockBlobPatch{Offset: 2000, Data: bytes.Repeat([]byte{'c'}, 1000)}
+	_, err = PatchBlockBlob(ctx, blobURL, []BlockBlobPatch{patch}, PatchBlockBlobOptions{BlockSize: 1024})
+	c.Assert(err, chk.IsNil)
+
+	bl, err := blobURL.GetBlockList(ctx, BlockListCommitted, LeaseAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(bl.CommittedBlocks, chk.HasLen, 3)
+	c.Assert(bl.CommittedBlocks[2].Size, chk.Equals, int64(3000-2048))
+	c.Assert(fake.blob("patch", "records").data, chk.DeepEquals, append(data[:2000:2000], patch.Data...))
+
+	_, err = PatchBlockBlob(ctx, blobURL, []BlockBlobPatch{{Offset: 3001}}, PatchBlockBlobOptions{})
+	c.Assert(err, chk.NotNil)
+}
+
+func (s *aztestsSuite) TestPatchBlockBlobFailsIfBlobChanges(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("patch")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("index")
+
+	_, data := getRandomDataAndReader(4096)
+	uploadInBlocks(c, blobURL, data, 1024, BlobHTTPHeaders{}, nil, nil)
+
+	// Another writer overwrites the blob while the replacement block is staged
+	var once sync.Once
+	fake.beforeRequest = func(r *http.Request) {
+		if r.URL.Query().Get("comp") == "block" {
+			once.Do(func() {
+				_, err := UploadBufferToBlockBlob(ctx, []byte("overwritten"), blobURL, UploadToBlockBlobOptions{})
+				c.Check(err, chk.IsNil)
+			})
+		}
+	}
+	_, err = PatchBlockBlob(ctx, blobURL, []BlockBlobPatch{{Offset: 0, Data: []byte("patched")}}, PatchBlockBlobOptions{})
+	c.Assert(err, chk.NotNil)
+	stgErr, ok := err.(StorageError)
+	c.Assert(ok, chk.Equals, true)
+	c.Assert(stgErr.ServiceCode(), chk.Equals, ServiceCodeConditionNotMet)
+	c.Assert(fake.blob("patch", "index").data, chk.DeepEquals, []byte("overwritten"))
+}
+
+func (s *aztestsSuite) TestUploadStreamContentAddressedSkipsExistingBlocks(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("layers")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("layer.tar")
+
+	tm, err := NewStaticBuffer(_1MiB, 2)
+	c.Assert(err, chk.IsNil)
+	defer tm.Close()
+	upload := func(data []byte) int {
+		staged := fake.requestCount(http.MethodPut, "block")
+		_, err := UploadStreamToBlockBlob(ctx, bytes.NewReader(data), blobURL, UploadStreamToBlockBlobOptions{TransferManager: tm, ContentAddressedBlockIDs: true})
+		c.Assert(err, chk.IsNil)
+		c.Assert(fake.blob("layers", "layer.tar").data, chk.DeepEquals, data)
+		return fake.requestCount(http.MethodPut, "block") - staged
+	}
+
+	_, data := getRandomDataAndReader(10*_1MiB + 100)
+	c.Assert(upload(data), chk.Equals, 11)
+	c.Assert(upload(data), chk.Equals, 0)
+	data[3*_1MiB+5]++
+	c.Assert(upload(data), chk.Equals, 1)
+
+	// Repeated content within the stream is only staged once
+	c.Assert(upload(bytes.Repeat([]byte{'z'}, 4*_1MiB)), chk.Equals, 1)
+}
+
+func (s *aztestsSuite) TestUploadBufferContentAddressedSkipsExistingBlocks(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("images")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("disk.vhd")
+
+	// Blocks staged but not committed by an interrupted upload are reused too
+	_, data := getRandomDataAndReader(8 * 1024)
+	_, err = blobURL.StageBlock(ctx, contentBlockID(sha256.Sum256(data[:1024])), bytes.NewReader(data[:1024]), LeaseAccessConditions{}, nil, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	o := UploadToBlockBlobOptions{BlockSize: 1024, ContentAddressedBlockIDs: true}
+	staged := fake.requestCount(http.MethodPut, "block")
+	_, err = UploadBufferToBlockBlob(ctx, data, blobURL, o)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requestCount(http.MethodPut, "block")-staged, chk.Equals, 7)
+	c.Assert(fake.blob("images", "disk.vhd").data, chk.DeepEquals, data)
+
+	// Progress also counts the blocks that aren't staged again
+	data[7*1024]++
+	var progress int64
+	o.Progress = func(bytesTransferred int64) { atomic.StoreInt64(&progress, bytesTransferred) }
+	staged = fake.requestCount(http.MethodPut, "block")
+	_, err = UploadBufferToBlockBlob(ctx, data, blobURL, o)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requestCount(http.MethodPut, "block")-staged, chk.Equals, 1)
+	c.Assert(fake.blob("images", "disk.vhd").data, chk.DeepEquals, data)
+	c.Assert(atomic.LoadInt64(&progress), chk.Equals, int64(len(data)))
+
+	// Repeated content within the data is only staged once
+	repeated := bytes.Repeat([]byte{'z'}, 4*1024)
+	staged = fake.requestCount(http.MethodPut, "block")
+	_, err = UploadBufferToBlockBlob(ctx, repeated, blobURL, o)
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.requestCount(http.MethodPut, "block")-staged, chk.Equals, 1)
+	c.Assert(fake.blob("images", "disk.vhd").data, chk.DeepEquals, repeated)
+	c.Assert(atomic.LoadInt64(&progress), chk.Equals, int64(len(repeated)))
+}
+
+func (s *aztestsSuite) TestUploadCompressedAndDownloadDecompressed(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("exports")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("export.csv")
+
+	data := bytes.Repeat([]byte("id,name,value\n1,compressible,42\n"), 100*1024)
+	var raw, compressed int64
+	_, err = UploadBufferToBlockBlob(ctx, data, blobURL, UploadToBlockBlobOptions{
+		BlockSize:           _1MiB,
+		Compression:         CompressionGzip,
+		CompressionProgress: func(rawBytes int64, compressedBytes int64) { raw, compressed = rawBytes, compressedBytes },
+	})
+	c.Assert(err, chk.IsNil)
+
+	stored := fake.blob("exports", "export.csv")
+	c.Assert(stored.headers.ContentEncoding, chk.Equals, "gzip")
+	c.Assert(raw, chk.Equals, int64(len(data)))
+	c.Assert(compressed, chk.Equals, int64(len(stored.data)))
+	c.Assert(compressed < raw/10, chk.Equals, true)
+	zr, err := gzip.NewReader(bytes.NewReader(stored.data))
+	c.Assert(err, chk.IsNil)
+	decoded, err := ioutil.ReadAll(zr)
+	c.Assert(err, chk.IsNil)
+	c.Assert(decoded, chk.DeepEquals, data)
+
+	// Decode the content both when net/http decodes gzip responses itself and when it doesn't
+	noDecoding := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, u := range []BlobURL{
+		blobURL.BlobURL,
+		fake.serviceURLWithOptions(PipelineOptions{HTTPSender: newClientSender(noDecoding)}).NewContainerURL("exports").NewBlobURL("export.csv"),
+	} {
+		buffer := make([]byte, 100)
+		raw, compressed = 0, 0
+		err = DownloadBlobToBuffer(ctx, u, 10, 100, buffer, DownloadFromBlobOptions{
+			Decompress:          true,
+			CompressionProgress: func(rawBytes int64, compressedBytes int64) { raw, compressed = rawBytes, compressedBytes },
+		})
+		c.Assert(err, chk.IsNil)
+		c.Assert(buffer, chk.DeepEquals, data[10:110])
+		c.Assert(raw >= 110, chk.Equals, true)
+		c.Assert(compressed != 0, chk.Equals, true)
+
+		file, err := ioutil.TempFile("", "decompressed")
+		c.Assert(err, chk.IsNil)
+		defer os.Remove(file.Name())
+		defer file.Close()
+		err = DownloadBlobToFile(ctx, u, 0, CountToEnd, file, DownloadFromBlobOptions{Decompress: true})
+		c.Assert(err, chk.IsNil)
+		fileData, err := ioutil.ReadFile(file.Name())
+		c.Assert(err, chk.IsNil)
+		c.Assert(fileData, chk.DeepEquals, data)
+
+		dr, err := u.Download(ctx, 0, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+		c.Assert(err, chk.IsNil)
+		body := dr.Body(RetryReaderOptions{Decompress: true})
+		decoded, err = ioutil.ReadAll(body)
+		body.Close()
+		c.Assert(err, chk.IsNil)
+		c.Assert(decoded, chk.DeepEquals, data)
+	}
+}
+
+// testCompression is a Compression registered under a Content-Encoding gzip doesn't use.
+type testCompression struct{}
+
+func (testCompression) ContentEncoding() string { return "x-test-deflate" }
+func (testCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.BestSpeed)
+}
+func (testCompression) NewReader(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil }
+
+func (s *aztestsSuite) TestUploadStreamCompressedWithRegisteredCompression(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("exports")
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	blobURL := containerURL.NewBlockBlobURL("export.json")
+	data := bytes.Repeat([]byte(`{"id":1,"name":"compressible"}`), 64*1024)
+
+	_, err = UploadStreamToBlockBlob(ctx, bytes.NewReader(data), blobURL, UploadStreamToBlockBlobOptions{
+		Compression:     testCompression{},
+		BlobHTTPHeaders: BlobHTTPHeaders{ContentEncoding: "gzip"},
+	})
+	c.Assert(err, chk.NotNil) // The content can't be both gzip and x-test-deflate encoded
+
+	_, err = UploadStreamToBlockBlob(ctx, bytes.NewReader(data), blobURL, UploadStreamToBlockBlobOptions{Compression: testCompression{}})
+	c.Assert(err, chk.IsNil)
+	c.Assert(fake.blob("exports", "export.json").headers.ContentEncoding, chk.Equals, "x-test-deflate")
+
+	// Until its Compression is registered, the content can't be decoded
+	dr, err := blobURL.Download(ctx, 0, CountToEnd, BlobAccessConditions{}, false, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	body := dr.Body(RetryReaderOptions{Decompress: true})
+	_, err = ioutil.ReadAll(body)
+	body.Close()
+	c.Assert(err, chk.ErrorMatches, `no Compression is registered for the Content-Encoding "x-test-deflate"; see RegisterCompression`)
+
+	RegisterCompression(testCompression{})
+	buffer := make([]byte, len(data))
+	err = DownloadBlobToBuffer(ctx, blobURL.BlobURL, 0, CountToEnd, buffer, DownloadFromBlobOptions{Decompress: true})
+	c.Assert(err, chk.IsNil)
+	c.Assert(buffer, chk.DeepEquals, data)
+}
+
 func (s *aztestsSuite) Test_CopyFromReader(c *chk.C) {
 	ctx := context.Background()
 	p, err := createSrcFile(_1MiB * 12)
@@ -0,0 +1,103 @@
+package azblob
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+func (s *aztestsSuite) TestLeaseKeeperRenewsLease(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	// The fake's clock moves on faster than the keeper's, so the lease would expire without renewals.
+	offset := int64(0)
+	fake.clock = func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+	}
+	containerURL := newFakeContainer(c, fake, "locks")
+	blobURL := containerURL.NewBlockBlobURL("lock")
+	uploadFakeBlob(c, blobURL, "", nil)
+
+	keeper, err := blobURL.KeepLease(ctx, LeaseKeeperOptions{Duration: 15 * time.Second, RenewInterval: 10 * time.Millisecond})
+	c.Assert(err, chk.IsNil)
+	c.Assert(keeper.LeaseID(), chk.Not(chk.Equals), "")
+	for renewals := 0; renewals < 5; {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&offset, int64(5*time.Second))
+		renewals = fake.requestCount(http.MethodPut, "lease") - 1
+	}
+	c.Assert(keeper.Context().Err(), chk.IsNil)
+
+	_, err = blobURL.KeepLease(ctx, LeaseKeeperOptions{Duration: 15 * time.Second})
+	c.Assert(errors.Is(err, ErrLeaseAlreadyPresent), chk.Equals, true)
+	var stgErr StorageError
+	c.Assert(errors.As(err, &stgErr), chk.Equals, true)
+	c.Assert(stgErr.ServiceCode(), chk.Equals, ServiceCodeLeaseAlreadyPresent)
+	_, err = blobURL.SetMetadata(ctx, Metadata{"a": "b"}, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	validateStorageError(c, err, ServiceCodeLeaseIDMissing)
+	_, err = blobURL.SetMetadata(ctx, Metadata{"a": "b"}, BlobAccessConditions{LeaseAccessConditions: keeper.AccessConditions()}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+
+	c.Assert(keeper.Close(ctx), chk.IsNil)
+	c.Assert(keeper.Context().Err(), chk.Equals, context.Canceled)
+	c.Assert(keeper.Close(ctx), chk.IsNil)
+	other, err := blobURL.KeepLease(ctx, LeaseKeeperOptions{Duration: 15 * time.Second})
+	c.Assert(err, chk.IsNil)
+	c.Assert(other.Close(ctx), chk.IsNil)
+}
+
+func (s *aztestsSuite) TestLeaseKeeperCancelsContextWhenLeaseIsLost(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "locks")
+
+	keeper, err := containerURL.KeepLease(ctx, LeaseKeeperOptions{ProposedID: newUUID().String(), RenewInterval: 10 * time.Millisecond})
+	c.Assert(err, chk.IsNil)
+	_, err = containerURL.Delete(ctx, ContainerAccessConditions{})
+	validateStorageError(c, err, ServiceCodeLeaseIDMissing)
+	_, err = containerURL.BreakLease(ctx, 0, ModifiedAccessConditions{})
+	c.Assert(err, chk.IsNil)
+
+	select {
+	case <-keeper.Context().Done():
+	case <-time.After(10 * time.Second):
+		c.Fatal("the keeper's context wasn't cancelled")
+	}
+	c.Assert(errors.Is(keeper.Err(), ErrLeaseLost), chk.Equals, true)
+	var stgErr StorageError
+	c.Assert(errors.As(keeper.Err(), &stgErr), chk.Equals, true)
+	c.Assert(stgErr.ServiceCode(), chk.Equals, ServiceCodeLeaseIsBrokenAndCannotBeRenewed)
+	c.Assert(keeper.Close(ctx), chk.Equals, keeper.Err())
+}
+
+func (s *aztestsSuite) TestLeaseKeeperKeepsLeaseThroughServerErrors(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	// The first renewals fail with a server error, which outlasts the pipeline's retries but not the lease.
+	failures := 3
+	fake.fail = func(r *http.Request) *fakeServiceError {
+		if r.Header.Get("x-ms-lease-action") == "renew" && failures > 0 {
+			failures--
+			return fakeError(http.StatusServiceUnavailable, ServiceCodeServerBusy)
+		}
+		return nil
+	}
+	containerURL := newFakeContainer(c, fake, "locks")
+	blobURL := containerURL.NewBlockBlobURL("lock")
+	uploadFakeBlob(c, blobURL, "", nil)
+
+	keeper, err := blobURL.KeepLease(ctx, LeaseKeeperOptions{Duration: 15 * time.Second, RenewInterval: 10 * time.Millisecond})
+	c.Assert(err, chk.IsNil)
+	deadline := time.Now().Add(10 * time.Second)
+	for renewals := 0; renewals < 6 && keeper.Context().Err() == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		renewals = fake.requestCount(http.MethodPut, "lease") - 1
+	}
+	c.Assert(keeper.Context().Err(), chk.IsNil)
+	c.Assert(keeper.Err(), chk.IsNil)
+	c.Assert(keeper.Close(ctx), chk.IsNil)
+}
@@ -0,0 +1,415 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+// createFakeBlobs creates empty block blobs with the names in a container of the fake service.
+func createFakeBlobs(c *chk.C, containerURL ContainerURL, tags BlobTagsMap, names ...string) {
+	for _, name := range names {
+		_, err := containerURL.NewBlockBlobURL(name).Upload(ctx, bytes.NewReader(nil), BlobHTTPHeaders{}, Metadata{"name": name},
+			BlobAccessConditions{}, DefaultAccessTier, tags, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+		c.Assert(err, chk.IsNil)
+	}
+}
+
+func newFakeContainer(c *chk.C, fake *fakeBlobService, name string) ContainerURL {
+	containerURL := fake.serviceURL().NewContainerURL(name)
+	_, err := containerURL.Create(ctx, nil, PublicAccessNone)
+	c.Assert(err, chk.IsNil)
+	return containerURL
+}
+
+func (s *aztestsSuite) TestBlobPagerListsAllSegments(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	names := []string{"a", "b/1", "b/2", "b/c/1", "c", "d/1", "e"}
+	createFakeBlobs(c, containerURL, nil, names...)
+
+	pager := containerURL.NewBlobPager(ListBlobsSegmentOptions{MaxResults: 2, Details: BlobListingDetails{Metadata: true}})
+	listed := []string{}
+	for pager.Next(ctx) {
+		c.Assert(pager.Item().Metadata["name"], chk.Equals, pager.Item().Name)
+		listed = append(listed, pager.Item().Name)
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, names)
+	c.Assert(fake.requestCount(http.MethodGet, "list"), chk.Equals, 4)
+	c.Assert(pager.Next(ctx), chk.Equals, false)
+	c.Assert(fake.requestCount(http.MethodGet, "list"), chk.Equals, 4)
+
+	pager = containerURL.NewBlobPager(ListBlobsSegmentOptions{Prefix: "b/"})
+	listed = []string{}
+	for pager.Next(ctx) {
+		listed = append(listed, pager.Item().Name)
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, []string{"b/1", "b/2", "b/c/1"})
+}
+
+func (s *aztestsSuite) TestBlobSegmentPagerResumesFromMarker(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	names := []string{"a", "b", "c", "d", "e", "f", "g"}
+	createFakeBlobs(c, containerURL, nil, names...)
+
+	pager := containerURL.NewBlobFlatSegmentPager(Marker{}, ListBlobsSegmentOptions{MaxResults: 3})
+	c.Assert(pager.NextPage(ctx), chk.Equals, true)
+	listed := []string{}
+	for _, b := range pager.Page().Segment.BlobItems {
+		listed = append(listed, b.Name)
+	}
+	c.Assert(pager.Marker().NotDone(), chk.Equals, true)
+	persisted := *pager.Marker().Val
+
+	pager = containerURL.NewBlobFlatSegmentPager(Marker{Val: &persisted}, ListBlobsSegmentOptions{MaxResults: 3})
+	for pager.NextPage(ctx) {
+		for _, b := range pager.Page().Segment.BlobItems {
+			listed = append(listed, b.Name)
+		}
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, names)
+	c.Assert(pager.Marker().NotDone(), chk.Equals, false)
+
+	// Resuming a finished listing lists nothing
+	pager = containerURL.NewBlobFlatSegmentPager(pager.Marker(), ListBlobsSegmentOptions{})
+	c.Assert(pager.NextPage(ctx), chk.Equals, false)
+	c.Assert(pager.Err(), chk.IsNil)
+}
+
+func (s *aztestsSuite) TestBlobHierarchyPagerListsPrefixesInOrder(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, nil, "a", "b/1", "b/2", "b/c/1", "c", "d/1", "e")
+
+	pager := containerURL.NewBlobHierarchyPager("/", ListBlobsSegmentOptions{MaxResults: 2})
+	listed := []string{}
+	for pager.Next(ctx) {
+		item := pager.Item()
+		c.Assert(item.Prefix == nil, chk.Equals, item.Blob != nil)
+		listed = append(listed, item.Name())
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, []string{"a", "b/", "c", "d/", "e"})
+
+	pager = containerURL.NewBlobHierarchyPager("/", ListBlobsSegmentOptions{Prefix: "b/"})
+	listed = []string{}
+	for pager.Next(ctx) {
+		listed = append(listed, pager.Item().Name())
+	}
+	c.Assert(listed, chk.DeepEquals, []string{"b/1", "b/2", "b/c/"})
+}
+
+func (s *aztestsSuite) TestContainerAndBlobsByTagsPagers(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	for _, name := range []string{"archive", "logs-1", "logs-2", "logs-3"} {
+		containerURL := newFakeContainer(c, fake, name)
+		createFakeBlobs(c, containerURL, BlobTagsMap{"project": "apollo"}, "tagged")
+		createFakeBlobs(c, containerURL, nil, "untagged")
+	}
+	serviceURL := fake.serviceURL()
+
+	containers := serviceURL.NewContainerPager(ListContainersSegmentOptions{Prefix: "logs-", MaxResults: 1})
+	listed := []string{}
+	for containers.Next(ctx) {
+		listed = append(listed, containers.Item().Name)
+	}
+	c.Assert(containers.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, []string{"logs-1", "logs-2", "logs-3"})
+
+	blobs := serviceURL.NewBlobsByTagsPager(`"project"='apollo'`, 3)
+	listed = []string{}
+	for blobs.Next(ctx) {
+		listed = append(listed, blobs.Item().ContainerName+"/"+blobs.Item().Name)
+	}
+	c.Assert(blobs.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, []string{"archive/tagged", "logs-1/tagged", "logs-2/tagged", "logs-3/tagged"})
+	c.Assert(fake.requestCount(http.MethodGet, "blobs"), chk.Equals, 2)
+}
+
+func (s *aztestsSuite) TestPagerStopsOnErrorAndCancellation(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+
+	pager := fake.serviceURL().NewContainerURL("missing").NewBlobPager(ListBlobsSegmentOptions{})
+	c.Assert(pager.Next(ctx), chk.Equals, false)
+	validateStorageError(c, pager.Err(), ServiceCodeContainerNotFound)
+
+	containerURL := newFakeContainer(c, fake, "logs")
+	createFakeBlobs(c, containerURL, nil, "a", "b", "c")
+	canceled, cancel := context.WithCancel(ctx)
+	pager = containerURL.NewBlobPager(ListBlobsSegmentOptions{MaxResults: 2})
+	c.Assert(pager.Next(canceled), chk.Equals, true)
+	cancel()
+	c.Assert(pager.Next(canceled), chk.Equals, false)
+	c.Assert(pager.Err(), chk.Equals, context.Canceled)
+	c.Assert(fake.requestCount(http.MethodGet, "list"), chk.Equals, 2)
+}
+
+func (s *aztestsSuite) TestParallelBlobPagerMergesPartitions(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "logs")
+	names := []string{}
+	for _, dir := range []string{"2021/", "2022/", "2023/q1/", "2023/q2/", "2024/"} {
+		for i := 0; i < 7; i++ {
+			names = append(names, fmt.Sprintf("%s%02d", dir, i))
+		}
+	}
+	names = append(names, "2021.txt", "2022-summary", "README")
+	createFakeBlobs(c, containerURL, nil, names...)
+	sort.Strings(names)
+
+	// Measure how many partitions are listed at once
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	fake.beforeRequest = func(r *http.Request) {
+		if r.URL.Query().Get("comp") != "list" || r.URL.Query().Get("delimiter") != "" {
+			return
+		}
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+
+	for _, depth := range []int{1, 2} {
+		maxRunning = 0
+		pager := containerURL.NewParallelBlobPager(ctx, ParallelListBlobsOptions{MaxResults: 3, SplitDepth: depth, Parallelism: 3, Ordered: true})
+		listed := []string{}
+		for pager.Next(ctx) {
+			listed = append(listed, pager.Item().Name)
+		}
+		c.Assert(pager.Err(), chk.IsNil)
+		c.Assert(listed, chk.DeepEquals, names)
+		c.Assert(maxRunning > 1, chk.Equals, true)
+		c.Assert(maxRunning <= 3, chk.Equals, true)
+	}
+
+	pager := containerURL.NewParallelBlobPager(ctx, ParallelListBlobsOptions{MaxResults: 2})
+	listed := []string{}
+	for pager.Next(ctx) {
+		listed = append(listed, pager.Item().Name)
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	sort.Strings(listed)
+	c.Assert(listed, chk.DeepEquals, names)
+}
+
+func (s *aztestsSuite) TestParallelBlobPagerPartitions(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "flat")
+	createFakeBlobs(c, containerURL, nil, "alpha", "apple", "banana", "blueberry", "cherry", "date")
+
+	pager := containerURL.NewParallelBlobPager(ctx, ParallelListBlobsOptions{Partitions: []string{"c", "a", "b"}, Ordered: true})
+	listed := []string{}
+	for pager.Next(ctx) {
+		listed = append(listed, pager.Item().Name)
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, []string{"alpha", "apple", "banana", "blueberry", "cherry"})
+
+	// The partitions are under Prefix
+	createFakeBlobs(c, containerURL, nil, "fruit/apple", "fruit/banana", "fruit/cherry", "veg/asparagus")
+	pager = containerURL.NewParallelBlobPager(ctx, ParallelListBlobsOptions{Prefix: "fruit/", Partitions: []string{"b", "a"}, Ordered: true})
+	listed = []string{}
+	for pager.Next(ctx) {
+		listed = append(listed, pager.Item().Name)
+	}
+	c.Assert(pager.Err(), chk.IsNil)
+	c.Assert(listed, chk.DeepEquals, []string{"fruit/apple", "fruit/banana"})
+
+	pager = containerURL.NewParallelBlobPager(ctx, ParallelListBlobsOptions{Partitions: []string{"a", "b", "ap"}})
+	c.Assert(pager.Next(ctx), chk.Equals, false)
+	c.Assert(pager.Err(), chk.ErrorMatches, ".*overlaps.*")
+}
+
+func (s *aztestsSuite) TestParallelBlobPagerStops(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+
+	pager := fake.serviceURL().NewContainerURL("missing").NewParallelBlobPager(ctx, ParallelListBlobsOptions{})
+	c.Assert(pager.Next(ctx), chk.Equals, false)
+	validateStorageError(c, pager.Err(), ServiceCodeContainerNotFound)
+
+	containerURL := newFakeContainer(c, fake, "logs")
+	for i := 0; i < 10; i++ {
+		createFakeBlobs(c, containerURL, nil, fmt.Sprintf("%d/a", i), fmt.Sprintf("%d/b", i))
+	}
+	pager = containerURL.NewParallelBlobPager(ctx, ParallelListBlobsOptions{MaxResults: 1, Ordered: true})
+	c.Assert(pager.Next(ctx), chk.Equals, true)
+	pager.Close()
+	for pager.Next(ctx) {
+	}
+	c.Assert(pager.Err(), chk.Equals, context.Canceled)
+}
+
+func (s *aztestsSuite) TestWalkVisitsTreeDepthFirst(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "tree")
+	createFakeBlobs(c, containerURL, nil, "a", "b/1", "b/c/1", "b/c/2", "b/d", "c/1", "c/2", "c/3", "d")
+
+	walk := func(prefix string, o WalkOptions, fn func(item BlobHierarchyItem) error) []string {
+		visited := []string{}
+		err := containerURL.Walk(ctx, prefix, "/", func(item BlobHierarchyItem, err error) error {
+			c.Assert(err, chk.IsNil)
+			visited = append(visited, item.Name())
+			if fn != nil {
+				return fn(item)
+			}
+			return nil
+		}, o)
+		c.Assert(err, chk.IsNil)
+		return visited
+	}
+	sequential := WalkOptions{Parallelism: 1, MaxResults: 2}
+	c.Assert(walk("", sequential, nil), chk.DeepEquals,
+		[]string{"", "a", "b/", "b/1", "b/c/", "b/c/1", "b/c/2", "b/d", "c/", "c/1", "c/2", "c/3", "d"})
+	c.Assert(walk("b/", sequential, nil), chk.DeepEquals, []string{"b/", "b/1", "b/c/", "b/c/1", "b/c/2", "b/d"})
+
+	// SkipDir prunes a virtual directory, or skips the rest of a blob's virtual directory
+	c.Assert(walk("", sequential, func(item BlobHierarchyItem) error {
+		if item.Name() == "b/c/" || item.Name() == "c/1" {
+			return SkipDir
+		}
+		return nil
+	}), chk.DeepEquals, []string{"", "a", "b/", "b/1", "b/c/", "b/d", "c/", "c/1", "d"})
+	c.Assert(walk("", sequential, func(item BlobHierarchyItem) error {
+		if item.Name() == "" {
+			return SkipDir
+		}
+		return nil
+	}), chk.DeepEquals, []string{""})
+
+	c.Assert(walk("", WalkOptions{Parallelism: 1, MaxDepth: 1}, nil), chk.DeepEquals, []string{"", "a", "b/", "c/", "d"})
+	c.Assert(walk("", WalkOptions{Parallelism: 1, MaxDepth: 2}, nil), chk.DeepEquals,
+		[]string{"", "a", "b/", "b/1", "b/c/", "b/d", "c/", "c/1", "c/2", "c/3", "d"})
+}
+
+func (s *aztestsSuite) TestWalkConcurrently(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "tree")
+	names := []string{}
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			names = append(names, fmt.Sprintf("%d/%d/blob", i, j))
+		}
+	}
+	createFakeBlobs(c, containerURL, nil, names...)
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	fake.beforeRequest = func(r *http.Request) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+
+	visited := []string{}
+	err := containerURL.Walk(ctx, "", "/", func(item BlobHierarchyItem, err error) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if item.Blob != nil {
+			visited = append(visited, item.Name())
+		}
+		return err
+	}, WalkOptions{Parallelism: 4})
+	c.Assert(err, chk.IsNil)
+	sort.Strings(visited)
+	c.Assert(visited, chk.DeepEquals, names)
+	c.Assert(maxRunning > 1, chk.Equals, true)
+	c.Assert(maxRunning <= 4, chk.Equals, true)
+
+	// An error from the WalkFunc stops the walk
+	stop := errors.New("stop")
+	err = containerURL.Walk(ctx, "", "/", func(item BlobHierarchyItem, err error) error {
+		if item.Name() == "3/1/" {
+			return stop
+		}
+		return err
+	}, WalkOptions{Parallelism: 4})
+	c.Assert(err, chk.Equals, stop)
+}
+
+func (s *aztestsSuite) TestWalkBoundsGoroutines(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "wide")
+	names := []string{}
+	for i := 0; i < 200; i++ {
+		names = append(names, fmt.Sprintf("%03d/blob", i))
+	}
+	createFakeBlobs(c, containerURL, nil, names...)
+
+	// The virtual directories found while listing the root are queued, not each given a goroutine.
+	before := runtime.NumGoroutine()
+	var lock sync.Mutex
+	maxGoroutines, visited := 0, 0
+	err := containerURL.Walk(ctx, "", "/", func(item BlobHierarchyItem, err error) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if n := runtime.NumGoroutine(); n > maxGoroutines {
+			maxGoroutines = n
+		}
+		if item.Blob != nil {
+			visited++
+		}
+		return err
+	}, WalkOptions{Parallelism: 2})
+	c.Assert(err, chk.IsNil)
+	c.Assert(visited, chk.Equals, len(names))
+	c.Assert(maxGoroutines-before < 50, chk.Equals, true)
+}
+
+func (s *aztestsSuite) TestWalkReportsListingErrors(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := fake.serviceURL().NewContainerURL("missing")
+
+	calls := 0
+	err := containerURL.Walk(ctx, "logs/", "/", func(item BlobHierarchyItem, err error) error {
+		calls++
+		c.Assert(item.Name(), chk.Equals, "logs/")
+		if calls == 2 {
+			validateStorageError(c, err, ServiceCodeContainerNotFound)
+		}
+		return err
+	}, WalkOptions{})
+	c.Assert(calls, chk.Equals, 2)
+	validateStorageError(c, err, ServiceCodeContainerNotFound)
+
+	// Returning nil for the failed virtual directory continues the walk without it
+	err = containerURL.Walk(ctx, "", "/", func(item BlobHierarchyItem, err error) error { return nil }, WalkOptions{Parallelism: 1})
+	c.Assert(err, chk.IsNil)
+}
@@ -0,0 +1,187 @@
+//go:build go1.18
+// +build go1.18
+
+package azblob
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	chk "gopkg.in/check.v1"
+)
+
+type storeUser struct {
+	Name   string
+	Team   string
+	Logins int
+}
+
+// indexUser indexes users by team.
+func indexUser(u *storeUser) BlobTagsMap {
+	return BlobTagsMap{"team": u.Team}
+}
+
+// storeNote encodes itself, as generated protocol buffer messages do.
+type storeNote struct {
+	text string
+}
+
+func (n *storeNote) Marshal() ([]byte, error) {
+	return []byte("note:" + n.text), nil
+}
+
+func (n *storeNote) Unmarshal(data []byte) error {
+	if !strings.HasPrefix(string(data), "note:") {
+		return errors.New("not a note")
+	}
+	n.text = strings.TrimPrefix(string(data), "note:")
+	return nil
+}
+
+func (s *aztestsSuite) TestStoreWritesDocumentsConditionally(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	fake.versioning = true
+	containerURL := newFakeContainer(c, fake, "docs")
+	users := NewStore(containerURL, "users/", StoreOptions[storeUser]{Index: indexUser})
+
+	created, err := users.Put(ctx, "ann", storeUser{Name: "Ann", Team: "blue"}, ModifiedAccessConditions{IfNoneMatch: ETagAny})
+	c.Assert(err, chk.IsNil)
+	c.Assert(created.ETag, chk.Not(chk.Equals), ETagNone)
+	_, err = users.Put(ctx, "ann", storeUser{Name: "Ann"}, ModifiedAccessConditions{IfNoneMatch: ETagAny})
+	validateStorageError(c, err, ServiceCodeBlobAlreadyExists)
+	b := fake.blob("docs", "users/ann")
+	c.Assert(b.headers.ContentType, chk.Equals, "application/json")
+	c.Assert(b.tags, chk.DeepEquals, BlobTagsMap{"team": "blue"})
+
+	doc, err := users.Get(ctx, "ann")
+	c.Assert(err, chk.IsNil)
+	c.Assert(*doc, chk.DeepEquals, *created)
+	_, err = users.Get(ctx, "bob")
+	validateStorageError(c, err, ServiceCodeBlobNotFound)
+
+	// Concurrent updates are all applied, and keep the index tags up to date.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := users.Update(ctx, "ann", func(u *storeUser, exists bool) error {
+				c.Check(exists, chk.Equals, true)
+				u.Logins++
+				u.Team = "red"
+				return nil
+			})
+			c.Check(err, chk.IsNil)
+		}()
+	}
+	wg.Wait()
+	updated, err := users.Get(ctx, "ann")
+	c.Assert(err, chk.IsNil)
+	c.Assert(updated.Value, chk.Equals, storeUser{Name: "Ann", Team: "red", Logins: 5})
+	c.Assert(fake.blob("docs", "users/ann").tags, chk.DeepEquals, BlobTagsMap{"team": "red"})
+	old, err := users.GetVersion(ctx, "ann", created.VersionID)
+	c.Assert(err, chk.IsNil)
+	c.Assert(old.Value, chk.Equals, storeUser{Name: "Ann", Team: "blue"})
+
+	_, err = users.Put(ctx, "ann", storeUser{Name: "Ann"}, ModifiedAccessConditions{IfMatch: created.ETag})
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	err = users.Delete(ctx, "ann", ModifiedAccessConditions{IfMatch: created.ETag})
+	validateStorageError(c, err, ServiceCodeConditionNotMet)
+	c.Assert(users.Delete(ctx, "ann", ModifiedAccessConditions{IfMatch: updated.ETag}), chk.IsNil)
+
+	doc, err = users.Update(ctx, "ann", func(u *storeUser, exists bool) error {
+		c.Assert(exists, chk.Equals, false)
+		*u = storeUser{Name: "Ann", Team: "green"}
+		return nil
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(doc.Value.Team, chk.Equals, "green")
+	_, err = users.Update(ctx, "ann", func(u *storeUser, exists bool) error { return errors.New("rejected") })
+	c.Assert(err, chk.ErrorMatches, "rejected")
+	_, err = users.Put(ctx, "bad", storeUser{Team: "blue;"}, ModifiedAccessConditions{})
+	c.Assert(err, chk.ErrorMatches, ".*can't contain")
+}
+
+func (s *aztestsSuite) TestStoreUpdateKeepsAccessTier(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "docs")
+	users := NewStore(containerURL, "users/", StoreOptions[storeUser]{})
+	_, err := users.Put(ctx, "ann", storeUser{Name: "Ann"}, ModifiedAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	_, err = containerURL.NewBlobURL("users/ann").SetTier(ctx, AccessTierCool, LeaseAccessConditions{}, RehydratePriorityNone)
+	c.Assert(err, chk.IsNil)
+
+	doc, err := users.Update(ctx, "ann", func(u *storeUser, exists bool) error {
+		u.Logins++
+		return nil
+	})
+	c.Assert(err, chk.IsNil)
+	c.Assert(doc.Value.Logins, chk.Equals, 1)
+	c.Assert(fake.blob("docs", "users/ann").tier, chk.Equals, AccessTierCool)
+}
+
+func (s *aztestsSuite) TestStoreListsAndFindsDocuments(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "docs")
+	users := NewStore(containerURL, "users/", StoreOptions[storeUser]{Index: indexUser, Codec: GobCodec})
+	teams := []string{"blue", "red", "blue", "green", "blue"}
+	for i, team := range teams {
+		_, err := users.Put(ctx, "u"+strconv.Itoa(i), storeUser{Name: "user " + strconv.Itoa(i), Team: team}, ModifiedAccessConditions{})
+		c.Assert(err, chk.IsNil)
+	}
+	// Blobs outside the store's prefix aren't documents of the store.
+	uploadFakeBlob(c, containerURL.NewBlockBlobURL("other/u9"), "not a user", BlobTagsMap{"team": "blue"})
+	c.Assert(fake.blob("docs", "users/u0").headers.ContentType, chk.Equals, "application/x-gob")
+
+	keys := func(p *StorePager[storeUser]) []string {
+		found := []string{}
+		for p.Next(ctx) {
+			c.Assert(p.Item().Value.Name, chk.Equals, "user "+strings.TrimPrefix(p.Item().Key, "u"))
+			found = append(found, p.Item().Key)
+		}
+		c.Assert(p.Err(), chk.IsNil)
+		return found
+	}
+	c.Assert(keys(users.List("")), chk.DeepEquals, []string{"u0", "u1", "u2", "u3", "u4"})
+	c.Assert(keys(users.List("u3")), chk.DeepEquals, []string{"u3"})
+	c.Assert(keys(users.Find(Tag("team").Eq("blue"))), chk.DeepEquals, []string{"u0", "u2", "u4"})
+	c.Assert(users.Find(Tag("team").Ne("red")).Err(), chk.NotNil)
+
+	// A document that can't be decoded stops the listing.
+	uploadFakeBlob(c, containerURL.NewBlockBlobURL("users/u5"), "not gob", nil)
+	p := users.List("")
+	for p.Next(ctx) {
+	}
+	c.Assert(p.Err(), chk.ErrorMatches, `decoding document "u5": .*`)
+}
+
+func (s *aztestsSuite) TestStoreMarshalerCodec(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "docs")
+
+	notes := NewStore(containerURL, "", StoreOptions[storeNote]{Codec: MarshalerCodec})
+	_, err := notes.Put(ctx, "a", storeNote{text: "hello"}, ModifiedAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(downloadFakeBlob(c, containerURL.NewBlobURL("a")), chk.Equals, "note:hello")
+	doc, err := notes.Get(ctx, "a")
+	c.Assert(err, chk.IsNil)
+	c.Assert(doc.Value.text, chk.Equals, "hello")
+
+	// Documents can be pointers to messages.
+	pointers := NewStore(containerURL, "", StoreOptions[*storeNote]{Codec: MarshalerCodec})
+	_, err = pointers.Put(ctx, "b", &storeNote{text: "world"}, ModifiedAccessConditions{})
+	c.Assert(err, chk.IsNil)
+	pdoc, err := pointers.Get(ctx, "b")
+	c.Assert(err, chk.IsNil)
+	c.Assert(pdoc.Value.text, chk.Equals, "world")
+
+	strs := NewStore(containerURL, "", StoreOptions[string]{Codec: MarshalerCodec})
+	_, err = strs.Put(ctx, "c", "text", ModifiedAccessConditions{})
+	c.Assert(err, chk.ErrorMatches, `encoding document "c": \*string has no Marshal.*`)
+}
@@ -0,0 +1,132 @@
+package azblob
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+// increment is an update that adds 1 to the number in the blob, or creates it with 1.
+func increment(old []byte) ([]byte, error) {
+	n := 0
+	if old != nil {
+		var err error
+		if n, err = strconv.Atoi(string(old)); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(strconv.Itoa(n + 1)), nil
+}
+
+func (s *aztestsSuite) TestUpdateBlobCreatesAndUpdatesBlob(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "state")
+	blobURL := containerURL.NewBlockBlobURL("counter")
+
+	etag, err := UpdateBlobWithOptions(ctx, blobURL, func(old []byte) ([]byte, error) {
+		c.Assert(old, chk.IsNil)
+		return []byte("1"), nil
+	}, UpdateBlobOptions{HTTPHeaders: BlobHTTPHeaders{ContentType: "text/plain"}, Metadata: Metadata{"owner": "jobs"}})
+	c.Assert(err, chk.IsNil)
+	c.Assert(etag, chk.Not(chk.Equals), ETagNone)
+	_, err = blobURL.SetTags(ctx, nil, nil, nil, BlobTagsMap{"kind": "counter"})
+	c.Assert(err, chk.IsNil)
+
+	etag, err = UpdateBlob(ctx, blobURL, increment)
+	c.Assert(err, chk.IsNil)
+	c.Assert(downloadFakeBlob(c, blobURL.BlobURL), chk.Equals, "2")
+	props, err := blobURL.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.ETag(), chk.Equals, etag)
+	c.Assert(props.ContentType(), chk.Equals, "text/plain")
+	c.Assert(props.NewMetadata(), chk.DeepEquals, Metadata{"owner": "jobs"})
+	c.Assert(fake.blob("state", "counter").tags, chk.DeepEquals, BlobTagsMap{"kind": "counter"})
+
+	// An unchanged blob isn't written.
+	puts := fake.requestCount(http.MethodPut, "")
+	unchanged, err := UpdateBlob(ctx, blobURL, func(old []byte) ([]byte, error) { return old, nil })
+	c.Assert(err, chk.IsNil)
+	c.Assert(unchanged, chk.Equals, etag)
+	c.Assert(fake.requestCount(http.MethodPut, ""), chk.Equals, puts)
+
+	// The update's error is returned as is.
+	_, err = UpdateBlob(ctx, blobURL, func(old []byte) ([]byte, error) { return nil, errors.New("invalid state") })
+	c.Assert(err, chk.ErrorMatches, "invalid state")
+}
+
+func (s *aztestsSuite) TestUpdateBlobKeepsAccessTier(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "state")
+	cool, inferred := containerURL.NewBlockBlobURL("cool"), containerURL.NewBlockBlobURL("inferred")
+	uploadFakeBlob(c, cool, "1", nil)
+	uploadFakeBlob(c, inferred, "1", nil)
+	_, err := cool.SetTier(ctx, AccessTierCool, LeaseAccessConditions{}, RehydratePriorityNone)
+	c.Assert(err, chk.IsNil)
+
+	for _, blobURL := range []BlockBlobURL{cool, inferred} {
+		_, err = UpdateBlob(ctx, blobURL, increment)
+		c.Assert(err, chk.IsNil)
+		c.Assert(downloadFakeBlob(c, blobURL.BlobURL), chk.Equals, "2")
+	}
+	c.Assert(fake.blob("state", "cool").tier, chk.Equals, AccessTierCool)
+	props, err := inferred.GetProperties(ctx, BlobAccessConditions{}, ClientProvidedKeyOptions{})
+	c.Assert(err, chk.IsNil)
+	c.Assert(props.AccessTierInferred(), chk.Equals, "true")
+}
+
+func (s *aztestsSuite) TestUpdateBlobRetriesConcurrentUpdates(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "state")
+	blobURL := containerURL.NewBlockBlobURL("counter")
+
+	const updaters = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, updaters)
+	for i := 0; i < updaters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := UpdateBlobWithOptions(ctx, blobURL, increment, UpdateBlobOptions{MaxTries: 100, RetryDelay: time.Millisecond, MaxRetryDelay: 10 * time.Millisecond})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, chk.IsNil)
+	}
+	c.Assert(downloadFakeBlob(c, blobURL.BlobURL), chk.Equals, strconv.Itoa(updaters))
+}
+
+func (s *aztestsSuite) TestUpdateBlobReturnsConflictErrorAfterMaxTries(c *chk.C) {
+	fake := newFakeBlobService()
+	defer fake.close()
+	containerURL := newFakeContainer(c, fake, "state")
+	blobURL := containerURL.NewBlockBlobURL("counter")
+	uploadFakeBlob(c, blobURL, "1", nil)
+
+	// Another writer changes the blob between each read and write.
+	fake.beforeRequest = func(r *http.Request) {
+		if r.Method == http.MethodPut && r.Header.Get("If-Match") != "" {
+			_, err := blobURL.Upload(ctx, strings.NewReader("100"), BlobHTTPHeaders{}, Metadata{}, BlobAccessConditions{},
+				DefaultAccessTier, nil, ClientProvidedKeyOptions{}, ImmutabilityPolicyOptions{})
+			c.Check(err, chk.IsNil)
+		}
+	}
+	_, err := UpdateBlobWithOptions(ctx, blobURL, increment, UpdateBlobOptions{MaxTries: 3, RetryDelay: time.Millisecond})
+	var conflict *UpdateConflictError
+	c.Assert(errors.As(err, &conflict), chk.Equals, true)
+	c.Assert(conflict.Tries, chk.Equals, 3)
+	var stgErr StorageError
+	c.Assert(errors.As(err, &stgErr), chk.Equals, true)
+	c.Assert(stgErr.ServiceCode(), chk.Equals, ServiceCodeConditionNotMet)
+	c.Assert(downloadFakeBlob(c, blobURL.BlobURL), chk.Equals, "100")
+}
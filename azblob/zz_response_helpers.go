@@ -57,7 +57,26 @@ type DownloadResponse struct {
 // while reading, it will make additional requests to reestablish a connection and
 // continue reading. Specifying a RetryReaderOption's with MaxRetryRequests set to 0
 // (the default), returns the original response body and no retries will be performed.
+// Specifying a RetryReaderOption's with Decompress set to true decodes the blob's content
+// according to its Content-Encoding.
 func (r *DownloadResponse) Body(o RetryReaderOptions) io.ReadCloser {
+	return r.body(o, nil)
+}
+
+// body returns the response body like Body, reporting the progress of decoding it if o.Decompress is true.
+func (r *DownloadResponse) body(o RetryReaderOptions, progress CompressionProgressReceiver) io.ReadCloser {
+	body := r.retryBody(o)
+	if o.ClientSideEncryption.enabled() {
+		body = newDecryptingReader(r.ctx, body, r.NewMetadata(), r.getInfo.Offset, o.ClientSideEncryption)
+	}
+	if o.Decompress {
+		// net/http decodes gzip responses itself unless its Transport disables compression
+		body = newDecompressingReader(body, r.ContentEncoding(), r.Response().Uncompressed, progress)
+	}
+	return body
+}
+
+func (r *DownloadResponse) retryBody(o RetryReaderOptions) io.ReadCloser {
 	if o.MaxRetryRequests == 0 { // No additional retries
 		return r.Response().Body
 	}